@@ -0,0 +1,78 @@
+package integration_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/common"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/streadway/amqp"
+)
+
+func TestAmqpDeadLetterExchange(t *testing.T) {
+	amqpURL := os.Getenv("AMQP_URL")
+	if amqpURL == "" {
+		return
+	}
+
+	connector := new(common.AMQPConnector)
+
+	// The dead-letter exchange and its queue are set up out-of-band
+	conn, channel, _, _, _, err := connector.Connect(
+		amqpURL,
+		nil,
+		"test_dlx",       // exchange name
+		"fanout",         // exchange type
+		"test_dlx_queue", // queue name
+		true,             // queue durable
+		false,            // queue delete when unused
+		"",               // queue binding key
+		nil,              // exchange declare args
+		nil,              // queue declare args
+		nil,              // queue binding args
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close(channel, conn)
+	channel.QueuePurge("test_dlx_queue", false)
+
+	// AMQP broker, AMQP result backend
+	server := testSetup(&config.Config{
+		Broker:        amqpURL,
+		DefaultQueue:  "test_dlx_source_queue",
+		ResultBackend: amqpURL,
+		AMQP: &config.AMQPConfig{
+			Exchange:           "test_exchange",
+			ExchangeType:       "direct",
+			BindingKey:         "test_dlx_task",
+			PrefetchCount:      1,
+			DeadLetterExchange: "test_dlx",
+		},
+	})
+	worker := server.NewWorker("test_worker", 0)
+	go worker.Launch()
+	<-time.After(time.Second)
+
+	// A message which cannot be decoded is rejected without requeueing
+	if err := channel.Publish(
+		"test_exchange", // exchange
+		"test_dlx_task", // routing key
+		false,           // mandatory
+		false,           // immediate
+		amqp.Publishing{ContentType: "application/json", Body: []byte("not a signature")},
+	); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(time.Second)
+	worker.Quit()
+
+	queue, err := connector.InspectQueue(channel, "test_dlx_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queue.Messages != 1 {
+		t.Errorf("%d messages in dead-letter exchange queue, should be %d", queue.Messages, 1)
+	}
+}
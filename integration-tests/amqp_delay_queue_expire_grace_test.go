@@ -0,0 +1,51 @@
+package integration_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/config"
+)
+
+func TestAmqpDelayQueueExpireGrace(t *testing.T) {
+	amqpURL := os.Getenv("AMQP_URL")
+	if amqpURL == "" {
+		return
+	}
+
+	// AMQP broker, AMQP result backend
+	server := testSetup(&config.Config{
+		Broker:        amqpURL,
+		DefaultQueue:  "test_delay_grace_queue",
+		ResultBackend: amqpURL,
+		AMQP: &config.AMQPConfig{
+			Exchange:              "test_exchange",
+			ExchangeType:          "direct",
+			BindingKey:            "test_delay_grace_task",
+			PrefetchCount:         1,
+			DelayQueueExpireGrace: 10,
+		},
+	})
+
+	// The task is delayed for a fraction of the time it takes the worker
+	// to start, it must still reach the default queue
+	eta := time.Now().UTC().Add(50 * time.Millisecond)
+	asyncResult, err := server.SendTask(newDelayTask(eta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(time.Second)
+
+	worker := server.NewWorker("test_worker", 0)
+	go worker.Launch()
+	defer worker.Quit()
+
+	results, err := asyncResult.GetWithTimeout(10*time.Second, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Errorf("Number of results returned = %d. Wanted %d", len(results), 1)
+	}
+}
@@ -0,0 +1,74 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/common"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/streadway/amqp"
+)
+
+func TestAmqpExchangeBindings(t *testing.T) {
+	amqpURL := os.Getenv("AMQP_URL")
+	if amqpURL == "" {
+		return
+	}
+
+	// AMQP broker, AMQP result backend, the built-in fan-out exchange feeds
+	// the configured exchange
+	server := testSetup(&config.Config{
+		Broker:        amqpURL,
+		DefaultQueue:  "test_queue",
+		ResultBackend: amqpURL,
+		AMQP: &config.AMQPConfig{
+			Exchange:      "test_exchange",
+			ExchangeType:  "direct",
+			BindingKey:    "test_task",
+			PrefetchCount: 1,
+			ExchangeBindings: []config.ExchangeBinding{
+				{Source: "amq.fanout", Destination: "test_exchange"},
+			},
+		},
+	})
+	worker := server.NewWorker("test_worker", 0)
+	go worker.Launch()
+	defer worker.Quit()
+	<-time.After(time.Second)
+
+	signature := newAddTask(2, 3)
+	signature.UUID = "task_exchange_bindings"
+	body, err := json.Marshal(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connector := new(common.AMQPConnector)
+	conn, channel, err := connector.Open(amqpURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close(channel, conn)
+
+	// Fan-out exchange keeps the routing key the configured exchange routes by
+	if err := channel.Publish(
+		"amq.fanout", // exchange
+		"test_task",  // routing key
+		false,        // mandatory
+		false,        // immediate
+		amqp.Publishing{ContentType: "application/json", Body: body},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := backends.NewAsyncResult(signature, server.GetBackend()).GetWithTimeout(5*time.Second, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Interface() != int64(5) {
+		t.Errorf("result = %v, should be %v", results[0].Interface(), int64(5))
+	}
+}
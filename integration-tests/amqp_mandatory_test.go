@@ -0,0 +1,49 @@
+package integration_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+func TestAmqpMandatoryUnroutable(t *testing.T) {
+	amqpURL := os.Getenv("AMQP_URL")
+	if amqpURL == "" {
+		return
+	}
+
+	// AMQP broker, AMQP result backend
+	server := testSetup(&config.Config{
+		Broker:        amqpURL,
+		DefaultQueue:  "test_mandatory_queue",
+		ResultBackend: amqpURL,
+		AMQP: &config.AMQPConfig{
+			Exchange:      "test_exchange",
+			ExchangeType:  "direct",
+			BindingKey:    "test_mandatory_task",
+			PrefetchCount: 1,
+		},
+	})
+
+	// No queue is bound to the routing key
+	_, err := server.SendTask(&tasks.Signature{
+		Name:       "add",
+		RoutingKey: "test_mandatory_nowhere",
+		Mandatory:  true,
+	})
+	if err != brokers.ErrTaskUnroutable {
+		t.Errorf("SendTask returned %v, should be %v", err, brokers.ErrTaskUnroutable)
+	}
+
+	_, err = server.SendTask(&tasks.Signature{
+		Name:       "add",
+		RoutingKey: "test_mandatory_task",
+		Mandatory:  true,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,66 @@
+package integration_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/common"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+func TestAmqpMaxRedeliveries(t *testing.T) {
+	amqpURL := os.Getenv("AMQP_URL")
+	if amqpURL == "" {
+		return
+	}
+
+	// AMQP broker, AMQP result backend
+	server := testSetup(&config.Config{
+		Broker:          amqpURL,
+		DefaultQueue:    "test_queue",
+		ResultBackend:   amqpURL,
+		MaxRedeliveries: 2,
+		AMQP: &config.AMQPConfig{
+			Exchange:      "test_exchange",
+			ExchangeType:  "direct",
+			BindingKey:    "test_task",
+			PrefetchCount: 1,
+		},
+	})
+
+	// Quorum queues count redeliveries of a message which keeps crashing
+	// the worker in x-delivery-count header
+	signature := newAddTask(1, 1)
+	signature.Headers = tasks.Headers{"x-delivery-count": int64(3)}
+	if _, err := server.SendTask(signature); err != nil {
+		t.Fatal(err)
+	}
+
+	worker := server.NewWorker("test_worker", 0)
+	go worker.Launch()
+	<-time.After(time.Second)
+	worker.Quit()
+
+	taskState, err := server.GetBackend().GetState(signature.UUID)
+	if err == nil && taskState.IsCompleted() {
+		t.Errorf("Task %s should not have been processed", signature.UUID)
+	}
+
+	connector := new(common.AMQPConnector)
+	conn, channel, err := connector.Open(amqpURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close(channel, conn)
+
+	queue, err := connector.InspectQueue(channel, "test_queue_dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queue.Messages != 1 {
+		t.Errorf("%d messages in dead-letter queue, should be %d", queue.Messages, 1)
+	}
+	connector.DeleteQueue(channel, "test_queue_dlq")
+}
@@ -1,6 +1,8 @@
 package integration_test
 
 import (
+	"encoding/json"
+	"math"
 	"reflect"
 	"testing"
 	"time"
@@ -11,11 +13,17 @@ import (
 	"github.com/stretchr/testify/suite"
 )
 
+type eagerPoint struct {
+	X int64
+	Y int64
+}
+
 type EagerIntegrationTestSuite struct {
 	suite.Suite
 
-	srv    *machinery.Server
-	called float64
+	srv       *machinery.Server
+	called    float64
+	calledInt int64
 }
 
 func TestEagerIntegrationTestSuite(t *testing.T) {
@@ -45,9 +53,18 @@ func (s *EagerIntegrationTestSuite) SetupSuite() {
 		return i + 100.0, nil
 	})
 
+	s.srv.RegisterTask("int_called", func(i int64) (int64, error) {
+		s.calledInt = i
+		return s.calledInt, nil
+	})
+
 	s.srv.RegisterTask("int_result", func(i int64) (int64, error) {
 		return i + 100, nil
 	})
+
+	s.srv.RegisterTask("struct_result", func(x, y int64) (eagerPoint, error) {
+		return eagerPoint{X: x, Y: y}, nil
+	})
 }
 
 func (s *EagerIntegrationTestSuite) TestCalled() {
@@ -65,6 +82,21 @@ func (s *EagerIntegrationTestSuite) TestCalled() {
 	s.Equal(100.0, s.called)
 }
 
+func (s *EagerIntegrationTestSuite) TestCalledWithLargeInt() {
+	_, err := s.srv.SendTask(&tasks.Signature{
+		Name: "int_called",
+		Args: []tasks.Arg{
+			{
+				Type:  "int64",
+				Value: int64(math.MaxInt64 - 1),
+			},
+		},
+	})
+
+	s.Nil(err)
+	s.Equal(int64(math.MaxInt64-1), s.calledInt)
+}
+
 func (s *EagerIntegrationTestSuite) TestSuccessResult() {
 	// float64
 	{
@@ -128,3 +160,38 @@ func (s *EagerIntegrationTestSuite) TestSuccessResult() {
 		}
 	}
 }
+
+func (s *EagerIntegrationTestSuite) TestJSONResult() {
+	asyncResult, err := s.srv.SendTask(&tasks.Signature{
+		Name: "struct_result",
+		Args: []tasks.Arg{
+			{
+				Type:  "int64",
+				Value: 1,
+			},
+			{
+				Type:  "int64",
+				Value: 2,
+			},
+		},
+	})
+
+	s.NotNil(asyncResult)
+	s.Nil(err)
+
+	data, err := asyncResult.GetJSON(time.Duration(time.Millisecond * 5))
+	s.Nil(err)
+
+	var results []struct {
+		Type  string
+		Value eagerPoint
+	}
+	s.Nil(json.Unmarshal(data, &results))
+
+	if len(results) != 1 {
+		s.T().Errorf("Number of results returned = %d. Wanted %d", len(results), 1)
+		return
+	}
+
+	s.Equal(eagerPoint{X: 1, Y: 2}, results[0].Value)
+}
@@ -0,0 +1,69 @@
+package integration_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+func TestRedisKeyPrefix(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	// Two deployments sharing one Redis server
+	newConfig := func(prefix string) *config.Config {
+		return &config.Config{
+			Broker:           fmt.Sprintf("redis://%v", redisURL),
+			DefaultQueue:     "test_queue",
+			ResultBackend:    fmt.Sprintf("redis://%v", redisURL),
+			ResultsKeyPrefix: prefix,
+			QueuePrefix:      prefix,
+		}
+	}
+	server1 := testSetup(newConfig("deployment1_"))
+	server2 := testSetup(newConfig("deployment2_"))
+
+	signature := &tasks.Signature{UUID: "task_key_prefix", Name: "add"}
+	if err := server1.GetBackend().SetStateSuccess(signature, []*tasks.TaskResult{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server2.GetBackend().SetStatePending(signature); err != nil {
+		t.Fatal(err)
+	}
+
+	taskState, err := server1.GetBackend().GetState(signature.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskState.State != tasks.StateSuccess {
+		t.Errorf("state = %s, should be %s", taskState.State, tasks.StateSuccess)
+	}
+
+	taskState, err = server2.GetBackend().GetState(signature.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskState.State != tasks.StatePending {
+		t.Errorf("state = %s, should be %s", taskState.State, tasks.StatePending)
+	}
+
+	// Tasks sent by one deployment are not queued for the other one
+	if _, err := server1.SendTask(newAddTask(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	pendingTasks, err := server2.GetBroker().GetPendingTasks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pendingTasks) != 0 {
+		t.Errorf("%d tasks pending, should be %d", len(pendingTasks), 0)
+	}
+
+	server1.GetBackend().PurgeState(signature.UUID)
+	server2.GetBackend().PurgeState(signature.UUID)
+}
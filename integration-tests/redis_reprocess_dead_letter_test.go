@@ -0,0 +1,88 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+func TestRedisReprocessDeadLetter(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	// Redis broker, Redis result backend
+	server := testSetup(&config.Config{
+		Broker:        fmt.Sprintf("redis://%v", redisURL),
+		DefaultQueue:  "test_queue",
+		ResultBackend: fmt.Sprintf("redis://%v", redisURL),
+	})
+
+	signature := &tasks.Signature{
+		UUID: "dead_letter_add",
+		Name: "add",
+		Args: []tasks.Arg{
+			{Type: "int64", Value: 2},
+			{Type: "int64", Value: 3},
+		},
+		Headers: tasks.Headers{brokers.OriginalRoutingKeyHeader: "test_queue"},
+	}
+	if err := server.GetBackend().SetStatePending(signature); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dead-letter the message
+	msg, err := json.Marshal(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := redis.Dial("tcp", redisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Do("RPUSH", "test_queue_dlq", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	reprocessor, ok := server.GetBroker().(brokers.DeadLetterReprocessor)
+	if !ok {
+		t.Fatal("Redis broker does not support reprocessing dead letters")
+	}
+	n, err := reprocessor.ReprocessDeadLetter("test_queue_dlq", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d messages reprocessed, should be %d", n, 1)
+	}
+
+	pendingMessages, err := server.GetBroker().GetPendingTasks("test_queue")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(pendingMessages) != 1 || pendingMessages[0].UUID != signature.UUID {
+		t.Errorf("Reprocessed message is not back on the main queue")
+	}
+
+	worker := server.NewWorker("test_worker", 0)
+	go worker.Launch()
+	defer worker.Quit()
+
+	results, err := backends.NewAsyncResult(signature, server.GetBackend()).Get(time.Duration(time.Millisecond * 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Interface() != int64(5) {
+		t.Errorf("result = %v(%v), want int64(5)", results[0].Type().String(), results[0].Interface())
+	}
+}
@@ -0,0 +1,47 @@
+package integration_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/config"
+)
+
+func TestRedisResultNotifications(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	// Redis broker, Redis result backend with result notifications
+	server := testSetup(&config.Config{
+		Broker:        fmt.Sprintf("redis://%v", redisURL),
+		DefaultQueue:  "test_queue",
+		ResultBackend: fmt.Sprintf("redis://%v", redisURL),
+		Redis:         &config.RedisConfig{NotifyResults: true},
+	})
+
+	worker := server.NewWorker("test_worker", 0)
+	go worker.Launch()
+	defer worker.Quit()
+
+	asyncResult, err := server.SendTask(newAddTask(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Polling would not return before the sleep duration has elapsed
+	start := time.Now()
+	results, err := asyncResult.Get(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Result returned after %v, notification was not received", elapsed)
+	}
+	if results[0].Interface() != int64(2) {
+		t.Errorf("result = %v(%v), want int64(2)", results[0].Type().String(), results[0].Interface())
+	}
+}
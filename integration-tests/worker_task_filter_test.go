@@ -0,0 +1,76 @@
+package integration_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+func TestWorkerTaskFilterRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	cnf := config.Config{
+		Broker:        fmt.Sprintf("redis://%v", redisURL),
+		DefaultQueue:  "test_queue",
+		ResultBackend: fmt.Sprintf("redis://%v", redisURL),
+	}
+
+	regions := []string{"eu", "us"}
+	workers := make([]*machinery.Worker, len(regions))
+	var server *machinery.Server
+
+	for i, region := range regions {
+		srv, err := machinery.NewServer(&cnf)
+		if err != nil {
+			t.Fatal(err, "Could not initialize server")
+		}
+
+		workerRegion := region
+		srv.RegisterTask("region", func() (string, error) {
+			return workerRegion, nil
+		})
+
+		workers[i] = srv.NewWorker(fmt.Sprintf("test_worker_%s", region), 0)
+		workers[i].SetTaskFilter(func(signature *tasks.Signature) bool {
+			return signature.Headers["region"] == workerRegion
+		})
+		go workers[i].Launch()
+
+		server = srv
+	}
+
+	for _, region := range regions {
+		asyncResult, err := server.SendTask(&tasks.Signature{
+			Name:    "region",
+			Headers: tasks.Headers{"region": region},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		results, err := asyncResult.Get(time.Duration(time.Millisecond * 5))
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(results) != 1 {
+			t.Errorf("Number of results returned = %d. Wanted %d", len(results), 1)
+		}
+
+		if results[0].Interface() != region {
+			t.Errorf("Task for region %s processed by %v worker", region, results[0].Interface())
+		}
+	}
+
+	for _, worker := range workers {
+		worker.Quit()
+	}
+}
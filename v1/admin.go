@@ -0,0 +1,100 @@
+package machinery
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/log"
+)
+
+// StartAdmin starts an admin HTTP server listening on addr, it serves
+// /healthz, /metrics, /tasks and /queues until it is shut down. Addr of the
+// returned server is the address it actually listens on, e.g. with port 0
+func (server *Server) StartAdmin(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Admin listen error: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", server.adminHealth)
+	mux.HandleFunc("/metrics", adminMetrics)
+	mux.HandleFunc("/tasks", server.adminTasks)
+	mux.HandleFunc("/queues", server.adminQueues)
+
+	adminServer := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	go func() {
+		if err := adminServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.ERROR.Printf("Admin server error: %s", err)
+		}
+	}()
+
+	return adminServer, nil
+}
+
+// adminHealth reports the server healthy unless the result backend fails to
+// respond to a ping
+func (server *Server) adminHealth(w http.ResponseWriter, r *http.Request) {
+	if pinger, ok := server.GetBackend().(backends.Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// adminTasks lists names of the registered tasks
+func (server *Server) adminTasks(w http.ResponseWriter, r *http.Request) {
+	taskNames := server.GetRegisteredTaskNames()
+	sort.Strings(taskNames)
+	writeJSON(w, http.StatusOK, taskNames)
+}
+
+// adminQueues reports stats of the default queue if the broker provides them
+func (server *Server) adminQueues(w http.ResponseWriter, r *http.Request) {
+	provider, ok := server.GetBroker().(brokers.QueueStatsProvider)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "Broker does not report queue stats"})
+		return
+	}
+
+	stats, err := provider.QueueStats("")
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]*brokers.QueueStats{server.GetConfig().DefaultQueue: stats})
+}
+
+// adminMetrics exposes machinery expvar counters in the Prometheus text
+// format, map keys become the "key" label
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	expvar.Do(func(kv expvar.KeyValue) {
+		counters, ok := kv.Value.(*expvar.Map)
+		if !ok || !strings.HasPrefix(kv.Key, "machinery_") {
+			return
+		}
+		fmt.Fprintf(w, "# TYPE %s counter\n", kv.Key)
+		counters.Do(func(counter expvar.KeyValue) {
+			fmt.Fprintf(w, "%s{key=%q} %s\n", kv.Key, counter.Key, counter.Value.String())
+		})
+	})
+}
+
+// writeJSON writes the JSON encoded value with the status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.ERROR.Printf("Admin response error: %s", err)
+	}
+}
@@ -16,7 +16,6 @@ package backends
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 
 	"github.com/koblelabs/machinery/v1/common"
@@ -34,7 +33,16 @@ type AMQPBackend struct {
 
 // NewAMQPBackend creates AMQPBackend instance
 func NewAMQPBackend(cnf *config.Config) Interface {
-	return &AMQPBackend{cnf: cnf, AMQPConnector: common.AMQPConnector{}}
+	backend := &AMQPBackend{cnf: cnf, AMQPConnector: common.AMQPConnector{}}
+	if cnf.AMQP != nil {
+		backend.ConnectionName = cnf.AMQP.ConnectionName
+	}
+	return backend
+}
+
+// Type returns the backend type
+func (b *AMQPBackend) Type() string {
+	return TypeAMQP
 }
 
 // InitGroup creates and saves a group meta data object
@@ -52,7 +60,7 @@ func (b *AMQPBackend) GroupCompleted(groupUUID string, groupTaskCount int) (bool
 	}
 	defer b.Close(channel, conn)
 
-	queueState, err := b.InspectQueue(channel, groupUUID)
+	queueState, err := b.InspectQueue(channel, storageKey(b.cnf, groupUUID))
 	if err != nil {
 		return false, nil
 	}
@@ -68,7 +76,7 @@ func (b *AMQPBackend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*
 	}
 	defer b.Close(channel, conn)
 
-	queueState, err := b.InspectQueue(channel, groupUUID)
+	queueState, err := b.InspectQueue(channel, storageKey(b.cnf, groupUUID))
 	if err != nil {
 		return nil, err
 	}
@@ -78,13 +86,13 @@ func (b *AMQPBackend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*
 	}
 
 	deliveries, err := channel.Consume(
-		groupUUID, // queue name
-		"",        // consumer tag
-		false,     // auto-ack
-		true,      // exclusive
-		false,     // no-local
-		false,     // no-wait
-		nil,       // arguments
+		storageKey(b.cnf, groupUUID), // queue name
+		"",                           // consumer tag
+		false,                        // auto-ack
+		true,                         // exclusive
+		false,                        // no-local
+		false,                        // no-wait
+		nil,                          // arguments
 	)
 	if err != nil {
 		return nil, fmt.Errorf("Queue consume error: %s", err)
@@ -120,7 +128,7 @@ func (b *AMQPBackend) TriggerChord(groupUUID string) (bool, error) {
 	}
 	defer b.Close(channel, conn)
 
-	_, err = b.InspectQueue(channel, amqmChordTriggeredQueue(groupUUID))
+	_, err = b.InspectQueue(channel, amqmChordTriggeredQueue(storageKey(b.cnf, groupUUID)))
 	if err != nil {
 		return true, nil
 	}
@@ -134,6 +142,18 @@ func (b *AMQPBackend) SetStatePending(signature *tasks.Signature) error {
 	return b.updateState(taskState)
 }
 
+// SetStateSkipped updates task state to SKIPPED
+func (b *AMQPBackend) SetStateSkipped(signature *tasks.Signature) error {
+	taskState := tasks.NewSkippedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateDeduplicated updates task state to DEDUPLICATED
+func (b *AMQPBackend) SetStateDeduplicated(signature *tasks.Signature, err string) error {
+	taskState := tasks.NewDeduplicatedTaskState(signature, err)
+	return b.updateState(taskState)
+}
+
 // SetStateReceived updates task state to RECEIVED
 func (b *AMQPBackend) SetStateReceived(signature *tasks.Signature) error {
 	taskState := tasks.NewReceivedTaskState(signature)
@@ -148,7 +168,13 @@ func (b *AMQPBackend) SetStateStarted(signature *tasks.Signature) error {
 
 // SetStateRetry updates task state to RETRY
 func (b *AMQPBackend) SetStateRetry(signature *tasks.Signature) error {
-	state := tasks.NewRetryTaskState(signature)
+	return b.SetStateRetryWithError(signature, "")
+}
+
+// SetStateRetryWithError updates task state to RETRY keeping the error the
+// task failed with
+func (b *AMQPBackend) SetStateRetryWithError(signature *tasks.Signature, err string) error {
+	state := tasks.NewRetryTaskState(signature, err)
 	return b.updateState(state)
 }
 
@@ -169,7 +195,14 @@ func (b *AMQPBackend) SetStateSuccess(signature *tasks.Signature, results []*tas
 
 // SetStateFailure updates task state to FAILURE
 func (b *AMQPBackend) SetStateFailure(signature *tasks.Signature, err string) error {
+	return b.SetStateFailureWithDetail(signature, err, nil)
+}
+
+// SetStateFailureWithDetail updates task state to FAILURE keeping
+// error chain and stack trace
+func (b *AMQPBackend) SetStateFailureWithDetail(signature *tasks.Signature, err string, detail *tasks.ErrorDetail) error {
 	taskState := tasks.NewFailureTaskState(signature, err)
+	taskState.ErrorDetail = detail
 
 	if err := b.updateState(taskState); err != nil {
 		return err
@@ -192,15 +225,16 @@ func (b *AMQPBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 		// Time after that the queue will be deleted.
 		"x-expires": int32(b.getExpiresIn()),
 	}
+	queueName := storageKey(b.cnf, taskUUID)
 	conn, channel, _, _, _, err := b.Connect(
 		b.cnf.Broker,
 		b.cnf.TLSConfig,
 		b.cnf.AMQP.Exchange,     // exchange name
 		b.cnf.AMQP.ExchangeType, // exchange type
-		taskUUID,                // queue name
+		queueName,               // queue name
 		false,                   // queue durable
 		true,                    // queue delete when unused
-		taskUUID,                // queue binding key
+		queueName,               // queue binding key
 		nil,                     // exchange declare args
 		declareQueueArgs,        // queue declare args
 		nil,                     // queue binding args
@@ -211,14 +245,14 @@ func (b *AMQPBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	defer b.Close(channel, conn)
 
 	d, ok, err := channel.Get(
-		taskUUID, // queue name
-		false,    // multiple
+		queueName, // queue name
+		false,     // multiple
 	)
 	if err != nil {
 		return nil, err
 	}
 	if !ok {
-		return nil, errors.New("No state ready")
+		return nil, ErrStateNotFound
 	}
 
 	d.Ack(false)
@@ -241,7 +275,7 @@ func (b *AMQPBackend) PurgeState(taskUUID string) error {
 	}
 	defer b.Close(channel, conn)
 
-	_, err = b.DeleteQueue(channel, taskUUID)
+	_, err = b.DeleteQueue(channel, storageKey(b.cnf, taskUUID))
 
 	return err
 }
@@ -254,13 +288,22 @@ func (b *AMQPBackend) PurgeGroupMeta(groupUUID string) error {
 	}
 	defer b.Close(channel, conn)
 
-	b.DeleteQueue(channel, amqmChordTriggeredQueue(groupUUID))
+	b.DeleteQueue(channel, amqmChordTriggeredQueue(storageKey(b.cnf, groupUUID)))
 
-	_, err = b.DeleteQueue(channel, groupUUID)
+	_, err = b.DeleteQueue(channel, storageKey(b.cnf, groupUUID))
 
 	return err
 }
 
+// Ping checks the RabbitMQ server is reachable
+func (b *AMQPBackend) Ping() error {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	return b.Close(channel, conn)
+}
+
 // updateState saves current task state
 func (b *AMQPBackend) updateState(taskState *tasks.TaskState) error {
 	message, err := json.Marshal(taskState)
@@ -278,15 +321,15 @@ func (b *AMQPBackend) updateState(taskState *tasks.TaskState) error {
 	conn, channel, queue, confirmsChan, _, err := b.Connect(
 		b.cnf.Broker,
 		b.cnf.TLSConfig,
-		b.cnf.AMQP.Exchange,     // exchange name
-		b.cnf.AMQP.ExchangeType, // exchange type
-		taskState.TaskUUID,      // queue name
-		false,                   // queue durable
-		true,                    // queue delete when unused
-		taskState.TaskUUID,      // queue binding key
-		nil,                     // exchange declare args
-		declareQueueArgs,        // queue declare args
-		nil,                     // queue binding args
+		b.cnf.AMQP.Exchange,                   // exchange name
+		b.cnf.AMQP.ExchangeType,               // exchange type
+		storageKey(b.cnf, taskState.TaskUUID), // queue name
+		false,                                 // queue durable
+		true,                                  // queue delete when unused
+		storageKey(b.cnf, taskState.TaskUUID), // queue binding key
+		nil,                                   // exchange declare args
+		declareQueueArgs,                      // queue declare args
+		nil,                                   // queue binding args
 	)
 	if err != nil {
 		return err
@@ -349,15 +392,15 @@ func (b *AMQPBackend) markTaskCompleted(signature *tasks.Signature, taskState *t
 	conn, channel, queue, confirmsChan, _, err := b.Connect(
 		b.cnf.Broker,
 		b.cnf.TLSConfig,
-		b.cnf.AMQP.Exchange,     // exchange name
-		b.cnf.AMQP.ExchangeType, // exchange type
-		signature.GroupUUID,     // queue name
-		false,                   // queue durable
-		true,                    // queue delete when unused
-		signature.GroupUUID,     // queue binding key
-		nil,                     // exchange declare args
-		declareQueueArgs,        // queue declare args
-		nil,                     // queue binding args
+		b.cnf.AMQP.Exchange,                    // exchange name
+		b.cnf.AMQP.ExchangeType,                // exchange type
+		storageKey(b.cnf, signature.GroupUUID), // queue name
+		false,                                  // queue durable
+		true,                                   // queue delete when unused
+		storageKey(b.cnf, signature.GroupUUID), // queue binding key
+		nil,                                    // exchange declare args
+		declareQueueArgs,                       // queue declare args
+		nil,                                    // queue binding args
 	)
 	if err != nil {
 		return err
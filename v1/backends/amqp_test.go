@@ -124,7 +124,7 @@ func TestGetStateAMQP(t *testing.T) {
 	for {
 		taskState, err = backend.GetState(signature.UUID)
 		if taskState == nil {
-			assert.Equal(t, "No state ready", err.Error())
+			assert.Equal(t, backends.ErrStateNotFound, err)
 			continue
 		}
 
@@ -1,10 +1,14 @@
 package backends
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
 	"time"
 
+	"github.com/koblelabs/machinery/v1/clock"
 	"github.com/koblelabs/machinery/v1/tasks"
 )
 
@@ -13,6 +17,19 @@ type AsyncResult struct {
 	Signature *tasks.Signature
 	taskState *tasks.TaskState
 	backend   Interface
+	clock     clock.Clock
+}
+
+// ResultEnvelope bundles results of a task with metadata about its run
+type ResultEnvelope struct {
+	Results     []reflect.Value
+	WorkerName  string
+	StartedAt   *time.Time
+	CompletedAt *time.Time
+	// Duration is how long the task ran, 0 if the start is unknown
+	Duration time.Duration
+	// RetryCount is the number of retries the task had left
+	RetryCount int
 }
 
 // ChordAsyncResult represents a result of a chord
@@ -20,12 +37,53 @@ type ChordAsyncResult struct {
 	groupAsyncResults []*AsyncResult
 	chordAsyncResult  *AsyncResult
 	backend           Interface
+	clock             clock.Clock
 }
 
 // ChainAsyncResult represents a result of a chain of tasks
 type ChainAsyncResult struct {
 	asyncResults []*AsyncResult
 	backend      Interface
+	clock        clock.Clock
+}
+
+// LazyGroupAsyncResult represents results of a lazy group, only tasks of the
+// current window are sent and tracked at any time
+type LazyGroupAsyncResult struct {
+	group *tasks.LazyGroup
+	send  func(signature *tasks.Signature) (*AsyncResult, error)
+	// window holds results of tasks sent but not iterated over yet
+	window  []*AsyncResult
+	sent    int
+	results []reflect.Value
+	err     error
+}
+
+// DynamicGroupResult represents results of a dynamic group, a group of tasks
+// the size of which is not known upfront as its tasks are added while other
+// tasks run, e.g. a task spawning a task per item of its input
+type DynamicGroupResult struct {
+	GroupUUID string
+	backend   Interface
+	clock     clock.Clock
+	// members caches results of the tasks of the group
+	members map[string]*AsyncResult
+}
+
+// watchPollInterval is how often Watch polls the task state when the backend
+// does not notify state changes
+var watchPollInterval = 100 * time.Millisecond
+
+// ChainTimeoutError is returned when a chain does not complete in time, it
+// carries results of the leading steps which did complete
+type ChainTimeoutError struct {
+	// Results holds results of the completed steps in chain order
+	Results [][]reflect.Value
+}
+
+// Error implements the error interface
+func (e *ChainTimeoutError) Error() string {
+	return "Timeout reached"
 }
 
 // NewAsyncResult creates AsyncResult instance
@@ -34,6 +92,7 @@ func NewAsyncResult(signature *tasks.Signature, backend Interface) *AsyncResult
 		Signature: signature,
 		taskState: new(tasks.TaskState),
 		backend:   backend,
+		clock:     clock.Real,
 	}
 }
 
@@ -43,10 +102,17 @@ func NewChordAsyncResult(groupTasks []*tasks.Signature, chordCallback *tasks.Sig
 	for i, task := range groupTasks {
 		asyncResults[i] = NewAsyncResult(task, backend)
 	}
+	return NewChordAsyncResultFromResults(asyncResults, NewAsyncResult(chordCallback, backend), backend)
+}
+
+// NewChordAsyncResultFromResults creates ChordAsyncResult instance from
+// results of the group tasks and the chord callback
+func NewChordAsyncResultFromResults(groupAsyncResults []*AsyncResult, chordAsyncResult *AsyncResult, backend Interface) *ChordAsyncResult {
 	return &ChordAsyncResult{
-		groupAsyncResults: asyncResults,
-		chordAsyncResult:  NewAsyncResult(chordCallback, backend),
+		groupAsyncResults: groupAsyncResults,
+		chordAsyncResult:  chordAsyncResult,
 		backend:           backend,
+		clock:             clock.Real,
 	}
 }
 
@@ -56,24 +122,74 @@ func NewChainAsyncResult(tasks []*tasks.Signature, backend Interface) *ChainAsyn
 	for i, task := range tasks {
 		asyncResults[i] = NewAsyncResult(task, backend)
 	}
+	return NewChainAsyncResultFromResults(asyncResults, backend)
+}
+
+// NewChainAsyncResultFromResults creates ChainAsyncResult instance from
+// results of the chained tasks
+func NewChainAsyncResultFromResults(asyncResults []*AsyncResult, backend Interface) *ChainAsyncResult {
 	return &ChainAsyncResult{
 		asyncResults: asyncResults,
 		backend:      backend,
+		clock:        clock.Real,
+	}
+}
+
+// NewLazyGroupAsyncResult creates LazyGroupAsyncResult instance, the first
+// window of tasks of the group is sent with the send func right away
+func NewLazyGroupAsyncResult(group *tasks.LazyGroup, send func(signature *tasks.Signature) (*AsyncResult, error)) (*LazyGroupAsyncResult, error) {
+	lazyGroupAsyncResult := &LazyGroupAsyncResult{
+		group: group,
+		send:  send,
+	}
+	if err := lazyGroupAsyncResult.fill(); err != nil {
+		return nil, err
+	}
+	return lazyGroupAsyncResult, nil
+}
+
+// NewDynamicGroupResult creates DynamicGroupResult instance
+func NewDynamicGroupResult(groupUUID string, backend Interface) *DynamicGroupResult {
+	return &DynamicGroupResult{
+		GroupUUID: groupUUID,
+		backend:   backend,
+		clock:     clock.Real,
+		members:   make(map[string]*AsyncResult),
 	}
 }
 
+// SetClock sets the clock timeouts and polling intervals are measured with
+func (asyncResult *AsyncResult) SetClock(clock clock.Clock) {
+	asyncResult.clock = clock
+}
+
+// SetClock sets the clock timeouts and polling intervals of the chain and
+// its tasks are measured with
+func (chainAsyncResult *ChainAsyncResult) SetClock(clock clock.Clock) {
+	chainAsyncResult.clock = clock
+	for _, asyncResult := range chainAsyncResult.asyncResults {
+		asyncResult.SetClock(clock)
+	}
+}
+
+// SetClock sets the clock timeouts and polling intervals of the chord and
+// its tasks are measured with
+func (chordAsyncResult *ChordAsyncResult) SetClock(clock clock.Clock) {
+	chordAsyncResult.clock = clock
+	for _, asyncResult := range chordAsyncResult.groupAsyncResults {
+		asyncResult.SetClock(clock)
+	}
+	chordAsyncResult.chordAsyncResult.SetClock(clock)
+}
+
 // Touch the state and don't wait
 func (asyncResult *AsyncResult) Touch() ([]reflect.Value, error) {
 	if asyncResult.backend == nil {
 		return nil, errors.New("Result backend not configured")
 	}
 
-	asyncResult.GetState()
-
-	// Purge state if we are using AMQP backend
-	_, isAMQPBackend := asyncResult.backend.(*AMQPBackend)
-	if isAMQPBackend && asyncResult.taskState.IsCompleted() {
-		asyncResult.backend.PurgeState(asyncResult.taskState.TaskUUID)
+	if err := asyncResult.touchState(); err != nil {
+		return nil, err
 	}
 
 	if asyncResult.taskState.IsSuccess() {
@@ -88,39 +204,102 @@ func (asyncResult *AsyncResult) Touch() ([]reflect.Value, error) {
 		return resultValues, nil
 	}
 
-	if asyncResult.taskState.IsFailure() {
+	if asyncResult.taskState.IsFailure() || asyncResult.taskState.IsDeduplicated() {
 		return nil, errors.New(asyncResult.taskState.Error)
 	}
 
 	return nil, nil
 }
 
+// GetOrDefault returns task results if the task has completed, the default
+// otherwise. A failed task returns its error instead (non-blocking call)
+func (asyncResult *AsyncResult) GetOrDefault(def []reflect.Value) ([]reflect.Value, error) {
+	results, err := asyncResult.Touch()
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		return def, nil
+	}
+	return results, nil
+}
+
 // Get returns task results (synchronous blocking call)
 func (asyncResult *AsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
+	notifications, unsubscribe := asyncResult.subscribe()
+	defer unsubscribe()
+
 	for {
 		result, err := asyncResult.Touch()
 
 		if result == nil && err == nil {
-			<-time.After(sleepDuration)
+			asyncResult.wait(notifications, sleepDuration)
 		} else {
 			return result, err
 		}
 	}
 }
 
+// GetEnvelope returns task results together with the worker which ran the
+// task and when (synchronous blocking call)
+func (asyncResult *AsyncResult) GetEnvelope(sleepDuration time.Duration) (*ResultEnvelope, error) {
+	results, err := asyncResult.Get(sleepDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	state := asyncResult.GetState()
+	envelope := &ResultEnvelope{
+		Results:     results,
+		WorkerName:  state.WorkerName,
+		StartedAt:   state.StartedAt,
+		CompletedAt: state.CompletedAt,
+		RetryCount:  state.RetryCount,
+	}
+	if state.StartedAt != nil && state.CompletedAt != nil {
+		envelope.Duration = state.CompletedAt.Sub(*state.StartedAt)
+	}
+	return envelope, nil
+}
+
+// GetFailFast returns task results but unlike Get it returns the task error
+// as soon as the task fails, even if the task is going to be retried. Use
+// GetState().IsRetry() to tell whether the failure is final or not
+// (synchronous blocking call)
+func (asyncResult *AsyncResult) GetFailFast(sleepDuration time.Duration) ([]reflect.Value, error) {
+	notifications, unsubscribe := asyncResult.subscribe()
+	defer unsubscribe()
+
+	for {
+		result, err := asyncResult.Touch()
+		if result != nil || err != nil {
+			return result, err
+		}
+
+		if asyncResult.taskState.IsRetry() {
+			return nil, errors.New(asyncResult.taskState.Error)
+		}
+
+		asyncResult.wait(notifications, sleepDuration)
+	}
+}
+
 // GetWithTimeout returns task results with a timeout (synchronous blocking call)
 func (asyncResult *AsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
-	timeout := time.NewTimer(timeoutDuration)
+	timeout := asyncResult.clock.NewTimer(timeoutDuration)
+
+	notifications, unsubscribe := asyncResult.subscribe()
+	defer unsubscribe()
 
 	for {
 		select {
-		case <-timeout.C:
+		case <-timeout.C():
 			return nil, errors.New("Timeout reached")
 		default:
 			result, err := asyncResult.Touch()
 
 			if result == nil && err == nil {
-				<-time.After(sleepDuration)
+				asyncResult.wait(notifications, sleepDuration)
 			} else {
 				return result, err
 			}
@@ -128,6 +307,85 @@ func (asyncResult *AsyncResult) GetWithTimeout(timeoutDuration, sleepDuration ti
 	}
 }
 
+// GetJSON returns JSON encoded task results without reflecting them into Go
+// values first, useful when results are passed through to another service
+// (synchronous blocking call)
+func (asyncResult *AsyncResult) GetJSON(sleepDuration time.Duration) ([]byte, error) {
+	if asyncResult.backend == nil {
+		return nil, errors.New("Result backend not configured")
+	}
+
+	notifications, unsubscribe := asyncResult.subscribe()
+	defer unsubscribe()
+
+	for {
+		if err := asyncResult.touchState(); err != nil {
+			return nil, err
+		}
+
+		if asyncResult.taskState.IsSuccess() {
+			return json.Marshal(asyncResult.taskState.Results)
+		}
+
+		if asyncResult.taskState.IsFailure() || asyncResult.taskState.IsDeduplicated() {
+			return nil, errors.New(asyncResult.taskState.Error)
+		}
+
+		asyncResult.wait(notifications, sleepDuration)
+	}
+}
+
+// GetInto decodes the first task result into the value v points to without
+// reflecting it first, e.g. a struct returned by the task. The result type
+// must match the type v points to unless that is an interface
+// (synchronous blocking call)
+func (asyncResult *AsyncResult) GetInto(sleepDuration time.Duration, v interface{}) error {
+	encoded, err := asyncResult.GetJSON(sleepDuration)
+	if err != nil {
+		return err
+	}
+
+	var results []struct {
+		Type  string
+		Value json.RawMessage
+	}
+	if err := json.Unmarshal(encoded, &results); err != nil {
+		return fmt.Errorf("JSON unmarshal error: %s", err)
+	}
+	if len(results) == 0 {
+		return errors.New("Task returned no results")
+	}
+
+	target := reflect.TypeOf(v)
+	if target == nil || target.Kind() != reflect.Ptr {
+		return fmt.Errorf("Results can only be decoded into a pointer, not %T", v)
+	}
+	if target.Elem().Kind() != reflect.Interface && results[0].Type != target.Elem().String() {
+		return fmt.Errorf("Result of type %s cannot be decoded into %s", results[0].Type, target.Elem())
+	}
+
+	if err := json.Unmarshal(results[0].Value, v); err != nil {
+		return fmt.Errorf("JSON unmarshal error: %s", err)
+	}
+	return nil
+}
+
+// GetMap decodes the first task result into a generic map, e.g. for a struct
+// returned by the task when its Go type is not known to the client
+// (synchronous blocking call)
+func (asyncResult *AsyncResult) GetMap(sleepDuration time.Duration) (map[string]interface{}, error) {
+	var result interface{}
+	if err := asyncResult.GetInto(sleepDuration, &result); err != nil {
+		return nil, err
+	}
+
+	resultMap, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Result %v cannot be decoded into a map", result)
+	}
+	return resultMap, nil
+}
+
 // GetState returns latest task state
 func (asyncResult *AsyncResult) GetState() *tasks.TaskState {
 	if asyncResult.taskState.IsCompleted() {
@@ -142,6 +400,107 @@ func (asyncResult *AsyncResult) GetState() *tasks.TaskState {
 	return asyncResult.taskState
 }
 
+// Watch emits the task state each time it changes, the channel is closed once
+// the task reaches a terminal state or the context is cancelled. State changes
+// in between polls are not emitted unless the backend notifies them
+func (asyncResult *AsyncResult) Watch(ctx context.Context) <-chan *tasks.TaskState {
+	states := make(chan *tasks.TaskState)
+
+	go func() {
+		defer close(states)
+
+		notifications, unsubscribe := asyncResult.subscribe()
+		defer unsubscribe()
+
+		var last string
+		for {
+			taskState, err := asyncResult.backend.GetState(asyncResult.Signature.UUID)
+			if err == nil && taskState.State != last {
+				select {
+				case states <- taskState:
+				case <-ctx.Done():
+					return
+				}
+				last = taskState.State
+				if taskState.IsCompleted() {
+					return
+				}
+			}
+
+			select {
+			case <-notifications:
+			case <-asyncResult.clock.After(watchPollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return states
+}
+
+// touchState refreshes the task state and purges it from the AMQP backend
+// once the task has completed. ErrResultExpired is returned if the state is
+// gone although the task completed
+func (asyncResult *AsyncResult) touchState() error {
+	if !asyncResult.taskState.IsCompleted() {
+		taskState, err := asyncResult.backend.GetState(asyncResult.Signature.UUID)
+		if err != nil {
+			return asyncResult.resultExpired()
+		}
+		asyncResult.taskState = taskState
+	}
+
+	// Purge state if we are using AMQP backend
+	if asyncResult.backend.Type() == TypeAMQP && asyncResult.taskState.IsCompleted() {
+		asyncResult.backend.PurgeState(asyncResult.taskState.TaskUUID)
+	}
+
+	return nil
+}
+
+// resultExpired returns ErrResultExpired if the backend remembers the task
+// completed, the task might still be pending otherwise
+func (asyncResult *AsyncResult) resultExpired() error {
+	marker, ok := asyncResult.backend.(CompletionMarker)
+	if !ok {
+		return nil
+	}
+
+	completed, err := marker.HasCompletionMarker(asyncResult.Signature.UUID)
+	if err != nil || !completed {
+		return nil
+	}
+
+	return ErrResultExpired
+}
+
+// subscribe subscribes to result notifications if the backend supports them,
+// the returned channel is nil otherwise so waiting falls back to polling
+func (asyncResult *AsyncResult) subscribe() (<-chan struct{}, func()) {
+	notifier, ok := asyncResult.backend.(ResultNotifier)
+	if !ok {
+		return nil, func() {}
+	}
+
+	notifications, unsubscribe, err := notifier.SubscribeResult(asyncResult.Signature.UUID)
+	if err != nil {
+		return nil, func() {}
+	}
+
+	return notifications, unsubscribe
+}
+
+// wait sleeps until the task completion is notified, sleepDuration is the
+// longest time to wait before polling the state again in case the
+// notification was missed
+func (asyncResult *AsyncResult) wait(notifications <-chan struct{}, sleepDuration time.Duration) {
+	select {
+	case <-notifications:
+	case <-asyncResult.clock.After(sleepDuration):
+	}
+}
+
 // Get returns results of a chain of tasks (synchronous blocking call)
 func (chainAsyncResult *ChainAsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
 	if chainAsyncResult.backend == nil {
@@ -191,20 +550,25 @@ func (chainAsyncResult *ChainAsyncResult) GetWithTimeout(timeoutDuration, sleepD
 		err     error
 	)
 
-	timeout := time.NewTimer(timeoutDuration)
+	timeout := chainAsyncResult.clock.NewTimer(timeoutDuration)
 	ln := len(chainAsyncResult.asyncResults)
 	lastResult := chainAsyncResult.asyncResults[ln-1]
+	completed := make([][]reflect.Value, 0, ln)
 
 	for {
 		select {
-		case <-timeout.C:
-			return nil, errors.New("Timeout reached")
+		case <-timeout.C():
+			return nil, &ChainTimeoutError{Results: completed}
 		default:
 
-			for _, asyncResult := range chainAsyncResult.asyncResults {
-				_, errcur := asyncResult.Touch()
+			completed = completed[:0]
+			for i, asyncResult := range chainAsyncResult.asyncResults {
+				stepResults, errcur := asyncResult.Touch()
 				if errcur != nil {
-					return nil, err
+					return nil, errcur
+				}
+				if len(completed) == i && asyncResult.taskState.IsSuccess() {
+					completed = append(completed, stepResults)
 				}
 			}
 
@@ -215,7 +579,7 @@ func (chainAsyncResult *ChainAsyncResult) GetWithTimeout(timeoutDuration, sleepD
 			if results != nil {
 				return results, err
 			}
-			<-time.After(sleepDuration)
+			<-chainAsyncResult.clock.After(sleepDuration)
 		}
 	}
 }
@@ -226,32 +590,170 @@ func (chordAsyncResult *ChordAsyncResult) GetWithTimeout(timeoutDuration, sleepD
 		return nil, errors.New("Result backend not configured")
 	}
 
-	var (
-		results []reflect.Value
-		err     error
-	)
-
-	timeout := time.NewTimer(timeoutDuration)
+	timeout := chordAsyncResult.clock.NewTimer(timeoutDuration)
 	for {
 		select {
-		case <-timeout.C:
+		case <-timeout.C():
 			return nil, errors.New("Timeout reached")
 		default:
 			for _, asyncResult := range chordAsyncResult.groupAsyncResults {
-				_, errcur := asyncResult.Touch()
-				if errcur != nil {
+				if _, err := asyncResult.Touch(); err != nil {
 					return nil, err
 				}
 			}
 
-			results, err = chordAsyncResult.chordAsyncResult.Touch()
+			callback := chordAsyncResult.chordAsyncResult
+			results, err := callback.Touch()
 			if err != nil {
-				return nil, nil
+				return nil, err
 			}
-			if results != nil {
+			// A callback without return values succeeds with no results,
+			// only its state tells it apart from one still pending
+			if callback.taskState.IsSuccess() {
+				return results, nil
+			}
+			<-chordAsyncResult.clock.After(sleepDuration)
+		}
+	}
+}
+
+// SetClock sets the clock timeouts and polling intervals of the dynamic group
+// are measured with
+func (dynamicGroupResult *DynamicGroupResult) SetClock(clock clock.Clock) {
+	dynamicGroupResult.clock = clock
+}
+
+// Get returns results of all tasks of a dynamic group in the order they were
+// added, once the group was closed and all of them succeeded. A failed task
+// returns its error instead (synchronous blocking call)
+func (dynamicGroupResult *DynamicGroupResult) Get(sleepDuration time.Duration) ([][]reflect.Value, error) {
+	for {
+		results, err := dynamicGroupResult.Touch()
+		if results != nil || err != nil {
+			return results, err
+		}
+		<-dynamicGroupResult.clock.After(sleepDuration)
+	}
+}
+
+// GetWithTimeout returns results of all tasks of a dynamic group with timeout
+// (synchronous blocking call)
+func (dynamicGroupResult *DynamicGroupResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([][]reflect.Value, error) {
+	timeout := dynamicGroupResult.clock.NewTimer(timeoutDuration)
+
+	for {
+		select {
+		case <-timeout.C():
+			return nil, errors.New("Timeout reached")
+		default:
+			results, err := dynamicGroupResult.Touch()
+			if results != nil || err != nil {
 				return results, err
 			}
-			<-time.After(sleepDuration)
+			<-dynamicGroupResult.clock.After(sleepDuration)
+		}
+	}
+}
+
+// Touch returns results of all tasks of a dynamic group if it is complete,
+// nil otherwise, and doesn't wait
+func (dynamicGroupResult *DynamicGroupResult) Touch() ([][]reflect.Value, error) {
+	store, ok := dynamicGroupResult.backend.(DynamicGroupStore)
+	if !ok {
+		return nil, errors.New("Result backend does not support dynamic groups")
+	}
+
+	taskUUIDs, closed, err := store.GetDynamicGroup(dynamicGroupResult.GroupUUID)
+	if err != nil || !closed {
+		return nil, err
+	}
+
+	results := make([][]reflect.Value, len(taskUUIDs))
+	for i, taskUUID := range taskUUIDs {
+		asyncResult, ok := dynamicGroupResult.members[taskUUID]
+		if !ok {
+			asyncResult = NewAsyncResult(&tasks.Signature{UUID: taskUUID}, dynamicGroupResult.backend)
+			dynamicGroupResult.members[taskUUID] = asyncResult
+		}
+
+		results[i], err = asyncResult.Touch()
+		if err != nil {
+			return nil, err
+		}
+		if !asyncResult.taskState.IsSuccess() {
+			return nil, nil
+		}
+	}
+
+	// Tasks are added to the group before the task adding them completes,
+	// so none was added while the states were checked if the group did not
+	// grow in the meantime
+	latestUUIDs, _, err := store.GetDynamicGroup(dynamicGroupResult.GroupUUID)
+	if err != nil || len(latestUUIDs) != len(taskUUIDs) {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Next waits for results of the next task of a lazy group in the order the
+// tasks were generated and sends another task in its place. It returns false
+// once all tasks were iterated over or on error, see Err (synchronous
+// blocking call)
+func (lazyGroupAsyncResult *LazyGroupAsyncResult) Next(sleepDuration time.Duration) bool {
+	if lazyGroupAsyncResult.err != nil || len(lazyGroupAsyncResult.window) == 0 {
+		lazyGroupAsyncResult.results = nil
+		return false
+	}
+
+	results, err := lazyGroupAsyncResult.window[0].Get(sleepDuration)
+	if err != nil {
+		lazyGroupAsyncResult.err = err
+		lazyGroupAsyncResult.results = nil
+		return false
+	}
+
+	// Forget the task so only the current window is held in memory
+	lazyGroupAsyncResult.window[0] = nil
+	lazyGroupAsyncResult.window = lazyGroupAsyncResult.window[1:]
+	lazyGroupAsyncResult.results = results
+
+	// A failure to send the next task is reported by the following call
+	lazyGroupAsyncResult.err = lazyGroupAsyncResult.fill()
+	return true
+}
+
+// Results returns results of the task Next waited for
+func (lazyGroupAsyncResult *LazyGroupAsyncResult) Results() []reflect.Value {
+	return lazyGroupAsyncResult.results
+}
+
+// Err returns the error which stopped the iteration, nil if all tasks of the
+// group completed
+func (lazyGroupAsyncResult *LazyGroupAsyncResult) Err() error {
+	return lazyGroupAsyncResult.err
+}
+
+// Pending returns how many tasks were sent but not iterated over yet
+func (lazyGroupAsyncResult *LazyGroupAsyncResult) Pending() int {
+	return len(lazyGroupAsyncResult.window)
+}
+
+// fill generates and sends tasks until the window is full or all tasks of
+// the group were sent
+func (lazyGroupAsyncResult *LazyGroupAsyncResult) fill() error {
+	group := lazyGroupAsyncResult.group
+	maxParallel := group.MaxParallel
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+
+	for len(lazyGroupAsyncResult.window) < maxParallel && lazyGroupAsyncResult.sent < group.Size {
+		asyncResult, err := lazyGroupAsyncResult.send(group.Task(lazyGroupAsyncResult.sent))
+		if err != nil {
+			return fmt.Errorf("Send lazy group task %d error: %s", lazyGroupAsyncResult.sent, err)
 		}
+		lazyGroupAsyncResult.window = append(lazyGroupAsyncResult.window, asyncResult)
+		lazyGroupAsyncResult.sent++
 	}
+	return nil
 }
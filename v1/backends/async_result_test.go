@@ -0,0 +1,293 @@
+package backends_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/clock"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+// notifyingBackend pushes a result notification once a task is completed
+type notifyingBackend struct {
+	backends.Interface
+	mu            sync.Mutex
+	notifications chan struct{}
+}
+
+func (b *notifyingBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Interface.GetState(taskUUID)
+}
+
+func (b *notifyingBackend) SubscribeResult(taskUUID string) (<-chan struct{}, func(), error) {
+	return b.notifications, func() {}, nil
+}
+
+func (b *notifyingBackend) update(set func()) {
+	b.mu.Lock()
+	set()
+	b.mu.Unlock()
+	b.notifications <- struct{}{}
+}
+
+func (b *notifyingBackend) complete(signature *tasks.Signature, results []*tasks.TaskResult) {
+	b.mu.Lock()
+	b.Interface.SetStateSuccess(signature, results)
+	b.mu.Unlock()
+	b.notifications <- struct{}{}
+}
+
+func TestGetNotified(t *testing.T) {
+	backend := &notifyingBackend{
+		Interface:     backends.NewEagerBackend(),
+		notifications: make(chan struct{}, 1),
+	}
+
+	signature := &tasks.Signature{UUID: "notified"}
+	assert.NoError(t, backend.SetStatePending(signature))
+
+	go func() {
+		<-time.After(10 * time.Millisecond)
+		backend.complete(signature, []*tasks.TaskResult{{Type: "int64", Value: 2}})
+	}()
+
+	// Get must not wait for the next poll
+	start := time.Now()
+	results, err := backends.NewAsyncResult(signature, backend).Get(time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, int64(2), results[0].Interface())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	backend := &notifyingBackend{
+		Interface:     backends.NewEagerBackend(),
+		notifications: make(chan struct{}, 1),
+	}
+
+	signature := &tasks.Signature{UUID: "watched"}
+	assert.NoError(t, backend.SetStatePending(signature))
+
+	states := backends.NewAsyncResult(signature, backend).Watch(context.Background())
+
+	steps := []struct {
+		set   func()
+		state string
+	}{
+		{func() {}, tasks.StatePending},
+		{func() { backend.Interface.SetStateReceived(signature) }, tasks.StateReceived},
+		{func() { backend.Interface.SetStateStarted(signature) }, tasks.StateStarted},
+		{func() { backend.Interface.SetStateSuccess(signature, []*tasks.TaskResult{}) }, tasks.StateSuccess},
+	}
+	for _, step := range steps {
+		backend.update(step.set)
+		select {
+		case taskState := <-states:
+			assert.Equal(t, step.state, taskState.State)
+		case <-time.After(time.Second):
+			t.Fatalf("%s state was not emitted", step.state)
+		}
+	}
+
+	_, ok := <-states
+	assert.False(t, ok, "Watch should close once the task completes")
+
+	// Cancelling the context closes the channel before the task completes
+	ctx, cancel := context.WithCancel(context.Background())
+	states = backends.NewAsyncResult(&tasks.Signature{UUID: "cancelled"}, backend).Watch(ctx)
+	cancel()
+	for range states {
+	}
+}
+
+// purgeRecordingBackend reports AMQP type and records purged states
+type purgeRecordingBackend struct {
+	backends.Interface
+	purged []string
+}
+
+func (b *purgeRecordingBackend) Type() string {
+	return backends.TypeAMQP
+}
+
+func (b *purgeRecordingBackend) PurgeState(taskUUID string) error {
+	b.purged = append(b.purged, taskUUID)
+	return b.Interface.PurgeState(taskUUID)
+}
+
+func TestTouchPurgesAMQPState(t *testing.T) {
+	backend := &purgeRecordingBackend{Interface: backends.NewEagerBackend()}
+
+	signature := &tasks.Signature{UUID: "purged"}
+	assert.NoError(t, backend.SetStateSuccess(signature, []*tasks.TaskResult{}))
+
+	_, err := backends.NewAsyncResult(signature, backend).Touch()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"purged"}, backend.purged)
+}
+
+func TestChainGetWithTimeoutPartialResults(t *testing.T) {
+	backend := backends.NewEagerBackend()
+
+	signatures := []*tasks.Signature{
+		{UUID: "chain_step_1"},
+		{UUID: "chain_step_2"},
+		{UUID: "chain_step_3"},
+	}
+	assert.NoError(t, backend.SetStateSuccess(signatures[0], []*tasks.TaskResult{{Type: "int64", Value: 1}}))
+	assert.NoError(t, backend.SetStateSuccess(signatures[1], []*tasks.TaskResult{{Type: "int64", Value: 2}}))
+	// The last step stalls
+	assert.NoError(t, backend.SetStateStarted(signatures[2]))
+
+	results, err := backends.NewChainAsyncResult(signatures, backend).GetWithTimeout(20*time.Millisecond, time.Millisecond)
+	assert.Nil(t, results)
+	assert.EqualError(t, err, "Timeout reached")
+
+	timeoutErr, ok := err.(*backends.ChainTimeoutError)
+	if assert.True(t, ok) && assert.Len(t, timeoutErr.Results, 2) {
+		assert.Equal(t, int64(1), timeoutErr.Results[0][0].Interface())
+		assert.Equal(t, int64(2), timeoutErr.Results[1][0].Interface())
+	}
+}
+
+func TestChainGetWithTimeoutFailedStep(t *testing.T) {
+	backend := backends.NewEagerBackend()
+
+	signatures := []*tasks.Signature{
+		{UUID: "failed_chain_step_1"},
+		{UUID: "failed_chain_step_2"},
+		{UUID: "failed_chain_step_3"},
+	}
+	assert.NoError(t, backend.SetStateSuccess(signatures[0], []*tasks.TaskResult{{Type: "int64", Value: 1}}))
+	// The middle step fails, so the last one is never sent
+	assert.NoError(t, backend.SetStateFailure(signatures[1], "step failed"))
+	assert.NoError(t, backend.SetStatePending(signatures[2]))
+
+	results, err := backends.NewChainAsyncResult(signatures, backend).GetWithTimeout(time.Second, time.Millisecond)
+	assert.Nil(t, results)
+	assert.EqualError(t, err, "step failed")
+}
+
+func TestChordGetWithTimeout(t *testing.T) {
+	backend := backends.NewEagerBackend()
+
+	groupTasks := []*tasks.Signature{{UUID: "chord_task_1"}, {UUID: "chord_task_2"}}
+	for _, signature := range groupTasks {
+		assert.NoError(t, backend.SetStateSuccess(signature, []*tasks.TaskResult{{Type: "int64", Value: 1}}))
+	}
+
+	// A failed callback surfaces its error
+	callback := &tasks.Signature{UUID: "chord_callback"}
+	assert.NoError(t, backend.SetStateFailure(callback, "callback failed"))
+	results, err := backends.NewChordAsyncResult(groupTasks, callback, backend).GetWithTimeout(time.Second, time.Millisecond)
+	assert.Nil(t, results)
+	assert.EqualError(t, err, "callback failed")
+
+	// A callback without return values is not mistaken for a pending one
+	assert.NoError(t, backend.SetStateSuccess(callback, []*tasks.TaskResult{}))
+	results, err = backends.NewChordAsyncResult(groupTasks, callback, backend).GetWithTimeout(time.Second, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	// A failed group task surfaces its error too
+	assert.NoError(t, backend.SetStateFailure(groupTasks[1], "group task failed"))
+	_, err = backends.NewChordAsyncResult(groupTasks, callback, backend).GetWithTimeout(time.Second, time.Millisecond)
+	assert.EqualError(t, err, "group task failed")
+}
+
+func TestGetWithTimeoutFakeClock(t *testing.T) {
+	backend := backends.NewEagerBackend()
+
+	signature := &tasks.Signature{UUID: "stalled"}
+	assert.NoError(t, backend.SetStateStarted(signature))
+
+	fakeClock := clock.NewFake(time.Now())
+	asyncResult := backends.NewAsyncResult(signature, backend)
+	asyncResult.SetClock(fakeClock)
+
+	done := make(chan error)
+	go func() {
+		_, err := asyncResult.GetWithTimeout(time.Hour, time.Minute)
+		done <- err
+	}()
+
+	// Wait for the timeout and the first poll interval to be set
+	fakeClock.BlockUntil(2)
+	fakeClock.Advance(time.Hour)
+
+	select {
+	case err := <-done:
+		assert.EqualError(t, err, "Timeout reached")
+	case <-time.After(time.Second):
+		t.Fatal("GetWithTimeout should time out once the clock passes the timeout")
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+	backend := backends.NewEagerBackend()
+	def := []reflect.Value{reflect.ValueOf("processing...")}
+
+	signature := &tasks.Signature{UUID: "rendered"}
+	assert.NoError(t, backend.SetStateStarted(signature))
+	asyncResult := backends.NewAsyncResult(signature, backend)
+
+	results, err := asyncResult.GetOrDefault(def)
+	assert.NoError(t, err)
+	assert.Equal(t, def, results)
+
+	assert.NoError(t, backend.SetStateSuccess(signature, []*tasks.TaskResult{{Type: "string", Value: "done"}}))
+	results, err = asyncResult.GetOrDefault(def)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "done", results[0].Interface())
+	}
+
+	// Failures are not hidden behind the default
+	failed := &tasks.Signature{UUID: "failed"}
+	assert.NoError(t, backend.SetStateFailure(failed, "oops"))
+	results, err = backends.NewAsyncResult(failed, backend).GetOrDefault(def)
+	assert.Nil(t, results)
+	assert.EqualError(t, err, "oops")
+}
+
+type point struct {
+	X, Y int
+}
+
+func TestResultViews(t *testing.T) {
+	tasks.RegisterResultType(point{})
+
+	backend := backends.NewEagerBackend()
+	signature := &tasks.Signature{UUID: "point"}
+	result := point{X: 1, Y: 2}
+	assert.NoError(t, backend.SetStateSuccess(signature, []*tasks.TaskResult{
+		{Type: reflect.TypeOf(result).String(), Value: result},
+	}))
+	asyncResult := backends.NewAsyncResult(signature, backend)
+
+	// Go value
+	results, err := asyncResult.Get(time.Millisecond)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, result, results[0].Interface())
+	}
+
+	// JSON
+	encoded, err := asyncResult.GetJSON(time.Millisecond)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"Type":"backends_test.point","Value":{"X":1,"Y":2}}]`, string(encoded))
+
+	// Generic map
+	resultMap, err := asyncResult.GetMap(time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"X": float64(1), "Y": float64(2)}, resultMap)
+}
@@ -0,0 +1,16 @@
+//go:build go1.18
+// +build go1.18
+
+package backends
+
+import (
+	"time"
+)
+
+// GetTyped returns the first task result decoded into T, see
+// AsyncResult.GetInto (synchronous blocking call)
+func GetTyped[T any](asyncResult *AsyncResult, sleepDuration time.Duration) (T, error) {
+	var result T
+	err := asyncResult.GetInto(sleepDuration, &result)
+	return result, err
+}
@@ -1,26 +1,68 @@
 package backends
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/koblelabs/machinery/v1/tasks"
 )
 
 // EagerBackend represents an "eager" in-memory result backend
 type EagerBackend struct {
-	groups map[string][]string
-	tasks  map[string][]byte
+	groups    map[string][]string
+	tasks     map[string][]byte
+	debounces map[string]string
+	// superseded maps replaced tasks to the tasks replacing them
+	superseded map[string]string
+	workflows  map[string][]byte
+	blobs      map[string][]byte
+	// dynamicGroups maps dynamic groups to their members, a group is closed
+	// once it is in closedGroups
+	dynamicGroups map[string][]string
+	closedGroups  map[string]bool
+	retryCounts   map[string]int
+	cache         map[string]eagerCacheItem
+	completed     map[string]bool
+	// slots maps leased slots of each task to their expiration, unlike the
+	// rest of the backend they are used by concurrently running tasks
+	slots   map[string]map[string]time.Time
+	slotsMu sync.Mutex
+}
+
+// eagerCacheItem holds encoded cached results, zero expiresAt never expires
+type eagerCacheItem struct {
+	results   []byte
+	expiresAt time.Time
 }
 
 // NewEagerBackend creates EagerBackend instance
 func NewEagerBackend() Interface {
 	return &EagerBackend{
-		groups: make(map[string][]string),
-		tasks:  make(map[string][]byte),
+		groups:        make(map[string][]string),
+		tasks:         make(map[string][]byte),
+		debounces:     make(map[string]string),
+		superseded:    make(map[string]string),
+		workflows:     make(map[string][]byte),
+		blobs:         make(map[string][]byte),
+		dynamicGroups: make(map[string][]string),
+		closedGroups:  make(map[string]bool),
+		retryCounts:   make(map[string]int),
+		cache:         make(map[string]eagerCacheItem),
+		completed:     make(map[string]bool),
+		slots:         make(map[string]map[string]time.Time),
 	}
 }
 
+// Type returns the backend type
+func (b *EagerBackend) Type() string {
+	return TypeEager
+}
+
 // InitGroup creates and saves a group meta data object
 func (b *EagerBackend) InitGroup(groupUUID string, taskUUIDs []string) error {
 	tasks := make([]string, 0, len(taskUUIDs))
@@ -89,6 +131,18 @@ func (b *EagerBackend) SetStatePending(signature *tasks.Signature) error {
 	return b.updateState(state)
 }
 
+// SetStateSkipped updates task state to SKIPPED
+func (b *EagerBackend) SetStateSkipped(signature *tasks.Signature) error {
+	state := tasks.NewSkippedTaskState(signature)
+	return b.updateState(state)
+}
+
+// SetStateDeduplicated updates task state to DEDUPLICATED
+func (b *EagerBackend) SetStateDeduplicated(signature *tasks.Signature, err string) error {
+	state := tasks.NewDeduplicatedTaskState(signature, err)
+	return b.updateState(state)
+}
+
 // SetStateReceived updates task state to RECEIVED
 func (b *EagerBackend) SetStateReceived(signature *tasks.Signature) error {
 	state := tasks.NewReceivedTaskState(signature)
@@ -103,7 +157,13 @@ func (b *EagerBackend) SetStateStarted(signature *tasks.Signature) error {
 
 // SetStateRetry updates task state to RETRY
 func (b *EagerBackend) SetStateRetry(signature *tasks.Signature) error {
-	state := tasks.NewRetryTaskState(signature)
+	return b.SetStateRetryWithError(signature, "")
+}
+
+// SetStateRetryWithError updates task state to RETRY keeping the error the
+// task failed with
+func (b *EagerBackend) SetStateRetryWithError(signature *tasks.Signature, err string) error {
+	state := tasks.NewRetryTaskState(signature, err)
 	return b.updateState(state)
 }
 
@@ -115,7 +175,14 @@ func (b *EagerBackend) SetStateSuccess(signature *tasks.Signature, results []*ta
 
 // SetStateFailure updates task state to FAILURE
 func (b *EagerBackend) SetStateFailure(signature *tasks.Signature, err string) error {
+	return b.SetStateFailureWithDetail(signature, err, nil)
+}
+
+// SetStateFailureWithDetail updates task state to FAILURE keeping
+// error chain and stack trace
+func (b *EagerBackend) SetStateFailureWithDetail(signature *tasks.Signature, err string, detail *tasks.ErrorDetail) error {
 	state := tasks.NewFailureTaskState(signature, err)
+	state.ErrorDetail = detail
 	return b.updateState(state)
 }
 
@@ -123,7 +190,7 @@ func (b *EagerBackend) SetStateFailure(signature *tasks.Signature, err string) e
 func (b *EagerBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	tasktStateBytes, ok := b.tasks[taskUUID]
 	if !ok {
-		return nil, fmt.Errorf("Task not found: %v", taskUUID)
+		return nil, ErrStateNotFound
 	}
 
 	state := new(tasks.TaskState)
@@ -157,6 +224,191 @@ func (b *EagerBackend) PurgeGroupMeta(groupUUID string) error {
 	return nil
 }
 
+// Ping always succeeds as eager backend keeps states in memory
+func (b *EagerBackend) Ping() error {
+	return nil
+}
+
+// SetDebounce stores UUID of the latest task sent with the debounce key
+func (b *EagerBackend) SetDebounce(debounceKey, taskUUID string) error {
+	b.debounces[debounceKey] = taskUUID
+	return nil
+}
+
+// SetSuperseded remembers the task was replaced by another one
+func (b *EagerBackend) SetSuperseded(taskUUID, replacementUUID string) error {
+	b.superseded[taskUUID] = replacementUUID
+	return nil
+}
+
+// GetSuperseded returns UUID of the task replacing the task, "" if it was
+// not replaced
+func (b *EagerBackend) GetSuperseded(taskUUID string) (string, error) {
+	return b.superseded[taskUUID], nil
+}
+
+// SetRetryCount stores the number of retries the task has left
+func (b *EagerBackend) SetRetryCount(taskUUID string, retryCount int) error {
+	b.retryCounts[taskUUID] = retryCount
+	return nil
+}
+
+// GetRetryCount returns the number of retries the task has left, false if it
+// was not stored
+func (b *EagerBackend) GetRetryCount(taskUUID string) (int, bool, error) {
+	retryCount, ok := b.retryCounts[taskUUID]
+	return retryCount, ok, nil
+}
+
+// SetWorkflow stores the structure of the workflow
+func (b *EagerBackend) SetWorkflow(workflow *tasks.Workflow) error {
+	encoded, err := json.Marshal(workflow)
+	if err != nil {
+		return err
+	}
+	b.workflows[workflow.UUID] = encoded
+	return nil
+}
+
+// GetWorkflow returns the stored structure of the workflow, nil if it was
+// not stored
+func (b *EagerBackend) GetWorkflow(workflowUUID string) (*tasks.Workflow, error) {
+	encoded, ok := b.workflows[workflowUUID]
+	if !ok {
+		return nil, nil
+	}
+
+	workflow := new(tasks.Workflow)
+	if err := json.Unmarshal(encoded, workflow); err != nil {
+		return nil, err
+	}
+	return workflow, nil
+}
+
+// AddDynamicGroupMember adds the task to the dynamic group
+func (b *EagerBackend) AddDynamicGroupMember(groupUUID, taskUUID string) error {
+	b.dynamicGroups[groupUUID] = append(b.dynamicGroups[groupUUID], taskUUID)
+	return nil
+}
+
+// CloseDynamicGroup marks the dynamic group as complete, no more tasks are
+// added to it
+func (b *EagerBackend) CloseDynamicGroup(groupUUID string) error {
+	b.closedGroups[groupUUID] = true
+	return nil
+}
+
+// GetDynamicGroup returns members of the dynamic group and whether it was
+// closed
+func (b *EagerBackend) GetDynamicGroup(groupUUID string) ([]string, bool, error) {
+	taskUUIDs := append([]string(nil), b.dynamicGroups[groupUUID]...)
+	return taskUUIDs, b.closedGroups[groupUUID], nil
+}
+
+// SetBlob stores the blob under the key
+func (b *EagerBackend) SetBlob(key string, blob io.Reader) error {
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	b.blobs[key] = data
+	return nil
+}
+
+// GetBlob returns a reader of the blob stored under the key
+func (b *EagerBackend) GetBlob(key string) (io.ReadCloser, error) {
+	data, ok := b.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("Blob not found: %v", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// SetCompletionMarker remembers the task completed, markers of the eager
+// backend never expire
+func (b *EagerBackend) SetCompletionMarker(taskUUID string) error {
+	b.completed[taskUUID] = true
+	return nil
+}
+
+// HasCompletionMarker returns true if the task is remembered as completed
+func (b *EagerBackend) HasCompletionMarker(taskUUID string) (bool, error) {
+	return b.completed[taskUUID], nil
+}
+
+// AcquireSlot leases one of max slots of the task to the holder for ttl,
+// returns false if all of them are taken
+func (b *EagerBackend) AcquireSlot(name, holder string, max int, ttl time.Duration) (bool, error) {
+	b.slotsMu.Lock()
+	defer b.slotsMu.Unlock()
+
+	now := time.Now()
+	slots, ok := b.slots[name]
+	if !ok {
+		slots = make(map[string]time.Time)
+		b.slots[name] = slots
+	}
+	for slotHolder, expiresAt := range slots {
+		if !expiresAt.After(now) {
+			delete(slots, slotHolder)
+		}
+	}
+
+	if _, ok := slots[holder]; !ok && len(slots) >= max {
+		return false, nil
+	}
+	slots[holder] = now.Add(ttl)
+	return true, nil
+}
+
+// ReleaseSlot frees the slot leased to the holder
+func (b *EagerBackend) ReleaseSlot(name, holder string) error {
+	b.slotsMu.Lock()
+	defer b.slotsMu.Unlock()
+
+	delete(b.slots[name], holder)
+	return nil
+}
+
+// GetDebounce returns UUID of the latest task sent with the debounce key
+func (b *EagerBackend) GetDebounce(debounceKey string) (string, error) {
+	taskUUID, ok := b.debounces[debounceKey]
+	if !ok {
+		return "", fmt.Errorf("Debounce key not found: %v", debounceKey)
+	}
+
+	return taskUUID, nil
+}
+
+// SetCachedResults caches task results under the cache key
+func (b *EagerBackend) SetCachedResults(cacheKey string, results []*tasks.TaskResult, ttl time.Duration) error {
+	msg, err := json.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("JSON Encode Results: %v", err)
+	}
+
+	item := eagerCacheItem{results: msg}
+	if ttl > 0 {
+		item.expiresAt = time.Now().Add(ttl)
+	}
+	b.cache[cacheKey] = item
+	return nil
+}
+
+// GetCachedResults returns results cached under the cache key
+func (b *EagerBackend) GetCachedResults(cacheKey string) ([]*tasks.TaskResult, error) {
+	item, ok := b.cache[cacheKey]
+	if !ok || (!item.expiresAt.IsZero() && time.Now().After(item.expiresAt)) {
+		return nil, nil
+	}
+
+	var results []*tasks.TaskResult
+	if err := json.Unmarshal(item.results, &results); err != nil {
+		return nil, fmt.Errorf("JSON Decode Results: %v", err)
+	}
+	return results, nil
+}
+
 func (b *EagerBackend) updateState(s *tasks.TaskState) error {
 	// simulate the behavior of json marshal/unmarshal
 	msg, err := json.Marshal(s)
@@ -1,10 +1,15 @@
 package backends_test
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/koblelabs/machinery/v1/backends"
 	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -269,13 +274,27 @@ func (s *EagerBackendTestSuite) TestSetStateRetry() {
 			s.Equal(tasks.StateRetry, st.State)
 		}
 	}
+
+	// the error is kept by backends recording it
+	{
+		t := s.st[5]
+		recorder, ok := s.backend.(backends.RetryErrorRecorder)
+		s.True(ok)
+		s.Nil(recorder.SetStateRetryWithError(t, "just a test"))
+		st, err := s.backend.GetState(t.UUID)
+		s.Nil(err)
+		if st != nil {
+			s.Equal(tasks.StateRetry, st.State)
+			s.Equal("just a test", st.Error)
+		}
+	}
 }
 
 func (s *EagerBackendTestSuite) TestGetState() {
 	// get something not existed -- empty string
 	st, err := s.backend.GetState("")
 	s.Nil(st)
-	s.NotNil(err)
+	s.Equal(backends.ErrStateNotFound, err)
 }
 
 func (s *EagerBackendTestSuite) TestPurgeState() {
@@ -292,7 +311,7 @@ func (s *EagerBackendTestSuite) TestPurgeState() {
 		// should be not found
 		st, err = s.backend.GetState(t.UUID)
 		s.Nil(st)
-		s.NotNil(err)
+		s.Equal(backends.ErrStateNotFound, err)
 	}
 
 	{
@@ -340,3 +359,54 @@ func (s *EagerBackendTestSuite) getTaskSignature(taskUUID string) *tasks.Signatu
 func TestEagerBackendMain(t *testing.T) {
 	suite.Run(t, &EagerBackendTestSuite{})
 }
+
+func TestEagerSemaphore(t *testing.T) {
+	semaphore := backends.NewEagerBackend().(backends.Semaphore)
+
+	// Workers running at once never exceed the limit
+	var running, maxRunning, completed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				holder := fmt.Sprintf("task_%d_%d", worker, j)
+				acquired, err := semaphore.AcquireSlot("charge", holder, 3, time.Minute)
+				assert.NoError(t, err)
+				if !acquired {
+					continue
+				}
+
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				atomic.AddInt32(&completed, 1)
+
+				assert.NoError(t, semaphore.ReleaseSlot("charge", holder))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, maxRunning <= 3)
+	assert.True(t, completed > 0)
+
+	// Slots of crashed workers are reclaimed once their lease expires
+	acquired, err := semaphore.AcquireSlot("report", "task_1", 1, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = semaphore.AcquireSlot("report", "task_2", 1, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	time.Sleep(20 * time.Millisecond)
+	acquired, err = semaphore.AcquireSlot("report", "task_2", 1, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+}
@@ -1,11 +1,34 @@
 package backends
 
 import (
+	"errors"
+	"io"
+	"time"
+
 	"github.com/koblelabs/machinery/v1/tasks"
 )
 
+// Result backend types returned by Interface.Type
+const (
+	TypeAMQP     = "amqp"
+	TypeEager    = "eager"
+	TypeMemcache = "memcache"
+	TypeMongoDB  = "mongodb"
+	TypeRedis    = "redis"
+)
+
+// ErrResultExpired is returned when waiting for a task which completed but
+// whose result is gone from the result backend, e.g. it expired
+var ErrResultExpired = errors.New("Task result expired")
+
+// ErrStateNotFound is returned by GetState of all result backends when no
+// state is stored for the task, e.g. it was not sent yet, rather than failing
+var ErrStateNotFound = errors.New("Task state not found")
+
 // Interface - a common interface for all result backends
 type Interface interface {
+	// Type returns a stable identifier of the backend implementation
+	Type() string
 	// Group related functions
 	InitGroup(groupUUID string, taskUUIDs []string) error
 	GroupCompleted(groupUUID string, groupTaskCount int) (bool, error)
@@ -23,3 +46,109 @@ type Interface interface {
 	PurgeState(taskUUID string) error
 	PurgeGroupMeta(groupUUID string) error
 }
+
+// Debouncer is implemented by backends able to keep track of the latest task
+// sent with a given debounce key, GetDebounce returns "" once the key expired
+type Debouncer interface {
+	SetDebounce(debounceKey, taskUUID string) error
+	GetDebounce(debounceKey string) (string, error)
+}
+
+// Superseder is implemented by backends able to remember that a task was
+// replaced by another one, GetSuperseded returns "" unless it was
+type Superseder interface {
+	SetSuperseded(taskUUID, replacementUUID string) error
+	GetSuperseded(taskUUID string) (string, error)
+}
+
+// WorkflowStore is implemented by backends able to store the structure of a
+// workflow, GetWorkflow returns nil unless it was stored
+type WorkflowStore interface {
+	SetWorkflow(workflow *tasks.Workflow) error
+	GetWorkflow(workflowUUID string) (*tasks.Workflow, error)
+}
+
+// DynamicGroupStore is implemented by backends able to keep members of a
+// dynamic group, which grows while its tasks run, GetDynamicGroup returns
+// members in the order they were added
+type DynamicGroupStore interface {
+	AddDynamicGroupMember(groupUUID, taskUUID string) error
+	CloseDynamicGroup(groupUUID string) error
+	GetDynamicGroup(groupUUID string) (taskUUIDs []string, closed bool, err error)
+}
+
+// RetryCountStore is implemented by backends able to keep the number of
+// retries a task has left, GetRetryCount returns false unless it was stored
+type RetryCountStore interface {
+	SetRetryCount(taskUUID string, retryCount int) error
+	GetRetryCount(taskUUID string) (int, bool, error)
+}
+
+// BlobStore is implemented by backends able to store blobs, e.g. large task
+// inputs passed to tasks as stream args referencing blob://key
+type BlobStore interface {
+	SetBlob(key string, blob io.Reader) error
+	GetBlob(key string) (io.ReadCloser, error)
+}
+
+// ErrorDetailRecorder is implemented by backends able to store error chain
+// and stack trace of a failed task alongside the error message
+type ErrorDetailRecorder interface {
+	SetStateFailureWithDetail(signature *tasks.Signature, err string, detail *tasks.ErrorDetail) error
+}
+
+// ResultNotifier is implemented by backends able to push a notification when
+// a task state changes, at least once it reaches a terminal state. The
+// returned channel receives a value for each notification and is nil if
+// notifications are disabled, calling the returned function cancels the
+// subscription
+type ResultNotifier interface {
+	SubscribeResult(taskUUID string) (<-chan struct{}, func(), error)
+}
+
+// RetryErrorRecorder is implemented by backends able to store the error a
+// task failed with alongside its RETRY state
+type RetryErrorRecorder interface {
+	SetStateRetryWithError(signature *tasks.Signature, err string) error
+}
+
+// SkipRecorder is implemented by backends able to record that a task was
+// not sent because its dispatch condition did not hold
+type SkipRecorder interface {
+	SetStateSkipped(signature *tasks.Signature) error
+}
+
+// DeduplicationRecorder is implemented by backends able to record that a
+// task was dropped as a duplicate of another one
+type DeduplicationRecorder interface {
+	SetStateDeduplicated(signature *tasks.Signature, err string) error
+}
+
+// ResultCache is implemented by backends able to cache task results under
+// a cache key, GetCachedResults returns nil results on a cache miss
+type ResultCache interface {
+	SetCachedResults(cacheKey string, results []*tasks.TaskResult, ttl time.Duration) error
+	GetCachedResults(cacheKey string) ([]*tasks.TaskResult, error)
+}
+
+// Pinger is implemented by backends able to check the backend is reachable
+type Pinger interface {
+	Ping() error
+}
+
+// CompletionMarker is implemented by backends able to remember that a task
+// completed for longer than its result is kept, so a result which expired can
+// be told apart from a task which is still pending
+type CompletionMarker interface {
+	SetCompletionMarker(taskUUID string) error
+	HasCompletionMarker(taskUUID string) (bool, error)
+}
+
+// Semaphore is implemented by backends able to limit how many tasks of the
+// same name run at once across all workers. Slots are leased for ttl so the
+// slot of a crashed worker is reclaimed, acquiring a slot the holder already
+// has renews its lease
+type Semaphore interface {
+	AcquireSlot(name, holder string, max int, ttl time.Duration) (bool, error)
+	ReleaseSlot(name, holder string) error
+}
@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"fmt"
+
+	"github.com/koblelabs/machinery/v1/config"
+)
+
+// storageKey prepends ResultsKeyPrefix to a key the backend stores data under
+func storageKey(cnf *config.Config, key string) string {
+	if cnf == nil {
+		return key
+	}
+	return cnf.ResultsKeyPrefix + key
+}
+
+// debounceStorageKey returns a key under which the latest task UUID for a
+// debounce key is stored
+func debounceStorageKey(debounceKey string) string {
+	return fmt.Sprintf("debounce_%s", debounceKey)
+}
+
+// supersededStorageKey returns a key under which the UUID of the task
+// replacing a task is stored
+func supersededStorageKey(taskUUID string) string {
+	return fmt.Sprintf("superseded_%s", taskUUID)
+}
+
+// workflowStorageKey returns a key under which the structure of a workflow
+// is stored
+func workflowStorageKey(workflowUUID string) string {
+	return fmt.Sprintf("workflow_%s", workflowUUID)
+}
+
+// dynamicGroupStorageKey returns a key under which members of a dynamic group
+// are stored
+func dynamicGroupStorageKey(groupUUID string) string {
+	return fmt.Sprintf("dynamic_group_%s", groupUUID)
+}
+
+// dynamicGroupClosedStorageKey returns a key under which the marker of a
+// closed dynamic group is stored
+func dynamicGroupClosedStorageKey(groupUUID string) string {
+	return fmt.Sprintf("dynamic_group_closed_%s", groupUUID)
+}
+
+// retryCountStorageKey returns a key under which the number of retries a task
+// has left is stored
+func retryCountStorageKey(taskUUID string) string {
+	return fmt.Sprintf("retry_count_%s", taskUUID)
+}
+
+// blobStorageKey returns a key under which a blob is stored
+func blobStorageKey(key string) string {
+	return fmt.Sprintf("blob_%s", key)
+}
+
+// completionMarkerStorageKey returns a key under which the completion marker
+// of a task is stored
+func completionMarkerStorageKey(taskUUID string) string {
+	return fmt.Sprintf("completed_%s", taskUUID)
+}
+
+// completionMarkerExpireIn returns how many seconds completion markers are
+// kept for
+func completionMarkerExpireIn(cnf *config.Config) int {
+	if cnf.CompletionMarkerExpireIn > 0 {
+		return cnf.CompletionMarkerExpireIn
+	}
+	if cnf.ResultsExpireIn > 0 {
+		return cnf.ResultsExpireIn * 10
+	}
+	// results expire after 1 hour by default
+	return 3600 * 10
+}
+
+// semaphoreStorageKey returns a key under which leased slots of the global
+// concurrency limit of a task are stored
+func semaphoreStorageKey(name string) string {
+	return fmt.Sprintf("semaphore_%s", name)
+}
+
+// resultCacheStorageKey returns a key under which cached results are stored
+func resultCacheStorageKey(cacheKey string) string {
+	return fmt.Sprintf("result_cache_%s", cacheKey)
+}
@@ -25,6 +25,11 @@ func NewMemcacheBackend(cnf *config.Config, servers []string) Interface {
 	}
 }
 
+// Type returns the backend type
+func (b *MemcacheBackend) Type() string {
+	return TypeMemcache
+}
+
 // InitGroup creates and saves a group meta data object
 func (b *MemcacheBackend) InitGroup(groupUUID string, taskUUIDs []string) error {
 	groupMeta := &tasks.GroupMeta{
@@ -38,7 +43,7 @@ func (b *MemcacheBackend) InitGroup(groupUUID string, taskUUIDs []string) error
 	}
 
 	return b.getClient().Set(&memcache.Item{
-		Key:        groupUUID,
+		Key:        storageKey(b.cnf, groupUUID),
 		Value:      encoded,
 		Expiration: b.getExpirationTimestamp(),
 	})
@@ -111,7 +116,7 @@ func (b *MemcacheBackend) TriggerChord(groupUUID string) (bool, error) {
 		return false, err
 	}
 	if err = b.getClient().Replace(&memcache.Item{
-		Key:        groupUUID,
+		Key:        storageKey(b.cnf, groupUUID),
 		Value:      encoded,
 		Expiration: b.getExpirationTimestamp(),
 	}); err != nil {
@@ -127,6 +132,18 @@ func (b *MemcacheBackend) SetStatePending(signature *tasks.Signature) error {
 	return b.updateState(taskState)
 }
 
+// SetStateSkipped updates task state to SKIPPED
+func (b *MemcacheBackend) SetStateSkipped(signature *tasks.Signature) error {
+	taskState := tasks.NewSkippedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateDeduplicated updates task state to DEDUPLICATED
+func (b *MemcacheBackend) SetStateDeduplicated(signature *tasks.Signature, err string) error {
+	taskState := tasks.NewDeduplicatedTaskState(signature, err)
+	return b.updateState(taskState)
+}
+
 // SetStateReceived updates task state to RECEIVED
 func (b *MemcacheBackend) SetStateReceived(signature *tasks.Signature) error {
 	taskState := tasks.NewReceivedTaskState(signature)
@@ -141,7 +158,13 @@ func (b *MemcacheBackend) SetStateStarted(signature *tasks.Signature) error {
 
 // SetStateRetry updates task state to RETRY
 func (b *MemcacheBackend) SetStateRetry(signature *tasks.Signature) error {
-	state := tasks.NewRetryTaskState(signature)
+	return b.SetStateRetryWithError(signature, "")
+}
+
+// SetStateRetryWithError updates task state to RETRY keeping the error the
+// task failed with
+func (b *MemcacheBackend) SetStateRetryWithError(signature *tasks.Signature, err string) error {
+	state := tasks.NewRetryTaskState(signature, err)
 	return b.updateState(state)
 }
 
@@ -153,13 +176,23 @@ func (b *MemcacheBackend) SetStateSuccess(signature *tasks.Signature, results []
 
 // SetStateFailure updates task state to FAILURE
 func (b *MemcacheBackend) SetStateFailure(signature *tasks.Signature, err string) error {
+	return b.SetStateFailureWithDetail(signature, err, nil)
+}
+
+// SetStateFailureWithDetail updates task state to FAILURE keeping
+// error chain and stack trace
+func (b *MemcacheBackend) SetStateFailureWithDetail(signature *tasks.Signature, err string, detail *tasks.ErrorDetail) error {
 	taskState := tasks.NewFailureTaskState(signature, err)
+	taskState.ErrorDetail = detail
 	return b.updateState(taskState)
 }
 
 // GetState returns the latest task state
 func (b *MemcacheBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
-	item, err := b.getClient().Get(taskUUID)
+	item, err := b.getClient().Get(storageKey(b.cnf, taskUUID))
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrStateNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -174,12 +207,145 @@ func (b *MemcacheBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 
 // PurgeState deletes stored task state
 func (b *MemcacheBackend) PurgeState(taskUUID string) error {
-	return b.getClient().Delete(taskUUID)
+	return b.getClient().Delete(storageKey(b.cnf, taskUUID))
 }
 
 // PurgeGroupMeta deletes stored group meta data
 func (b *MemcacheBackend) PurgeGroupMeta(groupUUID string) error {
-	return b.getClient().Delete(groupUUID)
+	return b.getClient().Delete(storageKey(b.cnf, groupUUID))
+}
+
+// SetDebounce stores UUID of the latest task sent with the debounce key
+func (b *MemcacheBackend) SetDebounce(debounceKey, taskUUID string) error {
+	return b.getClient().Set(&memcache.Item{
+		Key:        storageKey(b.cnf, debounceStorageKey(debounceKey)),
+		Value:      []byte(taskUUID),
+		Expiration: b.getExpirationTimestamp(),
+	})
+}
+
+// SetSuperseded remembers the task was replaced by another one
+func (b *MemcacheBackend) SetSuperseded(taskUUID, replacementUUID string) error {
+	return b.getClient().Set(&memcache.Item{
+		Key:        storageKey(b.cnf, supersededStorageKey(taskUUID)),
+		Value:      []byte(replacementUUID),
+		Expiration: b.getExpirationTimestamp(),
+	})
+}
+
+// GetSuperseded returns UUID of the task replacing the task, "" if it was
+// not replaced
+func (b *MemcacheBackend) GetSuperseded(taskUUID string) (string, error) {
+	item, err := b.getClient().Get(storageKey(b.cnf, supersededStorageKey(taskUUID)))
+	if err == memcache.ErrCacheMiss {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(item.Value), nil
+}
+
+// SetWorkflow stores the structure of the workflow
+func (b *MemcacheBackend) SetWorkflow(workflow *tasks.Workflow) error {
+	encoded, err := json.Marshal(workflow)
+	if err != nil {
+		return err
+	}
+
+	return b.getClient().Set(&memcache.Item{
+		Key:        storageKey(b.cnf, workflowStorageKey(workflow.UUID)),
+		Value:      encoded,
+		Expiration: b.getExpirationTimestamp(),
+	})
+}
+
+// GetWorkflow returns the stored structure of the workflow, nil if it was
+// not stored
+func (b *MemcacheBackend) GetWorkflow(workflowUUID string) (*tasks.Workflow, error) {
+	item, err := b.getClient().Get(storageKey(b.cnf, workflowStorageKey(workflowUUID)))
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	workflow := new(tasks.Workflow)
+	if err := json.Unmarshal(item.Value, workflow); err != nil {
+		return nil, err
+	}
+	return workflow, nil
+}
+
+// SetCompletionMarker remembers the task completed for longer than its
+// result is kept
+func (b *MemcacheBackend) SetCompletionMarker(taskUUID string) error {
+	return b.getClient().Set(&memcache.Item{
+		Key:        storageKey(b.cnf, completionMarkerStorageKey(taskUUID)),
+		Value:      []byte("1"),
+		Expiration: int32(time.Now().Unix() + int64(completionMarkerExpireIn(b.cnf))),
+	})
+}
+
+// HasCompletionMarker returns true if the task is remembered as completed
+func (b *MemcacheBackend) HasCompletionMarker(taskUUID string) (bool, error) {
+	_, err := b.getClient().Get(storageKey(b.cnf, completionMarkerStorageKey(taskUUID)))
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetDebounce returns UUID of the latest task sent with the debounce key,
+// "" if the key has expired
+func (b *MemcacheBackend) GetDebounce(debounceKey string) (string, error) {
+	item, err := b.getClient().Get(storageKey(b.cnf, debounceStorageKey(debounceKey)))
+	if err == memcache.ErrCacheMiss {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(item.Value), nil
+}
+
+// SetCachedResults caches task results under the cache key
+func (b *MemcacheBackend) SetCachedResults(cacheKey string, results []*tasks.TaskResult, ttl time.Duration) error {
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	expiration := b.getExpirationTimestamp()
+	if ttl > 0 {
+		expiration = int32(time.Now().Add(ttl).Unix())
+	}
+
+	return b.getClient().Set(&memcache.Item{
+		Key:        storageKey(b.cnf, resultCacheStorageKey(cacheKey)),
+		Value:      encoded,
+		Expiration: expiration,
+	})
+}
+
+// GetCachedResults returns results cached under the cache key
+func (b *MemcacheBackend) GetCachedResults(cacheKey string) ([]*tasks.TaskResult, error) {
+	item, err := b.getClient().Get(storageKey(b.cnf, resultCacheStorageKey(cacheKey)))
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*tasks.TaskResult
+	if err := json.Unmarshal(item.Value, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
 // updateState saves current task state
@@ -190,7 +356,7 @@ func (b *MemcacheBackend) updateState(taskState *tasks.TaskState) error {
 	}
 
 	return b.getClient().Set(&memcache.Item{
-		Key:        taskState.TaskUUID,
+		Key:        storageKey(b.cnf, taskState.TaskUUID),
 		Value:      encoded,
 		Expiration: b.getExpirationTimestamp(),
 	})
@@ -205,7 +371,7 @@ func (b *MemcacheBackend) lockGroupMeta(groupMeta *tasks.GroupMeta) error {
 	}
 
 	return b.getClient().Set(&memcache.Item{
-		Key:        groupMeta.GroupUUID,
+		Key:        storageKey(b.cnf, groupMeta.GroupUUID),
 		Value:      encoded,
 		Expiration: b.getExpirationTimestamp(),
 	})
@@ -220,7 +386,7 @@ func (b *MemcacheBackend) unlockGroupMeta(groupMeta *tasks.GroupMeta) error {
 	}
 
 	return b.getClient().Set(&memcache.Item{
-		Key:        groupMeta.GroupUUID,
+		Key:        storageKey(b.cnf, groupMeta.GroupUUID),
 		Value:      encoded,
 		Expiration: b.getExpirationTimestamp(),
 	})
@@ -228,7 +394,7 @@ func (b *MemcacheBackend) unlockGroupMeta(groupMeta *tasks.GroupMeta) error {
 
 // getGroupMeta retrieves group meta data, convenience function to avoid repetition
 func (b *MemcacheBackend) getGroupMeta(groupUUID string) (*tasks.GroupMeta, error) {
-	item, err := b.getClient().Get(groupUUID)
+	item, err := b.getClient().Get(storageKey(b.cnf, groupUUID))
 	if err != nil {
 		return nil, err
 	}
@@ -246,7 +412,7 @@ func (b *MemcacheBackend) getStates(taskUUIDs ...string) ([]*tasks.TaskState, er
 	states := make([]*tasks.TaskState, len(taskUUIDs))
 
 	for i, taskUUID := range taskUUIDs {
-		item, err := b.getClient().Get(taskUUID)
+		item, err := b.getClient().Get(storageKey(b.cnf, taskUUID))
 		if err != nil {
 			return nil, err
 		}
@@ -272,6 +438,16 @@ func (b *MemcacheBackend) getExpirationTimestamp() int32 {
 	return int32(time.Now().Unix() + int64(expiresIn))
 }
 
+// Ping checks the Memcache servers are reachable, a cache miss means
+// the server has responded
+func (b *MemcacheBackend) Ping() error {
+	_, err := b.getClient().Get("ping")
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
 // getClient returns or creates instance of Memcache client
 func (b *MemcacheBackend) getClient() *memcache.Client {
 	if b.client == nil {
@@ -138,5 +138,5 @@ func TestPurgeStateMemcache(t *testing.T) {
 	backend.PurgeState(taskState.TaskUUID)
 	taskState, err = backend.GetState(signature.UUID)
 	assert.Nil(t, taskState)
-	assert.Error(t, err)
+	assert.Equal(t, backends.ErrStateNotFound, err)
 }
@@ -24,6 +24,11 @@ func NewMongodbBackend(cnf *config.Config) Interface {
 	return &MongodbBackend{cnf: cnf}
 }
 
+// Type returns the backend type
+func (b *MongodbBackend) Type() string {
+	return TypeMongoDB
+}
+
 // InitGroup creates and saves a group meta data object
 func (b *MongodbBackend) InitGroup(groupUUID string, taskUUIDs []string) error {
 	if err := b.connect(); err != nil {
@@ -118,21 +123,50 @@ func (b *MongodbBackend) SetStatePending(signature *tasks.Signature) error {
 	return b.updateState(signature, update)
 }
 
+// SetStateSkipped updates task state to SKIPPED
+func (b *MongodbBackend) SetStateSkipped(signature *tasks.Signature) error {
+	update := bson.M{"state": tasks.StateSkipped}
+	return b.updateState(signature, update)
+}
+
+// SetStateDeduplicated updates task state to DEDUPLICATED
+func (b *MongodbBackend) SetStateDeduplicated(signature *tasks.Signature, err string) error {
+	update := bson.M{"state": tasks.StateDeduplicated, "error": err}
+	return b.updateState(signature, update)
+}
+
 // SetStateReceived updates task state to RECEIVED
 func (b *MongodbBackend) SetStateReceived(signature *tasks.Signature) error {
-	update := bson.M{"state": tasks.StateReceived}
+	update := bson.M{
+		"state":           tasks.StateReceived,
+		"queue_wait_time": signature.QueueWaitTime(),
+	}
 	return b.updateState(signature, update)
 }
 
 // SetStateStarted updates task state to STARTED
 func (b *MongodbBackend) SetStateStarted(signature *tasks.Signature) error {
-	update := bson.M{"state": tasks.StateStarted}
+	update := bson.M{
+		"state":       tasks.StateStarted,
+		"worker_name": signature.WorkerName,
+		"started_at":  signature.StartedAt,
+	}
 	return b.updateState(signature, update)
 }
 
 // SetStateRetry updates task state to RETRY
 func (b *MongodbBackend) SetStateRetry(signature *tasks.Signature) error {
-	update := bson.M{"state": tasks.StateRetry}
+	return b.SetStateRetryWithError(signature, "")
+}
+
+// SetStateRetryWithError updates task state to RETRY keeping the error the
+// task failed with
+func (b *MongodbBackend) SetStateRetryWithError(signature *tasks.Signature, err string) error {
+	update := bson.M{
+		"state":       tasks.StateRetry,
+		"error":       err,
+		"retry_count": signature.RetryCount,
+	}
 	return b.updateState(signature, update)
 }
 
@@ -146,15 +180,33 @@ func (b *MongodbBackend) SetStateSuccess(signature *tasks.Signature, results []*
 		}
 	}
 	update := bson.M{
-		"state":   tasks.StateSuccess,
-		"results": bsonResults,
+		"state":            tasks.StateSuccess,
+		"results":          bsonResults,
+		"group_task_index": signature.GroupTaskIndex,
+		"retry_count":      signature.RetryCount,
+		"completed_at":     time.Now().UTC(),
+	}
+	if signature.ChainRetryBudget != nil {
+		update["chain_retry_budget"] = *signature.ChainRetryBudget
 	}
 	return b.updateState(signature, update)
 }
 
 // SetStateFailure updates task state to FAILURE
 func (b *MongodbBackend) SetStateFailure(signature *tasks.Signature, err string) error {
-	update := bson.M{"state": tasks.StateFailure, "error": err}
+	return b.SetStateFailureWithDetail(signature, err, nil)
+}
+
+// SetStateFailureWithDetail updates task state to FAILURE keeping
+// error chain and stack trace
+func (b *MongodbBackend) SetStateFailureWithDetail(signature *tasks.Signature, err string, detail *tasks.ErrorDetail) error {
+	update := bson.M{
+		"state":        tasks.StateFailure,
+		"error":        err,
+		"error_detail": detail,
+		"retry_count":  signature.RetryCount,
+		"completed_at": time.Now().UTC(),
+	}
 	return b.updateState(signature, update)
 }
 
@@ -171,7 +223,11 @@ func (b *MongodbBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	}
 
 	state := new(tasks.TaskState)
-	if err := b.tasksCollection.FindId(taskUUID).One(state); err != nil {
+	err := b.tasksCollection.FindId(taskUUID).One(state)
+	if err == mgo.ErrNotFound {
+		return nil, ErrStateNotFound
+	}
+	if err != nil {
 		return nil, err
 	}
 	return state, nil
@@ -195,6 +251,14 @@ func (b *MongodbBackend) PurgeGroupMeta(groupUUID string) error {
 	return b.groupMetasCollection.RemoveId(groupUUID)
 }
 
+// Ping checks the MongoDB server is reachable
+func (b *MongodbBackend) Ping() error {
+	if err := b.connect(); err != nil {
+		return err
+	}
+	return b.session.Ping()
+}
+
 // lockGroupMeta acquires lock on groupUUID document
 func (b *MongodbBackend) lockGroupMeta(groupUUID string) error {
 	update := bson.M{"$set": bson.M{"lock": true}}
@@ -251,6 +315,9 @@ func (b *MongodbBackend) updateState(signature *tasks.Signature, update bson.M)
 		return err
 	}
 
+	if signature.CorrelationID != "" {
+		update["correlation_id"] = signature.CorrelationID
+	}
 	update = bson.M{"$set": update}
 	_, err := b.tasksCollection.UpsertId(signature.UUID, update)
 	if err != nil {
@@ -273,8 +340,8 @@ func (b *MongodbBackend) connect() error {
 	}
 	b.session = session
 
-	b.tasksCollection = b.session.DB("").C("tasks")
-	b.groupMetasCollection = b.session.DB("").C("group_metas")
+	b.tasksCollection = b.session.DB("").C(storageKey(b.cnf, "tasks"))
+	b.groupMetasCollection = b.session.DB("").C(storageKey(b.cnf, "group_metas"))
 
 	return b.createMongoIndexes()
 }
@@ -1,8 +1,11 @@
 package backends
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -37,6 +40,11 @@ func NewRedisBackend(cnf *config.Config, host, password, socketPath string, db i
 	}
 }
 
+// Type returns the backend type
+func (b *RedisBackend) Type() string {
+	return TypeRedis
+}
+
 // InitGroup creates and saves a group meta data object
 func (b *RedisBackend) InitGroup(groupUUID string, taskUUIDs []string) error {
 	groupMeta := &tasks.GroupMeta{
@@ -52,12 +60,13 @@ func (b *RedisBackend) InitGroup(groupUUID string, taskUUIDs []string) error {
 	conn := b.open()
 	defer conn.Close()
 
-	_, err = conn.Do("SET", groupUUID, encoded)
+	key := storageKey(b.cnf, groupUUID)
+	_, err = conn.Do("SET", key, encoded)
 	if err != nil {
 		return err
 	}
 
-	return b.setExpirationTime(groupUUID)
+	return b.setExpirationTime(key)
 }
 
 // GroupCompleted returns true if all tasks in a group finished
@@ -100,7 +109,7 @@ func (b *RedisBackend) TriggerChord(groupUUID string) (bool, error) {
 	conn := b.open()
 	defer conn.Close()
 
-	m := b.redsync.NewMutex("TriggerChordMutex")
+	m := b.redsync.NewMutex(storageKey(b.cnf, "TriggerChordMutex"))
 	if err := m.Lock(); err != nil {
 		return false, err
 	}
@@ -125,7 +134,7 @@ func (b *RedisBackend) TriggerChord(groupUUID string) (bool, error) {
 		return false, err
 	}
 
-	_, err = conn.Do("SET", groupUUID, encoded)
+	_, err = conn.Do("SET", storageKey(b.cnf, groupUUID), encoded)
 	if err != nil {
 		return false, err
 	}
@@ -139,6 +148,18 @@ func (b *RedisBackend) SetStatePending(signature *tasks.Signature) error {
 	return b.updateState(taskState)
 }
 
+// SetStateSkipped updates task state to SKIPPED
+func (b *RedisBackend) SetStateSkipped(signature *tasks.Signature) error {
+	taskState := tasks.NewSkippedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateDeduplicated updates task state to DEDUPLICATED
+func (b *RedisBackend) SetStateDeduplicated(signature *tasks.Signature, err string) error {
+	taskState := tasks.NewDeduplicatedTaskState(signature, err)
+	return b.updateState(taskState)
+}
+
 // SetStateReceived updates task state to RECEIVED
 func (b *RedisBackend) SetStateReceived(signature *tasks.Signature) error {
 	taskState := tasks.NewReceivedTaskState(signature)
@@ -153,7 +174,13 @@ func (b *RedisBackend) SetStateStarted(signature *tasks.Signature) error {
 
 // SetStateRetry updates task state to RETRY
 func (b *RedisBackend) SetStateRetry(signature *tasks.Signature) error {
-	state := tasks.NewRetryTaskState(signature)
+	return b.SetStateRetryWithError(signature, "")
+}
+
+// SetStateRetryWithError updates task state to RETRY keeping the error the
+// task failed with
+func (b *RedisBackend) SetStateRetryWithError(signature *tasks.Signature, err string) error {
+	state := tasks.NewRetryTaskState(signature, err)
 	return b.updateState(state)
 }
 
@@ -165,7 +192,14 @@ func (b *RedisBackend) SetStateSuccess(signature *tasks.Signature, results []*ta
 
 // SetStateFailure updates task state to FAILURE
 func (b *RedisBackend) SetStateFailure(signature *tasks.Signature, err string) error {
+	return b.SetStateFailureWithDetail(signature, err, nil)
+}
+
+// SetStateFailureWithDetail updates task state to FAILURE keeping
+// error chain and stack trace
+func (b *RedisBackend) SetStateFailureWithDetail(signature *tasks.Signature, err string, detail *tasks.ErrorDetail) error {
 	taskState := tasks.NewFailureTaskState(signature, err)
+	taskState.ErrorDetail = detail
 	return b.updateState(taskState)
 }
 
@@ -174,7 +208,10 @@ func (b *RedisBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	conn := b.open()
 	defer conn.Close()
 
-	item, err := redis.Bytes(conn.Do("GET", taskUUID))
+	item, err := redis.Bytes(conn.Do("GET", storageKey(b.cnf, taskUUID)))
+	if err == redis.ErrNil {
+		return nil, ErrStateNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -192,7 +229,7 @@ func (b *RedisBackend) PurgeState(taskUUID string) error {
 	conn := b.open()
 	defer conn.Close()
 
-	_, err := conn.Do("DEL", taskUUID)
+	_, err := conn.Do("DEL", storageKey(b.cnf, taskUUID))
 	if err != nil {
 		return err
 	}
@@ -205,7 +242,7 @@ func (b *RedisBackend) PurgeGroupMeta(groupUUID string) error {
 	conn := b.open()
 	defer conn.Close()
 
-	_, err := conn.Do("DEL", groupUUID)
+	_, err := conn.Do("DEL", storageKey(b.cnf, groupUUID))
 	if err != nil {
 		return err
 	}
@@ -213,12 +250,387 @@ func (b *RedisBackend) PurgeGroupMeta(groupUUID string) error {
 	return nil
 }
 
+// SetDebounce stores UUID of the latest task sent with the debounce key
+func (b *RedisBackend) SetDebounce(debounceKey, taskUUID string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, debounceStorageKey(debounceKey))
+	_, err := conn.Do("SET", key, taskUUID)
+	if err != nil {
+		return err
+	}
+
+	return b.setExpirationTime(key)
+}
+
+// SetSuperseded remembers the task was replaced by another one
+func (b *RedisBackend) SetSuperseded(taskUUID, replacementUUID string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, supersededStorageKey(taskUUID))
+	_, err := conn.Do("SET", key, replacementUUID)
+	if err != nil {
+		return err
+	}
+
+	return b.setExpirationTime(key)
+}
+
+// GetSuperseded returns UUID of the task replacing the task, "" if it was
+// not replaced
+func (b *RedisBackend) GetSuperseded(taskUUID string) (string, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	replacementUUID, err := redis.String(conn.Do("GET", storageKey(b.cnf, supersededStorageKey(taskUUID))))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return replacementUUID, err
+}
+
+// SetRetryCount stores the number of retries the task has left, it expires
+// like task states
+func (b *RedisBackend) SetRetryCount(taskUUID string, retryCount int) error {
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, retryCountStorageKey(taskUUID))
+	_, err := conn.Do("SET", key, retryCount)
+	if err != nil {
+		return err
+	}
+
+	return b.setExpirationTime(key)
+}
+
+// GetRetryCount returns the number of retries the task has left, false if it
+// was not stored
+func (b *RedisBackend) GetRetryCount(taskUUID string) (int, bool, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	retryCount, err := redis.Int(conn.Do("GET", storageKey(b.cnf, retryCountStorageKey(taskUUID))))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return retryCount, true, nil
+}
+
+// SetWorkflow stores the structure of the workflow
+func (b *RedisBackend) SetWorkflow(workflow *tasks.Workflow) error {
+	encoded, err := json.Marshal(workflow)
+	if err != nil {
+		return err
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, workflowStorageKey(workflow.UUID))
+	_, err = conn.Do("SET", key, encoded)
+	if err != nil {
+		return err
+	}
+
+	return b.setExpirationTime(key)
+}
+
+// GetWorkflow returns the stored structure of the workflow, nil if it was
+// not stored
+func (b *RedisBackend) GetWorkflow(workflowUUID string) (*tasks.Workflow, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	item, err := redis.Bytes(conn.Do("GET", storageKey(b.cnf, workflowStorageKey(workflowUUID))))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	workflow := new(tasks.Workflow)
+	if err := json.Unmarshal(item, workflow); err != nil {
+		return nil, err
+	}
+	return workflow, nil
+}
+
+// AddDynamicGroupMember adds the task to the dynamic group, members expire
+// like task states
+func (b *RedisBackend) AddDynamicGroupMember(groupUUID, taskUUID string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, dynamicGroupStorageKey(groupUUID))
+	if _, err := conn.Do("RPUSH", key, taskUUID); err != nil {
+		return err
+	}
+
+	return b.setExpirationTime(key)
+}
+
+// CloseDynamicGroup marks the dynamic group as complete, no more tasks are
+// added to it
+func (b *RedisBackend) CloseDynamicGroup(groupUUID string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, dynamicGroupClosedStorageKey(groupUUID))
+	if _, err := conn.Do("SET", key, 1); err != nil {
+		return err
+	}
+
+	return b.setExpirationTime(key)
+}
+
+// GetDynamicGroup returns members of the dynamic group and whether it was
+// closed
+func (b *RedisBackend) GetDynamicGroup(groupUUID string) ([]string, bool, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	taskUUIDs, err := redis.Strings(conn.Do("LRANGE", storageKey(b.cnf, dynamicGroupStorageKey(groupUUID)), 0, -1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	closed, err := redis.Bool(conn.Do("EXISTS", storageKey(b.cnf, dynamicGroupClosedStorageKey(groupUUID))))
+	if err != nil {
+		return nil, false, err
+	}
+	return taskUUIDs, closed, nil
+}
+
+// SetBlob stores the blob under the key, it expires like task states
+func (b *RedisBackend) SetBlob(key string, blob io.Reader) error {
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	storedKey := storageKey(b.cnf, blobStorageKey(key))
+	_, err = conn.Do("SET", storedKey, data)
+	if err != nil {
+		return err
+	}
+
+	return b.setExpirationTime(storedKey)
+}
+
+// GetBlob returns a reader of the blob stored under the key
+func (b *RedisBackend) GetBlob(key string) (io.ReadCloser, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", storageKey(b.cnf, blobStorageKey(key))))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("Blob not found: %v", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// SetCompletionMarker remembers the task completed for longer than its
+// result is kept
+func (b *RedisBackend) SetCompletionMarker(taskUUID string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, completionMarkerStorageKey(taskUUID))
+	_, err := conn.Do("SET", key, 1, "EX", completionMarkerExpireIn(b.cnf))
+	return err
+}
+
+// HasCompletionMarker returns true if the task is remembered as completed
+func (b *RedisBackend) HasCompletionMarker(taskUUID string) (bool, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", storageKey(b.cnf, completionMarkerStorageKey(taskUUID))))
+}
+
+// acquireSlotScript drops expired leases and leases a slot to the holder
+// unless all slots are taken, slots are members of a sorted set scored by
+// their lease expiration. Leases are timed by the Redis clock so workers with
+// skewed clocks neither steal nor hold on to slots. Before Redis 5 a script
+// reading TIME has to replicate its effects instead of itself
+var acquireSlotScript = redis.NewScript(1, `
+redis.replicate_commands()
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+if redis.call("ZSCORE", KEYS[1], ARGV[2]) or redis.call("ZCARD", KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call("ZADD", KEYS[1], now + tonumber(ARGV[3]), ARGV[2])
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// AcquireSlot leases one of max slots of the task to the holder for ttl,
+// returns false if all of them are taken
+func (b *RedisBackend) AcquireSlot(name, holder string, max int, ttl time.Duration) (bool, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	ttlMs := int64(ttl / time.Millisecond)
+	key := storageKey(b.cnf, semaphoreStorageKey(name))
+	return redis.Bool(acquireSlotScript.Do(conn, key, max, holder, ttlMs))
+}
+
+// ReleaseSlot frees the slot leased to the holder
+func (b *RedisBackend) ReleaseSlot(name, holder string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", storageKey(b.cnf, semaphoreStorageKey(name)), holder)
+	return err
+}
+
+// GetDebounce returns UUID of the latest task sent with the debounce key,
+// "" if the key has expired
+func (b *RedisBackend) GetDebounce(debounceKey string) (string, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	latestUUID, err := redis.String(conn.Do("GET", storageKey(b.cnf, debounceStorageKey(debounceKey))))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return latestUUID, err
+}
+
+// SetCachedResults caches task results under the cache key
+func (b *RedisBackend) SetCachedResults(cacheKey string, results []*tasks.TaskResult, ttl time.Duration) error {
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	key := storageKey(b.cnf, resultCacheStorageKey(cacheKey))
+	if ttl > 0 {
+		_, err = conn.Do("SET", key, encoded, "PX", int64(ttl/time.Millisecond))
+		return err
+	}
+
+	if _, err = conn.Do("SET", key, encoded); err != nil {
+		return err
+	}
+	return b.setExpirationTime(key)
+}
+
+// GetCachedResults returns results cached under the cache key
+func (b *RedisBackend) GetCachedResults(cacheKey string) ([]*tasks.TaskResult, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	item, err := redis.Bytes(conn.Do("GET", storageKey(b.cnf, resultCacheStorageKey(cacheKey))))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*tasks.TaskResult
+	if err := json.Unmarshal(item, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Ping checks the Redis server is reachable
+func (b *RedisBackend) Ping() error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+// SubscribeResult subscribes to notifications published each time the task
+// state changes
+func (b *RedisBackend) SubscribeResult(taskUUID string) (<-chan struct{}, func(), error) {
+	if !b.notifyResults() {
+		return nil, func() {}, nil
+	}
+
+	conn := b.open()
+	psc := redis.PubSubConn{Conn: conn}
+
+	// Wait for the subscription to be confirmed so notifications published
+	// after this method returns are not missed
+	if err := psc.Subscribe(resultChannel(storageKey(b.cnf, taskUUID))); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	switch v := psc.Receive().(type) {
+	case redis.Subscription:
+	case error:
+		conn.Close()
+		return nil, nil, v
+	default:
+		conn.Close()
+		return nil, nil, fmt.Errorf("Unexpected subscribe reply: %v", v)
+	}
+
+	notifications := make(chan struct{}, 1)
+	go func() {
+		defer conn.Close()
+
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				select {
+				case notifications <- struct{}{}:
+				default:
+				}
+			case redis.Subscription:
+				if v.Count == 0 {
+					return
+				}
+			case error:
+				// The client falls back to polling
+				return
+			}
+		}
+	}()
+
+	return notifications, func() { psc.Unsubscribe() }, nil
+}
+
+// notifyResults returns true if result notifications are enabled
+func (b *RedisBackend) notifyResults() bool {
+	return b.cnf.Redis != nil && b.cnf.Redis.NotifyResults
+}
+
+// resultChannel returns name of the pub/sub channel result notifications
+// for a task are published to
+func resultChannel(taskUUID string) string {
+	return fmt.Sprintf("result_%s", taskUUID)
+}
+
 // getGroupMeta retrieves group meta data, convenience function to avoid repetition
 func (b *RedisBackend) getGroupMeta(groupUUID string) (*tasks.GroupMeta, error) {
 	conn := b.open()
 	defer conn.Close()
 
-	item, err := redis.Bytes(conn.Do("GET", groupUUID))
+	item, err := redis.Bytes(conn.Do("GET", storageKey(b.cnf, groupUUID)))
 	if err != nil {
 		return nil, err
 	}
@@ -241,7 +653,7 @@ func (b *RedisBackend) getStates(taskUUIDs ...string) ([]*tasks.TaskState, error
 	// conn.Do requires []interface{}... can't pass []string unfortunately
 	taskUUIDInterfaces := make([]interface{}, len(taskUUIDs))
 	for i, taskUUID := range taskUUIDs {
-		taskUUIDInterfaces[i] = interface{}(taskUUID)
+		taskUUIDInterfaces[i] = interface{}(storageKey(b.cnf, taskUUID))
 	}
 
 	reply, err := redis.Values(conn.Do("MGET", taskUUIDInterfaces...))
@@ -277,12 +689,23 @@ func (b *RedisBackend) updateState(taskState *tasks.TaskState) error {
 		return err
 	}
 
-	_, err = conn.Do("SET", taskState.TaskUUID, encoded)
+	key := storageKey(b.cnf, taskState.TaskUUID)
+	_, err = conn.Do("SET", key, encoded)
 	if err != nil {
 		return err
 	}
 
-	return b.setExpirationTime(taskState.TaskUUID)
+	if err := b.setExpirationTime(key); err != nil {
+		return err
+	}
+
+	// Wake up clients waiting for the result or watching the state
+	if b.notifyResults() {
+		_, err = conn.Do("PUBLISH", resultChannel(key), taskState.State)
+		return err
+	}
+
+	return nil
 }
 
 // setExpirationTime sets expiration timestamp on a stored task state
@@ -141,5 +141,45 @@ func TestPurgeStateRedis(t *testing.T) {
 	backend.PurgeState(taskState.TaskUUID)
 	taskState, err = backend.GetState(signature.UUID)
 	assert.Nil(t, taskState)
-	assert.Error(t, err)
+	assert.Equal(t, backends.ErrStateNotFound, err)
+}
+
+func TestSemaphoreRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if redisURL == "" {
+		return
+	}
+
+	backend := backends.NewRedisBackend(new(config.Config), redisURL, redisPassword, "", 0)
+	semaphore := backend.(backends.Semaphore)
+
+	// Cleanup before the test
+	semaphore.ReleaseSlot("test_semaphore", "task_1")
+	semaphore.ReleaseSlot("test_semaphore", "task_2")
+	semaphore.ReleaseSlot("test_semaphore", "task_3")
+
+	acquired, err := semaphore.AcquireSlot("test_semaphore", "task_1", 2, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = semaphore.AcquireSlot("test_semaphore", "task_2", 2, 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// All slots are taken, renewing a lease still succeeds
+	acquired, err = semaphore.AcquireSlot("test_semaphore", "task_3", 2, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	acquired, err = semaphore.AcquireSlot("test_semaphore", "task_1", 2, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// The slot of task_2 is reclaimed once its lease expires
+	time.Sleep(200 * time.Millisecond)
+	acquired, err = semaphore.AcquireSlot("test_semaphore", "task_3", 2, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	assert.NoError(t, semaphore.ReleaseSlot("test_semaphore", "task_1"))
+	assert.NoError(t, semaphore.ReleaseSlot("test_semaphore", "task_3"))
 }
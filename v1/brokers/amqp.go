@@ -1,9 +1,12 @@
 package brokers
 
 import (
-	"encoding/json"
+	"context"
+	"encoding/base64"
 	"errors"
+	"expvar"
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -14,15 +17,47 @@ import (
 	"github.com/streadway/amqp"
 )
 
+// redeliveries counts deliveries redelivered by the AMQP broker by queue,
+// a rising rate hints at poison messages, consumer timeouts or crashing
+// tasks. It is published with other expvar variables, e.g. on /debug/vars
+var redeliveries = expvar.NewMap("machinery_redeliveries_total")
+
+// connectionTimeout bounds the TLS and AMQP handshakes of connections the
+// broker dials itself, like the amqp package does for its own
+const connectionTimeout = 30 * time.Second
+
 // AMQPBroker represents an AMQP broker
 type AMQPBroker struct {
 	Broker
 	common.AMQPConnector
+	// delayQueues maps per-task delay queues declared by the broker to when
+	// they expire
+	delayQueues   map[string]time.Time
+	delayQueuesMu sync.Mutex
+	// republish replaces publishCopy in tests
+	republish func(d amqp.Delivery, headers amqp.Table) error
+	// publishDeadLetter replaces publishToDeadLetterQueue in tests
+	publishDeadLetter func(d amqp.Delivery, headers amqp.Table) error
+	// consumingQueue is the name of the queue deliveries are consumed from
+	consumingQueue string
 }
 
 // NewAMQPBroker creates new AMQPBroker instance
 func NewAMQPBroker(cnf *config.Config) Interface {
-	return &AMQPBroker{Broker: New(cnf), AMQPConnector: common.AMQPConnector{}}
+	broker := &AMQPBroker{
+		Broker:        New(cnf),
+		AMQPConnector: common.AMQPConnector{},
+		delayQueues:   make(map[string]time.Time),
+	}
+	if cnf.AMQP != nil {
+		broker.ConnectionName = cnf.AMQP.ConnectionName
+	}
+	return broker
+}
+
+// Type returns the broker type
+func (b *AMQPBroker) Type() string {
+	return TypeAMQP
 }
 
 // StartConsuming enters a loop and waits for incoming messages
@@ -32,14 +67,14 @@ func (b *AMQPBroker) StartConsuming(consumerTag string, concurrency int, taskPro
 	conn, channel, queue, _, amqpCloseChan, err := b.Connect(
 		b.cnf.Broker,
 		b.cnf.TLSConfig,
-		b.cnf.AMQP.Exchange,     // exchange name
-		b.cnf.AMQP.ExchangeType, // exchange type
-		b.cnf.DefaultQueue,      // queue name
-		true,                    // queue durable
-		false,                   // queue delete when unused
-		b.cnf.AMQP.BindingKey, // queue binding key
-		nil, // exchange declare args
-		nil, // queue declare args
+		b.exchangeName(),                        // exchange name
+		b.cnf.AMQP.ExchangeType,                 // exchange type
+		b.queueName(b.cnf.DefaultQueue),         // queue name
+		true,                                    // queue durable
+		false,                                   // queue delete when unused
+		b.cnf.AMQP.BindingKey,                   // queue binding key
+		nil,                                     // exchange declare args
+		b.QueueDeclareArgs(),                    // queue declare args
 		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
 	)
 	if err != nil {
@@ -48,6 +83,16 @@ func (b *AMQPBroker) StartConsuming(consumerTag string, concurrency int, taskPro
 	}
 	defer b.Close(channel, conn)
 
+	// Declaring the queue reports its consumers, refusing to start is final
+	// so a runaway deployment does not keep retrying
+	if err = b.checkConsumers(queue); err != nil {
+		return false, err
+	}
+
+	if err = b.bindExchanges(channel); err != nil {
+		return b.retry, err
+	}
+
 	if err = channel.Qos(
 		b.cnf.AMQP.PrefetchCount,
 		0,     // prefetch size
@@ -56,15 +101,19 @@ func (b *AMQPBroker) StartConsuming(consumerTag string, concurrency int, taskPro
 		return b.retry, fmt.Errorf("Channel qos error: %s", err)
 	}
 
-	deliveries, err := channel.Consume(
-		queue.Name,  // queue
-		consumerTag, // consumer tag
-		false,       // auto-ack
-		false,       // exclusive
-		false,       // no-local
-		false,       // no-wait
-		nil,         // arguments
-	)
+	if b.scheduler != nil {
+		stopScheduler := make(chan struct{})
+		defer close(stopScheduler)
+		go b.runScheduler(b.Publish, stopScheduler)
+	}
+
+	if b.cnf.AMQP.SaturatedPrefetchCount > 0 && concurrency > 0 {
+		stopAdapting := make(chan struct{})
+		defer close(stopAdapting)
+		go b.adaptPrefetch(channel, concurrency, stopAdapting)
+	}
+
+	deliveries, err := b.startDeliveries(channel, queue.Name, consumerTag)
 	if err != nil {
 		return b.retry, fmt.Errorf("Queue consume error: %s", err)
 	}
@@ -83,38 +132,112 @@ func (b *AMQPBroker) StopConsuming() {
 	b.stopConsuming()
 }
 
+// StopConsumingWithTimeout quits the loop and waits up to the timeout for
+// tasks being processed to finish
+func (b *AMQPBroker) StopConsumingWithTimeout(timeout time.Duration) *ShutdownReport {
+	b.StopConsuming()
+	return b.inFlight.report(b.clock, timeout)
+}
+
+// RawConnection opens a connection and a channel with the broker settings
+// (URL, TLS config and connection name) for operations the package does not
+// wrap. Advanced and unsafe: the connection is dedicated to the caller so
+// whatever is done with it does not affect connections of the broker, it is
+// not closed by the broker and must be closed with the returned func
+func (b *AMQPBroker) RawConnection() (*amqp.Connection, *amqp.Channel, func() error, error) {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return conn, channel, func() error {
+		return b.Close(channel, conn)
+	}, nil
+}
+
 // Publish places a new message on the default queue
 func (b *AMQPBroker) Publish(signature *tasks.Signature) error {
-	b.AdjustRoutingKey(signature)
+	return b.PublishWithContext(context.Background(), signature)
+}
 
-	// Check the ETA signature field, if it is set and it is in the future,
-	// delay the task
-	if signature.ETA != nil {
-		now := time.Now().UTC()
+// PublishWithContext places a new message on the default queue, it gives up
+// with ctx.Err() once ctx is done. Connections opened for the message are
+// closed then, which aborts connecting as well as waiting for the confirm
+func (b *AMQPBroker) PublishWithContext(ctx context.Context, signature *tasks.Signature) error {
+	connector, release := b.contextConnector(ctx)
+	defer release()
+
+	start := time.Now()
+	err := b.publish(connector, signature)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	b.observePublish(signature, time.Since(start), err)
+	return err
+}
+
+// contextConnector returns a connector whose connections are closed once ctx
+// is done, until release is called
+func (b *AMQPBroker) contextConnector(ctx context.Context) (*common.AMQPConnector, func()) {
+	if ctx.Done() == nil {
+		return &b.AMQPConnector, func() {}
+	}
 
-		if signature.ETA.After(now) {
-			delayMs := int64(signature.ETA.Sub(now) / time.Millisecond)
+	released := make(chan struct{})
+	connector := b.AMQPConnector
+	connector.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
 
-			return b.delay(signature, delayMs)
+		// Same handshake deadline as the amqp package sets by default, it is
+		// cleared once the connection is established
+		if err := conn.SetDeadline(time.Now().Add(connectionTimeout)); err != nil {
+			conn.Close()
+			return nil, err
 		}
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-released:
+			}
+		}()
+		return conn, nil
+	}
+
+	return &connector, func() { close(released) }
+}
+
+// publish places a new message on the default queue, the whole path is
+// measured as publish latency
+func (b *AMQPBroker) publish(connector *common.AMQPConnector, signature *tasks.Signature) error {
+	b.AdjustRoutingKey(signature)
+
+	// Check the ETA signature field, if it is set and it is in the future,
+	// delay the task
+	if scheduled, err := b.schedule(signature, &amqpScheduler{b, connector}); scheduled {
+		return err
 	}
 
-	message, err := json.Marshal(signature)
+	message, err := b.encode(signature)
 	if err != nil {
 		return fmt.Errorf("JSON marshal error: %s", err)
 	}
 
-	conn, channel, _, confirmsChan, _, err := b.Connect(
+	conn, channel, _, confirmsChan, _, err := connector.Connect(
 		b.cnf.Broker,
 		b.cnf.TLSConfig,
-		b.cnf.AMQP.Exchange,     // exchange name
-		b.cnf.AMQP.ExchangeType, // exchange type
-		b.cnf.DefaultQueue,      // queue name
-		true,                    // queue durable
-		false,                   // queue delete when unused
-		b.cnf.AMQP.BindingKey, // queue binding key
-		nil, // exchange declare args
-		nil, // queue declare args
+		b.exchangeName(),                        // exchange name
+		b.cnf.AMQP.ExchangeType,                 // exchange type
+		b.queueName(b.cnf.DefaultQueue),         // queue name
+		true,                                    // queue durable
+		false,                                   // queue delete when unused
+		b.cnf.AMQP.BindingKey,                   // queue binding key
+		nil,                                     // exchange declare args
+		b.QueueDeclareArgs(),                    // queue declare args
 		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
 	)
 	if err != nil {
@@ -122,23 +245,79 @@ func (b *AMQPBroker) Publish(signature *tasks.Signature) error {
 	}
 	defer b.Close(channel, conn)
 
+	// Unroutable mandatory messages are returned before they are confirmed
+	var returnsChan <-chan amqp.Return
+	if signature.Mandatory {
+		returnsChan = channel.NotifyReturn(make(chan amqp.Return, 1))
+	}
+
 	if err := channel.Publish(
-		b.cnf.AMQP.Exchange,  // exchange name
+		b.exchangeName(),     // exchange name
 		signature.RoutingKey, // routing key
-		false,                // mandatory
+		signature.Mandatory,  // mandatory
 		false,                // immediate
-		amqp.Publishing{
-			Headers:      amqp.Table(signature.Headers),
-			ContentType:  "application/json",
-			Body:         message,
-			DeliveryMode: amqp.Persistent,
-		},
+		b.newPublishing(signature, message),
 	); err != nil {
 		return err
 	}
 
+	return waitForConfirm(signature, confirmsChan, returnsChan)
+}
+
+// newPublishing creates the AMQP message carrying the encoded signature
+func (b *AMQPBroker) newPublishing(signature *tasks.Signature, message []byte) amqp.Publishing {
+	deliveryMode := amqp.Persistent
+	if signature.Persistent != nil && !*signature.Persistent {
+		deliveryMode = amqp.Transient
+	}
+
+	headers := amqp.Table(signature.Headers)
+	if b.cnf.Base64Encode {
+		// Copied so the flag does not end up in the signature's headers
+		headers = amqp.Table{BodyEncodingHeader: BodyEncodingBase64}
+		for key, value := range signature.Headers {
+			headers[key] = value
+		}
+		message = []byte(base64.StdEncoding.EncodeToString(message))
+	}
+
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   "application/json",
+		Body:          message,
+		DeliveryMode:  deliveryMode,
+		MessageId:     signature.UUID,
+		CorrelationId: signature.CorrelationID,
+	}
+}
+
+// deliveryBody returns the message body of the delivery, decoded if it was
+// published base64 encoded
+func deliveryBody(d amqp.Delivery) ([]byte, error) {
+	if d.Headers[BodyEncodingHeader] != BodyEncodingBase64 {
+		return d.Body, nil
+	}
+
+	body, err := base64.StdEncoding.DecodeString(string(d.Body))
+	if err != nil {
+		return nil, fmt.Errorf("Base64 decode error: %s", err)
+	}
+	return body, nil
+}
+
+// waitForConfirm waits for the publish confirm of the signature, a return of
+// the same message received before it means the message was unroutable
+func waitForConfirm(signature *tasks.Signature, confirmsChan <-chan amqp.Confirmation, returnsChan <-chan amqp.Return) error {
 	confirmed := <-confirmsChan
 
+	select {
+	case returned := <-returnsChan:
+		if returned.MessageId == signature.UUID {
+			return ErrTaskUnroutable
+		}
+	default:
+	}
+
 	if confirmed.Ack {
 		return nil
 	}
@@ -146,179 +325,1318 @@ func (b *AMQPBroker) Publish(signature *tasks.Signature) error {
 	return fmt.Errorf("Failed delivery of delivery tag: %v", confirmed.DeliveryTag)
 }
 
-// PurgeQueue ... removes all the items from the queue
-func (b *AMQPBroker) PurgeQueue(queueName string) (bool, int, error) {
-	conn, channel, _, _, _, err := b.Connect(
+// PublishBatch places multiple messages on the default queue. Unlike calling
+// Publish repeatedly, publish confirms are only waited for after all messages
+// have been sent. Mandatory messages which could not be routed are listed by
+// the returned BatchPublishError
+func (b *AMQPBroker) PublishBatch(signatures []*tasks.Signature) error {
+	start := time.Now()
+	err := b.publishBatch(signatures)
+	b.observeBatch(signatures, time.Since(start), err)
+	return err
+}
+
+// publishBatch places multiple messages on the default queue, the whole path
+// is measured as publish latency
+func (b *AMQPBroker) publishBatch(signatures []*tasks.Signature) error {
+	batch := make([]*tasks.Signature, 0, len(signatures))
+	for _, signature := range signatures {
+		b.AdjustRoutingKey(signature)
+
+		// Tasks with ETA in the future are delayed one by one
+		if scheduled, err := b.schedule(signature, &amqpScheduler{b, &b.AMQPConnector}); scheduled {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		batch = append(batch, signature)
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	conn, channel, _, confirmsChan, _, err := b.Connect(
 		b.cnf.Broker,
 		b.cnf.TLSConfig,
-		b.cnf.AMQP.Exchange,     // exchange name
-		b.cnf.AMQP.ExchangeType, // exchange type
-		b.cnf.DefaultQueue,      // queue name
-		true,                    // queue durable
-		false,                   // queue delete when unused
-		b.cnf.AMQP.BindingKey, // queue binding key
-		nil, // exchange declare args
-		nil, // queue declare args
+		b.exchangeName(),                        // exchange name
+		b.cnf.AMQP.ExchangeType,                 // exchange type
+		b.queueName(b.cnf.DefaultQueue),         // queue name
+		true,                                    // queue durable
+		false,                                   // queue delete when unused
+		b.cnf.AMQP.BindingKey,                   // queue binding key
+		nil,                                     // exchange declare args
+		b.QueueDeclareArgs(),                    // queue declare args
 		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
 	)
 	if err != nil {
-		b.retryFunc(b.retryStopChan)
-		return b.retry, 0, err
+		return err
 	}
 	defer b.Close(channel, conn)
 
-	if err = channel.Qos(
-		b.cnf.AMQP.PrefetchCount,
-		0,     // prefetch size
-		false, // global
-	); err != nil {
-		return b.retry, 0, fmt.Errorf("Channel qos error: %s", err)
+	// Unroutable mandatory messages are returned before they are confirmed
+	var returnsChan <-chan amqp.Return
+	for _, signature := range batch {
+		if signature.Mandatory {
+			returnsChan = channel.NotifyReturn(make(chan amqp.Return, len(batch)))
+			break
+		}
 	}
 
-	n, err := b.DeleteQueue(channel, queueName)
-
-	return b.retry, n, err
-}
-
-// consume takes delivered messages from the channel and manages a worker pool
-// to process tasks concurrently
-func (b *AMQPBroker) consume(deliveries <-chan amqp.Delivery, concurrency int, taskProcessor TaskProcessor, amqpCloseChan <-chan *amqp.Error) error {
-	pool := make(chan struct{}, concurrency)
-
-	// initialize worker pool with maxWorkers workers
-	go func() {
-		for i := 0; i < concurrency; i++ {
-			pool <- struct{}{}
+	return publishWithConfirms(batch, confirmsChan, returnsChan, func(signature *tasks.Signature) error {
+		message, err := b.encode(signature)
+		if err != nil {
+			return fmt.Errorf("JSON marshal error: %s", err)
 		}
-	}()
 
-	errorsChan := make(chan error)
-
-	// Use wait group to make sure task processing completes on interrupt signal
-	var wg sync.WaitGroup
-	defer wg.Wait()
+		return channel.Publish(
+			b.exchangeName(),     // exchange name
+			signature.RoutingKey, // routing key
+			signature.Mandatory,  // mandatory
+			false,                // immediate
+			b.newPublishing(signature, message),
+		)
+	})
+}
 
-	for {
-		select {
-		case amqpErr := <-amqpCloseChan:
-			return amqpErr
-		case err := <-errorsChan:
-			return err
-		case d := <-deliveries:
-			if concurrency > 0 {
-				// get worker from pool (blocks until one is available)
-				<-pool
-			}
+// PublishTransaction places multiple messages on the default queue (or delay
+// queues) in an AMQP transaction, so either all of them are enqueued or none.
+// Members are prepared like tasks published one by one, ErrTaskUnroutable is
+// returned if a Mandatory member was returned although the rest is committed
+func (b *AMQPBroker) PublishTransaction(signatures []*tasks.Signature) error {
+	start := time.Now()
+	err := b.publishTransaction(signatures)
+	b.observeBatch(signatures, time.Since(start), err)
+	return err
+}
 
-			wg.Add(1)
+// publishTransaction places multiple messages in an AMQP transaction, the
+// whole path is measured as publish latency
+func (b *AMQPBroker) publishTransaction(signatures []*tasks.Signature) error {
+	pending, err := b.prepareTransaction(signatures)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
 
-			// Consume the task inside a gotourine so multiple tasks
-			// can be processed concurrently
-			go func() {
-				defer wg.Done()
+	conn, channel, _, _, _, err := b.Connect(
+		b.cnf.Broker,
+		b.cnf.TLSConfig,
+		b.exchangeName(),                        // exchange name
+		b.cnf.AMQP.ExchangeType,                 // exchange type
+		b.queueName(b.cnf.DefaultQueue),         // queue name
+		true,                                    // queue durable
+		false,                                   // queue delete when unused
+		b.cnf.AMQP.BindingKey,                   // queue binding key
+		nil,                                     // exchange declare args
+		b.QueueDeclareArgs(),                    // queue declare args
+		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
+	)
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
 
-				if err := b.consumeOne(d, taskProcessor); err != nil {
-					errorsChan <- err
-				}
+	// The channel returned by Connect is in confirm mode which can't be
+	// combined with transactions
+	txChannel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Channel error: %s", err)
+	}
+	defer txChannel.Close()
 
-				if concurrency > 0 {
-					// give worker back to pool
-					pool <- struct{}{}
-				}
-			}()
-		case <-b.stopChan:
-			return nil
+	// Unroutable mandatory messages are returned before the commit is
+	// confirmed
+	var returnsChan <-chan amqp.Return
+	for _, signature := range pending {
+		if signature.Mandatory {
+			returnsChan = txChannel.NotifyReturn(make(chan amqp.Return, len(pending)))
+			break
 		}
 	}
-}
 
-// consumeOne processes a single message using TaskProcessor
-func (b *AMQPBroker) consumeOne(d amqp.Delivery, taskProcessor TaskProcessor) error {
-	if len(d.Body) == 0 {
-		d.Nack(false, false)                           // multiple, requeue
-		return errors.New("Received an empty message") // RabbitMQ down?
-	}
+	err = publishInTransaction(txChannel, pending, func(signature *tasks.Signature) error {
+		message, err := b.encode(signature)
+		if err != nil {
+			return fmt.Errorf("JSON marshal error: %s", err)
+		}
 
-	log.INFO.Printf("Received new message: %s", d.Body)
+		// Tasks with ETA in the future go to their delay queue, only the
+		// publishing is part of the transaction
+		routingKey := signature.RoutingKey
+		if delay := b.etaDelay(signature); delay > 0 {
+			queueName, declareQueueArgs := b.delayQueue(signature, int64(delay/time.Millisecond))
+			if _, err := txChannel.QueueDeclare(
+				queueName,        // name
+				true,             // durable
+				false,            // delete when unused
+				false,            // exclusive
+				false,            // no-wait
+				declareQueueArgs, // arguments
+			); err != nil {
+				return fmt.Errorf("Queue declare error: %s", err)
+			}
+			if err := txChannel.QueueBind(
+				queueName,                               // name of the queue
+				queueName,                               // binding key
+				b.exchangeName(),                        // source exchange
+				false,                                   // noWait
+				amqp.Table(b.cnf.AMQP.QueueBindingArgs), // arguments
+			); err != nil {
+				return fmt.Errorf("Queue bind error: %s", err)
+			}
+			routingKey = queueName
+		}
 
-	// Unmarshal message body into signature struct
-	signature := new(tasks.Signature)
-	if err := json.Unmarshal(d.Body, signature); err != nil {
-		d.Nack(false, false) // multiple, requeue
+		return txChannel.Publish(
+			b.exchangeName(),    // exchange name
+			routingKey,          // routing key
+			signature.Mandatory, // mandatory
+			false,               // immediate
+			b.newPublishing(signature, message),
+		)
+	})
+	if err != nil {
 		return err
 	}
 
-	// If the task is not registered, we nack it and requeue,
-	// there might be different workers for processing specific tasks
-	if !b.IsTaskRegistered(signature.Name) {
-		d.Nack(false, true) // multiple, requeue
+	select {
+	case <-returnsChan:
+		return ErrTaskUnroutable
+	default:
 		return nil
 	}
+}
 
-	d.Ack(false) // multiple
-	return taskProcessor.Process(signature)
+// amqpTransactor is the part of amqp.Channel used for transactions
+type amqpTransactor interface {
+	Tx() error
+	TxCommit() error
+	TxRollback() error
 }
 
-// delay a task by delayDuration miliseconds, the way it works is a new queue
-// is created without any consumers, the message is then published to this queue
-// with appropriate ttl expiration headers, after the expiration, it is sent to
-// the proper queue with consumers
-func (b *AMQPBroker) delay(signature *tasks.Signature, delayMs int64) error {
-	if delayMs <= 0 {
-		return errors.New("Cannot delay task by 0ms")
+// publishInTransaction publishes signatures one by one on a channel put into
+// transaction mode, the transaction is rolled back if any of them fails
+func publishInTransaction(channel amqpTransactor, signatures []*tasks.Signature, publish func(signature *tasks.Signature) error) error {
+	if err := channel.Tx(); err != nil {
+		return fmt.Errorf("Channel could not be put into transaction mode: %s", err)
 	}
 
-	message, err := json.Marshal(signature)
-	if err != nil {
-		return fmt.Errorf("JSON marshal error: %s", err)
+	for _, signature := range signatures {
+		if err := publish(signature); err != nil {
+			if rollbackErr := channel.TxRollback(); rollbackErr != nil {
+				return fmt.Errorf("Transaction rollback error: %s (after %s)", rollbackErr, err)
+			}
+			return err
+		}
 	}
 
-	// It's necessary to redeclare the queue each time (to zero its TTL timer).
-	queueName := signature.UUID
-
-	declareQueueArgs := amqp.Table{
-		// Exchange where to send messages after TTL expiration.
-		"x-dead-letter-exchange": b.cnf.AMQP.Exchange,
-		// Routing key which use when resending expired messages.
-		"x-dead-letter-routing-key": b.cnf.AMQP.BindingKey,
-		// Time in milliseconds
-		// after that message will expire and be sent to destination.
-		"x-message-ttl": delayMs,
-		// Time after that the queue will be deleted...3 seconds after queue is unused, it will (hopefully) be cleaned up
-		"x-expires": delayMs + 3000,
+	if err := channel.TxCommit(); err != nil {
+		return fmt.Errorf("Transaction commit error: %s", err)
 	}
+	return nil
+}
+
+// PurgeQueue deletes the queue of a deferred task together with the messages
+// waiting in it, QueuePrefix is applied to queueName the same way it is when
+// delay queues are declared, so the task UUID can be passed as is
+func (b *AMQPBroker) PurgeQueue(queueName string) (bool, int, error) {
 	conn, channel, _, _, _, err := b.Connect(
 		b.cnf.Broker,
 		b.cnf.TLSConfig,
-		b.cnf.AMQP.Exchange,                     // exchange name
+		b.exchangeName(),                        // exchange name
 		b.cnf.AMQP.ExchangeType,                 // exchange type
-		queueName,                               // queue name
+		b.queueName(b.cnf.DefaultQueue),         // queue name
 		true,                                    // queue durable
 		false,                                   // queue delete when unused
-		queueName,                               // queue binding key
+		b.cnf.AMQP.BindingKey,                   // queue binding key
 		nil,                                     // exchange declare args
-		declareQueueArgs,                        // queue declare args
+		b.QueueDeclareArgs(),                    // queue declare args
 		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
 	)
 	if err != nil {
-		return err
+		b.retryFunc(b.retryStopChan)
+		return b.retry, 0, err
 	}
 	defer b.Close(channel, conn)
 
-	if err := channel.Publish(
-		b.cnf.AMQP.Exchange, // exchange
-		queueName,           // routing key
-		false,               // mandatory
-		false,               // immediate
-		amqp.Publishing{
-			Headers:      amqp.Table(signature.Headers),
-			ContentType:  "application/json",
-			Body:         message,
-			DeliveryMode: amqp.Persistent,
-		},
+	if err = channel.Qos(
+		b.cnf.AMQP.PrefetchCount,
+		0,     // prefetch size
+		false, // global
 	); err != nil {
-		return err
+		return b.retry, 0, fmt.Errorf("Channel qos error: %s", err)
 	}
 
-	return nil
+	n, err := b.purgeQueue(channel, queueName)
+
+	return b.retry, n, err
+}
+
+// amqpQueueDeleter is the part of amqp.Channel used to delete queues
+type amqpQueueDeleter interface {
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+}
+
+// purgeQueue deletes the prefixed queue and returns the number of messages
+// deleted with it
+func (b *AMQPBroker) purgeQueue(channel amqpQueueDeleter, queueName string) (int, error) {
+	return channel.QueueDelete(
+		b.queueName(queueName), // name
+		false,                  // ifUnused
+		false,                  // ifEmpty
+		false,                  // noWait
+	)
+}
+
+// ReprocessDeadLetter moves up to limit messages from the dead-letter queue
+// back to the exchange using routing key they were originally published with
+func (b *AMQPBroker) ReprocessDeadLetter(dlqName string, limit int) (int, error) {
+	conn, channel, _, confirmsChan, _, err := b.Connect(
+		b.cnf.Broker,
+		b.cnf.TLSConfig,
+		b.exchangeName(),        // exchange name
+		b.cnf.AMQP.ExchangeType, // exchange type
+		"",                      // queue name
+		true,                    // queue durable
+		false,                   // queue delete when unused
+		"",                      // queue binding key
+		nil,                     // exchange declare args
+		nil,                     // queue declare args
+		nil,                     // queue binding args
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close(channel, conn)
+
+	return b.reprocessDeadLetter(channel, confirmsChan, dlqName, limit)
+}
+
+// amqpGetPublisher is the part of amqp.Channel used to move messages from
+// one queue to another
+type amqpGetPublisher interface {
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// reprocessDeadLetter moves up to limit messages from the dead-letter queue
+// on a channel in confirm mode, a message is only acked once its copy was
+// confirmed and requeued if that fails
+func (b *AMQPBroker) reprocessDeadLetter(channel amqpGetPublisher, confirmsChan <-chan amqp.Confirmation, dlqName string, limit int) (int, error) {
+	reprocessed := 0
+	for reprocessed < limit {
+		d, ok, err := channel.Get(b.queueName(dlqName), false) // no auto-ack, acked once republished
+		if err != nil {
+			return reprocessed, fmt.Errorf("Queue get error: %s", err)
+		}
+		if !ok {
+			break
+		}
+
+		// Redelivery counts are dropped so the copy gets a fresh set of
+		// MaxRedeliveries instead of going straight back to the dead letters
+		headers := amqp.Table{}
+		for key, value := range d.Headers {
+			headers[key] = value
+		}
+		delete(headers, RedeliveryCountHeader)
+		delete(headers, "x-delivery-count")
+
+		routingKey := originalRoutingKey(d.Headers, b.cnf.AMQP.BindingKey)
+		if err := channel.Publish(
+			b.exchangeName(), // exchange name
+			routingKey,       // routing key
+			false,            // mandatory
+			false,            // immediate
+			amqp.Publishing{
+				Headers:      headers,
+				ContentType:  d.ContentType,
+				Body:         d.Body,
+				DeliveryMode: amqp.Persistent,
+			},
+		); err != nil {
+			d.Nack(false, true) // multiple, requeue
+			return reprocessed, err
+		}
+
+		confirmed := <-confirmsChan
+		if !confirmed.Ack {
+			d.Nack(false, true) // multiple, requeue
+			return reprocessed, fmt.Errorf("Failed delivery of delivery tag: %v", confirmed.DeliveryTag)
+		}
+
+		d.Ack(false) // multiple
+		reprocessed++
+	}
+
+	return reprocessed, nil
+}
+
+// QueueStats returns the number of messages ready in the queue and the
+// number of its consumers
+func (b *AMQPBroker) QueueStats(queue string) (*QueueStats, error) {
+	conn, channel, _, _, _, err := b.Connect(
+		b.cnf.Broker,
+		b.cnf.TLSConfig,
+		b.exchangeName(),        // exchange name
+		b.cnf.AMQP.ExchangeType, // exchange type
+		"",                      // queue name
+		true,                    // queue durable
+		false,                   // queue delete when unused
+		"",                      // queue binding key
+		nil,                     // exchange declare args
+		nil,                     // queue declare args
+		nil,                     // queue binding args
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close(channel, conn)
+
+	if queue == "" {
+		queue = b.cnf.DefaultQueue
+	}
+	state, err := channel.QueueInspect(b.queueName(queue))
+	if err != nil {
+		return nil, fmt.Errorf("Queue inspect error: %s", err)
+	}
+	return &QueueStats{Messages: state.Messages, Consumers: state.Consumers}, nil
+}
+
+// checkConsumers returns an error if the queue already has
+// MaxConsumersPerQueue consumers
+func (b *AMQPBroker) checkConsumers(queue amqp.Queue) error {
+	max := b.cnf.MaxConsumersPerQueue
+	if max > 0 && queue.Consumers >= max {
+		return fmt.Errorf("Queue %s already has %d consumers, MaxConsumersPerQueue is %d", queue.Name, queue.Consumers, max)
+	}
+	return nil
+}
+
+// QueueDeclareArgs returns arguments used when declaring the default queue.
+// Setting AMQP.QueueType to "quorum" declares a durable, replicated quorum
+// queue instead of a classic one, AMQP.DeadLetterExchange makes the broker
+// dead-letter messages rejected without requeueing instead of dropping them
+func (b *AMQPBroker) QueueDeclareArgs() amqp.Table {
+	if b.cnf.AMQP == nil {
+		return nil
+	}
+
+	args := amqp.Table{}
+	if b.cnf.AMQP.QueueType != "" && b.cnf.AMQP.QueueType != "classic" {
+		args["x-queue-type"] = b.cnf.AMQP.QueueType
+	}
+	if b.cnf.AMQP.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = b.cnf.AMQP.DeadLetterExchange
+		if b.cnf.AMQP.DeadLetterRoutingKey != "" {
+			args["x-dead-letter-routing-key"] = b.cnf.AMQP.DeadLetterRoutingKey
+		}
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// amqpExchangeBinder is the part of amqp.Channel used to bind exchanges
+type amqpExchangeBinder interface {
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+}
+
+// bindExchanges declares AMQP.ExchangeBindings, both exchanges of a binding
+// must exist already unless one of them is the configured exchange
+func (b *AMQPBroker) bindExchanges(channel amqpExchangeBinder) error {
+	for _, binding := range b.cnf.AMQP.ExchangeBindings {
+		if err := channel.ExchangeBind(
+			binding.Destination, // destination exchange
+			binding.RoutingKey,  // routing key
+			binding.Source,      // source exchange
+			false,               // noWait
+			nil,                 // arguments
+		); err != nil {
+			return fmt.Errorf("Exchange bind error: %s", err)
+		}
+	}
+	return nil
+}
+
+// amqpConsumer is the part of amqp.Channel used to start consuming
+type amqpConsumer interface {
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+}
+
+// amqpQoS is the part of amqp.Channel used to change the prefetch count
+type amqpQoS interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+}
+
+// prefetchAdapter lowers the prefetch count of a channel while the worker is
+// saturated, so the broker holds back deliveries instead of the worker
+// buffering them, and restores it once the worker has capacity again
+type prefetchAdapter struct {
+	channel        amqpQoS
+	concurrency    int
+	prefetch       int
+	reduced        int
+	period         time.Duration
+	saturatedSince time.Time
+	lowered        bool
+}
+
+// observe updates the prefetch count according to the number of tasks in
+// flight at the given time
+func (a *prefetchAdapter) observe(inFlight int, now time.Time) error {
+	if inFlight < a.concurrency {
+		a.saturatedSince = time.Time{}
+		if a.lowered {
+			a.lowered = false
+			return a.channel.Qos(a.prefetch, 0, false)
+		}
+		return nil
+	}
+
+	if a.saturatedSince.IsZero() {
+		a.saturatedSince = now
+	}
+	if !a.lowered && now.Sub(a.saturatedSince) >= a.period {
+		a.lowered = true
+		return a.channel.Qos(a.reduced, 0, false)
+	}
+	return nil
+}
+
+// adaptPrefetch checks how many tasks are in flight a few times per
+// saturation period until stopChan is closed
+func (b *AMQPBroker) adaptPrefetch(channel amqpQoS, concurrency int, stopChan <-chan struct{}) {
+	period := time.Duration(b.cnf.AMQP.SaturationPeriod) * time.Second
+	if period <= 0 {
+		period = 5 * time.Second
+	}
+	adapter := &prefetchAdapter{
+		channel:     channel,
+		concurrency: concurrency,
+		prefetch:    b.cnf.AMQP.PrefetchCount,
+		reduced:     b.cnf.AMQP.SaturatedPrefetchCount,
+		period:      period,
+	}
+
+	for {
+		select {
+		case <-b.clock.After(period / 5):
+		case <-stopChan:
+			return
+		}
+		if err := adapter.observe(b.inFlight.count(), b.clock.Now()); err != nil {
+			log.WARNING.Printf("Channel qos error: %s", err)
+		}
+	}
+}
+
+// startDeliveries starts consuming from the queue, AMQP.ConsumerArgs are
+// passed to the broker so it can apply them before delivering messages
+func (b *AMQPBroker) startDeliveries(channel amqpConsumer, queueName, consumerTag string) (<-chan amqp.Delivery, error) {
+	b.consumingQueue = queueName
+	return channel.Consume(
+		queueName,                           // queue
+		consumerTag,                         // consumer tag
+		false,                               // auto-ack
+		false,                               // exclusive
+		false,                               // no-local
+		false,                               // no-wait
+		amqp.Table(b.cnf.AMQP.ConsumerArgs), // arguments
+	)
+}
+
+// publishWithConfirms publishes signatures one by one on a channel in confirm
+// mode and waits for all publish confirms. Confirms are received while still
+// publishing so the connection is never blocked by a full confirms channel.
+// Delivery tags are sequence numbers starting at 1, i.e. tag N confirms the
+// Nth published signature regardless of the order confirms arrive in.
+// Returned messages arrive before their confirm, so once all confirms are in
+// returnsChan holds every message which was unroutable
+func publishWithConfirms(signatures []*tasks.Signature, confirmsChan <-chan amqp.Confirmation, returnsChan <-chan amqp.Return, publish func(signature *tasks.Signature) error) error {
+	var publishErr error
+	publishedChan := make(chan int, 1)
+
+	go func() {
+		for i, signature := range signatures {
+			if err := publish(signature); err != nil {
+				publishErr = err
+				publishedChan <- i
+				return
+			}
+		}
+		publishedChan <- len(signatures)
+	}()
+
+	nacked := make([]bool, len(signatures))
+	published, confirmed := -1, 0
+	for published < 0 || confirmed < published {
+		select {
+		case published = <-publishedChan:
+		case confirmation, ok := <-confirmsChan:
+			if !ok {
+				return errors.New("Channel closed before all publishings were confirmed")
+			}
+
+			tag := int(confirmation.DeliveryTag)
+			if tag < 1 || tag > len(signatures) {
+				return fmt.Errorf("Unexpected delivery tag: %v", confirmation.DeliveryTag)
+			}
+
+			nacked[tag-1] = !confirmation.Ack
+			confirmed++
+		}
+	}
+
+	if publishErr != nil {
+		return publishErr
+	}
+
+	returned := make(map[string]bool)
+	for drained := false; !drained; {
+		select {
+		case r := <-returnsChan:
+			returned[r.MessageId] = true
+		default:
+			drained = true
+		}
+	}
+
+	batchErr := new(BatchPublishError)
+	for i, signature := range signatures {
+		if nacked[i] {
+			batchErr.Nacked = append(batchErr.Nacked, signature)
+		} else if returned[signature.UUID] {
+			batchErr.Unroutable = append(batchErr.Unroutable, signature)
+		}
+	}
+	if len(batchErr.Nacked) > 0 || len(batchErr.Unroutable) > 0 {
+		return batchErr
+	}
+
+	return nil
+}
+
+// consume takes delivered messages from the channel and manages a worker pool
+// to process tasks concurrently
+func (b *AMQPBroker) consume(deliveries <-chan amqp.Delivery, concurrency int, taskProcessor TaskProcessor, amqpCloseChan <-chan *amqp.Error) error {
+	pool := b.newWorkerPool(concurrency)
+
+	// Make sure task processing completes on interrupt signal
+	defer pool.Stop()
+
+	// Only the first error is returned, the rest is dropped so jobs
+	// never block once the loop has returned
+	errorsChan := make(chan error, 1)
+
+	// Fetch deliveries ahead of the pool so bursts don't stall it
+	if size := b.deliveryBufferSize(); size > 0 {
+		deliveries = bufferDeliveries(deliveries, size, b.stopChan)
+	}
+
+	counter := b.newTaskCounter(taskProcessor)
+
+	var budget *weightBudget
+	if b.cnf.WeightBudget > 0 && !b.cnf.OrderedMode {
+		budget = newWeightBudget(b.cnf.WeightBudget)
+	}
+
+	// Closed once the channel deliveries come from is closed
+	channelClosed := make(chan struct{})
+
+	// Standalone tasks only get the slots not reserved for workflow steps,
+	// the broker backs off while they keep being requeued for lack of one
+	var standaloneSlots chan struct{}
+	busy := new(requeueBackoff)
+	if reserved := b.cnf.WorkflowReservedConcurrency; reserved > 0 && concurrency > reserved && !b.cnf.OrderedMode {
+		standaloneSlots = make(chan struct{}, concurrency-reserved)
+	}
+
+	for {
+		// Stop once as many tasks as the task processor is limited to were
+		// completed, no more deliveries are taken meanwhile than needed
+		if !counter.wait(b.stopChan) {
+			if counter.reached() {
+				b.retry = false
+			}
+			return nil
+		}
+
+		// Stop pulling new tasks while the task processor is paused
+		select {
+		case <-resumed(taskProcessor):
+		case <-b.stopChan:
+			return nil
+		}
+
+		// Back off while only tasks of other workers are received, or
+		// standalone tasks while their slots are busy
+		if !b.unregistered.wait(b.clock, b.stopChan) || !busy.wait(b.clock, b.stopChan) {
+			return nil
+		}
+
+		select {
+		case amqpErr := <-amqpCloseChan:
+			// Tasks still in flight don't acknowledge their deliveries on
+			// the dead channel, the AMQP server requeues them
+			close(channelClosed)
+			return amqpErr
+		case err := <-errorsChan:
+			return err
+		case d := <-deliveries:
+			if d.Acknowledger != nil {
+				d.Acknowledger = &channelAcknowledger{Acknowledger: d.Acknowledger, closed: channelClosed}
+			}
+
+			// Process the delivery in the loop so tasks run strictly in order
+			if b.cnf.OrderedMode {
+				counter.take()
+				err := b.consumeOne(d, taskProcessor)
+				counter.done()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			body, signature, err := b.decodeDelivery(d)
+			if err != nil {
+				return err
+			}
+
+			// A standalone task received while all goroutines it may run on
+			// are busy is requeued, so it holds neither a prefetch credit
+			// nor weight workflow steps received meanwhile need
+			standalone := standaloneSlots != nil && !isWorkflowStep(signature)
+			if standalone {
+				select {
+				case standaloneSlots <- struct{}{}:
+					busy.reset()
+				default:
+					busy.requeued()
+					d.Nack(false, true) // multiple, requeue
+					continue
+				}
+			}
+
+			// Hold the delivery unacked, so no more are pulled beyond the
+			// prefetch count, until its weight fits into the budget
+			weight := 0
+			if budget != nil {
+				weight = taskWeight(signature)
+				if !budget.acquire(weight, b.stopChan) {
+					if standalone {
+						<-standaloneSlots
+					}
+					d.Nack(false, true) // multiple, requeue
+					return nil
+				}
+			}
+
+			job := func() {
+				defer counter.done()
+				if standalone {
+					defer func() { <-standaloneSlots }()
+				}
+				if budget != nil {
+					defer budget.release(weight)
+				}
+				if err := b.consumeSignature(d, body, signature, taskProcessor); err != nil {
+					select {
+					case errorsChan <- err:
+					default:
+					}
+				}
+			}
+
+			// Let other consumers take the delivery if no pool goroutine
+			// is free to run it right away
+			counter.take()
+			if b.cnf.OnPoolFull == config.PoolFullRequeue {
+				if !pool.TrySubmit(job) {
+					counter.done()
+					if standalone {
+						<-standaloneSlots
+					}
+					if budget != nil {
+						budget.release(weight)
+					}
+					d.Nack(false, true) // multiple, requeue
+				}
+				continue
+			}
+
+			// Consume the task on a pool goroutine so multiple tasks can be
+			// processed concurrently (blocks until one is available)
+			pool.Submit(job)
+		case <-b.stopChan:
+			return nil
+		}
+	}
+}
+
+// errDeliveryAbandoned is returned acknowledging a delivery after its channel
+// was closed, the AMQP server requeues the delivery
+var errDeliveryAbandoned = errors.New("Channel closed, delivery abandoned")
+
+// channelAcknowledger acknowledges deliveries until the channel they came
+// from is closed. Later acknowledgements are abandoned, the AMQP server
+// requeues unacknowledged deliveries of a closed channel by itself
+type channelAcknowledger struct {
+	amqp.Acknowledger
+	closed <-chan struct{}
+}
+
+// Ack acknowledges the delivery unless the channel is closed
+func (a *channelAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.acknowledge(tag, func() error {
+		return a.Acknowledger.Ack(tag, multiple)
+	})
+}
+
+// Nack negatively acknowledges the delivery unless the channel is closed
+func (a *channelAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.acknowledge(tag, func() error {
+		return a.Acknowledger.Nack(tag, multiple, requeue)
+	})
+}
+
+// Reject rejects the delivery unless the channel is closed
+func (a *channelAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.acknowledge(tag, func() error {
+		return a.Acknowledger.Reject(tag, requeue)
+	})
+}
+
+// acknowledge calls ack unless the channel is closed, a channel closing
+// before the broker noticed is not logged as an error either, only
+// errDeliveryAbandoned is returned
+func (a *channelAcknowledger) acknowledge(tag uint64, ack func() error) error {
+	select {
+	case <-a.closed:
+	default:
+		err := ack()
+		if err != amqp.ErrClosed {
+			if err != nil {
+				log.ERROR.Printf("Acknowledge delivery %d error: %s", tag, err)
+			}
+			return err
+		}
+	}
+
+	log.INFO.Printf("Channel closed, delivery %d is left to be requeued", tag)
+	return errDeliveryAbandoned
+}
+
+// taskWeight returns the weight of the task, tasks without one weigh 1
+func taskWeight(signature *tasks.Signature) int {
+	if signature.Weight < 1 {
+		return 1
+	}
+	return signature.Weight
+}
+
+// isWorkflowStep returns true if the task is part of a group, chord or chain
+func isWorkflowStep(signature *tasks.Signature) bool {
+	return signature.GroupUUID != "" || signature.WorkflowDepth > 0 ||
+		len(signature.OnSuccess) > 0 || signature.ChordCallback != nil
+}
+
+// deliveryBufferSize returns how many deliveries can be buffered ahead of the
+// worker pool, buffered deliveries are not acked yet so the buffer never holds
+// more than the prefetch count allows
+func (b *AMQPBroker) deliveryBufferSize() int {
+	size := b.cnf.DeliveryBuffer
+	if b.cnf.AMQP != nil && b.cnf.AMQP.PrefetchCount > 0 && size > b.cnf.AMQP.PrefetchCount {
+		size = b.cnf.AMQP.PrefetchCount
+	}
+	return size
+}
+
+// bufferDeliveries forwards deliveries to a channel holding up to size of them
+// (including the one waiting to be forwarded) until the stop channel is closed
+func bufferDeliveries(deliveries <-chan amqp.Delivery, size int, stopChan <-chan int) <-chan amqp.Delivery {
+	buffered := make(chan amqp.Delivery, size-1)
+
+	go func() {
+		for {
+			select {
+			case d, ok := <-deliveries:
+				if !ok {
+					close(buffered)
+					return
+				}
+				select {
+				case buffered <- d:
+				case <-stopChan:
+					return
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+
+	return buffered
+}
+
+// consumeOne processes a single message using TaskProcessor
+func (b *AMQPBroker) consumeOne(d amqp.Delivery, taskProcessor TaskProcessor) error {
+	body, signature, err := b.decodeDelivery(d)
+	if err != nil {
+		return err
+	}
+	return b.consumeSignature(d, body, signature, taskProcessor)
+}
+
+// decodeDelivery decodes the task in the delivery, deliveries which can't be
+// decoded are dead-lettered
+func (b *AMQPBroker) decodeDelivery(d amqp.Delivery) ([]byte, *tasks.Signature, error) {
+	if d.Redelivered {
+		redeliveries.Add(b.consumingQueue, 1)
+	}
+
+	if len(d.Body) == 0 {
+		err := errors.New("Received an empty message") // RabbitMQ down?
+		b.deadLettered(d.Body, err)
+		d.Nack(false, false) // multiple, requeue
+		return nil, nil, err
+	}
+
+	// Unmarshal message body into signature struct
+	body, err := deliveryBody(d)
+	if err != nil {
+		b.deadLettered(d.Body, err)
+		d.Nack(false, false) // multiple, requeue
+		return nil, nil, err
+	}
+	signature, err := b.decode(body, d.Headers)
+	if err != nil {
+		log.INFO.Printf("Received new message: %s", body)
+		b.deadLettered(d.Body, err)
+		d.Nack(false, false) // multiple, requeue
+		return nil, nil, err
+	}
+	return body, signature, nil
+}
+
+// consumeSignature processes the task decoded from the delivery
+func (b *AMQPBroker) consumeSignature(d amqp.Delivery, body []byte, signature *tasks.Signature, taskProcessor TaskProcessor) error {
+
+	// If the task is not registered, we nack it and requeue,
+	// there might be different workers for processing specific tasks
+	if !b.IsTaskRegistered(signature.Name) {
+		b.unregistered.received(signature)
+		d.Nack(false, true) // multiple, requeue
+		return nil
+	}
+	b.unregistered.reset()
+
+	log.INFO.Printf("Received new message: %s", body)
+
+	// If the task does not pass the worker's task filter, we nack it and
+	// requeue so another worker can pick it up
+	if !acceptsTask(taskProcessor, signature) {
+		d.Nack(false, true) // multiple, requeue
+		return nil
+	}
+
+	switch b.intercept(signature) {
+	case InterceptReject:
+		d.Ack(false) // multiple
+		return nil
+	case InterceptRequeue:
+		d.Nack(false, true) // multiple, requeue
+		return nil
+	}
+
+	// Poison messages which keep being redelivered are moved to the
+	// dead-letter queue instead of being processed again
+	if b.cnf.MaxRedeliveries > 0 {
+		count, counted := redeliveryCount(d)
+		if count > b.cnf.MaxRedeliveries {
+			log.WARNING.Printf("Task %s redelivered more than %d times, moving it to dead-letter queue", signature.UUID, b.cnf.MaxRedeliveries)
+			b.deadLettered(d.Body, fmt.Errorf("Task %s redelivered more than %d times", signature.UUID, b.cnf.MaxRedeliveries))
+
+			if err := b.deadLetter(d); err != nil {
+				d.Nack(false, true) // multiple, requeue
+				return err
+			}
+			d.Ack(false) // multiple
+			return nil
+		}
+
+		// Classic queues don't count redeliveries, the count is carried in
+		// a copy of the message so it survives the worker crashing again
+		if !counted && d.Redelivered {
+			if err := b.redeliver(d, count); err != nil {
+				d.Nack(false, true) // multiple, requeue
+				return err
+			}
+			d.Ack(false) // multiple
+			return nil
+		}
+	}
+
+	// Tasks with manual commit ack the delivery themselves once their work
+	// is durable
+	if committer, ok := committingProcessor(taskProcessor, signature); ok {
+		return b.processed(d, b.processWithCommit(committer, signature, func() {
+			d.Ack(false) // multiple
+		}))
+	}
+
+	// Ordered mode acks only once the task has been processed so the next
+	// delivery is never acknowledged before the previous one. So do workers
+	// limiting redeliveries, a task crashing the worker is redelivered then
+	if b.cnf.OrderedMode || b.cnf.MaxRedeliveries > 0 {
+		err := b.process(taskProcessor, signature)
+		d.Ack(false) // multiple
+		return b.processed(d, err)
+	}
+
+	d.Ack(false) // multiple
+	return b.processed(d, b.process(taskProcessor, signature))
+}
+
+// processed moves the delivery to the dead-letter queue if the task
+// processor returned DeadLetterError, the delivery is acknowledged already
+// so a copy of it is published
+func (b *AMQPBroker) processed(d amqp.Delivery, err error) error {
+	deadLetterErr, ok := err.(*DeadLetterError)
+	if !ok {
+		return err
+	}
+
+	log.WARNING.Printf("Moving message %s to dead-letter queue: %s", d.MessageId, deadLetterErr.Err)
+	b.deadLettered(d.Body, deadLetterErr.Err)
+	if err := b.deadLetter(d); err != nil {
+		return fmt.Errorf("Dead-letter error: %s", err)
+	}
+	return nil
+}
+
+// exchangeName returns name of the configured exchange with QueuePrefix
+func (b *AMQPBroker) exchangeName() string {
+	if b.cnf.AMQP.Exchange == "" {
+		return ""
+	}
+	return b.queueName(b.cnf.AMQP.Exchange)
+}
+
+// deadLetter publishes the delivery to the dead-letter queue, the routing key
+// it was originally published with is kept in a header so the message can be
+// reprocessed later
+func (b *AMQPBroker) deadLetter(d amqp.Delivery) error {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	headers[OriginalRoutingKeyHeader] = d.RoutingKey
+
+	publish := b.publishToDeadLetterQueue
+	if b.publishDeadLetter != nil {
+		publish = b.publishDeadLetter
+	}
+	return publish(d, headers)
+}
+
+// publishToDeadLetterQueue publishes the delivery with headers to the
+// dead-letter queue through the default exchange
+func (b *AMQPBroker) publishToDeadLetterQueue(d amqp.Delivery, headers amqp.Table) error {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	queue, err := channel.QueueDeclare(
+		b.deadLetterQueue(), // name
+		true,                // durable
+		false,               // delete when unused
+		false,               // exclusive
+		false,               // no-wait
+		nil,                 // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Queue declare error: %s", err)
+	}
+
+	if err = channel.Confirm(false); err != nil {
+		return fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+	}
+	confirmsChan := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	// The default exchange routes messages to the queue named by routing key
+	if err := channel.Publish(
+		"",         // exchange name
+		queue.Name, // routing key
+		false,      // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			Headers:      headers,
+			ContentType:  d.ContentType,
+			Body:         d.Body,
+			DeliveryMode: amqp.Persistent,
+		},
+	); err != nil {
+		return err
+	}
+
+	confirmed := <-confirmsChan
+	if confirmed.Ack {
+		return nil
+	}
+
+	return fmt.Errorf("Failed delivery of delivery tag: %v", confirmed.DeliveryTag)
+}
+
+// deadLetterQueue returns name of the queue poison messages are moved to
+func (b *AMQPBroker) deadLetterQueue() string {
+	return b.queueName(b.cnf.DefaultQueue + "_dlq")
+}
+
+// redeliveryCount returns how many times the message has been redelivered
+// and whether the queue counted it. Quorum queues count deliveries in
+// x-delivery-count header, classic queues only flag redelivered messages so
+// the count is kept in RedeliveryCountHeader of copies the broker publishes
+func redeliveryCount(d amqp.Delivery) (int, bool) {
+	switch count := d.Headers["x-delivery-count"].(type) {
+	case int64:
+		return int(count), true
+	case int32:
+		return int(count), true
+	case int:
+		return count, true
+	}
+
+	count := 0
+	switch republished := d.Headers[RedeliveryCountHeader].(type) {
+	case int64:
+		count = int(republished)
+	case int32:
+		count = int(republished)
+	case int:
+		count = republished
+	}
+	if d.Redelivered {
+		count++
+	}
+	return count, false
+}
+
+// redeliver publishes a copy of the redelivered message counting the
+// redelivery in RedeliveryCountHeader, the delivery is acknowledged after
+func (b *AMQPBroker) redeliver(d amqp.Delivery, count int) error {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	headers[RedeliveryCountHeader] = int64(count)
+
+	republish := b.publishCopy
+	if b.republish != nil {
+		republish = b.republish
+	}
+	if err := republish(d, headers); err != nil {
+		return fmt.Errorf("Republish redelivered message error: %s", err)
+	}
+	return nil
+}
+
+// publishCopy publishes the delivery with headers to the default queue
+// through the default exchange, so it isn't routed to other queues again
+func (b *AMQPBroker) publishCopy(d amqp.Delivery, headers amqp.Table) error {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	if err = channel.Confirm(false); err != nil {
+		return fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+	}
+	confirmsChan := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	if err := channel.Publish(
+		"",                              // exchange name
+		b.queueName(b.cnf.DefaultQueue), // routing key
+		false,                           // mandatory
+		false,                           // immediate
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			Body:          d.Body,
+			DeliveryMode:  d.DeliveryMode,
+			Priority:      d.Priority,
+			MessageId:     d.MessageId,
+			CorrelationId: d.CorrelationId,
+		},
+	); err != nil {
+		return err
+	}
+
+	confirmed := <-confirmsChan
+	if confirmed.Ack {
+		return nil
+	}
+
+	return fmt.Errorf("Failed delivery of delivery tag: %v", confirmed.DeliveryTag)
+}
+
+// delay a task by delayDuration miliseconds, the way it works is a queue
+// is declared without any consumers, the message is then published to this queue
+// with appropriate ttl expiration headers, after the expiration, it is sent to
+// the proper queue with consumers.
+// NOTE: delay queues are always declared as classic queues regardless of
+// AMQP.QueueType as they rely on per-queue expiration and are short lived
+func (b *AMQPBroker) delay(connector *common.AMQPConnector, signature *tasks.Signature, delayMs int64) error {
+	if delayMs <= 0 {
+		return errors.New("Cannot delay task by 0ms")
+	}
+
+	message, err := b.encode(signature)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	queueName, declareQueueArgs := b.delayQueue(signature, delayMs)
+	conn, channel, _, _, _, err := connector.Connect(
+		b.cnf.Broker,
+		b.cnf.TLSConfig,
+		b.exchangeName(),                        // exchange name
+		b.cnf.AMQP.ExchangeType,                 // exchange type
+		queueName,                               // queue name
+		true,                                    // queue durable
+		false,                                   // queue delete when unused
+		queueName,                               // queue binding key
+		nil,                                     // exchange declare args
+		declareQueueArgs,                        // queue declare args
+		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
+	)
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	if err := channel.Publish(
+		b.exchangeName(), // exchange
+		queueName,        // routing key
+		false,            // mandatory
+		false,            // immediate
+		b.newPublishing(signature, message),
+	); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// amqpScheduler delays tasks natively in delay queues, the AMQP server
+// dead-letters them to the exchange once their TTL expires
+type amqpScheduler struct {
+	broker    *AMQPBroker
+	connector *common.AMQPConnector
+}
+
+// Schedule publishes the task to a delay queue expiring at the given time
+func (s *amqpScheduler) Schedule(signature *tasks.Signature, at time.Time) error {
+	delay := at.Sub(s.broker.clock.Now())
+	return s.broker.delay(s.connector, signature, int64(delay/time.Millisecond))
+}
+
+// Poll returns nothing, due tasks are routed by the AMQP server itself
+func (s *amqpScheduler) Poll() ([]*tasks.Signature, error) {
+	return nil, nil
+}
+
+// delayQueue returns name and declare arguments of the queue the task is
+// delayed in. By default each task gets a queue of its own, the bucketed
+// strategy rounds the delay up to a power of two seconds and reuses one queue
+// per bucket so delaying many tasks does not create as many queues
+func (b *AMQPBroker) delayQueue(signature *tasks.Signature, delayMs int64) (string, amqp.Table) {
+	if b.cnf.AMQP.DelayStrategy == config.DelayStrategyBucketed {
+		return b.bucketedDelayQueue(delayMs)
+	}
+
+	// Fall back to bucketed queues rather than exhausting the broker's
+	// queue limit with per-task queues
+	queueName := b.queueName(signature.UUID)
+	if !b.reserveDelayQueue(queueName, delayMs+b.delayQueueExpireGrace()) {
+		log.WARNING.Printf("%d delay queues active, delaying task %s in a bucketed queue", b.cnf.AMQP.MaxDelayQueues, signature.UUID)
+		return b.bucketedDelayQueue(delayMs)
+	}
+
+	// It's necessary to redeclare the queue each time (to zero its TTL timer).
+	return queueName, amqp.Table{
+		// Exchange where to send messages after TTL expiration.
+		"x-dead-letter-exchange": b.exchangeName(),
+		// Routing key which use when resending expired messages.
+		"x-dead-letter-routing-key": b.cnf.AMQP.BindingKey,
+		// Time in milliseconds
+		// after that message will expire and be sent to destination.
+		"x-message-ttl": delayMs,
+		// Time after that the queue will be deleted, the grace period after
+		// the message expires leaves time to dead-letter it
+		"x-expires": delayMs + b.delayQueueExpireGrace(),
+	}
+}
+
+// bucketedDelayQueue returns name and declare arguments of the bucketed
+// queue the delay is rounded up to
+func (b *AMQPBroker) bucketedDelayQueue(delayMs int64) (string, amqp.Table) {
+	bucketMs := int64(1000)
+	for bucketMs < delayMs {
+		bucketMs *= 2
+	}
+
+	return b.queueName(fmt.Sprintf("%s_delay_%ds", b.cnf.DefaultQueue, bucketMs/1000)), amqp.Table{
+		"x-dead-letter-exchange":    b.exchangeName(),
+		"x-dead-letter-routing-key": b.cnf.AMQP.BindingKey,
+		// All messages of the queue expire after the same time so
+		// expired ones never wait behind others
+		"x-message-ttl": bucketMs,
+		// The queue is reused until no task has been delayed in it for
+		// a while
+		"x-expires": bucketMs + 60000,
+	}
+}
+
+// reserveDelayQueue keeps track of the per-task delay queue until it expires,
+// false is returned if MaxDelayQueues other queues have not expired yet
+func (b *AMQPBroker) reserveDelayQueue(queueName string, expiresInMs int64) bool {
+	if b.cnf.AMQP.MaxDelayQueues <= 0 {
+		return true
+	}
+
+	b.delayQueuesMu.Lock()
+	defer b.delayQueuesMu.Unlock()
+
+	now := b.clock.Now()
+	for name, expiresAt := range b.delayQueues {
+		if !expiresAt.After(now) {
+			delete(b.delayQueues, name)
+		}
+	}
+
+	_, redeclared := b.delayQueues[queueName]
+	if !redeclared && len(b.delayQueues) >= b.cnf.AMQP.MaxDelayQueues {
+		return false
+	}
+
+	b.delayQueues[queueName] = now.Add(time.Duration(expiresInMs) * time.Millisecond)
+	return true
+}
+
+// delayQueueExpireGrace returns how many milliseconds a per-task delay queue
+// outlives its message
+func (b *AMQPBroker) delayQueueExpireGrace() int64 {
+	if b.cnf.AMQP.DelayQueueExpireGrace > 0 {
+		return int64(b.cnf.AMQP.DelayQueueExpireGrace) * 1000
+	}
+	return 3000
 }
@@ -1,14 +1,93 @@
 package brokers
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/koblelabs/machinery/v1/clock"
 	"github.com/koblelabs/machinery/v1/config"
 	"github.com/koblelabs/machinery/v1/log"
 	"github.com/koblelabs/machinery/v1/retry"
 	"github.com/koblelabs/machinery/v1/tasks"
 )
 
+// ErrTaskUnroutable is returned when a mandatory task could not be routed
+// to any queue
+var ErrTaskUnroutable = errors.New("Task unroutable, no queue bound to its routing key")
+
+// BodyEncodingHeader is the message header flagging a message body encoded
+// for transport, BodyEncodingBase64 is the only encoding
+const (
+	BodyEncodingHeader = "x-body-encoding"
+	BodyEncodingBase64 = "base64"
+)
+
+// OriginalRoutingKeyHeader is the message header holding routing key (or
+// queue name) a message was published with before it was dead-lettered
+const OriginalRoutingKeyHeader = "x-original-routing-key"
+
+// RedeliveryCountHeader is the message header counting redeliveries of a
+// message from a classic AMQP queue, which only flags redelivered messages
+const RedeliveryCountHeader = "x-redelivery-count"
+
+// BatchPublishError is returned when some of the messages published in a batch
+// were not confirmed by the broker, or were Mandatory and could not be routed
+// to any queue
+type BatchPublishError struct {
+	Nacked     []*tasks.Signature
+	Unroutable []*tasks.Signature
+}
+
+// Error lists UUIDs of the tasks which failed to be delivered
+func (e *BatchPublishError) Error() string {
+	var messages []string
+	if len(e.Nacked) > 0 {
+		messages = append(messages, fmt.Sprintf("Failed delivery of tasks: %s", signatureUUIDs(e.Nacked)))
+	}
+	if len(e.Unroutable) > 0 {
+		messages = append(messages, fmt.Sprintf("Unroutable tasks: %s", signatureUUIDs(e.Unroutable)))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// failed returns true if the signature is one of the tasks which failed to
+// be delivered
+func (e *BatchPublishError) failed(signature *tasks.Signature) bool {
+	for _, failed := range append(e.Nacked, e.Unroutable...) {
+		if failed == signature {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureUUIDs returns comma separated UUIDs of the signatures
+func signatureUUIDs(signatures []*tasks.Signature) string {
+	uuids := make([]string, len(signatures))
+	for i, signature := range signatures {
+		uuids[i] = signature.UUID
+	}
+	return strings.Join(uuids, ", ")
+}
+
+// DeadLetterError is returned by a task processor to have the message of a
+// task which failed for good dead-lettered, e.g. because the task panicked
+type DeadLetterError struct {
+	Err error
+}
+
+// Error returns the message of the error the task failed with
+func (e *DeadLetterError) Error() string {
+	return e.Err.Error()
+}
+
 // Broker represents a base broker structure
 type Broker struct {
 	cnf                 *config.Config
@@ -17,11 +96,29 @@ type Broker struct {
 	retryFunc           func(chan int)
 	retryStopChan       chan int
 	stopChan            chan int
+	stopOnce            *sync.Once
+	messageAdapter      MessageAdapter
+	workerPoolHooks     WorkerPoolHooks
+	deadLetterHandler   DeadLetterHandler
+	consumeInterceptors []ConsumeInterceptor
+	publishObserver     PublishObserver
+	scheduler           Scheduler
+	undispatched        *undispatchedTasks
+	unregistered        *unregisteredTasks
+	inFlight            *inFlightTasks
+	clock               clock.Clock
 }
 
 // New creates new Broker instance
 func New(cnf *config.Config) Broker {
-	return Broker{cnf: cnf, retry: true}
+	return Broker{
+		cnf:          cnf,
+		retry:        true,
+		unregistered: new(unregisteredTasks),
+		undispatched: new(undispatchedTasks),
+		inFlight:     &inFlightTasks{uuids: make(map[string]int)},
+		clock:        clock.Real,
+	}
 }
 
 // SetRegisteredTaskNames sets registered task names
@@ -39,28 +136,574 @@ func (b *Broker) IsTaskRegistered(name string) bool {
 	return false
 }
 
+// SetMessageAdapter sets an adapter used to decode consumed messages
+func (b *Broker) SetMessageAdapter(adapter MessageAdapter) {
+	b.messageAdapter = adapter
+}
+
+// SetDeadLetterHandler sets a handler called with messages which can't be
+// processed before they are discarded or dead-lettered
+func (b *Broker) SetDeadLetterHandler(handler DeadLetterHandler) {
+	b.deadLetterHandler = handler
+}
+
+// deadLettered passes a message which can't be processed to the dead-letter
+// handler if one is set
+func (b *Broker) deadLettered(body []byte, reason error) {
+	if b.deadLetterHandler != nil {
+		b.deadLetterHandler(body, reason)
+	}
+}
+
+// SetConsumeInterceptors sets interceptors consumed tasks are passed through,
+// in order, before they are processed
+func (b *Broker) SetConsumeInterceptors(interceptors ...ConsumeInterceptor) {
+	b.consumeInterceptors = interceptors
+}
+
+// intercept passes the consumed task through the interceptors until one of
+// them decides not to continue
+func (b *Broker) intercept(signature *tasks.Signature) InterceptDecision {
+	for _, interceptor := range b.consumeInterceptors {
+		if decision := interceptor(signature); decision != InterceptContinue {
+			return decision
+		}
+	}
+	return InterceptContinue
+}
+
+// SetPublishObserver sets an observer measuring publish latency, e.g. to
+// feed a machinery_publish_duration_seconds histogram
+func (b *Broker) SetPublishObserver(observer PublishObserver) {
+	b.publishObserver = observer
+}
+
+// observePublish reports publish latency of the task to the observer if one
+// is set
+func (b *Broker) observePublish(signature *tasks.Signature, duration time.Duration, err error) {
+	if b.publishObserver != nil {
+		b.publishObserver(signature.RoutingKey, duration, err)
+	}
+}
+
+// SetWorkerPoolHooks sets hooks called by the pool running consumed tasks
+func (b *Broker) SetWorkerPoolHooks(hooks WorkerPoolHooks) {
+	b.workerPoolHooks = hooks
+}
+
+// SetScheduler sets the scheduler tasks with ETA in the future are handed to
+// instead of the broker's native scheduler, consumers publish them once due
+func (b *Broker) SetScheduler(scheduler Scheduler) {
+	b.scheduler = scheduler
+}
+
+// schedule hands a task with ETA in the future to the scheduler set with
+// SetScheduler, or to native if none is set. It returns false if there is no
+// scheduler or the task is due so the broker publishes the task itself
+func (b *Broker) schedule(signature *tasks.Signature, native Scheduler) (bool, error) {
+	scheduler := b.scheduler
+	if scheduler == nil {
+		scheduler = native
+	}
+	if scheduler == nil || b.etaDelay(signature) <= 0 {
+		return false, nil
+	}
+	if err := scheduler.Schedule(signature, *signature.ETA); err != nil {
+		return true, fmt.Errorf("Schedule error: %s", err)
+	}
+	return true, nil
+}
+
+// prepareTransaction prepares members of a transaction the way a single task
+// is prepared for publishing: routing keys are adjusted and tasks with ETA in
+// the future are handed to the scheduler if one is set. Members left to be
+// written in the transaction are returned, natively delayed ones included,
+// scheduled ones can't be taken back if the transaction fails
+func (b *Broker) prepareTransaction(signatures []*tasks.Signature) ([]*tasks.Signature, error) {
+	pending := make([]*tasks.Signature, 0, len(signatures))
+	for _, signature := range signatures {
+		b.AdjustRoutingKey(signature)
+		if scheduled, err := b.schedule(signature, nil); scheduled {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		pending = append(pending, signature)
+	}
+	return pending, nil
+}
+
+// observeBatch reports the latency of a batch or transaction to the publish
+// observer for each of its members, members of a batch which were delivered
+// are reported as such even if others were not
+func (b *Broker) observeBatch(signatures []*tasks.Signature, duration time.Duration, err error) {
+	batchErr, partial := err.(*BatchPublishError)
+	for _, signature := range signatures {
+		if partial && !batchErr.failed(signature) {
+			b.observePublish(signature, duration, nil)
+			continue
+		}
+		b.observePublish(signature, duration, err)
+	}
+}
+
+// dispatchDue publishes tasks the scheduler reports due, a task which fails
+// to be published is scheduled again to be retried with the next poll. Tasks
+// which can't be scheduled again either are kept in memory and retried first
+// with the next dispatch, the poll handed them out only once
+func (b *Broker) dispatchDue(publish func(signature *tasks.Signature) error) error {
+	signatures := b.undispatched.take()
+
+	var firstErr error
+	polled, err := b.scheduler.Poll()
+	if err != nil {
+		firstErr = fmt.Errorf("Scheduler poll error: %s", err)
+	}
+	signatures = append(signatures, polled...)
+
+	for _, signature := range signatures {
+		eta := signature.ETA
+		signature.ETA = nil // due, so not scheduled again
+		if err := publish(signature); err != nil {
+			log.WARNING.Printf("Publish scheduled task %s error: %s", signature.UUID, err)
+			signature.ETA = eta
+			if err := b.scheduler.Schedule(signature, b.clock.Now()); err != nil {
+				b.undispatched.add(signature)
+				if firstErr == nil {
+					firstErr = fmt.Errorf("Schedule error: %s", err)
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// runScheduler dispatches due tasks every schedulerPollInterval until
+// stopChan is closed
+func (b *Broker) runScheduler(publish func(signature *tasks.Signature) error, stopChan <-chan struct{}) {
+	for {
+		select {
+		case <-b.clock.After(schedulerPollInterval):
+		case <-stopChan:
+			return
+		}
+		if err := b.dispatchDue(publish); err != nil {
+			log.WARNING.Print(err)
+		}
+	}
+}
+
+// SetClock sets the clock ETAs and back offs are measured with
+func (b *Broker) SetClock(clock clock.Clock) {
+	b.clock = clock
+}
+
+// etaDelay returns how long until the task's ETA, 0 if the task has no ETA
+// or it has passed
+func (b *Broker) etaDelay(signature *tasks.Signature) time.Duration {
+	if signature.ETA == nil {
+		return 0
+	}
+	if delay := signature.ETA.Sub(b.clock.Now()); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// newWorkerPool creates the pool running consumed tasks, warming it up
+// if configured
+func (b *Broker) newWorkerPool(concurrency int) *WorkerPool {
+	pool := NewWorkerPool(concurrency, b.workerPoolHooks)
+	pool.WarmUp(time.Duration(b.cnf.WarmupDuration) * time.Second)
+	return pool
+}
+
 // GetPendingTasks returns a slice of task.Signatures waiting in the queue
 func (b *Broker) GetPendingTasks(queue string) ([]*tasks.Signature, error) {
 	return nil, errors.New("Not implemented")
 }
 
+// acceptsTask returns false if the task processor filters out the task
+func acceptsTask(taskProcessor TaskProcessor, signature *tasks.Signature) bool {
+	acceptor, ok := taskProcessor.(TaskAcceptor)
+	if !ok {
+		return true
+	}
+	return acceptor.AcceptsTask(signature)
+}
+
+var (
+	// requeueThreshold is how many consecutive requeued deliveries, e.g.
+	// of unregistered tasks, make the broker back off
+	requeueThreshold = 10
+	// requeueBackoffStep is the first back off, it doubles with each
+	// further requeueThreshold deliveries requeued
+	requeueBackoffStep = 100 * time.Millisecond
+	// requeueMaxBackoff caps the back off
+	requeueMaxBackoff = 5 * time.Second
+	// inFlightPollInterval is how often a shutdown report checks whether
+	// tasks in flight have finished
+	inFlightPollInterval = 10 * time.Millisecond
+	// schedulerPollInterval is how often consumers poll the scheduler for
+	// due tasks
+	schedulerPollInterval = time.Second
+)
+
+// ShutdownReport summarizes the outcome of stopping to consume tasks
+type ShutdownReport struct {
+	// Completed is how many tasks were processed since consuming started
+	Completed int
+	// Interrupted is how many tasks were still being processed when the
+	// stop timeout elapsed
+	Interrupted int
+	// InFlightUUIDs are UUIDs of the interrupted tasks
+	InFlightUUIDs []string
+}
+
+// undispatchedTasks holds due tasks which could neither be published nor
+// handed back to the scheduler
+type undispatchedTasks struct {
+	mu         sync.Mutex
+	signatures []*tasks.Signature
+}
+
+// add keeps a task to be dispatched with the next poll
+func (u *undispatchedTasks) add(signature *tasks.Signature) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.signatures = append(u.signatures, signature)
+}
+
+// take returns the kept tasks and forgets them
+func (u *undispatchedTasks) take() []*tasks.Signature {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	signatures := u.signatures
+	u.signatures = nil
+	return signatures
+}
+
+// inFlightTasks tracks tasks being processed so a shutdown report can list
+// the ones which did not finish in time
+type inFlightTasks struct {
+	mu        sync.Mutex
+	uuids     map[string]int
+	completed int
+}
+
+// started records a task the processing of which started
+func (f *inFlightTasks) started(signature *tasks.Signature) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uuids[signature.UUID]++
+}
+
+// finished records a task the processing of which finished
+func (f *inFlightTasks) finished(signature *tasks.Signature) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.uuids[signature.UUID]--; f.uuids[signature.UUID] <= 0 {
+		delete(f.uuids, signature.UUID)
+	}
+	f.completed++
+}
+
+// count returns the number of tasks being processed
+func (f *inFlightTasks) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, started := range f.uuids {
+		n += started
+	}
+	return n
+}
+
+// completedCount returns the number of tasks completed since the last reset
+func (f *inFlightTasks) completedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.completed
+}
+
+// reset clears the count of completed tasks
+func (f *inFlightTasks) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completed = 0
+}
+
+// report waits up to the timeout for tasks in flight to finish and reports
+// the ones which did not
+func (f *inFlightTasks) report(clock clock.Clock, timeout time.Duration) *ShutdownReport {
+	deadline := clock.Now().Add(timeout)
+	for {
+		f.mu.Lock()
+		if len(f.uuids) == 0 || !clock.Now().Before(deadline) {
+			report := &ShutdownReport{Completed: f.completed}
+			for uuid, count := range f.uuids {
+				report.Interrupted += count
+				report.InFlightUUIDs = append(report.InFlightUUIDs, uuid)
+			}
+			f.mu.Unlock()
+
+			sort.Strings(report.InFlightUUIDs)
+			return report
+		}
+		f.mu.Unlock()
+
+		<-clock.After(inFlightPollInterval)
+	}
+}
+
+// requeueBackoff counts consecutive deliveries requeued without being
+// processed, so a queue full of tasks the worker can't take is not received
+// and requeued in a tight loop
+type requeueBackoff struct {
+	mu          sync.Mutex
+	consecutive int
+}
+
+// requeued records a requeued delivery and returns how many were requeued
+// in a row
+func (r *requeueBackoff) requeued() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.consecutive++
+	return r.consecutive
+}
+
+// reset is called once a delivery is processed
+func (r *requeueBackoff) reset() {
+	r.mu.Lock()
+	r.consecutive = 0
+	r.mu.Unlock()
+}
+
+// backoff returns how long to wait before pulling the next delivery
+func (r *requeueBackoff) backoff() time.Duration {
+	r.mu.Lock()
+	steps := r.consecutive / requeueThreshold
+	r.mu.Unlock()
+
+	if steps == 0 {
+		return 0
+	}
+
+	backoff := requeueBackoffStep
+	for i := 1; i < steps && backoff < requeueMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > requeueMaxBackoff {
+		backoff = requeueMaxBackoff
+	}
+	return backoff
+}
+
+// wait blocks for the back off, it returns false if the broker is stopped
+// in the meantime
+func (r *requeueBackoff) wait(clock clock.Clock, stopChan <-chan int) bool {
+	backoff := r.backoff()
+	if backoff == 0 {
+		return true
+	}
+
+	select {
+	case <-clock.After(backoff):
+		return true
+	case <-stopChan:
+		return false
+	}
+}
+
+// unregisteredTasks counts consecutive deliveries of tasks not registered
+// with the worker, which are requeued for other workers
+type unregisteredTasks struct {
+	requeueBackoff
+}
+
+// received records a delivery of an unregistered task, only the first one
+// and each time the back off grows are logged
+func (u *unregisteredTasks) received(signature *tasks.Signature) {
+	consecutive := u.requeued()
+	if consecutive == 1 {
+		log.WARNING.Printf("Task %s is not registered, requeueing it for other workers", signature.Name)
+		return
+	}
+
+	if consecutive%requeueThreshold == 0 && isPowerOfTwo(consecutive/requeueThreshold) {
+		log.WARNING.Printf("Received %d consecutive unregistered tasks, backing off for %s", consecutive, u.backoff())
+	}
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// closedChan is returned by resumed when consumption is not paused
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// resumed returns a channel closed once the task processor allows pulling
+// new tasks again
+func resumed(taskProcessor TaskProcessor) <-chan struct{} {
+	if pausable, ok := taskProcessor.(PausableTaskProcessor); ok {
+		return pausable.Resumed()
+	}
+	return closedChan
+}
+
+// taskLimit returns how many tasks the task processor consumes before
+// consuming stops, 0 means no limit
+func taskLimit(taskProcessor TaskProcessor) int {
+	if limited, ok := taskProcessor.(LimitedTaskProcessor); ok {
+		return limited.TaskLimit()
+	}
+	return 0
+}
+
+// taskCounter counts tasks towards the task limit of a task processor. Tasks
+// count once they completed, so deliveries which end up requeued don't, and
+// no more deliveries are taken than may be needed to reach the limit
+type taskCounter struct {
+	limit    int
+	inFlight *inFlightTasks
+	start    int
+	mu       sync.Mutex
+	taken    int
+	changed  chan struct{}
+}
+
+// newTaskCounter returns a counter for the task limit of the task processor,
+// nil if it has none
+func (b *Broker) newTaskCounter(taskProcessor TaskProcessor) *taskCounter {
+	limit := taskLimit(taskProcessor)
+	if limit <= 0 {
+		return nil
+	}
+	return &taskCounter{
+		limit:    limit,
+		inFlight: b.inFlight,
+		start:    b.inFlight.completedCount(),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// wait blocks while the deliveries being consumed may be enough to reach the
+// limit, it returns false once the limit is reached or stopChan is notified
+func (c *taskCounter) wait(stopChan <-chan int) bool {
+	if c == nil {
+		return true
+	}
+	for {
+		// Taken deliveries are read first, a delivery is done being
+		// consumed only after its task completed
+		c.mu.Lock()
+		taken := c.taken
+		c.mu.Unlock()
+		completed := c.completed()
+
+		if completed >= c.limit {
+			return false
+		}
+		if completed+taken < c.limit {
+			return true
+		}
+
+		select {
+		case <-c.changed:
+		case <-stopChan:
+			return false
+		}
+	}
+}
+
+// reached returns true once limit tasks completed
+func (c *taskCounter) reached() bool {
+	return c != nil && c.completed() >= c.limit
+}
+
+// completed returns the number of tasks completed since the counter was
+// created
+func (c *taskCounter) completed() int {
+	return c.inFlight.completedCount() - c.start
+}
+
+// take counts a delivery taken to be consumed
+func (c *taskCounter) take() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.taken++
+	c.mu.Unlock()
+}
+
+// done counts a taken delivery which was consumed, whether its task was
+// processed or it was requeued
+func (c *taskCounter) done() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.taken--
+	c.mu.Unlock()
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
 // AdjustRoutingKey makes sure the routing key is correct.
 // If the routing key is an empty string:
 // a) set it to binding key for direct exchange type
 // b) set it to default queue name
+// Tasks with a partition key are routed to the partition of the key then,
+// workers of a partition route tasks by the queue names shared by all of them
 func (b *Broker) AdjustRoutingKey(s *tasks.Signature) {
 	if s.RoutingKey != "" {
 		return
 	}
 
-	if b.cnf.AMQP != nil && b.cnf.AMQP.ExchangeType == "direct" {
+	cnf := b.cnf.Unpartitioned()
+	if cnf.AMQP != nil && cnf.AMQP.ExchangeType == "direct" {
 		// The routing algorithm behind a direct exchange is simple - a message goes
 		// to the queues whose binding key exactly matches the routing key of the message.
-		s.RoutingKey = b.cnf.AMQP.BindingKey
-		return
+		s.RoutingKey = cnf.AMQP.BindingKey
+	} else {
+		s.RoutingKey = cnf.DefaultQueue
 	}
 
-	s.RoutingKey = b.cnf.DefaultQueue
+	if s.PartitionKey != "" && cnf.Partitions > 0 {
+		s.RoutingKey = config.PartitionName(s.RoutingKey, Partition(s.PartitionKey, cnf.Partitions))
+	}
+}
+
+// Partition maps the partition key to one of the partitions by jump
+// consistent hashing, so when the number of partitions changes only the keys
+// of the added or removed partitions move
+func Partition(key string, partitions int) int {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	h := hash.Sum64()
+
+	var b, j int64 = -1, 0
+	for j < int64(partitions) {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((h>>33)+1)))
+	}
+	return int(b)
+}
+
+// queueName prepends QueuePrefix to the queue name
+func (b *Broker) queueName(name string) string {
+	return b.cnf.QueuePrefix + name
 }
 
 // startConsuming is a common part of StartConsuming method
@@ -70,7 +713,9 @@ func (b *Broker) startConsuming(consumerTag string, taskProcessor TaskProcessor)
 	}
 
 	b.stopChan = make(chan int)
+	b.stopOnce = new(sync.Once)
 	b.retryStopChan = make(chan int)
+	b.inFlight.reset()
 }
 
 // startConsuming is a common part of StopConsuming
@@ -83,6 +728,100 @@ func (b *Broker) stopConsuming() {
 		log.WARNING.Print("Stopping retry closue.")
 	default:
 	}
-	// Notifying the stop channel stops consuming of messages
-	b.stopChan <- 1
+	// Closing the stop channel stops consuming of messages, only once so
+	// stopping a broker which stopped on its own already does not block
+	if b.stopOnce != nil {
+		b.stopOnce.Do(func() { close(b.stopChan) })
+	}
+}
+
+// process processes the task using TaskProcessor keeping track of tasks
+// in flight
+func (b *Broker) process(taskProcessor TaskProcessor, signature *tasks.Signature) error {
+	b.inFlight.started(signature)
+	defer b.inFlight.finished(signature)
+
+	return taskProcessor.Process(signature)
+}
+
+// committingProcessor returns the task processor if the task acknowledges
+// its delivery itself
+func committingProcessor(taskProcessor TaskProcessor, signature *tasks.Signature) (CommittingTaskProcessor, bool) {
+	committer, ok := taskProcessor.(CommittingTaskProcessor)
+	if !ok || !committer.CommitsTask(signature) {
+		return nil, false
+	}
+	return committer, true
+}
+
+// processWithCommit processes a task which acknowledges its delivery itself,
+// ack is called once either when the task commits or after processing
+func (b *Broker) processWithCommit(committer CommittingTaskProcessor, signature *tasks.Signature, ack func()) error {
+	b.inFlight.started(signature)
+	defer b.inFlight.finished(signature)
+
+	var once sync.Once
+	commit := func() { once.Do(ack) }
+	defer commit()
+
+	return committer.ProcessWithCommit(signature, commit)
+}
+
+// decode converts a consumed message body into a signature using the message
+// adapter if one is set. Adapters detecting their format leave other messages,
+// e.g. retries and callbacks sent by machinery itself, to the native decoding
+func (b *Broker) decode(data []byte, headers map[string]interface{}) (*tasks.Signature, error) {
+	var signature *tasks.Signature
+	var err error
+	switch adapter := b.messageAdapter.(type) {
+	case nil:
+		signature, err = decodeSignature(data)
+	case MessageFormatDetector:
+		if !adapter.Detect(data, headers) {
+			signature, err = decodeSignature(data)
+		} else if headerAdapter, ok := adapter.(HeaderMessageAdapter); ok {
+			signature, err = headerAdapter.DecodeWithHeaders(data, headers)
+		} else {
+			signature, err = adapter.Decode(data)
+		}
+	case HeaderMessageAdapter:
+		signature, err = adapter.DecodeWithHeaders(data, headers)
+	default:
+		signature, err = adapter.Decode(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.decryptArgs(signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// decodeSignature unmarshals a message body into a signature, numbers are
+// decoded as json.Number so large integer arguments do not lose precision
+func decodeSignature(data []byte) (*tasks.Signature, error) {
+	signature := new(tasks.Signature)
+	if err := decodeJSON(data, signature); err != nil {
+		return nil, err
+	}
+
+	return signature, nil
+}
+
+// decodeJSON unmarshals data keeping numbers as json.Number
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// originalRoutingKey returns routing key stored in headers of a dead-lettered
+// message or the fallback if the header is missing
+func originalRoutingKey(headers map[string]interface{}, fallback string) string {
+	if routingKey, ok := headers[OriginalRoutingKeyHeader].(string); ok && routingKey != "" {
+		return routingKey
+	}
+	return fallback
 }
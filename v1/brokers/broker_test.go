@@ -1,9 +1,12 @@
 package brokers_test
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/clock"
 	"github.com/koblelabs/machinery/v1/config"
 	"github.com/koblelabs/machinery/v1/tasks"
 	"github.com/stretchr/testify/assert"
@@ -55,3 +58,74 @@ func TestAdjustRoutingKey(t *testing.T) {
 	broker.AdjustRoutingKey(s)
 	assert.Equal(t, "queue", s.RoutingKey)
 }
+
+func TestETADelay(t *testing.T) {
+	fakeClock := clock.NewFake(time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC))
+	broker := brokers.New(new(config.Config))
+	broker.SetClock(fakeClock)
+
+	assert.Equal(t, time.Duration(0), broker.ETADelay(&tasks.Signature{}))
+
+	eta := fakeClock.Now().Add(5 * time.Second)
+	signature := &tasks.Signature{ETA: &eta}
+	assert.Equal(t, 5*time.Second, broker.ETADelay(signature))
+
+	fakeClock.Advance(3 * time.Second)
+	assert.Equal(t, 2*time.Second, broker.ETADelay(signature))
+
+	// Tasks are no longer delayed once their ETA has passed
+	fakeClock.Advance(3 * time.Second)
+	assert.Equal(t, time.Duration(0), broker.ETADelay(signature))
+}
+
+func TestPartitionRouting(t *testing.T) {
+	cnf := &config.Config{
+		DefaultQueue: "queue",
+		Partitions:   8,
+	}
+	broker := brokers.New(cnf)
+
+	keys := []string{"customer_1", "customer_2", "customer_3", "customer_4", "customer_5"}
+	routes := make(map[string]string)
+	partitions := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		for _, key := range keys {
+			s := &tasks.Signature{PartitionKey: key}
+			broker.AdjustRoutingKey(s)
+
+			// All tasks of a key are routed to the same partition
+			if route, ok := routes[key]; ok {
+				assert.Equal(t, route, s.RoutingKey)
+			}
+			routes[key] = s.RoutingKey
+			partitions[s.RoutingKey] = true
+		}
+	}
+	assert.True(t, len(partitions) > 1)
+	for key, route := range routes {
+		assert.Equal(t, config.PartitionName("queue", brokers.Partition(key, 8)), route)
+	}
+
+	// Tasks without a partition key use the default queue
+	s := new(tasks.Signature)
+	broker.AdjustRoutingKey(s)
+	assert.Equal(t, "queue", s.RoutingKey)
+
+	// Workers of a partition route tasks like any other producer
+	partitionBroker := brokers.New(cnf.ForPartition(3))
+	for key, route := range routes {
+		s := &tasks.Signature{PartitionKey: key}
+		partitionBroker.AdjustRoutingKey(s)
+		assert.Equal(t, route, s.RoutingKey)
+	}
+	s = new(tasks.Signature)
+	partitionBroker.AdjustRoutingKey(s)
+	assert.Equal(t, "queue", s.RoutingKey)
+
+	// Adding a partition only moves keys to the new one
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		before, after := brokers.Partition(key, 8), brokers.Partition(key, 9)
+		assert.True(t, before == after || after == 8)
+	}
+}
@@ -0,0 +1,212 @@
+package brokers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+// CeleryMessageAdapter decodes task messages sent by Celery producers so
+// machinery workers can consume tasks from a queue shared with a Celery app.
+// Version 1 message bodies, version 2 messages with meta data in AMQP headers
+// and kombu envelopes (used by Redis transport) carrying version 1 or
+// version 2 bodies are supported. Messages sent by machinery are left to the
+// native decoding.
+type CeleryMessageAdapter struct{}
+
+// celeryEnvelope is the kombu message envelope
+type celeryEnvelope struct {
+	Body       string             `json:"body"`
+	Headers    celeryMessage      `json:"headers"`
+	Properties celeryMessageProps `json:"properties"`
+}
+
+type celeryMessageProps struct {
+	BodyEncoding string `json:"body_encoding"`
+}
+
+// celeryMessage holds task meta data, it is the whole body in protocol
+// version 1 and message headers in protocol version 2
+type celeryMessage struct {
+	Task   string                 `json:"task"`
+	ID     string                 `json:"id"`
+	Args   []interface{}          `json:"args"`
+	Kwargs map[string]interface{} `json:"kwargs"`
+	ETA    *string                `json:"eta"`
+	// Retries is how many times Celery retried the task so far, it is passed
+	// to the task in the retries header
+	Retries int `json:"retries"`
+}
+
+// NewCeleryMessageAdapter creates new CeleryMessageAdapter instance
+func NewCeleryMessageAdapter() MessageAdapter {
+	return new(CeleryMessageAdapter)
+}
+
+// Detect reports whether the message was sent by a Celery producer. Protocol
+// version 2 messages name the task in the task header, version 1 bodies and
+// kombu envelopes have lowercase keys unlike machinery messages
+func (a *CeleryMessageAdapter) Detect(body []byte, headers map[string]interface{}) bool {
+	if _, ok := headers["task"]; ok {
+		return true
+	}
+
+	var raw map[string]json.RawMessage
+	if err := decodeJSON(body, &raw); err != nil {
+		return false
+	}
+	_, task := raw["task"]
+	_, envelope := raw["body"]
+	return task || envelope
+}
+
+// DecodeWithHeaders converts a Celery task message into a signature, task
+// meta data of protocol version 2 messages is read from the headers
+func (a *CeleryMessageAdapter) DecodeWithHeaders(body []byte, headers map[string]interface{}) (*tasks.Signature, error) {
+	if _, ok := headers["task"]; !ok {
+		return a.Decode(body)
+	}
+
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return nil, fmt.Errorf("Celery headers encode error: %s", err)
+	}
+	msg := new(celeryMessage)
+	if err := decodeJSON(encoded, msg); err != nil {
+		return nil, fmt.Errorf("Celery headers decode error: %s", err)
+	}
+	return msg.decodeBody(body)
+}
+
+// Decode converts a Celery task message into a signature
+func (a *CeleryMessageAdapter) Decode(body []byte) (*tasks.Signature, error) {
+	var raw map[string]json.RawMessage
+	if err := decodeJSON(body, &raw); err != nil {
+		return nil, fmt.Errorf("Celery message decode error: %s", err)
+	}
+
+	// Plain protocol version 1 message body
+	if _, ok := raw["body"]; !ok {
+		msg := new(celeryMessage)
+		if err := decodeJSON(body, msg); err != nil {
+			return nil, fmt.Errorf("Celery message decode error: %s", err)
+		}
+		return msg.signature()
+	}
+
+	envelope := new(celeryEnvelope)
+	if err := decodeJSON(body, envelope); err != nil {
+		return nil, fmt.Errorf("Celery envelope decode error: %s", err)
+	}
+
+	payload := []byte(envelope.Body)
+	if envelope.Properties.BodyEncoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(envelope.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Celery body decode error: %s", err)
+		}
+		payload = decoded
+	}
+
+	// Protocol version 2 body is a [args, kwargs, embed] tuple while task
+	// name, ID and the rest of meta data is sent in headers
+	if envelope.Headers.Task != "" {
+		return envelope.Headers.decodeBody(payload)
+	}
+
+	msg := new(celeryMessage)
+	if err := decodeJSON(payload, msg); err != nil {
+		return nil, fmt.Errorf("Celery message decode error: %s", err)
+	}
+	return msg.signature()
+}
+
+// decodeBody decodes a protocol version 2 body, an [args, kwargs, embed]
+// tuple, into a signature of the task described by the headers
+func (msg celeryMessage) decodeBody(payload []byte) (*tasks.Signature, error) {
+	var tuple []json.RawMessage
+	if err := decodeJSON(payload, &tuple); err != nil {
+		return nil, fmt.Errorf("Celery body decode error: %s", err)
+	}
+	if len(tuple) < 2 {
+		return nil, errors.New("Celery body must contain args and kwargs")
+	}
+
+	if err := decodeJSON(tuple[0], &msg.Args); err != nil {
+		return nil, fmt.Errorf("Celery args decode error: %s", err)
+	}
+	if err := decodeJSON(tuple[1], &msg.Kwargs); err != nil {
+		return nil, fmt.Errorf("Celery kwargs decode error: %s", err)
+	}
+	return msg.signature()
+}
+
+// signature converts Celery task meta data into a signature
+func (msg *celeryMessage) signature() (*tasks.Signature, error) {
+	if msg.Task == "" {
+		return nil, errors.New("Celery message is missing task name")
+	}
+
+	if len(msg.Kwargs) > 0 {
+		return nil, errors.New("Celery keyword arguments are not supported")
+	}
+
+	args := make([]tasks.Arg, len(msg.Args))
+	for i, value := range msg.Args {
+		arg, err := celeryArg(value)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = arg
+	}
+
+	signature := &tasks.Signature{
+		UUID: msg.ID,
+		Name: msg.Task,
+		Args: args,
+	}
+	if msg.Retries > 0 {
+		signature.Headers = tasks.Headers{"retries": msg.Retries}
+	}
+
+	if msg.ETA != nil {
+		eta, err := parseCeleryTime(*msg.ETA)
+		if err != nil {
+			return nil, fmt.Errorf("Celery ETA parse error: %s", err)
+		}
+		signature.ETA = &eta
+	}
+
+	return signature, nil
+}
+
+// celeryArg infers machinery argument type from a decoded JSON value
+func celeryArg(value interface{}) (tasks.Arg, error) {
+	switch v := value.(type) {
+	case bool:
+		return tasks.Arg{Type: "bool", Value: v}, nil
+	case string:
+		return tasks.Arg{Type: "string", Value: v}, nil
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return tasks.Arg{Type: "int64", Value: v}, nil
+		}
+		return tasks.Arg{Type: "float64", Value: v}, nil
+	}
+	return tasks.Arg{}, fmt.Errorf("Celery argument %v is not one of supported types", value)
+}
+
+// parseCeleryTime parses ISO 8601 timestamps produced by Python's isoformat
+func parseCeleryTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err == nil {
+		return t, nil
+	}
+
+	// Naive timestamps without a timezone are treated as UTC
+	return time.Parse("2006-01-02T15:04:05.999999999", value)
+}
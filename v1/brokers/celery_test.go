@@ -0,0 +1,157 @@
+package brokers_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCeleryMessageAdapterProtocol1(t *testing.T) {
+	body := []byte(`{
+		"task": "tasks.add",
+		"id": "dc4ba8a4-d8d4-4f2d-a5b8-2fb1c8f1d6b0",
+		"args": [2, 3.5, "foo", true],
+		"kwargs": {},
+		"retries": 0,
+		"eta": "2017-08-01T12:00:00.000000+00:00"
+	}`)
+
+	signature, err := brokers.NewCeleryMessageAdapter().Decode(body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tasks.add", signature.Name)
+		assert.Equal(t, "dc4ba8a4-d8d4-4f2d-a5b8-2fb1c8f1d6b0", signature.UUID)
+		assert.Equal(t, []tasks.Arg{
+			{Type: "int64", Value: json.Number("2")},
+			{Type: "float64", Value: json.Number("3.5")},
+			{Type: "string", Value: "foo"},
+			{Type: "bool", Value: true},
+		}, signature.Args)
+		if assert.NotNil(t, signature.ETA) {
+			assert.True(t, signature.ETA.Equal(time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)))
+		}
+	}
+
+	for _, arg := range signature.Args {
+		_, err := tasks.ReflectValue(arg.Type, arg.Value)
+		assert.NoError(t, err)
+	}
+}
+
+func TestCeleryMessageAdapterProtocol2(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte(`[[1, 2], {}, {"callbacks": null}]`))
+	body := []byte(fmt.Sprintf(`{
+		"body": "%s",
+		"content-encoding": "utf-8",
+		"content-type": "application/json",
+		"headers": {
+			"lang": "py",
+			"task": "tasks.add",
+			"id": "a0e4d5f1-3b1c-4c77-a0f0-5f0a4a1ee5d6",
+			"eta": null,
+			"retries": 0
+		},
+		"properties": {
+			"body_encoding": "base64",
+			"delivery_tag": "5c8b4d0e-0a56-4c1f-8c1b-2d0d0e4b0e39"
+		}
+	}`, payload))
+
+	signature, err := brokers.NewCeleryMessageAdapter().Decode(body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tasks.add", signature.Name)
+		assert.Equal(t, "a0e4d5f1-3b1c-4c77-a0f0-5f0a4a1ee5d6", signature.UUID)
+		assert.Equal(t, []tasks.Arg{
+			{Type: "int64", Value: json.Number("1")},
+			{Type: "int64", Value: json.Number("2")},
+		}, signature.Args)
+		assert.Nil(t, signature.ETA)
+	}
+}
+
+func TestCeleryMessageAdapterAMQPHeaders(t *testing.T) {
+	adapter := brokers.NewCeleryMessageAdapter().(*brokers.CeleryMessageAdapter)
+
+	// Protocol version 2 over AMQP sends task meta data in message headers
+	headers := amqp.Table{
+		"lang":    "py",
+		"task":    "tasks.add",
+		"id":      "a0e4d5f1-3b1c-4c77-a0f0-5f0a4a1ee5d6",
+		"eta":     "2017-08-01T12:00:00.000000+00:00",
+		"retries": int64(2),
+	}
+	body := []byte(`[[1, 2], {}, {"callbacks": null}]`)
+	assert.True(t, adapter.Detect(body, headers))
+
+	signature, err := adapter.DecodeWithHeaders(body, headers)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tasks.add", signature.Name)
+		assert.Equal(t, "a0e4d5f1-3b1c-4c77-a0f0-5f0a4a1ee5d6", signature.UUID)
+		assert.Len(t, signature.Args, 2)
+		if assert.NotNil(t, signature.ETA) {
+			assert.True(t, signature.ETA.Equal(time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)))
+		}
+		assert.Equal(t, tasks.Headers{"retries": 2}, signature.Headers)
+	}
+
+	// Machinery messages are left to the native decoding
+	assert.False(t, adapter.Detect([]byte(`{"UUID":"task_1","Name":"tasks.add"}`), nil))
+}
+
+func TestCeleryMessageAdapterSharedQueue(t *testing.T) {
+	cnf := &config.Config{
+		DefaultQueue: "queue",
+		OrderedMode:  true,
+		AMQP:         &config.AMQPConfig{ExchangeType: "direct"},
+	}
+	broker := brokers.NewAMQPBroker(cnf).(*brokers.AMQPBroker)
+	broker.SetRegisteredTaskNames([]string{"tasks.add"})
+	broker.SetMessageAdapter(brokers.NewCeleryMessageAdapter())
+
+	// A Celery task and a retry sent by machinery itself on the same queue
+	recorder := &eventRecorder{done: make(chan struct{}, 2)}
+	deliveries := make(chan amqp.Delivery, 2)
+	deliveries <- amqp.Delivery{
+		Acknowledger: recorder,
+		DeliveryTag:  1,
+		Headers:      amqp.Table{"task": "tasks.add", "id": "celery_task"},
+		Body:         []byte(`[[1, 2], {}, {}]`),
+	}
+	deliveries <- amqp.Delivery{
+		Acknowledger: recorder,
+		DeliveryTag:  2,
+		Body:         []byte(`{"UUID":"machinery_task","Name":"tasks.add","RetryCount":2}`),
+	}
+
+	closeChan := make(chan *amqp.Error)
+	done := make(chan error)
+	go func() {
+		done <- broker.Consume(deliveries, 1, recorder, closeChan)
+	}()
+	<-recorder.done
+	<-recorder.done
+	closeChan <- &amqp.Error{Reason: "closed"}
+	assert.Error(t, <-done)
+
+	assert.Equal(t, []string{"process celery_task", "ack 1", "process machinery_task", "ack 2"}, recorder.events)
+}
+
+func TestCeleryMessageAdapterErrors(t *testing.T) {
+	adapter := brokers.NewCeleryMessageAdapter()
+
+	_, err := adapter.Decode([]byte(`{"id": "foo", "args": []}`))
+	assert.EqualError(t, err, "Celery message is missing task name")
+
+	_, err = adapter.Decode([]byte(`{"task": "foo", "args": [], "kwargs": {"x": 1}}`))
+	assert.EqualError(t, err, "Celery keyword arguments are not supported")
+
+	_, err = adapter.Decode([]byte(`{"task": "foo", "args": [[1, 2]]}`))
+	assert.Error(t, err)
+}
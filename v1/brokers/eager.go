@@ -24,6 +24,11 @@ type EagerMode interface {
 	AssignWorker(p TaskProcessor)
 }
 
+// Type returns the broker type
+func (eagerBroker *EagerBroker) Type() string {
+	return TypeEager
+}
+
 // StartConsuming enters a loop and waits for incoming messages
 func (eagerBroker *EagerBroker) StartConsuming(consumerTag string, concurrency int, p TaskProcessor) (bool, error) {
 	return true, nil
@@ -47,8 +52,7 @@ func (eagerBroker *EagerBroker) Publish(task *tasks.Signature) error {
 		return fmt.Errorf("JSON marshal error: %s", err)
 	}
 
-	signature := new(tasks.Signature)
-	err = json.Unmarshal(message, &signature)
+	signature, err := decodeSignature(message)
 	if err != nil {
 		return fmt.Errorf("JSON unmarshal error: %s", err)
 	}
@@ -57,6 +61,12 @@ func (eagerBroker *EagerBroker) Publish(task *tasks.Signature) error {
 	return eagerBroker.worker.Process(signature)
 }
 
+// DeliversImmediately returns true, tasks are processed when published
+// regardless of their ETA
+func (eagerBroker *EagerBroker) DeliversImmediately() bool {
+	return true
+}
+
 // GetPendingTasks returns a slice of task.Signatures waiting in the queue
 func (eagerBroker *EagerBroker) GetPendingTasks(queue string) ([]*tasks.Signature, error) {
 	return []*tasks.Signature{}, errors.New("Not implemented")
@@ -0,0 +1,188 @@
+package brokers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+// encode marshals a signature into a message body, values of args flagged as
+// encrypted (including args of callbacks) are replaced with their ciphertext.
+// The signature's headers are stamped with the MessageVersion first
+func (b *Broker) encode(signature *tasks.Signature) ([]byte, error) {
+	b.stampVersion(signature)
+	if !hasEncryptedArgs(signature) {
+		return json.Marshal(signature)
+	}
+
+	aead, err := b.argCipher()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptArgs(aead, signature)
+	if err != nil {
+		return nil, fmt.Errorf("Encrypt args error: %s", err)
+	}
+	return json.Marshal(encrypted)
+}
+
+// decryptArgs replaces ciphertext of args flagged as encrypted (including args
+// of callbacks) with their values, the flag is kept so the args are encrypted
+// again when the task is republished
+func (b *Broker) decryptArgs(signature *tasks.Signature) error {
+	if !hasEncryptedArgs(signature) {
+		return nil
+	}
+
+	aead, err := b.argCipher()
+	if err != nil {
+		return err
+	}
+	if err := decryptArgs(aead, signature); err != nil {
+		return fmt.Errorf("Decrypt args error: %s", err)
+	}
+	return nil
+}
+
+// argCipher returns the AES-GCM cipher args are encrypted with
+func (b *Broker) argCipher() (cipher.AEAD, error) {
+	if b.cnf == nil || b.cnf.ArgEncryptionKey == "" {
+		return nil, errors.New("Arg encryption key not configured")
+	}
+
+	key, err := hex.DecodeString(b.cnf.ArgEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Arg encryption key error: %s", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Arg encryption key error: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// hasEncryptedArgs returns true if any arg of the task or its callbacks is
+// flagged as encrypted
+func hasEncryptedArgs(signature *tasks.Signature) bool {
+	if signature == nil {
+		return false
+	}
+	for _, arg := range signature.Args {
+		if arg.Encrypted {
+			return true
+		}
+	}
+	for _, callback := range callbacks(signature) {
+		if hasEncryptedArgs(callback) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptArgs returns a copy of the signature with values of args flagged as
+// encrypted replaced with their base64 encoded ciphertext
+func encryptArgs(aead cipher.AEAD, signature *tasks.Signature) (*tasks.Signature, error) {
+	encrypted := *signature
+
+	encrypted.Args = make([]tasks.Arg, len(signature.Args))
+	for i, arg := range signature.Args {
+		if arg.Encrypted {
+			plaintext, err := json.Marshal(arg.Value)
+			if err != nil {
+				return nil, err
+			}
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			arg.Value = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil))
+		}
+		encrypted.Args[i] = arg
+	}
+
+	var err error
+	if encrypted.OnSuccess, err = encryptCallbackArgs(aead, signature.OnSuccess); err != nil {
+		return nil, err
+	}
+	if encrypted.OnError, err = encryptCallbackArgs(aead, signature.OnError); err != nil {
+		return nil, err
+	}
+	if signature.ChordCallback != nil {
+		if encrypted.ChordCallback, err = encryptArgs(aead, signature.ChordCallback); err != nil {
+			return nil, err
+		}
+	}
+	return &encrypted, nil
+}
+
+// encryptCallbackArgs encrypts args of callbacks
+func encryptCallbackArgs(aead cipher.AEAD, signatures []*tasks.Signature) ([]*tasks.Signature, error) {
+	if signatures == nil {
+		return nil, nil
+	}
+
+	encrypted := make([]*tasks.Signature, len(signatures))
+	for i, signature := range signatures {
+		var err error
+		if encrypted[i], err = encryptArgs(aead, signature); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// decryptArgs decrypts values of args flagged as encrypted in place
+func decryptArgs(aead cipher.AEAD, signature *tasks.Signature) error {
+	for i, arg := range signature.Args {
+		if !arg.Encrypted {
+			continue
+		}
+
+		encoded, ok := arg.Value.(string)
+		if !ok {
+			return fmt.Errorf("Encrypted arg %d is not a string", i)
+		}
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return fmt.Errorf("Encrypted arg %d is too short", i)
+		}
+		plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+		if err != nil {
+			return err
+		}
+
+		var value interface{}
+		if err := decodeJSON(plaintext, &value); err != nil {
+			return err
+		}
+		signature.Args[i].Value = value
+	}
+
+	for _, callback := range callbacks(signature) {
+		if err := decryptArgs(aead, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// callbacks returns success and error callbacks and the chord callback of
+// the task
+func callbacks(signature *tasks.Signature) []*tasks.Signature {
+	all := append(append([]*tasks.Signature{}, signature.OnSuccess...), signature.OnError...)
+	if signature.ChordCallback != nil {
+		all = append(all, signature.ChordCallback)
+	}
+	return all
+}
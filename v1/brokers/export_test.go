@@ -0,0 +1,137 @@
+package brokers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/streadway/amqp"
+)
+
+// PublishWithConfirms is exported for tests only
+var PublishWithConfirms = publishWithConfirms
+
+// NewPublishing is exported for tests only
+func (b *AMQPBroker) NewPublishing(signature *tasks.Signature, message []byte) amqp.Publishing {
+	return b.newPublishing(signature, message)
+}
+
+// WaitForConfirm is exported for tests only
+var WaitForConfirm = waitForConfirm
+
+// PublishInTransaction is exported for tests only
+var PublishInTransaction = publishInTransaction
+
+// RedeliveryCount is exported for tests only
+var RedeliveryCount = redeliveryCount
+
+// SetRepublish is exported for tests only
+func (b *AMQPBroker) SetRepublish(republish func(d amqp.Delivery, headers amqp.Table) error) {
+	b.republish = republish
+}
+
+// SetPublishDeadLetter is exported for tests only
+func (b *AMQPBroker) SetPublishDeadLetter(publish func(d amqp.Delivery, headers amqp.Table) error) {
+	b.publishDeadLetter = publish
+}
+
+// PurgeQueueOn is exported for tests only
+func (b *AMQPBroker) PurgeQueueOn(channel amqpQueueDeleter, queueName string) (int, error) {
+	return b.purgeQueue(channel, queueName)
+}
+
+// ReprocessDeadLetterFrom is exported for tests only
+func (b *AMQPBroker) ReprocessDeadLetterFrom(channel amqpGetPublisher, confirmsChan <-chan amqp.Confirmation, dlqName string, limit int) (int, error) {
+	return b.reprocessDeadLetter(channel, confirmsChan, dlqName, limit)
+}
+
+// StartDeliveries is exported for tests only
+func (b *AMQPBroker) StartDeliveries(channel amqpConsumer, queueName, consumerTag string) (<-chan amqp.Delivery, error) {
+	return b.startDeliveries(channel, queueName, consumerTag)
+}
+
+// Consume is exported for tests only
+func (b *AMQPBroker) Consume(deliveries <-chan amqp.Delivery, concurrency int, taskProcessor TaskProcessor, amqpCloseChan <-chan *amqp.Error) error {
+	b.stopChan = make(chan int)
+	b.stopOnce = new(sync.Once)
+	return b.consume(deliveries, concurrency, taskProcessor, amqpCloseChan)
+}
+
+// NewPrefetchAdapter is exported for tests only
+func NewPrefetchAdapter(channel amqpQoS, concurrency, prefetch, reduced int, period time.Duration) func(inFlight int, now time.Time) error {
+	adapter := &prefetchAdapter{
+		channel:     channel,
+		concurrency: concurrency,
+		prefetch:    prefetch,
+		reduced:     reduced,
+		period:      period,
+	}
+	return adapter.observe
+}
+
+// DispatchDue is exported for tests only
+func (b *Broker) DispatchDue(publish func(signature *tasks.Signature) error) error {
+	return b.dispatchDue(publish)
+}
+
+// CheckConsumers is exported for tests only
+func (b *AMQPBroker) CheckConsumers(queue amqp.Queue) error {
+	return b.checkConsumers(queue)
+}
+
+// Encode is exported for tests only
+func (b *Broker) Encode(signature *tasks.Signature) ([]byte, error) {
+	return b.encode(signature)
+}
+
+// ETADelay is exported for tests only
+func (b *Broker) ETADelay(signature *tasks.Signature) time.Duration {
+	return b.etaDelay(signature)
+}
+
+// SetRequeueBackoff is exported for tests only
+func SetRequeueBackoff(step, max time.Duration) func() {
+	prevStep, prevMax := requeueBackoffStep, requeueMaxBackoff
+	requeueBackoffStep, requeueMaxBackoff = step, max
+	return func() {
+		requeueBackoffStep, requeueMaxBackoff = prevStep, prevMax
+	}
+}
+
+// BufferDeliveries is exported for tests only
+var BufferDeliveries = bufferDeliveries
+
+// DeliveryBufferSize is exported for tests only
+func (b *AMQPBroker) DeliveryBufferSize() int {
+	return b.deliveryBufferSize()
+}
+
+// BindExchanges is exported for tests only
+func (b *AMQPBroker) BindExchanges(channel amqpExchangeBinder) error {
+	return b.bindExchanges(channel)
+}
+
+// DelayQueue is exported for tests only
+func (b *AMQPBroker) DelayQueue(signature *tasks.Signature, delayMs int64) (string, amqp.Table) {
+	return b.delayQueue(signature, delayMs)
+}
+
+// SetPool is exported for tests only
+func (b *RedisBroker) SetPool(pool *redis.Pool) {
+	b.pool = pool
+}
+
+// Consume is exported for tests only
+func (b *RedisBroker) Consume(deliveries <-chan []byte, concurrency int, taskProcessor TaskProcessor) error {
+	b.stopChan = make(chan int)
+	b.stopOnce = new(sync.Once)
+	b.stopReceivingChan = make(chan struct{})
+	b.stopReceivingOnce = new(sync.Once)
+	return b.consume(deliveries, concurrency, taskProcessor)
+}
+
+// NextTask is exported for tests only
+func (b *RedisBroker) NextTask(queue string) ([]byte, error) {
+	return b.nextTask(queue)
+}
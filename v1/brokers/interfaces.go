@@ -1,21 +1,193 @@
 package brokers
 
 import (
+	"context"
+	"time"
+
 	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/streadway/amqp"
+)
+
+// Broker types returned by Interface.Type
+const (
+	TypeAMQP  = "amqp"
+	TypeEager = "eager"
+	TypeRedis = "redis"
 )
 
 // Interface - a common interface for all brokers
 type Interface interface {
+	// Type returns a stable identifier of the broker implementation
+	Type() string
 	SetRegisteredTaskNames(names []string)
 	IsTaskRegistered(name string) bool
 	StartConsuming(consumerTag string, concurrency int, p TaskProcessor) (bool, error)
 	StopConsuming()
 	Publish(task *tasks.Signature) error
 	GetPendingTasks(queue string) ([]*tasks.Signature, error)
+	SetMessageAdapter(adapter MessageAdapter)
+}
+
+// MessageAdapter - converts a raw message body into a task signature,
+// useful for consuming messages sent by non-machinery producers
+type MessageAdapter interface {
+	Decode(body []byte) (*tasks.Signature, error)
+}
+
+// HeaderMessageAdapter - a message adapter which reads message headers too,
+// e.g. because the protocol sends task meta data in them
+type HeaderMessageAdapter interface {
+	MessageAdapter
+	DecodeWithHeaders(body []byte, headers map[string]interface{}) (*tasks.Signature, error)
 }
 
+// MessageFormatDetector - a message adapter which tells messages in its own
+// format apart, other messages are decoded as machinery messages so both
+// can share a queue
+type MessageFormatDetector interface {
+	MessageAdapter
+	Detect(body []byte, headers map[string]interface{}) bool
+}
+
+// DeadLetterHandler - called with the raw body of a message which can't be
+// processed, e.g. because it can't be decoded, and the reason why
+type DeadLetterHandler func(body []byte, reason error)
+
+// DeadLetterHandlerSetter - a broker which can hand messages it can't
+// process to a DeadLetterHandler before discarding or dead-lettering them
+type DeadLetterHandlerSetter interface {
+	SetDeadLetterHandler(handler DeadLetterHandler)
+}
+
+// InterceptDecision - what a broker does with a consumed task once it was
+// passed to a ConsumeInterceptor
+type InterceptDecision int
+
+const (
+	// InterceptContinue passes the task to the next interceptor and then
+	// processes it
+	InterceptContinue InterceptDecision = iota
+	// InterceptReject acknowledges the task without processing it
+	InterceptReject
+	// InterceptRequeue puts the task back on the queue
+	InterceptRequeue
+)
+
+// ConsumeInterceptor - called with each consumed task after it was decoded
+// and before it is processed, it may modify the signature (e.g. rewrite
+// arguments) and decides whether the task is processed
+type ConsumeInterceptor func(signature *tasks.Signature) InterceptDecision
+
+// ConsumeInterceptorSetter - a broker which passes consumed tasks through
+// ConsumeInterceptors before processing them
+type ConsumeInterceptorSetter interface {
+	SetConsumeInterceptors(interceptors ...ConsumeInterceptor)
+}
+
+// Scheduler - holds tasks with ETA in the future until they are due instead
+// of the broker's native delay, e.g. in a database table. Poll returns tasks
+// which are due, each of them only once even with many workers polling
+type Scheduler interface {
+	Schedule(signature *tasks.Signature, at time.Time) error
+	Poll() ([]*tasks.Signature, error)
+}
+
+// SchedulerSetter - a broker which can delay tasks with a Scheduler
+type SchedulerSetter interface {
+	SetScheduler(scheduler Scheduler)
+}
+
+// ImmediateDeliverer - a broker which may deliver tasks as soon as they are
+// published regardless of their ETA, e.g. the eager broker. Workers run
+// tasks it delivers before their ETA instead of delaying them again
+type ImmediateDeliverer interface {
+	DeliversImmediately() bool
+}
+
+// PublishObserver - called after each published task with the queue it was
+// published to, how long publishing took (including connecting and waiting
+// for the confirmation) and the error if it failed
+type PublishObserver func(queue string, duration time.Duration, err error)
+
 // TaskProcessor - can process a delivered task
 // This will probably always be a worker instance
 type TaskProcessor interface {
 	Process(signature *tasks.Signature) error
 }
+
+// PausableTaskProcessor - a task processor which can temporarily pause
+// consumption, brokers stop pulling new tasks until the channel is closed
+type PausableTaskProcessor interface {
+	Resumed() <-chan struct{}
+}
+
+// LimitedTaskProcessor - a task processor which consumes a limited number of
+// tasks, brokers stop consuming once TaskLimit tasks were processed (0 means
+// no limit). Requeued deliveries don't count towards the limit
+type LimitedTaskProcessor interface {
+	TaskLimit() int
+}
+
+// TaskAcceptor - a task processor which only accepts some of the delivered
+// tasks, tasks it does not accept are requeued for other workers
+type TaskAcceptor interface {
+	AcceptsTask(signature *tasks.Signature) bool
+}
+
+// CommittingTaskProcessor - a task processor running tasks which acknowledge
+// their delivery themselves, the broker acknowledges such deliveries once
+// commit is called or processing returns, whichever happens first
+type CommittingTaskProcessor interface {
+	CommitsTask(signature *tasks.Signature) bool
+	ProcessWithCommit(signature *tasks.Signature, commit func()) error
+}
+
+// DeadLetterReprocessor - a broker which can move dead-lettered messages back
+// to the queue they were originally routed to
+type DeadLetterReprocessor interface {
+	ReprocessDeadLetter(dlqName string, limit int) (int, error)
+}
+
+// GracefulStopper - a broker which can report tasks left unfinished when it
+// stops consuming
+type GracefulStopper interface {
+	StopConsumingWithTimeout(timeout time.Duration) *ShutdownReport
+}
+
+// RawConnectionProvider - a broker which gives access to a connection to the
+// underlying AMQP server for operations the package does not wrap, e.g.
+// declaring policies. Advanced and unsafe: the connection is opened for the
+// caller, who must close it with the returned func
+type RawConnectionProvider interface {
+	RawConnection() (*amqp.Connection, *amqp.Channel, func() error, error)
+}
+
+// TransactionalPublisher - a broker which can publish multiple tasks so that
+// either all of them are enqueued or none is
+type TransactionalPublisher interface {
+	PublishTransaction(signatures []*tasks.Signature) error
+}
+
+// QueueStatsProvider - a broker which can report how many tasks are waiting
+// in a queue, "" meaning the default queue
+type QueueStatsProvider interface {
+	QueueStats(queue string) (*QueueStats, error)
+}
+
+// QueueStats holds the number of tasks waiting in a queue and the number of
+// consumers draining it (if the broker reports them)
+type QueueStats struct {
+	Messages  int `json:"messages"`
+	Consumers int `json:"consumers"`
+}
+
+// ContextPublisher - a broker which can give up publishing a task once a
+// context is done, e.g. when the deadline of a request expires
+type ContextPublisher interface {
+	PublishWithContext(ctx context.Context, signature *tasks.Signature) error
+}
+
+// BatchPublisher - a broker which can publish multiple tasks at once
+type BatchPublisher interface {
+	PublishBatch(signatures []*tasks.Signature) error
+}
@@ -0,0 +1,205 @@
+package brokers
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/log"
+)
+
+// WorkerPoolHooks are called on lifecycle events of jobs run by a WorkerPool,
+// useful for instrumentation. Any of the hooks can be nil
+type WorkerPoolHooks struct {
+	// OnSubmit is called before a job is handed over to the pool
+	OnSubmit func()
+	// OnStart is called when a pool goroutine starts running a job
+	OnStart func()
+	// OnFinish is called when a job returns or panics
+	OnFinish func(duration time.Duration)
+	// OnPanic is called with the value recovered from a panicking job
+	OnPanic func(recovered interface{})
+}
+
+// WorkerPool runs jobs on a fixed number of pre-spawned goroutines pulling
+// from a job channel. A panicking job is recovered so its goroutine keeps
+// running further jobs. A pool of size 0 runs each job in a new goroutine,
+// i.e. the concurrency is unlimited
+type WorkerPool struct {
+	size  int
+	hooks WorkerPoolHooks
+	jobs  chan func()
+	slots chan struct{}
+	wg    sync.WaitGroup
+	done  chan struct{}
+}
+
+// NewWorkerPool creates a new WorkerPool and spawns its goroutines
+func NewWorkerPool(size int, hooks WorkerPoolHooks) *WorkerPool {
+	pool := &WorkerPool{
+		size:  size,
+		hooks: hooks,
+		jobs:  make(chan func(), size),
+		slots: make(chan struct{}, size),
+		done:  make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+
+			for job := range pool.jobs {
+				pool.run(job)
+				<-pool.slots
+			}
+		}()
+	}
+
+	return pool
+}
+
+// Submit hands the job over to the pool, it blocks until one of the pool
+// goroutines is free to run it
+func (p *WorkerPool) Submit(job func()) {
+	if p.hooks.OnSubmit != nil {
+		p.hooks.OnSubmit()
+	}
+
+	if p.size > 0 {
+		p.slots <- struct{}{}
+		p.jobs <- job
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.run(job)
+	}()
+}
+
+// TrySubmit hands the job over to the pool only if one of the pool
+// goroutines is free to run it right away, it returns false otherwise
+func (p *WorkerPool) TrySubmit(job func()) bool {
+	if p.size == 0 {
+		p.Submit(job)
+		return true
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		if p.hooks.OnSubmit != nil {
+			p.hooks.OnSubmit()
+		}
+		p.jobs <- job
+		return true
+	default:
+		return false
+	}
+}
+
+// WarmUp limits the pool to a single job at a time and grows the limit
+// evenly until it reaches the pool size after duration, so a freshly
+// started worker does not hit cold dependencies with its full concurrency.
+// It has to be called before any job is submitted
+func (p *WorkerPool) WarmUp(duration time.Duration) {
+	if p.size < 2 || duration <= 0 {
+		return
+	}
+
+	// Slots taken up front can't be used by jobs until they are freed
+	reserved := p.size - 1
+	for i := 0; i < reserved; i++ {
+		p.slots <- struct{}{}
+	}
+
+	go func() {
+		ticker := time.NewTicker(duration / time.Duration(reserved))
+		defer ticker.Stop()
+
+		for ; reserved > 0; reserved-- {
+			select {
+			case <-ticker.C:
+				<-p.slots
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for all submitted jobs to finish and stops pool goroutines,
+// no more jobs can be submitted afterwards
+func (p *WorkerPool) Stop() {
+	close(p.done)
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// run runs a single job and recovers from a panic
+func (p *WorkerPool) run(job func()) {
+	start := time.Now()
+	if p.hooks.OnStart != nil {
+		p.hooks.OnStart()
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.ERROR.Printf("Worker pool job panicked: %v\n%s", recovered, debug.Stack())
+
+			if p.hooks.OnPanic != nil {
+				p.hooks.OnPanic(recovered)
+			}
+		}
+
+		if p.hooks.OnFinish != nil {
+			p.hooks.OnFinish(time.Since(start))
+		}
+	}()
+
+	job()
+}
+
+// weightBudget limits the sum of weights of tasks in flight
+type weightBudget struct {
+	mu       sync.Mutex
+	budget   int
+	inFlight int
+	released chan struct{}
+}
+
+func newWeightBudget(budget int) *weightBudget {
+	return &weightBudget{budget: budget, released: make(chan struct{})}
+}
+
+// acquire blocks until the weight fits into the budget, a task heavier than
+// the whole budget is let through once nothing else is in flight. It returns
+// false if stopped while waiting
+func (w *weightBudget) acquire(weight int, stopChan <-chan int) bool {
+	for {
+		w.mu.Lock()
+		if w.inFlight == 0 || w.inFlight+weight <= w.budget {
+			w.inFlight += weight
+			w.mu.Unlock()
+			return true
+		}
+		released := w.released
+		w.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-stopChan:
+			return false
+		}
+	}
+}
+
+// release returns the weight to the budget and wakes up waiting acquires
+func (w *weightBudget) release(weight int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inFlight -= weight
+	close(w.released)
+	w.released = make(chan struct{})
+}
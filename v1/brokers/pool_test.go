@@ -0,0 +1,117 @@
+package brokers_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolRecoversFromPanic(t *testing.T) {
+	var panics, finished int32
+	pool := brokers.NewWorkerPool(1, brokers.WorkerPoolHooks{
+		OnPanic: func(recovered interface{}) {
+			atomic.AddInt32(&panics, 1)
+		},
+		OnFinish: func(duration time.Duration) {
+			atomic.AddInt32(&finished, 1)
+		},
+	})
+
+	pool.Submit(func() {
+		panic("oops")
+	})
+
+	// The only pool goroutine must still be alive to run the next job
+	var ran int32
+	pool.Submit(func() {
+		atomic.StoreInt32(&ran, 1)
+	})
+	pool.Stop()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ran))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&panics))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&finished))
+}
+
+func TestWorkerPoolUnlimited(t *testing.T) {
+	pool := brokers.NewWorkerPool(0, brokers.WorkerPoolHooks{})
+
+	// All jobs have to run at the same time to release each other
+	var wg sync.WaitGroup
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		pool.Submit(func() {
+			wg.Done()
+			wg.Wait()
+		})
+	}
+	pool.Stop()
+}
+
+func TestWorkerPoolWarmUp(t *testing.T) {
+	var running, maxRunning int32
+	pool := brokers.NewWorkerPool(4, brokers.WorkerPoolHooks{})
+	pool.WarmUp(300 * time.Millisecond)
+
+	release, submitted := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(submitted)
+		for i := 0; i < 8; i++ {
+			pool.Submit(func() {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+			})
+		}
+	}()
+
+	<-time.After(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+
+	<-time.After(400 * time.Millisecond)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&running))
+
+	close(release)
+	<-submitted
+	pool.Stop()
+	assert.Equal(t, int32(4), atomic.LoadInt32(&maxRunning))
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	b.ReportAllocs()
+
+	pool := brokers.NewWorkerPool(8, brokers.WorkerPoolHooks{})
+	job := func() {}
+	for i := 0; i < b.N; i++ {
+		pool.Submit(job)
+	}
+	pool.Stop()
+}
+
+// BenchmarkGoroutinePerJob measures spawning a goroutine per job limited by
+// a token pool which WorkerPool replaces
+func BenchmarkGoroutinePerJob(b *testing.B) {
+	b.ReportAllocs()
+
+	tokens := make(chan struct{}, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < b.N; i++ {
+		tokens <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-tokens
+		}()
+	}
+	wg.Wait()
+}
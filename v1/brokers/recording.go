@@ -0,0 +1,63 @@
+package brokers
+
+import (
+	"sync"
+
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+// RecordingBroker wraps a broker and records every task published through
+// it, so tests can assert on tasks a producer sends without a real broker
+// round-trip. Optional interfaces of the wrapped broker are not exposed,
+// except for ImmediateDeliverer
+type RecordingBroker struct {
+	Interface
+	recordOnly bool
+	mu         sync.Mutex
+	published  []*tasks.Signature
+}
+
+// NewRecordingBroker creates a RecordingBroker publishing to the broker, a
+// nil broker only records published tasks
+func NewRecordingBroker(broker Interface) *RecordingBroker {
+	if broker == nil {
+		return &RecordingBroker{Interface: NewEagerBroker(), recordOnly: true}
+	}
+	return &RecordingBroker{Interface: broker}
+}
+
+// Publish publishes the task to the wrapped broker and records it once
+// published, tasks are recorded right away in record-only mode
+func (b *RecordingBroker) Publish(signature *tasks.Signature) error {
+	if !b.recordOnly {
+		if err := b.Interface.Publish(signature); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, signature)
+	return nil
+}
+
+// DeliversImmediately returns true if the wrapped broker delivers tasks as
+// soon as they are published, tasks are never delivered in record-only mode
+func (b *RecordingBroker) DeliversImmediately() bool {
+	deliverer, ok := b.Interface.(ImmediateDeliverer)
+	return ok && !b.recordOnly && deliverer.DeliversImmediately()
+}
+
+// Published returns tasks published so far in the order they were published
+func (b *RecordingBroker) Published() []*tasks.Signature {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*tasks.Signature{}, b.published...)
+}
+
+// Reset forgets the tasks published so far
+func (b *RecordingBroker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = nil
+}
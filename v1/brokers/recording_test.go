@@ -0,0 +1,54 @@
+package brokers_test
+
+import (
+	"testing"
+
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingProcessor struct {
+	processed []string
+}
+
+func (p *countingProcessor) Process(signature *tasks.Signature) error {
+	p.processed = append(p.processed, signature.UUID)
+	return nil
+}
+
+func TestRecordingBroker(t *testing.T) {
+	eager := brokers.NewEagerBroker()
+	processor := new(countingProcessor)
+	eager.(brokers.EagerMode).AssignWorker(processor)
+
+	broker := brokers.NewRecordingBroker(eager)
+	assert.Equal(t, brokers.TypeEager, broker.Type())
+
+	assert.NoError(t, broker.Publish(&tasks.Signature{
+		UUID:       "task_1",
+		Name:       "add",
+		RoutingKey: "math",
+		Args:       []tasks.Arg{{Type: "int64", Value: 1}, {Type: "int64", Value: 2}},
+	}))
+	assert.NoError(t, broker.Publish(&tasks.Signature{UUID: "task_2", Name: "notify"}))
+
+	// Tasks are published to the wrapped broker and recorded
+	assert.Equal(t, []string{"task_1", "task_2"}, processor.processed)
+	published := broker.Published()
+	if assert.Len(t, published, 2) {
+		assert.Equal(t, "add", published[0].Name)
+		assert.Equal(t, "math", published[0].RoutingKey)
+		assert.Equal(t, []tasks.Arg{{Type: "int64", Value: 1}, {Type: "int64", Value: 2}}, published[0].Args)
+		assert.Equal(t, "notify", published[1].Name)
+	}
+
+	broker.Reset()
+	assert.Empty(t, broker.Published())
+
+	// Record-only mode publishes nowhere
+	broker = brokers.NewRecordingBroker(nil)
+	assert.NoError(t, broker.Publish(&tasks.Signature{UUID: "task_3", Name: "add"}))
+	assert.Len(t, broker.Published(), 1)
+	assert.Len(t, processor.processed, 2)
+}
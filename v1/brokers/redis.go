@@ -16,16 +16,21 @@ import (
 
 var redisDelayedTasksKey = "delayed_tasks"
 
+// defaultRedisBlockTimeout is for how many seconds BLPOP blocks on an empty
+// queue unless configured otherwise
+const defaultRedisBlockTimeout = 1
+
 // RedisBroker represents a Redis broker
 type RedisBroker struct {
-	host              string
-	password          string
-	db                int
-	pool              *redis.Pool
-	stopReceivingChan chan int
-	stopDelayedChan   chan int
+	host     string
+	password string
+	db       int
+	pool     *redis.Pool
+	// stopReceivingChan is closed to stop the receiving goroutines, once
+	// only so stopping twice does not block
+	stopReceivingChan chan struct{}
+	stopReceivingOnce *sync.Once
 	receivingWG       sync.WaitGroup
-	delayedWG         sync.WaitGroup
 	// If set, path to a socket file overrides hostname
 	socketPath string
 	redsync    *redsync.Redsync
@@ -44,6 +49,11 @@ func NewRedisBroker(cnf *config.Config, host, password, socketPath string, db in
 	return b
 }
 
+// Type returns the broker type
+func (b *RedisBroker) Type() string {
+	return TypeRedis
+}
+
 // StartConsuming enters a loop and waits for incoming messages
 func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskProcessor TaskProcessor) (bool, error) {
 	b.startConsuming(consumerTag, taskProcessor)
@@ -60,11 +70,16 @@ func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskPr
 		return b.retry, err
 	}
 
-	// Channels and wait groups used to properly close down goroutines
-	b.stopReceivingChan = make(chan int)
-	b.stopDelayedChan = make(chan int)
-	b.receivingWG.Add(1)
-	b.delayedWG.Add(1)
+	if b.scheduler != nil {
+		stopScheduler := make(chan struct{})
+		defer close(stopScheduler)
+		go b.runScheduler(b.Publish, stopScheduler)
+	}
+
+	// Channel and wait group used to properly close down goroutines
+	b.stopReceivingChan = make(chan struct{})
+	b.stopReceivingOnce = new(sync.Once)
+	b.receivingWG.Add(2)
 
 	// Channel to which we will push tasks ready for processing by worker
 	deliveries := make(chan []byte)
@@ -83,12 +98,18 @@ func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskPr
 			case <-b.stopReceivingChan:
 				return
 			default:
-				task, err := b.nextTask(b.cnf.DefaultQueue)
+				task, err := b.nextTask(b.queueName(b.cnf.DefaultQueue))
 				if err != nil {
 					continue
 				}
 
-				deliveries <- task
+				select {
+				case deliveries <- task:
+				case <-b.stopReceivingChan:
+					// Put the task back so it is not lost
+					b.requeue(task)
+					return
+				}
 			}
 		}
 	}()
@@ -96,20 +117,26 @@ func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskPr
 	// A goroutine to watch for delayed tasks and push them to deliveries
 	// channel for consumption by the worker
 	go func() {
-		defer b.delayedWG.Done()
+		defer b.receivingWG.Done()
 
 		for {
 			select {
 			// A way to stop this goroutine from b.StopConsuming
-			case <-b.stopDelayedChan:
+			case <-b.stopReceivingChan:
 				return
 			default:
-				delayedTask, err := b.nextDelayedTask(redisDelayedTasksKey)
+				delayedTask, err := b.nextDelayedTask(b.queueName(redisDelayedTasksKey))
 				if err != nil {
 					continue
 				}
 
-				deliveries <- delayedTask
+				select {
+				case deliveries <- delayedTask:
+				case <-b.stopReceivingChan:
+					// The task is due already, put it on the default queue
+					b.requeue(delayedTask)
+					return
+				}
 			}
 		}
 	}()
@@ -121,43 +148,111 @@ func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskPr
 	return b.retry, nil
 }
 
-// StopConsuming quits the loop
+// StopConsuming quits the loop, stopping a broker which stopped already
+// does nothing
 func (b *RedisBroker) StopConsuming() {
-	// Stop the receiving goroutine
+	// Stop the receiving and the delayed tasks goroutines
 	b.stopReceiving()
 
-	// Stop the delayed tasks goroutine
-	b.stopDelayed()
-
 	b.stopConsuming()
 }
 
+// StopConsumingWithTimeout quits the loop and waits up to the timeout for
+// tasks being processed to finish
+func (b *RedisBroker) StopConsumingWithTimeout(timeout time.Duration) *ShutdownReport {
+	b.StopConsuming()
+	return b.inFlight.report(b.clock, timeout)
+}
+
 // Publish places a new message on the default queue
 func (b *RedisBroker) Publish(signature *tasks.Signature) error {
-	msg, err := json.Marshal(signature)
+	start := time.Now()
+	err := b.publish(signature)
+	b.observePublish(signature, time.Since(start), err)
+	return err
+}
+
+// publish places a new message on the default queue, the whole path is
+// measured as publish latency
+func (b *RedisBroker) publish(signature *tasks.Signature) error {
+	msg, err := b.encode(signature)
 	if err != nil {
 		return fmt.Errorf("JSON marshal error: %s", err)
 	}
 
 	b.AdjustRoutingKey(signature)
 
+	// Check the ETA signature field, if it is set and it is in the future,
+	// delay the task
+	if scheduled, err := b.schedule(signature, &redisScheduler{b}); scheduled {
+		return err
+	}
+
 	conn := b.open()
 	defer conn.Close()
 
-	// Check the ETA signature field, if it is set and it is in the future,
-	// delay the task
-	if signature.ETA != nil {
-		now := time.Now().UTC()
+	_, err = conn.Do("RPUSH", b.queueName(signature.RoutingKey), msg)
+	return err
+}
+
+// PublishTransaction places multiple messages on their queues (or the delayed
+// tasks set) in a MULTI/EXEC transaction, so none of them is enqueued unless
+// all commands are sent. Members are prepared like tasks published one by one
+// and a command failing once the transaction is executed is returned as an
+// error
+func (b *RedisBroker) PublishTransaction(signatures []*tasks.Signature) error {
+	start := time.Now()
+	err := b.publishTransaction(signatures)
+	b.observeBatch(signatures, time.Since(start), err)
+	return err
+}
+
+// publishTransaction places multiple messages in a MULTI/EXEC transaction,
+// the whole path is measured as publish latency
+func (b *RedisBroker) publishTransaction(signatures []*tasks.Signature) error {
+	pending, err := b.prepareTransaction(signatures)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	msgs := make([][]byte, len(pending))
+	for i, signature := range pending {
+		msg, err := b.encode(signature)
+		if err != nil {
+			return fmt.Errorf("JSON marshal error: %s", err)
+		}
+		msgs[i] = msg
+	}
+
+	conn := b.open()
+	defer conn.Close()
 
-		if signature.ETA.After(now) {
-			score := signature.ETA.UnixNano()
-			_, err = conn.Do("ZADD", redisDelayedTasksKey, score, msg)
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for i, signature := range pending {
+		var err error
+		if b.etaDelay(signature) > 0 {
+			err = conn.Send("ZADD", b.queueName(redisDelayedTasksKey), signature.ETA.UnixNano(), msgs[i])
+		} else {
+			err = conn.Send("RPUSH", b.queueName(signature.RoutingKey), msgs[i])
+		}
+		if err != nil {
+			conn.Do("DISCARD")
 			return err
 		}
 	}
 
-	_, err = conn.Do("RPUSH", signature.RoutingKey, msg)
-	return err
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return fmt.Errorf("Transaction exec error: %s", err)
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("Transaction command error: %s", err)
+		}
+	}
+	return nil
 }
 
 // GetPendingTasks returns a slice of task signatures waiting in the queue
@@ -168,7 +263,7 @@ func (b *RedisBroker) GetPendingTasks(queue string) ([]*tasks.Signature, error)
 	if queue == "" {
 		queue = b.cnf.DefaultQueue
 	}
-	bytes, err := conn.Do("LRANGE", queue, 0, 10)
+	bytes, err := conn.Do("LRANGE", b.queueName(queue), 0, 10)
 	if err != nil {
 		return nil, err
 	}
@@ -179,8 +274,8 @@ func (b *RedisBroker) GetPendingTasks(queue string) ([]*tasks.Signature, error)
 
 	taskSignatures := make([]*tasks.Signature, len(results))
 	for i, result := range results {
-		sig := new(tasks.Signature)
-		if err := json.Unmarshal(result, sig); err != nil {
+		sig, err := b.decode(result, nil)
+		if err != nil {
 			return nil, err
 		}
 		taskSignatures[i] = sig
@@ -188,51 +283,124 @@ func (b *RedisBroker) GetPendingTasks(queue string) ([]*tasks.Signature, error)
 	return taskSignatures, nil
 }
 
+// QueueStats returns the number of tasks waiting in the queue
+func (b *RedisBroker) QueueStats(queue string) (*QueueStats, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	if queue == "" {
+		queue = b.cnf.DefaultQueue
+	}
+	messages, err := redis.Int(conn.Do("LLEN", b.queueName(queue)))
+	if err != nil {
+		return nil, err
+	}
+	return &QueueStats{Messages: messages}, nil
+}
+
+// ReprocessDeadLetter moves up to limit messages from the dead-letter list
+// back to the queue they were originally published to
+func (b *RedisBroker) ReprocessDeadLetter(dlqName string, limit int) (int, error) {
+	dlqName = b.queueName(dlqName)
+
+	conn := b.open()
+	defer conn.Close()
+
+	reprocessed := 0
+	for reprocessed < limit {
+		msg, err := redis.Bytes(conn.Do("LPOP", dlqName))
+		if err == redis.ErrNil {
+			break
+		}
+		if err != nil {
+			return reprocessed, err
+		}
+
+		message := new(struct {
+			Headers map[string]interface{}
+		})
+		if err := json.Unmarshal(msg, message); err != nil {
+			// Put the message back so it is not lost
+			conn.Do("LPUSH", dlqName, msg)
+			return reprocessed, fmt.Errorf("JSON unmarshal error: %s", err)
+		}
+
+		queue := b.queueName(originalRoutingKey(message.Headers, b.cnf.DefaultQueue))
+		if _, err := conn.Do("RPUSH", queue, msg); err != nil {
+			conn.Do("LPUSH", dlqName, msg)
+			return reprocessed, err
+		}
+
+		reprocessed++
+	}
+
+	return reprocessed, nil
+}
+
 // consume takes delivered messages from the channel and manages a worker pool
 // to process tasks concurrently
 func (b *RedisBroker) consume(deliveries <-chan []byte, concurrency int, taskProcessor TaskProcessor) error {
-	pool := make(chan struct{}, concurrency)
+	pool := b.newWorkerPool(concurrency)
 
-	// initialize worker pool with maxWorkers workers
-	go func() {
-		for i := 0; i < concurrency; i++ {
-			pool <- struct{}{}
-		}
-	}()
+	// Make sure task processing completes on interrupt signal
+	defer pool.Stop()
 
-	errorsChan := make(chan error, concurrency*2)
-	//errorsChan := make(chan error)
+	// Only the first error is returned, the rest is dropped so jobs
+	// never block once the loop has returned
+	errorsChan := make(chan error, 1)
 
-	// Use wait group to make sure task processing completes on interrupt signal
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	counter := b.newTaskCounter(taskProcessor)
 
 	for {
+		// Stop once as many tasks as the task processor is limited to were
+		// completed, no more deliveries are taken meanwhile than needed
+		if !counter.wait(b.Broker.stopChan) {
+			if counter.reached() {
+				b.retry = false
+				b.stopReceiving()
+			}
+			return nil
+		}
+
+		// Stop pulling new tasks while the task processor is paused
+		select {
+		case <-resumed(taskProcessor):
+		case <-b.Broker.stopChan:
+			return nil
+		}
+
+		// Back off while only tasks of other workers are received
+		if !b.unregistered.wait(b.clock, b.Broker.stopChan) {
+			return nil
+		}
+
 		select {
 		case err := <-errorsChan:
 			return err
 		case d := <-deliveries:
-			if concurrency > 0 {
-				// get worker from pool (blocks until one is available)
-				<-pool
-			}
-
-			wg.Add(1)
+			counter.take()
 
-			// Consume the task inside a gotourine so multiple tasks
-			// can be processed concurrently
-			go func() {
-				defer wg.Done()
-
-				if err := b.consumeOne(d, taskProcessor); err != nil {
-					errorsChan <- err
+			// Process the delivery in the loop so tasks run strictly in order
+			if b.cnf.OrderedMode {
+				err := b.consumeOne(d, taskProcessor)
+				counter.done()
+				if err != nil {
+					return err
 				}
+				continue
+			}
 
-				if concurrency > 0 {
-					// give worker back to pool
-					pool <- struct{}{}
+			// Consume the task on a pool goroutine so multiple tasks can be
+			// processed concurrently (blocks until one is available)
+			pool.Submit(func() {
+				defer counter.done()
+				if err := b.consumeOne(d, taskProcessor); err != nil {
+					select {
+					case errorsChan <- err:
+					default:
+					}
 				}
-			}()
+			})
 		case <-b.Broker.stopChan:
 			return nil
 		}
@@ -241,24 +409,52 @@ func (b *RedisBroker) consume(deliveries <-chan []byte, concurrency int, taskPro
 
 // consumeOne processes a single message using TaskProcessor
 func (b *RedisBroker) consumeOne(delivery []byte, taskProcessor TaskProcessor) error {
-	log.INFO.Printf("Received new message: %s", delivery)
-
-	sig := new(tasks.Signature)
-	if err := json.Unmarshal(delivery, sig); err != nil {
+	sig, err := b.decode(delivery, nil)
+	if err != nil {
+		log.INFO.Printf("Received new message: %s", delivery)
+		b.deadLettered(delivery, err)
 		return err
 	}
 
-	// If the task is not registered, we requeue it,
-	// there might be different workers for processing specific tasks
-	if !b.IsTaskRegistered(sig.Name) {
-		conn := b.open()
-		defer conn.Close()
+	// If the task is not registered or does not pass the worker's task filter,
+	// we requeue it, there might be different workers for processing specific tasks
+	registered := b.IsTaskRegistered(sig.Name)
+	if !registered || !acceptsTask(taskProcessor, sig) {
+		if !registered {
+			b.unregistered.received(sig)
+		}
 
-		conn.Do("RPUSH", b.cnf.DefaultQueue, delivery)
+		b.requeue(delivery)
+		return nil
+	}
+	b.unregistered.reset()
+
+	log.INFO.Printf("Received new message: %s", delivery)
+
+	switch b.intercept(sig) {
+	case InterceptReject:
+		return nil
+	case InterceptRequeue:
+		b.requeue(delivery)
 		return nil
 	}
 
-	return taskProcessor.Process(sig)
+	// There is no dead-letter queue, the message is only passed to the
+	// dead-letter handler
+	err = b.process(taskProcessor, sig)
+	if deadLetterErr, ok := err.(*DeadLetterError); ok {
+		b.deadLettered(delivery, deadLetterErr.Err)
+		return nil
+	}
+	return err
+}
+
+// requeue puts the message back on the default queue
+func (b *RedisBroker) requeue(delivery []byte) {
+	conn := b.open()
+	defer conn.Close()
+
+	conn.Do("RPUSH", b.queueName(b.cnf.DefaultQueue), delivery)
 }
 
 // nextTask pops next available task from the default queue
@@ -266,7 +462,7 @@ func (b *RedisBroker) nextTask(queue string) (result []byte, err error) {
 	conn := b.open()
 	defer conn.Close()
 
-	items, err := redis.ByteSlices(conn.Do("BLPOP", queue, 1))
+	items, err := redis.ByteSlices(conn.Do("BLPOP", queue, b.blockTimeout()))
 	if err != nil {
 		return []byte{}, err
 	}
@@ -282,6 +478,56 @@ func (b *RedisBroker) nextTask(queue string) (result []byte, err error) {
 	return result, nil
 }
 
+// blockTimeout returns for how many seconds BLPOP blocks on an empty queue,
+// which also bounds how long stopping the receiving goroutine takes
+func (b *RedisBroker) blockTimeout() int {
+	if b.cnf.Redis != nil && b.cnf.Redis.BlockTimeout > 0 {
+		return b.cnf.Redis.BlockTimeout
+	}
+	return defaultRedisBlockTimeout
+}
+
+// redisScheduler delays tasks natively in the delayed tasks ZSET scored by
+// their ETA, consumers pop them once due
+type redisScheduler struct {
+	broker *RedisBroker
+}
+
+// Schedule adds the task to the delayed tasks ZSET
+func (s *redisScheduler) Schedule(signature *tasks.Signature, at time.Time) error {
+	msg, err := s.broker.encode(signature)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	conn := s.broker.open()
+	defer conn.Close()
+
+	_, err = conn.Do("ZADD", s.broker.queueName(redisDelayedTasksKey), at.UnixNano(), msg)
+	return err
+}
+
+// Poll pops all due tasks from the delayed tasks ZSET, tasks popped before
+// an error are returned along with it
+func (s *redisScheduler) Poll() ([]*tasks.Signature, error) {
+	var due []*tasks.Signature
+	for {
+		msg, err := s.broker.nextDelayedTask(s.broker.queueName(redisDelayedTasksKey))
+		if err == redis.ErrNil {
+			return due, nil
+		}
+		if err != nil {
+			return due, err
+		}
+
+		signature, err := s.broker.decode(msg, nil)
+		if err != nil {
+			return due, fmt.Errorf("JSON unmarshal error: %s", err)
+		}
+		due = append(due, signature)
+	}
+}
+
 // nextDelayedTask pops a value from the ZSET key using WATCH/MULTI/EXEC commands.
 // https://github.com/garyburd/redigo/blob/master/redis/zpop_example_test.go
 func (b *RedisBroker) nextDelayedTask(key string) (result []byte, err error) {
@@ -310,7 +556,7 @@ func (b *RedisBroker) nextDelayedTask(key string) (result []byte, err error) {
 			return
 		}
 
-		now := time.Now().UTC().UnixNano()
+		now := b.clock.Now().UTC().UnixNano()
 
 		// https://redis.io/commands/zrangebyscore
 		items, err = redis.ByteSlices(conn.Do(
@@ -346,20 +592,16 @@ func (b *RedisBroker) nextDelayedTask(key string) (result []byte, err error) {
 	return
 }
 
-// Stops the receiving goroutine
+// stopReceiving stops the receiving and the delayed tasks goroutines and
+// waits for them to have stopped
 func (b *RedisBroker) stopReceiving() {
-	b.stopReceivingChan <- 1
-	// Waiting for the receiving goroutine to have stopped
+	if b.stopReceivingOnce == nil {
+		return
+	}
+	b.stopReceivingOnce.Do(func() { close(b.stopReceivingChan) })
 	b.receivingWG.Wait()
 }
 
-// Stops the delayed tasks goroutine
-func (b *RedisBroker) stopDelayed() {
-	b.stopDelayedChan <- 1
-	// Waiting for the delayed tasks goroutine to have stopped
-	b.delayedWG.Wait()
-}
-
 // open returns or creates instance of Redis connection
 func (b *RedisBroker) open() redis.Conn {
 	if b.pool == nil {
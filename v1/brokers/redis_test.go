@@ -0,0 +1,191 @@
+package brokers_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/koblelabs/machinery/v1"
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingConn is a redis.Conn recording the commands it is sent, all of
+// them get a nil reply as if the queue was empty. The empty command the pool
+// flushes connections with is not recorded
+type recordingConn struct {
+	mu       sync.Mutex
+	commands [][]interface{}
+}
+
+func (c *recordingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if command == "" {
+		return nil, nil
+	}
+	c.commands = append(c.commands, append([]interface{}{command}, args...))
+	return nil, nil
+}
+
+func (c *recordingConn) Send(command string, args ...interface{}) error {
+	_, err := c.Do(command, args...)
+	return err
+}
+
+func (c *recordingConn) Close() error                  { return nil }
+func (c *recordingConn) Err() error                    { return nil }
+func (c *recordingConn) Flush() error                  { return nil }
+func (c *recordingConn) Receive() (interface{}, error) { return nil, nil }
+
+func TestRedisBlockTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		cnf     *config.RedisConfig
+		timeout int
+	}{
+		{nil, 1},
+		{&config.RedisConfig{BlockTimeout: 5}, 5},
+	} {
+		conn := new(recordingConn)
+		broker := brokers.NewRedisBroker(&config.Config{Redis: tc.cnf}, "", "", "", 0).(*brokers.RedisBroker)
+		broker.SetPool(&redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		})
+
+		// An idle consumer blocks on the queue once per attempt
+		for i := 0; i < 3; i++ {
+			_, err := broker.NextTask("machinery_tasks")
+			assert.Equal(t, redis.ErrNil, err)
+		}
+
+		if assert.Len(t, conn.commands, 3) {
+			for _, command := range conn.commands {
+				assert.Equal(t, []interface{}{"BLPOP", "machinery_tasks", tc.timeout}, command)
+			}
+		}
+	}
+}
+
+// execConn replies to EXEC with the replies of the queued commands
+type execConn struct {
+	recordingConn
+	replies []interface{}
+}
+
+func (c *execConn) Do(command string, args ...interface{}) (interface{}, error) {
+	reply, err := c.recordingConn.Do(command, args...)
+	if command == "EXEC" {
+		return c.replies, nil
+	}
+	return reply, err
+}
+
+func (c *execConn) Send(command string, args ...interface{}) error {
+	_, err := c.Do(command, args...)
+	return err
+}
+
+func TestSendGroupTransaction(t *testing.T) {
+	cnf := &config.Config{
+		Broker:        "eager",
+		ResultBackend: "eager",
+		DefaultQueue:  "machinery_tasks",
+	}
+	server, err := machinery.NewServer(cnf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sendGroup := func(conn *execConn, scheduler brokers.Scheduler) ([]string, error) {
+		broker := brokers.NewRedisBroker(cnf, "", "", "", 0).(*brokers.RedisBroker)
+		broker.SetPool(&redis.Pool{
+			Dial: func() (redis.Conn, error) { return conn, nil },
+		})
+		broker.SetScheduler(scheduler)
+		var observed []string
+		broker.SetPublishObserver(func(queue string, duration time.Duration, err error) {
+			observed = append(observed, queue)
+		})
+		server.SetBroker(broker)
+
+		eta := time.Now().Add(time.Hour)
+		group := tasks.NewGroup(
+			&tasks.Signature{UUID: "task_1", Name: "test_task"},
+			&tasks.Signature{UUID: "task_2", Name: "test_task", ETA: &eta},
+		)
+		_, err := server.SendGroup(group, 0)
+		return observed, err
+	}
+
+	// Members are prepared like single tasks, a task with ETA goes to the
+	// scheduler and only the rest is written in the transaction
+	conn := &execConn{replies: []interface{}{int64(1)}}
+	scheduler := newFakeScheduler()
+	observed, err := sendGroup(conn, scheduler)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"machinery_tasks", "machinery_tasks"}, observed)
+	assert.Contains(t, scheduler.scheduled, "task_2")
+	if assert.Len(t, conn.commands, 3) {
+		assert.Equal(t, "MULTI", conn.commands[0][0])
+		assert.Equal(t, []interface{}{"RPUSH", "machinery_tasks"}, conn.commands[1][:2])
+		assert.Equal(t, "EXEC", conn.commands[2][0])
+	}
+
+	// A command failing within the transaction fails the group
+	conn = &execConn{replies: []interface{}{redis.Error("OOM command not allowed")}}
+	observed, err = sendGroup(conn, newFakeScheduler())
+	assert.EqualError(t, err, "Publish message error: Transaction command error: OOM command not allowed")
+	assert.Len(t, observed, 2)
+}
+
+// limitedProcessor counts processed tasks, it consumes a limited number of
+// them
+type limitedProcessor struct {
+	mu        sync.Mutex
+	processed int
+	limit     int
+}
+
+func (p *limitedProcessor) Process(signature *tasks.Signature) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed++
+	return nil
+}
+
+func (p *limitedProcessor) TaskLimit() int {
+	return p.limit
+}
+
+func TestRedisTaskLimit(t *testing.T) {
+	broker := brokers.NewRedisBroker(&config.Config{DefaultQueue: "machinery_tasks"}, "", "", "", 0).(*brokers.RedisBroker)
+	broker.SetRegisteredTaskNames([]string{"test_task"})
+
+	deliveries := make(chan []byte, 10)
+	for i := 1; i <= 10; i++ {
+		deliveries <- []byte(fmt.Sprintf(`{"UUID":"task_%d","Name":"test_task"}`, i))
+	}
+
+	// Consuming stops on its own once the limit is reached
+	processor := &limitedProcessor{limit: 5}
+	assert.NoError(t, broker.Consume(deliveries, 2, processor))
+	assert.Equal(t, 5, processor.processed)
+	assert.Len(t, deliveries, 5)
+
+	// Stopping the broker afterwards, e.g. on a signal, does not block
+	stopped := make(chan struct{})
+	go func() {
+		broker.StopConsuming()
+		broker.StopConsuming()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("StopConsuming blocked")
+	}
+}
@@ -0,0 +1,122 @@
+package brokers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+// MessageVersionHeader is the message header holding the MessageVersion of
+// the producer, brokers without message headers carry it in the signature's
+// Headers
+const MessageVersionHeader = "x-message-version"
+
+// FieldMapping maps JSON field names used on the wire to Signature field names
+type FieldMapping map[string]string
+
+// VersionedMessageAdapter decodes signatures whose JSON field names differ
+// from machinery's own, e.g. ones sent by producers running another version
+// during a rolling upgrade. The mapping is picked by the MessageVersionHeader
+// of the message, messages without one are decoded with the mapping of
+// version "" if there is one
+type VersionedMessageAdapter struct {
+	mappings map[string]FieldMapping
+}
+
+// signatureFields are Signature fields holding nested signatures
+var signatureFields = []string{"OnSuccess", "OnError", "ChordCallback"}
+
+// NewVersionedMessageAdapter creates new VersionedMessageAdapter instance
+func NewVersionedMessageAdapter(mappings map[string]FieldMapping) MessageAdapter {
+	return &VersionedMessageAdapter{mappings: mappings}
+}
+
+// Decode translates field names of the message and decodes it into a
+// signature, the version is read from the signature's headers
+func (a *VersionedMessageAdapter) Decode(body []byte) (*tasks.Signature, error) {
+	return a.DecodeWithHeaders(body, nil)
+}
+
+// DecodeWithHeaders translates field names of the message by the mapping of
+// the version in its headers and decodes it into a signature
+func (a *VersionedMessageAdapter) DecodeWithHeaders(body []byte, headers map[string]interface{}) (*tasks.Signature, error) {
+	var fields map[string]interface{}
+	if err := decodeJSON(body, &fields); err != nil {
+		return nil, fmt.Errorf("Versioned message decode error: %s", err)
+	}
+
+	version := messageVersion(fields, headers)
+	mapping, ok := a.mappings[version]
+	if !ok && version != "" {
+		return nil, fmt.Errorf("Unknown message version: %s", version)
+	}
+
+	nested := make(map[string]bool, len(signatureFields))
+	for _, name := range signatureFields {
+		nested[name] = true
+	}
+
+	encoded, err := json.Marshal(renameFields(fields, mapping, nested))
+	if err != nil {
+		return nil, fmt.Errorf("JSON marshal error: %s", err)
+	}
+	return decodeSignature(encoded)
+}
+
+// messageVersion returns the version in the message headers or, as the field
+// holding the signature's headers may be renamed, in any object of the body
+func messageVersion(fields map[string]interface{}, headers map[string]interface{}) string {
+	if version, ok := headers[MessageVersionHeader].(string); ok {
+		return version
+	}
+	for _, value := range fields {
+		if object, ok := value.(map[string]interface{}); ok {
+			if version, ok := object[MessageVersionHeader].(string); ok {
+				return version
+			}
+		}
+	}
+	return ""
+}
+
+// stampVersion sets the MessageVersionHeader of the signature to the
+// configured MessageVersion before it is published
+func (b *Broker) stampVersion(signature *tasks.Signature) {
+	if b.cnf == nil || b.cnf.MessageVersion == "" {
+		return
+	}
+	if signature.Headers == nil {
+		signature.Headers = make(tasks.Headers)
+	}
+	signature.Headers[MessageVersionHeader] = b.cnf.MessageVersion
+}
+
+// renameFields renames keys of the decoded signature and of signatures nested
+// under the given keys (named after renaming)
+func renameFields(fields map[string]interface{}, mapping map[string]string, nested map[string]bool) map[string]interface{} {
+	renamed := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if name, ok := mapping[key]; ok {
+			key = name
+		}
+		if nested[key] {
+			value = renameNested(value, mapping, nested)
+		}
+		renamed[key] = value
+	}
+	return renamed
+}
+
+// renameNested renames keys of a nested signature or a list of signatures
+func renameNested(value interface{}, mapping map[string]string, nested map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return renameFields(v, mapping, nested)
+	case []interface{}:
+		for i, item := range v {
+			v[i] = renameNested(item, mapping, nested)
+		}
+	}
+	return value
+}
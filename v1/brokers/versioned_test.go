@@ -0,0 +1,86 @@
+package brokers_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+var legacyMapping = brokers.FieldMapping{
+	"uuid":       "UUID",
+	"name":       "Name",
+	"args":       "Args",
+	"headers":    "Headers",
+	"on_success": "OnSuccess",
+}
+
+func TestVersionedMessageAdapter(t *testing.T) {
+	adapter := brokers.NewVersionedMessageAdapter(map[string]brokers.FieldMapping{
+		"legacy": legacyMapping,
+	}).(brokers.HeaderMessageAdapter)
+
+	body := []byte(`{"uuid": "task_1", "name": "add", "args": [{"Type": "int64", "Value": 1}], "on_success": [{"uuid": "task_2", "name": "multiply"}]}`)
+
+	// The version is read from the message headers
+	decoded, err := adapter.DecodeWithHeaders(body, map[string]interface{}{
+		brokers.MessageVersionHeader: "legacy",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "task_1", decoded.UUID)
+		assert.Equal(t, "add", decoded.Name)
+		assert.Equal(t, []tasks.Arg{{Type: "int64", Value: json.Number("1")}}, decoded.Args)
+		if assert.Len(t, decoded.OnSuccess, 1) {
+			assert.Equal(t, "task_2", decoded.OnSuccess[0].UUID)
+			assert.Equal(t, "multiply", decoded.OnSuccess[0].Name)
+		}
+	}
+
+	// or from the signature's headers for brokers without message headers
+	body = []byte(`{"uuid": "task_1", "name": "add", "headers": {"x-message-version": "legacy"}}`)
+	decoded, err = adapter.Decode(body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "task_1", decoded.UUID)
+		assert.Equal(t, "legacy", decoded.Headers[brokers.MessageVersionHeader])
+	}
+
+	// Signatures without a version are decoded as they are
+	body, err = json.Marshal(&tasks.Signature{UUID: "task_1", Name: "add"})
+	assert.NoError(t, err)
+	decoded, err = adapter.Decode(body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "task_1", decoded.UUID)
+	}
+
+	_, err = adapter.DecodeWithHeaders([]byte(`{}`), map[string]interface{}{
+		brokers.MessageVersionHeader: "unknown",
+	})
+	assert.EqualError(t, err, "Unknown message version: unknown")
+}
+
+func TestMessageVersionHeader(t *testing.T) {
+	cnf := &config.Config{AMQP: new(config.AMQPConfig), MessageVersion: "v2"}
+	broker := brokers.NewAMQPBroker(cnf).(*brokers.AMQPBroker)
+
+	signature := &tasks.Signature{UUID: "task_1", Name: "add"}
+	body, err := broker.Encode(signature)
+	assert.NoError(t, err)
+
+	publishing := broker.NewPublishing(signature, body)
+	assert.Equal(t, "v2", publishing.Headers[brokers.MessageVersionHeader])
+
+	decoded := new(tasks.Signature)
+	if assert.NoError(t, json.Unmarshal(body, decoded)) {
+		assert.Equal(t, "v2", decoded.Headers[brokers.MessageVersionHeader])
+	}
+
+	// Nothing is stamped unless a version is configured
+	broker = brokers.NewAMQPBroker(&config.Config{AMQP: new(config.AMQPConfig)}).(*brokers.AMQPBroker)
+	signature = &tasks.Signature{UUID: "task_1", Name: "add"}
+	_, err = broker.Encode(signature)
+	assert.NoError(t, err)
+	assert.Nil(t, signature.Headers)
+}
@@ -0,0 +1,45 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFake(start)
+
+	after := fakeClock.After(time.Second)
+	timer := fakeClock.NewTimer(2 * time.Second)
+	stopped := fakeClock.NewTimer(time.Second)
+	assert.True(t, stopped.Stop())
+
+	fakeClock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), fakeClock.Now())
+
+	select {
+	case now := <-after:
+		assert.Equal(t, start.Add(time.Second), now)
+	default:
+		t.Fatal("After should fire once the clock is advanced past it")
+	}
+
+	select {
+	case <-timer.C():
+		t.Fatal("Timer should not fire before its deadline")
+	case <-stopped.C():
+		t.Fatal("Stopped timer should not fire")
+	default:
+	}
+
+	fakeClock.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("Timer should fire once the clock reaches its deadline")
+	}
+	assert.False(t, timer.Stop())
+}
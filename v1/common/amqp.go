@@ -3,12 +3,21 @@ package common
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
 // AMQPConnector ...
-type AMQPConnector struct{}
+type AMQPConnector struct {
+	// ConnectionName is advertised to the server as connection_name client
+	// property so connections can be identified e.g. in the management UI
+	ConnectionName string
+	// Dial opens the network connection, the default of the amqp package is
+	// used if nil
+	Dial func(network, addr string) (net.Conn, error)
+}
 
 // Connect opens a connection to RabbitMQ, declares an exchange, opens a channel,
 // declares and binds the queue and enables publish notifications
@@ -94,7 +103,7 @@ func (ac *AMQPConnector) Open(url string, tlsConfig *tls.Config) (*amqp.Connecti
 	// Connect
 	// From amqp docs: DialTLS will use the provided tls.Config when it encounters an amqps:// scheme
 	// and will dial a plain connection when it encounters an amqp:// scheme.
-	conn, err := amqp.DialTLS(url, tlsConfig)
+	conn, err := amqp.DialConfig(url, ac.DialConfig(tlsConfig))
 	if err != nil {
 		return nil, nil, fmt.Errorf("Dial error: %s", err)
 	}
@@ -108,6 +117,23 @@ func (ac *AMQPConnector) Open(url string, tlsConfig *tls.Config) (*amqp.Connecti
 	return conn, channel, nil
 }
 
+// DialConfig returns configuration used when opening a new connection, it
+// uses the same defaults as amqp.DialTLS
+func (ac *AMQPConnector) DialConfig(tlsConfig *tls.Config) amqp.Config {
+	cfg := amqp.Config{
+		Heartbeat:       10 * time.Second,
+		TLSClientConfig: tlsConfig,
+		Locale:          "en_US",
+		Dial:            ac.Dial,
+	}
+
+	if ac.ConnectionName != "" {
+		cfg.Properties = amqp.Table{"connection_name": ac.ConnectionName}
+	}
+
+	return cfg
+}
+
 // Close connection
 func (ac *AMQPConnector) Close(channel *amqp.Channel, conn *amqp.Connection) error {
 	if channel != nil {
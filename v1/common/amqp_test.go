@@ -0,0 +1,21 @@
+package common_test
+
+import (
+	"testing"
+
+	"github.com/koblelabs/machinery/v1/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialConfig(t *testing.T) {
+	connector := new(common.AMQPConnector)
+
+	cfg := connector.DialConfig(nil)
+	assert.Nil(t, cfg.Properties)
+	assert.Equal(t, "en_US", cfg.Locale)
+
+	connector.ConnectionName = "orders-worker-3"
+
+	cfg = connector.DialConfig(nil)
+	assert.Equal(t, "orders-worker-3", cfg.Properties["connection_name"])
+}
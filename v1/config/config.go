@@ -27,26 +27,233 @@ var (
 	reloadDelay = time.Second * 10
 )
 
+const (
+	// PoolFullBlock holds deliveries until the worker pool can run them
+	PoolFullBlock = "block"
+	// PoolFullRequeue requeues deliveries received while the pool is full
+	PoolFullRequeue = "requeue"
+)
+
+const (
+	// DuplicateRegistrationOverwrite replaces a task registered already
+	// under the same name and logs a warning
+	DuplicateRegistrationOverwrite = "overwrite"
+	// DuplicateRegistrationError rejects a task registered already
+	DuplicateRegistrationError = "error"
+	// DuplicateRegistrationIgnore keeps the task registered first
+	DuplicateRegistrationIgnore = "ignore"
+)
+
+const (
+	// DelayStrategyPerTask delays each task in a queue of its own
+	DelayStrategyPerTask = "per-task"
+	// DelayStrategyBucketed delays tasks in a fixed set of queues, one per
+	// power of two seconds, rounding delays up
+	DelayStrategyBucketed = "bucketed"
+)
+
+const (
+	// BackpressureBlock blocks publishing until the queue is below MaxQueueDepth
+	BackpressureBlock = "block"
+	// BackpressureError fails publishing while the queue is at MaxQueueDepth
+	BackpressureError = "error"
+)
+
 // Config holds all configuration for our program
 type Config struct {
-	Broker          string      `yaml:"broker" envconfig:"BROKER"`
-	DefaultQueue    string      `yaml:"default_queue" envconfig:"DEFAULT_QUEUE"`
-	ResultBackend   string      `yaml:"result_backend" envconfig:"RESULT_BACKEND"`
-	ResultsExpireIn int         `yaml:"results_expire_in" envconfig:"RESULTS_EXPIRE_IN"`
-	AMQP            *AMQPConfig `yaml:"amqp"`
+	Broker          string       `yaml:"broker" envconfig:"BROKER"`
+	DefaultQueue    string       `yaml:"default_queue" envconfig:"DEFAULT_QUEUE"`
+	ResultBackend   string       `yaml:"result_backend" envconfig:"RESULT_BACKEND"`
+	ResultsExpireIn int          `yaml:"results_expire_in" envconfig:"RESULTS_EXPIRE_IN"`
+	AMQP            *AMQPConfig  `yaml:"amqp"`
+	Redis           *RedisConfig `yaml:"redis"`
 	TLSConfig       *tls.Config
+	// TLS is assembled into TLSConfig by the server unless TLSConfig is set
+	TLS *TLS `yaml:"tls"`
+	// CaptureStackTraces stores error chain and stack trace of failed tasks
+	// in TaskState.ErrorDetail, disabled by default to avoid the overhead
+	CaptureStackTraces bool `yaml:"capture_stack_traces" envconfig:"CAPTURE_STACK_TRACES"`
+	// StoreWorkflows stores the structure of each chain, group and chord
+	// when it is sent so Server.GetWorkflowState can report its progress,
+	// disabled by default to avoid the extra write. Reactive chains are
+	// always stored
+	StoreWorkflows bool `yaml:"store_workflows" envconfig:"STORE_WORKFLOWS"`
+	// PauseOnBackendUnavailable stops consuming tasks while the result
+	// backend cannot be written to until it is reachable again
+	PauseOnBackendUnavailable bool `yaml:"pause_on_backend_unavailable" envconfig:"PAUSE_ON_BACKEND_UNAVAILABLE"`
+	// MaxRedeliveries is how many times a message can be redelivered before
+	// it is moved to the dead-letter queue, 0 means no limit. Deliveries are
+	// acknowledged once processed then, so tasks crashing the worker are
+	// redelivered (AMQP only)
+	MaxRedeliveries int `yaml:"max_redeliveries" envconfig:"MAX_REDELIVERIES"`
+	// DefaultTaskTimeLimit is how many seconds tasks without their own
+	// TimeLimit are allowed to run, 0 means no limit
+	DefaultTaskTimeLimit int `yaml:"default_task_time_limit" envconfig:"DEFAULT_TASK_TIME_LIMIT"`
+	// OnPoolFull is either PoolFullBlock (default) or PoolFullRequeue to let
+	// other consumers take deliveries the worker cannot run right away
+	// (AMQP only)
+	OnPoolFull string `yaml:"on_pool_full" envconfig:"ON_POOL_FULL"`
+	// OnDuplicateRegistration is DuplicateRegistrationOverwrite (default),
+	// DuplicateRegistrationError or DuplicateRegistrationIgnore
+	OnDuplicateRegistration string `yaml:"on_duplicate_registration" envconfig:"ON_DUPLICATE_REGISTRATION"`
+	// MaxArgBytes is how large a single JSON encoded task argument can be
+	// for the task to be sent, 0 means no limit
+	MaxArgBytes int `yaml:"max_arg_bytes" envconfig:"MAX_ARG_BYTES"`
+	// DeadLetterOnPanic makes a task which panicked fail without retries and
+	// its message dead-lettered, as a panic usually means a bug rather than
+	// a transient condition
+	DeadLetterOnPanic bool `yaml:"dead_letter_on_panic" envconfig:"DEAD_LETTER_ON_PANIC"`
+	// StoreRetryCount keeps the number of retries a task has left in the
+	// result backend, so it is not reset if a retried message loses fields
+	// on its way back to the queue
+	StoreRetryCount bool `yaml:"store_retry_count" envconfig:"STORE_RETRY_COUNT"`
+	// BackendWriteRetries is how many times the worker retries storing the
+	// final state of a task after the result backend failed to store it
+	BackendWriteRetries int `yaml:"backend_write_retries" envconfig:"BACKEND_WRITE_RETRIES"`
+	// BackendWriteBackoff is how many milliseconds the worker waits before
+	// the first backend write retry, following retries are spaced out by the
+	// Fibonacci sequence, 0 means 100 milliseconds
+	BackendWriteBackoff int `yaml:"backend_write_backoff" envconfig:"BACKEND_WRITE_BACKOFF"`
+	// MaxConsumeAge is how many seconds after it was published, or its ETA
+	// passed, a task is still processed, older tasks are discarded as stale,
+	// 0 means no limit
+	MaxConsumeAge int `yaml:"max_consume_age" envconfig:"MAX_CONSUME_AGE"`
+	// WorkerGroup is the group of the worker, it processes tasks sent to
+	// its group and tasks without a group
+	WorkerGroup string `yaml:"worker_group" envconfig:"WORKER_GROUP"`
+	// MessageVersion is sent in the x-message-version header of published
+	// messages, consumers decoding with a versioned message adapter pick
+	// the field mapping by it
+	MessageVersion string `yaml:"message_version" envconfig:"MESSAGE_VERSION"`
+	// Base64Encode publishes message bodies base64 encoded, flagged by a
+	// header, for proxies which only pass text payloads (AMQP only)
+	Base64Encode bool `yaml:"base64_encode" envconfig:"BASE64_ENCODE"`
+	// DeliveryBuffer is how many deliveries are fetched ahead of the worker
+	// pool to smooth bursts, capped by AMQP.PrefetchCount as buffered
+	// deliveries are unacked, 0 disables buffering (AMQP only)
+	DeliveryBuffer int `yaml:"delivery_buffer" envconfig:"DELIVERY_BUFFER"`
+	// WeightBudget caps the sum of weights of tasks a worker runs at once,
+	// new tasks are not pulled until enough weight is released, 0 disables
+	// the budget (AMQP only)
+	WeightBudget int `yaml:"weight_budget" envconfig:"WEIGHT_BUDGET"`
+	// WorkflowReservedConcurrency is how many of the worker's goroutines
+	// only run workflow steps (tasks of groups, chords and chains), so
+	// standalone tasks can't starve workflows, 0 reserves none (AMQP only)
+	WorkflowReservedConcurrency int `yaml:"workflow_reserved_concurrency" envconfig:"WORKFLOW_RESERVED_CONCURRENCY"`
+	// MaxConsumersPerQueue makes a worker refuse to start consuming if the
+	// queue already has that many consumers, 0 means no limit (AMQP only)
+	MaxConsumersPerQueue int `yaml:"max_consumers_per_queue" envconfig:"MAX_CONSUMERS_PER_QUEUE"`
+	// WarmupDuration is how many seconds a worker takes after it starts
+	// consuming to ramp up from one task at a time to its full concurrency,
+	// 0 starts at full concurrency
+	WarmupDuration int `yaml:"warmup_duration" envconfig:"WARMUP_DURATION"`
+	// ArgEncryptionKey is a hex encoded AES key (16, 24 or 32 bytes) values
+	// of task args flagged as encrypted are encrypted with in the broker
+	ArgEncryptionKey string `yaml:"arg_encryption_key" envconfig:"ARG_ENCRYPTION_KEY"`
+	// ETAPrecision is how many milliseconds a delayed task can arrive before
+	// its ETA and still run, earlier tasks are delayed again for the time
+	// left, 0 means 100 milliseconds
+	ETAPrecision int `yaml:"eta_precision" envconfig:"ETA_PRECISION"`
+	// StartJitter is up to how many milliseconds the worker waits before
+	// starting a task, a random delay so tasks sent at once don't all hit
+	// shared resources at the same instant, 0 means no jitter
+	StartJitter int `yaml:"start_jitter" envconfig:"START_JITTER"`
+	// MaxWorkflowDepth is how many steps deep a workflow can get before its
+	// callbacks fail instead of being sent, 0 means no limit
+	MaxWorkflowDepth int `yaml:"max_workflow_depth" envconfig:"MAX_WORKFLOW_DEPTH"`
+	// DrainTimeout is how many seconds a draining worker waits for tasks
+	// being processed to finish, 0 means 30 seconds
+	DrainTimeout int `yaml:"drain_timeout" envconfig:"DRAIN_TIMEOUT"`
+	// OrderedMode processes tasks one by one in the order they are received
+	// and acknowledges them only after processing, concurrency is ignored
+	OrderedMode bool `yaml:"ordered_mode" envconfig:"ORDERED_MODE"`
+	// CompletionMarkerExpireIn is how many seconds result backends remember
+	// that a task completed after its result expired, 0 means ten times the
+	// results expiration
+	CompletionMarkerExpireIn int `yaml:"completion_marker_expire_in" envconfig:"COMPLETION_MARKER_EXPIRE_IN"`
+	// ResultsKeyPrefix is prepended to keys (queue names with AMQP, collection
+	// names with MongoDB) result backends store task states and group meta
+	// data under, so several deployments can share one server
+	ResultsKeyPrefix string `yaml:"results_key_prefix" envconfig:"RESULTS_KEY_PREFIX"`
+	// TaskNamePrefix is prepended to names of registered and sent tasks, so
+	// services sharing a broker don't run each other's tasks of the same name
+	TaskNamePrefix string `yaml:"task_name_prefix" envconfig:"TASK_NAME_PREFIX"`
+	// QueuePrefix is prepended to queue names (and the exchange name with
+	// AMQP) brokers publish tasks to and consume them from
+	QueuePrefix string `yaml:"queue_prefix" envconfig:"QUEUE_PREFIX"`
+	// Partitions is the number of partition queues tasks with a partition
+	// key are routed to by consistent hashing, 0 disables partitioning
+	Partitions int `yaml:"partitions" envconfig:"PARTITIONS"`
+	// MaxQueueDepth is how many tasks can wait in the default queue before
+	// publishing is held back, 0 means no limit
+	MaxQueueDepth int `yaml:"max_queue_depth" envconfig:"MAX_QUEUE_DEPTH"`
+	// PublishBackpressureMode is either BackpressureBlock (default) or
+	// BackpressureError to return ErrQueueFull instead of waiting
+	PublishBackpressureMode string `yaml:"publish_backpressure_mode" envconfig:"PUBLISH_BACKPRESSURE_MODE"`
+
+	// unpartitioned is the configuration ForPartition derived this one from
+	unpartitioned *Config
 }
 
 // QueueBindingArgs arguments which are used when binding to the exchange
 type QueueBindingArgs map[string]interface{}
 
+// ConsumerArgs arguments which are passed to the broker when consuming
+// from the queue, e.g. consumer priority or stream offset
+type ConsumerArgs map[string]interface{}
+
+// ExchangeBinding binds the destination exchange to the source exchange so
+// messages published to the source exchange are routed through the
+// destination exchange as well
+type ExchangeBinding struct {
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination"`
+	RoutingKey  string `yaml:"routing_key"`
+}
+
 // AMQPConfig wraps RabbitMQ related configuration
 type AMQPConfig struct {
-	Exchange         string           `yaml:"exchange" envconfig:"AMQP_EXCHANGE"`
-	ExchangeType     string           `yaml:"exchange_type" envconfig:"AMQP_EXCHANGE_TYPE"`
-	QueueBindingArgs QueueBindingArgs `yaml:"queue_binding_args" envconfig:"AMQP_QUEUE_BINDING_ARGS"`
-	BindingKey       string           `yaml:"binding_key" envconfig:"AMQP_BINDING_KEY"`
-	PrefetchCount    int              `yaml:"prefetch_count" envconfig:"AMQP_PREFETCH_COUNT"`
+	Exchange         string            `yaml:"exchange" envconfig:"AMQP_EXCHANGE"`
+	ExchangeType     string            `yaml:"exchange_type" envconfig:"AMQP_EXCHANGE_TYPE"`
+	QueueBindingArgs QueueBindingArgs  `yaml:"queue_binding_args" envconfig:"AMQP_QUEUE_BINDING_ARGS"`
+	BindingKey       string            `yaml:"binding_key" envconfig:"AMQP_BINDING_KEY"`
+	PrefetchCount    int               `yaml:"prefetch_count" envconfig:"AMQP_PREFETCH_COUNT"`
+	QueueType        string            `yaml:"queue_type" envconfig:"AMQP_QUEUE_TYPE"`
+	ConnectionName   string            `yaml:"connection_name" envconfig:"AMQP_CONNECTION_NAME"`
+	ConsumerArgs     ConsumerArgs      `yaml:"consumer_args" envconfig:"AMQP_CONSUMER_ARGS"`
+	ExchangeBindings []ExchangeBinding `yaml:"exchange_bindings" ignored:"true"`
+	// DelayStrategy is either DelayStrategyPerTask (default) or
+	// DelayStrategyBucketed to reuse delay queues
+	DelayStrategy string `yaml:"delay_strategy" envconfig:"AMQP_DELAY_STRATEGY"`
+	// DelayQueueExpireGrace is how many seconds a per-task delay queue is
+	// kept after its message expires, so the message is dead-lettered before
+	// the queue is deleted even under load, 0 means 3 seconds
+	DelayQueueExpireGrace int `yaml:"delay_queue_expire_grace" envconfig:"AMQP_DELAY_QUEUE_EXPIRE_GRACE"`
+	// MaxDelayQueues caps how many per-task delay queues a broker keeps at
+	// once, further tasks are delayed in bucketed queues until some of them
+	// expire, 0 means no limit
+	MaxDelayQueues int `yaml:"max_delay_queues" envconfig:"AMQP_MAX_DELAY_QUEUES"`
+	// SaturatedPrefetchCount is the prefetch count a worker lowers its
+	// channel QoS to once all its goroutines stayed busy for
+	// SaturationPeriod seconds (0 means 5), the configured PrefetchCount is
+	// restored when a goroutine frees up. 0 disables adapting the prefetch
+	SaturatedPrefetchCount int `yaml:"saturated_prefetch_count" envconfig:"AMQP_SATURATED_PREFETCH_COUNT"`
+	SaturationPeriod       int `yaml:"saturation_period" envconfig:"AMQP_SATURATION_PERIOD"`
+	// DeadLetterExchange captures messages rejected without requeueing from
+	// the default queue, DeadLetterRoutingKey optionally replaces their
+	// routing key
+	DeadLetterExchange   string `yaml:"dead_letter_exchange" envconfig:"AMQP_DEAD_LETTER_EXCHANGE"`
+	DeadLetterRoutingKey string `yaml:"dead_letter_routing_key" envconfig:"AMQP_DEAD_LETTER_ROUTING_KEY"`
+}
+
+// RedisConfig wraps Redis related configuration
+type RedisConfig struct {
+	// NotifyResults publishes a notification on a pub/sub channel when a task
+	// state changes so AsyncResult does not need to poll
+	NotifyResults bool `yaml:"notify_results" envconfig:"REDIS_NOTIFY_RESULTS"`
+	// BlockTimeout is for how many seconds an idle worker blocks waiting
+	// for a task before checking whether it should stop, defaults to 1
+	BlockTimeout int `yaml:"block_timeout" envconfig:"REDIS_BLOCK_TIMEOUT"`
 }
 
 // Decode from yaml to map (any field whose type or pointer-to-type implements
@@ -65,6 +272,49 @@ func (args *QueueBindingArgs) Decode(value string) error {
 	return nil
 }
 
+// Decode from yaml to map the same way as QueueBindingArgs
+func (args *ConsumerArgs) Decode(value string) error {
+	var mp QueueBindingArgs
+	if err := mp.Decode(value); err != nil {
+		return err
+	}
+	*args = ConsumerArgs(mp)
+	return nil
+}
+
+// PartitionName returns the name of the queue (or routing key) of a partition
+func PartitionName(name string, partition int) string {
+	return fmt.Sprintf("%s.%d", name, partition)
+}
+
+// ForPartition returns a copy of the configuration consuming from the queue
+// of the partition, i.e. with the default queue (and binding key of a direct
+// AMQP exchange) of the partition. Tasks are still published as by any other
+// producer, routed by the queue names of the configuration it was called on
+func (cnf *Config) ForPartition(partition int) *Config {
+	unpartitioned := *cnf.Unpartitioned()
+	partitionCnf := unpartitioned
+	partitionCnf.unpartitioned = &unpartitioned
+	partitionCnf.DefaultQueue = PartitionName(unpartitioned.DefaultQueue, partition)
+	if unpartitioned.AMQP != nil {
+		amqpCnf := *unpartitioned.AMQP
+		if amqpCnf.ExchangeType == "direct" {
+			amqpCnf.BindingKey = PartitionName(amqpCnf.BindingKey, partition)
+		}
+		partitionCnf.AMQP = &amqpCnf
+	}
+	return &partitionCnf
+}
+
+// Unpartitioned returns the configuration ForPartition derived this one from,
+// or this one if it is not the configuration of a partition
+func (cnf *Config) Unpartitioned() *Config {
+	if cnf.unpartitioned != nil {
+		return cnf.unpartitioned
+	}
+	return cnf
+}
+
 // Get returns internally stored configuration
 func Get() *Config {
 	return cnf
@@ -18,3 +18,23 @@ func TestRefreshConfig(t *testing.T) {
 	config.Refresh(&config.Config{Broker: "bar"})
 	assert.Equal(t, "bar", cnf.Broker)
 }
+
+func TestConfigForPartition(t *testing.T) {
+	cnf := &config.Config{
+		DefaultQueue: "queue",
+		AMQP: &config.AMQPConfig{
+			ExchangeType: "direct",
+			BindingKey:   "binding_key",
+		},
+	}
+
+	partitionCnf := cnf.ForPartition(3)
+	assert.Equal(t, "queue.3", partitionCnf.DefaultQueue)
+	assert.Equal(t, "binding_key.3", partitionCnf.AMQP.BindingKey)
+	assert.Equal(t, "binding_key", cnf.AMQP.BindingKey)
+	assert.Equal(t, "queue", partitionCnf.Unpartitioned().DefaultQueue)
+	assert.Equal(t, cnf, cnf.Unpartitioned())
+
+	// Partitions are derived from the shared queue names only
+	assert.Equal(t, "queue.5", partitionCnf.ForPartition(5).DefaultQueue)
+}
@@ -39,5 +39,6 @@ func TestNewFromEnvironment(t *testing.T) {
 	assert.Equal(t, "machinery_task", cnf.AMQP.BindingKey)
 	assert.Equal(t, "any", cnf.AMQP.QueueBindingArgs["x-match"])
 	assert.Equal(t, "png", cnf.AMQP.QueueBindingArgs["image-type"])
+	assert.Equal(t, "10", cnf.AMQP.ConsumerArgs["x-priority"])
 	assert.Equal(t, 3, cnf.AMQP.PrefetchCount)
 }
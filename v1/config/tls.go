@@ -0,0 +1,63 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS holds paths of PEM encoded certificates a *tls.Config is assembled
+// from, so TLS (including mutual TLS) can be configured without building
+// the config by hand
+type TLS struct {
+	// CACert is the CA certificate server certificates are verified with,
+	// the system pool is used if empty
+	CACert string `yaml:"ca_cert" envconfig:"TLS_CA_CERT"`
+	// ClientCert and ClientKey are the certificate and key the client
+	// authenticates itself with
+	ClientCert string `yaml:"client_cert" envconfig:"TLS_CLIENT_CERT"`
+	ClientKey  string `yaml:"client_key" envconfig:"TLS_CLIENT_KEY"`
+	// ServerName is the name server certificates are verified against
+	// (SNI), the host of the URL connected to is used if empty
+	ServerName         string `yaml:"server_name" envconfig:"TLS_SERVER_NAME"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" envconfig:"TLS_INSECURE_SKIP_VERIFY"`
+}
+
+// Load assembles a *tls.Config from the configured certificates, nil is
+// returned if nothing is configured
+func (t *TLS) Load() (*tls.Config, error) {
+	if t == nil || *t == (TLS{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CACert != "" {
+		caCert, err := ioutil.ReadFile(t.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Read CA certificate error: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates found in %s", t.CACert)
+		}
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		if t.ClientCert == "" || t.ClientKey == "" {
+			return nil, errors.New("Both client certificate and key are required")
+		}
+		clientCert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Load client certificate error: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
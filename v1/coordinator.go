@@ -0,0 +1,163 @@
+package machinery
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+// Coordinator advances reactive workflows from states stored in the result
+// backend, i.e. it publishes a step of a reactive chain once the previous
+// one succeeded. Unlike callbacks sent by the worker which ran the previous
+// step, progress is not lost if that worker crashes right after the step
+// completed
+type Coordinator struct {
+	server *Server
+	// PollInterval is how often task states are checked while waiting for
+	// a step to complete if the result backend does not notify about them
+	PollInterval time.Duration
+}
+
+// NewCoordinator creates Coordinator instance
+func (server *Server) NewCoordinator() *Coordinator {
+	return &Coordinator{server: server, PollInterval: time.Second}
+}
+
+// Advance publishes the next step of the reactive workflow if the previous
+// one succeeded and the step was not published yet. It returns true once the
+// workflow completed, i.e. all steps succeeded or one of them failed
+func (coordinator *Coordinator) Advance(workflowUUID string) (bool, error) {
+	state, err := coordinator.advance(workflowUUID)
+	if err != nil {
+		return false, err
+	}
+	return state.ActiveStep == -1 || state.State == tasks.StateFailure, nil
+}
+
+// Watch advances the reactive workflow until it completes or stop is closed,
+// it waits for tasks to complete by result notifications if the result
+// backend supports them and polls every PollInterval otherwise
+func (coordinator *Coordinator) Watch(workflowUUID string, stop <-chan struct{}) error {
+	for {
+		state, err := coordinator.advance(workflowUUID)
+		if err != nil {
+			return err
+		}
+		if state.ActiveStep == -1 || state.State == tasks.StateFailure {
+			return nil
+		}
+
+		notifications, unsubscribe := coordinator.subscribe(state.Steps[state.ActiveStep])
+		select {
+		case <-notifications:
+		case <-time.After(coordinator.PollInterval):
+		case <-stop:
+			unsubscribe()
+			return nil
+		}
+		unsubscribe()
+	}
+}
+
+// advance publishes the active step of the workflow if it was not published
+// yet and returns the workflow state
+func (coordinator *Coordinator) advance(workflowUUID string) (*tasks.WorkflowState, error) {
+	server := coordinator.server
+
+	workflow, err := server.getWorkflow(workflowUUID)
+	if err != nil {
+		return nil, err
+	}
+	if workflow.Signatures == nil {
+		return nil, fmt.Errorf("Workflow %s is not reactive", workflowUUID)
+	}
+
+	// The first step is published when the workflow is sent. Failing to
+	// read a task state fails the check, so the step after it is not
+	// published until the result backend answers again
+	state, err := server.workflowState(workflow)
+	if err != nil {
+		return nil, err
+	}
+	state = settleIgnoredResults(workflow, state)
+	step := state.ActiveStep
+	if step < 1 || state.State == tasks.StateFailure {
+		return state, nil
+	}
+
+	previous := workflow.Signatures[step-1][0]
+	previousState := state.Steps[step-1].Tasks[0]
+	for i, signature := range workflow.Signatures[step] {
+		// SendTask marks the task as pending before it is published, so
+		// only the marker saved after publishing tells the step was sent.
+		// A crash right after publishing publishes the task twice
+		if workflow.Published[signature.UUID] {
+			continue
+		}
+
+		if !previous.Immutable {
+			passResults(signature, previousState.Results)
+		}
+		signature.WorkflowDepth = previous.WorkflowDepth + 1
+		// Hand over what is left of the chain retry budget
+		if previousState.ChainRetryBudget != nil {
+			budget := *previousState.ChainRetryBudget
+			signature.ChainRetryBudget = &budget
+		}
+		if _, err := server.SendTask(signature); err != nil {
+			return nil, fmt.Errorf("Send step %d task %d error: %s", step, i, err)
+		}
+
+		if err := server.markPublished(workflow, signature); err != nil {
+			return nil, err
+		}
+	}
+
+	return settleIgnoredResults(workflow, state), nil
+}
+
+// settleIgnoredResults reports published tasks which ignore their results as
+// succeeded with the retry budget they were published with, they never get
+// a state so the next step follows once they are published
+func settleIgnoredResults(workflow *tasks.Workflow, state *tasks.WorkflowState) *tasks.WorkflowState {
+	settled := false
+	states := make([][]*tasks.TaskState, len(state.Steps))
+	for i, stepState := range state.Steps {
+		states[i] = stepState.Tasks
+		for j, signature := range workflow.Signatures[i] {
+			if signature.IgnoreResult && workflow.Published[signature.UUID] && !states[i][j].IsSuccess() {
+				states[i][j] = tasks.NewSuccessTaskState(signature, nil)
+				settled = true
+			}
+		}
+	}
+	if !settled {
+		return state
+	}
+	return tasks.NewWorkflowState(workflow, states)
+}
+
+// subscribe subscribes to result notifications of the first task of the
+// step which has not completed yet, the returned channel is nil if the
+// result backend does not support them so waiting falls back to polling
+func (coordinator *Coordinator) subscribe(step *tasks.WorkflowStepState) (<-chan struct{}, func()) {
+	notifier, ok := coordinator.server.GetBackend().(backends.ResultNotifier)
+	if !ok {
+		return nil, func() {}
+	}
+
+	for _, taskState := range step.Tasks {
+		if taskState.IsCompleted() {
+			continue
+		}
+		notifications, unsubscribe, err := notifier.SubscribeResult(taskState.TaskUUID)
+		if err != nil {
+			return nil, func() {}
+		}
+		return notifications, unsubscribe
+	}
+
+	return nil, func() {}
+}
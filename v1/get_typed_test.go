@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package machinery_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+type Invoice struct {
+	Number string
+	Total  int64
+	Paid   bool
+}
+
+func TestGetTyped(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTask("invoice", func(number string) (Invoice, error) {
+		return Invoice{Number: number, Total: 1200}, nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name: "invoice",
+		Args: []tasks.Arg{{Type: "string", Value: "INV-1"}},
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(broker.published()[0]))
+
+	invoice, err := backends.GetTyped[Invoice](asyncResult, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, Invoice{Number: "INV-1", Total: 1200}, invoice)
+
+	_, err = backends.GetTyped[string](asyncResult, time.Millisecond)
+	assert.EqualError(t, err, "Result of type machinery_test.Invoice cannot be decoded into string")
+}
@@ -1,12 +1,25 @@
 package log
 
 import (
+	"io/ioutil"
+	stdlog "log"
+
 	"github.com/RichardKnop/logging"
 )
 
+// Levels tasks can log their lifecycle at
+const (
+	LevelDebug   = "debug"
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
 var (
 	logger = logging.New(nil, nil, new(logging.ColouredFormatter))
 
+	// DEBUG discards its output unless a custom logger is set
+	DEBUG logging.LoggerInterface = stdlog.New(ioutil.Discard, "", 0)
 	// INFO ...
 	INFO = logger[logging.INFO]
 	// WARNING ...
@@ -19,8 +32,23 @@ var (
 
 // Set sets a custom logger
 func Set(l logging.LoggerInterface) {
+	DEBUG = l
 	INFO = l
 	WARNING = l
 	ERROR = l
 	FATAL = l
 }
+
+// Logger returns the logger of the given level, INFO for unknown levels
+func Logger(level string) logging.LoggerInterface {
+	switch level {
+	case LevelDebug:
+		return DEBUG
+	case LevelWarning:
+		return WARNING
+	case LevelError:
+		return ERROR
+	default:
+		return INFO
+	}
+}
@@ -4,11 +4,21 @@ import (
 	"testing"
 
 	"github.com/koblelabs/machinery/v1/log"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDefaultLogger(t *testing.T) {
+	log.DEBUG.Print("should not panic")
 	log.INFO.Print("should not panic")
 	log.WARNING.Print("should not panic")
 	log.ERROR.Print("should not panic")
 	log.FATAL.Print("should not panic")
 }
+
+func TestLogger(t *testing.T) {
+	assert.Equal(t, log.DEBUG, log.Logger(log.LevelDebug))
+	assert.Equal(t, log.INFO, log.Logger(log.LevelInfo))
+	assert.Equal(t, log.WARNING, log.Logger(log.LevelWarning))
+	assert.Equal(t, log.ERROR, log.Logger(log.LevelError))
+	assert.Equal(t, log.INFO, log.Logger("verbose"))
+}
@@ -1,13 +1,25 @@
 package machinery
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/koblelabs/machinery/v1/backends"
 	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/clock"
 	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/log"
 	"github.com/koblelabs/machinery/v1/tasks"
 	"github.com/satori/go.uuid"
 )
@@ -19,13 +31,85 @@ type Server struct {
 	registeredTasks map[string]interface{}
 	broker          brokers.Interface
 	backend         backends.Interface
+	streamOpeners   map[string]StreamOpener
+	taskOptions     map[string]TaskOptions
+	queueRoom       queueHeadroom
+	clock           clock.Clock
 }
 
+// queueHeadroom counts down the room left in the default queue at the last
+// reading of its depth, so the depth is not read for every published task
+type queueHeadroom struct {
+	mu   sync.Mutex
+	room int
+	read time.Time
+}
+
+// TaskOptions set how workers run a task, the Set* methods of Server change
+// single options of a task
+type TaskOptions struct {
+	// LogLevel (log.LevelDebug, log.LevelInfo, ...) workers log the
+	// lifecycle of the task at. Tasks without one log only when they are
+	// processed at INFO, receiving and starting them is logged at DEBUG
+	LogLevel string
+	// Backend stores states of the task instead of the default result
+	// backend, see SetTaskBackend
+	Backend backends.Interface
+	// OptionalArgs are defaults of optional trailing parameters, nil if
+	// all parameters are required, see SetOptionalArgs
+	OptionalArgs []interface{}
+	// RunOnLockedThread runs the task on a goroutine locked to its OS
+	// thread, see SetRunOnLockedThread
+	RunOnLockedThread bool
+	// GlobalConcurrency limits how many of the tasks run at once across all
+	// workers, 0 means no limit, see SetGlobalTaskConcurrency
+	GlobalConcurrency int
+	// ManualCommit makes the task acknowledge its delivery itself, see
+	// SetManualCommit
+	ManualCommit bool
+	// MaxMemoryBytes cancels the task and fails it once more than that was
+	// allocated on the heap while it ran, sampled every 100ms, 0 means no
+	// limit. Only enforced while no other task runs on the worker
+	MaxMemoryBytes uint64
+	// FailOnGoroutineLeak fails the task if goroutines started while it ran
+	// are still running 100ms after it returned. Only checked while no other
+	// task runs on the worker
+	FailOnGoroutineLeak bool
+}
+
+// StreamOpener opens the stream a stream arg references, openers are looked
+// up by the scheme of the URL. ctx is the context the task is called with
+type StreamOpener func(ctx context.Context, ref *url.URL) (io.ReadCloser, error)
+
 // ErrNonePurged for when it's ok that no messages were purged
 var ErrNonePurged = errors.New("No messages purged!")
 
+// ErrTaskSkipped is returned by SendTaskIf when the condition does not hold
+var ErrTaskSkipped = errors.New("Task skipped, condition not met")
+
+// ErrNotReplaceable is returned by ReplaceTask when the old task was not sent
+// as Replaceable, workers would not skip it
+var ErrNotReplaceable = errors.New("Task was not sent as Replaceable")
+
+// ErrQueueFull is returned when publishing to a queue holding MaxQueueDepth
+// tasks with PublishBackpressureMode set to error
+var ErrQueueFull = errors.New("Queue full, too many tasks waiting")
+
+// backpressurePollInterval is how often the queue depth is checked while
+// publishing is blocked
+var backpressurePollInterval = 100 * time.Millisecond
+
 // NewServer creates Server instance
 func NewServer(cnf *config.Config) (*Server, error) {
+	// Assemble TLS config from configured certificates
+	if cnf.TLSConfig == nil {
+		tlsConfig, err := cnf.TLS.Load()
+		if err != nil {
+			return nil, fmt.Errorf("TLS config error: %s", err)
+		}
+		cnf.TLSConfig = tlsConfig
+	}
+
 	broker, err := BrokerFactory(cnf)
 	if err != nil {
 		return nil, err
@@ -39,6 +123,11 @@ func NewServer(cnf *config.Config) (*Server, error) {
 		registeredTasks: make(map[string]interface{}),
 		broker:          broker,
 		backend:         backend,
+		taskOptions:     make(map[string]TaskOptions),
+		clock:           clock.Real,
+	}
+	srv.streamOpeners = map[string]StreamOpener{
+		"blob": srv.openBlob,
 	}
 
 	// init for eager-mode
@@ -58,9 +147,18 @@ func (server *Server) NewWorker(consumerTag string, concurrency int) *Worker {
 		server:      server,
 		ConsumerTag: consumerTag,
 		Concurrency: concurrency,
+		clock:       server.clock,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
+// SetClock sets the clock publish times, ETAs of debounced tasks and queue
+// depth readings are measured with, and publishers held back by a full queue
+// wait on. Workers created afterwards use it too
+func (server *Server) SetClock(clock clock.Clock) {
+	server.clock = clock
+}
+
 // GetBroker returns broker
 func (server *Server) GetBroker() brokers.Interface {
 	return server.broker
@@ -71,6 +169,100 @@ func (server *Server) SetBroker(broker brokers.Interface) {
 	server.broker = broker
 }
 
+// SetDeadLetterHandler sets a handler the broker calls with messages which
+// can't be processed (malformed or redelivered too many times) before they
+// are discarded or moved to the dead-letter queue
+func (server *Server) SetDeadLetterHandler(handler func(body []byte, reason error)) error {
+	setter, ok := server.broker.(brokers.DeadLetterHandlerSetter)
+	if !ok {
+		return errors.New("Broker does not support dead-letter handlers")
+	}
+	setter.SetDeadLetterHandler(handler)
+	return nil
+}
+
+// SetConsumeInterceptors sets interceptors the broker passes consumed tasks
+// through, in order, before they are processed, e.g. to drop tasks of
+// disabled tenants
+func (server *Server) SetConsumeInterceptors(interceptors ...brokers.ConsumeInterceptor) error {
+	setter, ok := server.broker.(brokers.ConsumeInterceptorSetter)
+	if !ok {
+		return errors.New("Broker does not support consume interceptors")
+	}
+	setter.SetConsumeInterceptors(interceptors...)
+	return nil
+}
+
+// SetScheduler sets the scheduler holding tasks with ETA in the future until
+// they are due instead of the broker's native delay
+func (server *Server) SetScheduler(scheduler brokers.Scheduler) error {
+	setter, ok := server.broker.(brokers.SchedulerSetter)
+	if !ok {
+		return errors.New("Broker does not support schedulers")
+	}
+	setter.SetScheduler(scheduler)
+	return nil
+}
+
+// SetStreamOpener sets the opener of stream args referencing URLs with the
+// scheme, blob:// (result backend blobs) is supported already. Opening
+// http(s):// streams has to be enabled with NewHTTPStreamOpener as task
+// args would otherwise make workers request any URL they can reach
+func (server *Server) SetStreamOpener(scheme string, opener StreamOpener) {
+	server.streamOpeners[scheme] = opener
+}
+
+// openStream opens the stream the URL references
+func (server *Server) openStream(ctx context.Context, ref string) (io.ReadCloser, error) {
+	parsed, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	opener, ok := server.streamOpeners[parsed.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("No opener of %s streams", parsed.Scheme)
+	}
+	return opener(ctx, parsed)
+}
+
+// openBlob opens a blob://key stream stored in the result backend
+func (server *Server) openBlob(ctx context.Context, ref *url.URL) (io.ReadCloser, error) {
+	store, ok := server.backend.(backends.BlobStore)
+	if !ok {
+		return nil, errors.New("Result backend does not support blobs")
+	}
+	return store.GetBlob(ref.Host + ref.Path)
+}
+
+// NewHTTPStreamOpener returns an opener of http(s):// streams fetched with a
+// GET request. Connecting and waiting for the response headers each time out
+// after timeout, the body is read as long as the task does
+func NewHTTPStreamOpener(timeout time.Duration) StreamOpener {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+	return func(ctx context.Context, ref *url.URL) (io.ReadCloser, error) {
+		req, err := http.NewRequest("GET", ref.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+}
+
 // GetBackend returns backend
 func (server *Server) GetBackend() backends.Interface {
 	return server.backend
@@ -81,6 +273,85 @@ func (server *Server) SetBackend(backend backends.Interface) {
 	server.backend = backend
 }
 
+// SetTaskBackend sets a result backend storing states of tasks with the
+// given name instead of the default backend
+func (server *Server) SetTaskBackend(name string, backend backends.Interface) {
+	server.updateTaskOptions(name, func(options *TaskOptions) {
+		options.Backend = backend
+	})
+}
+
+// GetTaskBackend returns the result backend storing state of the task,
+// tasks which are part of a group always use the default backend as
+// the group completion is tracked there
+func (server *Server) GetTaskBackend(signature *tasks.Signature) backends.Interface {
+	if signature.GroupUUID != "" {
+		return server.backend
+	}
+	if backend := server.taskOptions[server.taskName(signature.Name)].Backend; backend != nil {
+		return backend
+	}
+	return server.backend
+}
+
+// SetOptionalArgs makes trailing parameters of the task with the given name
+// optional, signatures with fewer arguments than the task function has
+// parameters get the defaults (aligned to the last parameters) or zero
+// values instead of failing, e.g. so parameters can be added to a task while
+// older messages are still queued
+func (server *Server) SetOptionalArgs(name string, defaults ...interface{}) {
+	if defaults == nil {
+		defaults = []interface{}{}
+	}
+	server.updateTaskOptions(name, func(options *TaskOptions) {
+		options.OptionalArgs = defaults
+	})
+}
+
+// SetRunOnLockedThread makes workers run the task with the given name on a
+// goroutine locked to its OS thread, for tasks calling into cgo or other
+// thread-affine native code
+func (server *Server) SetRunOnLockedThread(name string, runOnLockedThread bool) {
+	server.updateTaskOptions(name, func(options *TaskOptions) {
+		options.RunOnLockedThread = runOnLockedThread
+	})
+}
+
+// SetGlobalTaskConcurrency limits how many tasks with the given name run at
+// once across all workers, e.g. for tasks calling an API which allows only
+// so many concurrent calls. The slots are kept in the result backend, a task
+// received while all of them are taken is put back to the queue
+func (server *Server) SetGlobalTaskConcurrency(name string, max int) {
+	server.updateTaskOptions(name, func(options *TaskOptions) {
+		options.GlobalConcurrency = max
+	})
+}
+
+// SetManualCommit makes the task with the given name acknowledge its delivery
+// itself by calling tasks.Commit with its context once its work is durable,
+// e.g. after its own database commit. Deliveries of tasks which don't commit
+// are acknowledged once processed (AMQP only, Redis removes tasks from the
+// queue when they are received)
+func (server *Server) SetManualCommit(name string, manualCommit bool) {
+	server.updateTaskOptions(name, func(options *TaskOptions) {
+		options.ManualCommit = manualCommit
+	})
+}
+
+// SetTaskOptions sets the options of the task with the given name, replacing
+// any set before
+func (server *Server) SetTaskOptions(name string, options TaskOptions) {
+	server.taskOptions[server.taskName(name)] = options
+}
+
+// updateTaskOptions changes the options of the task with the given name
+func (server *Server) updateTaskOptions(name string, update func(options *TaskOptions)) {
+	name = server.taskName(name)
+	options := server.taskOptions[name]
+	update(&options)
+	server.taskOptions[name] = options
+}
+
 // GetConfig returns connection object
 func (server *Server) GetConfig() *config.Config {
 	return server.config
@@ -93,63 +364,385 @@ func (server *Server) SetConfig(cnf *config.Config) {
 
 // RegisterTasks registers all tasks at once
 func (server *Server) RegisterTasks(namedTaskFuncs map[string]interface{}) error {
-	for _, task := range namedTaskFuncs {
+	registeredTasks := make(map[string]interface{}, len(namedTaskFuncs))
+	for name, task := range namedTaskFuncs {
 		if err := tasks.ValidateTask(task); err != nil {
 			return err
 		}
+		registeredTasks[server.taskName(name)] = task
 	}
-	server.registeredTasks = namedTaskFuncs
+	server.registeredTasks = registeredTasks
 	server.broker.SetRegisteredTaskNames(server.GetRegisteredTaskNames())
 	return nil
 }
 
-// RegisterTask registers a single task
+// RegisterTask registers a single task, registering a name registered
+// already is handled as configured by OnDuplicateRegistration
 func (server *Server) RegisterTask(name string, taskFunc interface{}) error {
 	if err := tasks.ValidateTask(taskFunc); err != nil {
 		return err
 	}
+
+	name = server.taskName(name)
+	if _, ok := server.registeredTasks[name]; ok {
+		switch server.config.OnDuplicateRegistration {
+		case config.DuplicateRegistrationError:
+			return fmt.Errorf("Task already registered: %s", name)
+		case config.DuplicateRegistrationIgnore:
+			return nil
+		default:
+			log.WARNING.Printf("Task %s registered again, replacing the previous one", name)
+		}
+	}
+
 	server.registeredTasks[name] = taskFunc
 	server.broker.SetRegisteredTaskNames(server.GetRegisteredTaskNames())
 	return nil
 }
 
+// RegisterTaskWithOptions registers a single task like RegisterTask along
+// with its options
+func (server *Server) RegisterTaskWithOptions(name string, taskFunc interface{}, options TaskOptions) error {
+	if err := server.RegisterTask(name, taskFunc); err != nil {
+		return err
+	}
+	server.SetTaskOptions(name, options)
+	return nil
+}
+
+// RegisterTaskFunc registers a task under the name derived from the function
+// by tasks.FuncName, so producers sending it with SendTaskFunc can't use a
+// different name
+func (server *Server) RegisterTaskFunc(taskFunc interface{}) error {
+	if err := tasks.ValidateTask(taskFunc); err != nil {
+		return err
+	}
+	return server.RegisterTask(tasks.FuncName(taskFunc), taskFunc)
+}
+
 // IsTaskRegistered returns true if the task name is registered with this broker
 func (server *Server) IsTaskRegistered(name string) bool {
-	_, ok := server.registeredTasks[name]
+	_, ok := server.registeredTasks[server.taskName(name)]
 	return ok
 }
 
 // GetRegisteredTask returns registered task by name
 func (server *Server) GetRegisteredTask(name string) (interface{}, error) {
-	taskFunc, ok := server.registeredTasks[name]
+	taskFunc, ok := server.registeredTasks[server.taskName(name)]
 	if !ok {
 		return nil, fmt.Errorf("Task not registered error: %s", name)
 	}
 	return taskFunc, nil
 }
 
+// ValidateWorkflow walks the signature and the callbacks it references,
+// i.e. the following chain steps, error callbacks and chord callback, and
+// returns names of the tasks which are not registered (in order found)
+func (server *Server) ValidateWorkflow(signature *tasks.Signature) []string {
+	var missing []string
+	seen := map[string]bool{}
+
+	var walk func(signature *tasks.Signature)
+	walk = func(signature *tasks.Signature) {
+		if signature == nil {
+			return
+		}
+		if !server.IsTaskRegistered(signature.Name) && !seen[signature.Name] {
+			seen[signature.Name] = true
+			missing = append(missing, signature.Name)
+		}
+		for _, callback := range signature.OnSuccess {
+			walk(callback)
+		}
+		for _, callback := range signature.OnError {
+			walk(callback)
+		}
+		walk(signature.ChordCallback)
+	}
+	walk(signature)
+
+	return missing
+}
+
+// taskName prepends TaskNamePrefix to the task name unless it is prefixed
+// already, e.g. a callback of a task which has been sent before
+func (server *Server) taskName(name string) string {
+	prefix := server.config.TaskNamePrefix
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
+// SendTaskFunc publishes a task registered with RegisterTaskFunc to the
+// default queue, its name is derived from the function
+func (server *Server) SendTaskFunc(taskFunc interface{}, args ...tasks.Arg) (*backends.AsyncResult, error) {
+	name := tasks.FuncName(taskFunc)
+	if name == "" {
+		return nil, tasks.ErrTaskMustBeFunc
+	}
+	return server.SendTask(tasks.NewSignature(name, args))
+}
+
 // SendTask publishes a task to the default queue
 func (server *Server) SendTask(signature *tasks.Signature) (*backends.AsyncResult, error) {
+	signature.Name = server.taskName(signature.Name)
+
 	// Make sure result backend is defined
-	if server.backend == nil {
+	backend := server.GetTaskBackend(signature)
+	if backend == nil {
 		return nil, errors.New("Result backend required")
 	}
 
+	if err := server.checkArgSizes(signature); err != nil {
+		return nil, err
+	}
+
 	// Auto generate a UUID if not set already
 	if signature.UUID == "" {
 		signature.UUID = fmt.Sprintf("task_%v", uuid.NewV4())
 	}
 
-	// Set initial task state to PENDING
-	if err := server.backend.SetStatePending(signature); err != nil {
-		return nil, fmt.Errorf("Set state pending error: %s", err)
+	// Start a new workflow unless the task belongs to one already, callbacks
+	// inherit the correlation ID
+	if signature.CorrelationID == "" {
+		signature.CorrelationID = tasks.NewCorrelationID()
 	}
+	signature.PropagateCorrelationID()
+
+	// Hold back while the queue is too deep
+	if err := server.backpressure(); err != nil {
+		return nil, err
+	}
+
+	// Remember this task as the latest one for its debounce key
+	if signature.DebounceKey != "" {
+		if err := server.debounce(signature); err != nil {
+			return nil, fmt.Errorf("Debounce error: %s", err)
+		}
+	}
+
+	// Set initial task state to PENDING unless nobody reads the result
+	if !signature.IgnoreResult {
+		if err := backend.SetStatePending(signature); err != nil {
+			return nil, fmt.Errorf("Set state pending error: %s", err)
+		}
+	}
+
+	now := server.clock.Now().UTC()
+	signature.PublishedAt = &now
 
 	if err := server.broker.Publish(signature); err != nil {
+		if err == brokers.ErrTaskUnroutable {
+			return nil, err
+		}
 		return nil, fmt.Errorf("Publish message error: %s", err)
 	}
 
-	return backends.NewAsyncResult(signature, server.backend), nil
+	return backends.NewAsyncResult(signature, backend), nil
+}
+
+// checkArgSizes returns an error naming the first argument of the task which
+// is larger than MaxArgBytes once JSON encoded
+func (server *Server) checkArgSizes(signature *tasks.Signature) error {
+	max := server.config.MaxArgBytes
+	if max <= 0 {
+		return nil
+	}
+
+	for i, arg := range signature.Args {
+		encoded, err := json.Marshal(arg)
+		if err != nil {
+			return fmt.Errorf("JSON marshal error: %s", err)
+		}
+		if len(encoded) > max {
+			return fmt.Errorf("Argument %d of task %s is %d bytes, exceeds limit of %d bytes", i, signature.Name, len(encoded), max)
+		}
+	}
+	return nil
+}
+
+// RunTaskSync runs the registered task in process, bypassing the broker, and
+// returns the resulting task state. The signature and results go through the
+// same JSON encoding and reflection as with a broker, so task funcs can be
+// tested exactly as workers run them. Callbacks and retries are not triggered
+func (server *Server) RunTaskSync(signature *tasks.Signature) (*tasks.TaskState, error) {
+	if !server.IsTaskRegistered(signature.Name) {
+		return nil, fmt.Errorf("Task not registered: %s", signature.Name)
+	}
+
+	// Encode and decode the task the same way brokers do
+	message, err := json.Marshal(signature)
+	if err != nil {
+		return nil, fmt.Errorf("JSON marshal error: %s", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	received := new(tasks.Signature)
+	if err := decoder.Decode(received); err != nil {
+		return nil, fmt.Errorf("JSON unmarshal error: %s", err)
+	}
+
+	received.Name = server.taskName(received.Name)
+	if received.UUID == "" {
+		received.UUID = fmt.Sprintf("task_%v", uuid.NewV4())
+	}
+	received.OnSuccess = nil
+	received.OnError = nil
+	received.ChordCallback = nil
+	received.GroupUUID = ""
+	received.RetryCount = 0
+	received.RetryUntil = nil
+
+	// The task runs against a throwaway in-memory result backend, nothing
+	// can be published as no worker is assigned to the eager broker
+	taskOptions := make(map[string]TaskOptions, len(server.taskOptions))
+	for name, options := range server.taskOptions {
+		options.Backend = nil
+		options.GlobalConcurrency = 0
+		options.ManualCommit = false
+		taskOptions[name] = options
+	}
+	syncServer := &Server{
+		config:          server.config,
+		registeredTasks: server.registeredTasks,
+		broker:          brokers.NewEagerBroker(),
+		backend:         backends.NewEagerBackend(),
+		streamOpeners:   server.streamOpeners,
+		taskOptions:     taskOptions,
+		clock:           server.clock,
+	}
+	if err := syncServer.NewWorker("sync", 0).Process(received); err != nil {
+		return nil, err
+	}
+
+	return syncServer.backend.GetState(received.UUID)
+}
+
+// backpressure waits until the default queue holds less than MaxQueueDepth
+// tasks or returns ErrQueueFull if PublishBackpressureMode is error. The
+// depth is only read again once as many tasks were published as there was
+// room for at the last reading, or backpressurePollInterval later as other
+// publishers fill the queue too. Only SendTask, SendGroup and the workflows
+// built on them are held back, not publishes through the broker directly
+func (server *Server) backpressure() error {
+	if server.config.MaxQueueDepth <= 0 {
+		return nil
+	}
+	provider, ok := server.broker.(brokers.QueueStatsProvider)
+	if !ok {
+		return nil
+	}
+
+	for {
+		full, err := server.takeQueueRoom(provider)
+		if err != nil || !full {
+			return err
+		}
+		if server.config.PublishBackpressureMode == config.BackpressureError {
+			return ErrQueueFull
+		}
+		// Waiting without the lock held so publishers blocked by a full
+		// queue don't hold back each other's readings
+		<-server.clock.After(backpressurePollInterval)
+	}
+}
+
+// takeQueueRoom takes room for a task in the default queue, reading its depth
+// unless there was room left at the last reading. It returns true if the
+// queue is full
+func (server *Server) takeQueueRoom(provider brokers.QueueStatsProvider) (bool, error) {
+	headroom := &server.queueRoom
+	headroom.mu.Lock()
+	defer headroom.mu.Unlock()
+	if headroom.room > 0 && server.clock.Now().Sub(headroom.read) < backpressurePollInterval {
+		headroom.room--
+		return false, nil
+	}
+
+	stats, err := provider.QueueStats("")
+	if err != nil {
+		return false, fmt.Errorf("Queue stats error: %s", err)
+	}
+	if stats.Messages >= server.config.MaxQueueDepth {
+		return true, nil
+	}
+	headroom.room = server.config.MaxQueueDepth - stats.Messages - 1
+	headroom.read = server.clock.Now()
+	return false, nil
+}
+
+// SendTaskIf publishes the task only if the condition holds at the time of
+// dispatch, otherwise ErrTaskSkipped is returned and the task state is set
+// to SKIPPED if supported by the result backend
+func (server *Server) SendTaskIf(condition func() (bool, error), signature *tasks.Signature) (*backends.AsyncResult, error) {
+	ok, err := condition()
+	if err != nil {
+		return nil, fmt.Errorf("Condition error: %s", err)
+	}
+	if ok {
+		return server.SendTask(signature)
+	}
+
+	if signature.UUID == "" {
+		signature.UUID = fmt.Sprintf("task_%v", uuid.NewV4())
+	}
+
+	recorder, ok := server.GetTaskBackend(signature).(backends.SkipRecorder)
+	if ok && !signature.IgnoreResult {
+		if err := recorder.SetStateSkipped(signature); err != nil {
+			return nil, fmt.Errorf("Set state skipped error: %s", err)
+		}
+	}
+
+	return nil, ErrTaskSkipped
+}
+
+// debounce stores the task as the latest one sent with its debounce key and
+// delays it by the debounce window so that tasks sent within the window
+// supersede it before it gets executed
+func (server *Server) debounce(signature *tasks.Signature) error {
+	debouncer, ok := server.GetTaskBackend(signature).(backends.Debouncer)
+	if !ok {
+		return errors.New("Result backend does not support debouncing")
+	}
+
+	if signature.ETA == nil && signature.DebounceWindow > 0 {
+		eta := server.clock.Now().UTC().Add(time.Second * time.Duration(signature.DebounceWindow))
+		signature.ETA = &eta
+	}
+
+	return debouncer.SetDebounce(signature.DebounceKey, signature.UUID)
+}
+
+// ReplaceTask sends a task replacing the old one, the old task is marked as
+// superseded and skipped by the worker unless it has run already. This is
+// useful for pending work which can be edited, the latest version wins. Only
+// tasks sent as Replaceable are skipped, ErrNotReplaceable is returned for
+// others, the replacement is sent as Replaceable so it can be replaced again
+func (server *Server) ReplaceTask(old *tasks.Signature, signature *tasks.Signature) (*backends.AsyncResult, error) {
+	superseder, ok := server.backend.(backends.Superseder)
+	if !ok {
+		return nil, errors.New("Result backend does not support replacing tasks")
+	}
+	// Workers don't look up whether other tasks were replaced, both tasks
+	// would run
+	if !old.Replaceable {
+		return nil, ErrNotReplaceable
+	}
+	signature.Replaceable = true
+
+	// Send the replacement first so the work is not lost if that fails
+	asyncResult, err := server.SendTask(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := superseder.SetSuperseded(old.UUID, signature.UUID); err != nil {
+		return nil, fmt.Errorf("Set superseded error: %s", err)
+	}
+
+	return asyncResult, nil
 }
 
 // CancelDeferredTask cancels a queued task
@@ -188,21 +781,92 @@ func (server *Server) CancelDeferredTask(signature *tasks.Signature) (*tasks.Sig
 
 // SendChain triggers a chain of tasks
 func (server *Server) SendChain(chain *tasks.Chain) (*backends.ChainAsyncResult, error) {
+	// The retry budget travels with the chain and is handed over
+	// to the next task once the previous one succeeds
+	if chain.MaxTotalRetries > 0 {
+		budget := chain.MaxTotalRetries
+		chain.Tasks[0].ChainRetryBudget = &budget
+	}
+
+	// Every task knows the deadline so it runs under the time remaining
+	if chain.Deadline != nil {
+		for _, signature := range chain.Tasks {
+			signature.ChainDeadline = chain.Deadline
+		}
+	}
+
+	// Tasks of the chain share a correlation ID, the chain is stored under
+	// its own UUID as correlation IDs can be shared by many workflows
+	if chain.UUID == "" {
+		chain.UUID = tasks.NewChainUUID()
+	}
+	if chain.Tasks[0].CorrelationID == "" {
+		chain.Tasks[0].CorrelationID = tasks.NewCorrelationID()
+	}
+	chain.Tasks[0].PropagateCorrelationID()
+	workflow := tasks.NewChainWorkflow(chain)
+
+	// Tasks of a reactive chain are published by a Coordinator, which finds
+	// them in the stored workflow
+	if chain.Reactive {
+		if _, ok := server.backend.(backends.WorkflowStore); !ok {
+			return nil, errors.New("Result backend does not support reactive workflows")
+		}
+		workflow.Signatures = make([][]*tasks.Signature, len(chain.Tasks))
+		for i, signature := range chain.Tasks {
+			signature.OnSuccess = nil
+			workflow.Signatures[i] = []*tasks.Signature{signature}
+		}
+	}
+
+	if chain.Reactive || server.config.StoreWorkflows {
+		if err := server.saveWorkflow(workflow); err != nil {
+			return nil, err
+		}
+	}
+
 	_, err := server.SendTask(chain.Tasks[0])
 	if err != nil {
 		return nil, err
 	}
+	if chain.Reactive {
+		if err := server.markPublished(workflow, chain.Tasks[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	asyncResults := make([]*backends.AsyncResult, len(chain.Tasks))
+	for i, signature := range chain.Tasks {
+		asyncResults[i] = backends.NewAsyncResult(signature, server.GetTaskBackend(signature))
+	}
 
-	return backends.NewChainAsyncResult(chain.Tasks, server.backend), nil
+	return backends.NewChainAsyncResultFromResults(asyncResults, server.backend), nil
 }
 
-// SendGroup triggers a group of parallel tasks
+// SendGroup triggers a group of parallel tasks, up to sendConcurrency of
+// them are published at a time (0 meaning no limit). Brokers implementing
+// brokers.TransactionalPublisher (AMQP and Redis) publish all tasks of the
+// group in a single transaction instead, sendConcurrency is ignored then
 func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*backends.AsyncResult, error) {
 	// Make sure result backend is defined
 	if server.backend == nil {
 		return nil, errors.New("Result backend required")
 	}
 
+	for _, signature := range group.Tasks {
+		if err := server.checkArgSizes(signature); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkChordMembers(group); err != nil {
+		return nil, err
+	}
+
+	// Hold back while the queue is too deep
+	if err := server.backpressure(); err != nil {
+		return nil, err
+	}
+
 	asyncResults := make([]*backends.AsyncResult, len(group.Tasks))
 
 	var wg sync.WaitGroup
@@ -212,14 +876,64 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*bac
 	// Init group
 	server.backend.InitGroup(group.GroupUUID, group.GetUUIDs())
 
+	// The structure of a chord is stored by SendChord
+	setGroupCorrelationID(group)
+	if server.config.StoreWorkflows && len(group.Tasks) > 0 && group.Tasks[0].ChordCallback == nil {
+		if err := server.saveWorkflow(tasks.NewGroupWorkflow(group)); err != nil {
+			return nil, err
+		}
+	}
+
 	// Init the tasks Pending state first
 	for _, signature := range group.Tasks {
+		signature.Name = server.taskName(signature.Name)
 		if err := server.backend.SetStatePending(signature); err != nil {
 			errorsChan <- err
 			continue
 		}
 	}
 
+	// Publish all tasks or none of them if the broker supports it, so a
+	// failure does not leave a chord waiting for tasks never sent. Members
+	// are written in order, so OrderedDispatch holds as well
+	if publisher, ok := server.broker.(brokers.TransactionalPublisher); ok {
+		select {
+		case err := <-errorsChan:
+			return nil, err
+		default:
+		}
+
+		now := server.clock.Now().UTC()
+		for i, signature := range group.Tasks {
+			signature.PublishedAt = &now
+			asyncResults[i] = backends.NewAsyncResult(signature, server.backend)
+		}
+
+		if err := publisher.PublishTransaction(group.Tasks); err != nil {
+			return nil, fmt.Errorf("Publish message error: %s", err)
+		}
+		return asyncResults, nil
+	}
+
+	// Publish tasks one by one to keep them in order
+	if group.OrderedDispatch {
+		select {
+		case err := <-errorsChan:
+			return nil, err
+		default:
+		}
+
+		for i, signature := range group.Tasks {
+			now := server.clock.Now().UTC()
+			signature.PublishedAt = &now
+			if err := server.broker.Publish(signature); err != nil {
+				return asyncResults, fmt.Errorf("Publish message error: %s", err)
+			}
+			asyncResults[i] = backends.NewAsyncResult(signature, server.backend)
+		}
+		return asyncResults, nil
+	}
+
 	pool := make(chan struct{}, sendConcurrency)
 	go func() {
 		for i := 0; i < sendConcurrency; i++ {
@@ -238,6 +952,8 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*bac
 
 			// Publish task
 
+			now := server.clock.Now().UTC()
+			s.PublishedAt = &now
 			err := server.broker.Publish(s)
 
 			if sendConcurrency > 0 {
@@ -267,20 +983,202 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*bac
 	}
 }
 
-// SendChord triggers a group of parallel tasks with a callback
+// SendLazyGroup triggers a lazy group of parallel tasks, the first window of
+// MaxParallel tasks is sent right away and each task iterated over with the
+// returned result is replaced by the next one
+func (server *Server) SendLazyGroup(group *tasks.LazyGroup) (*backends.LazyGroupAsyncResult, error) {
+	return backends.NewLazyGroupAsyncResult(group, server.SendTask)
+}
+
+// NewDynamicGroup creates an empty dynamic group, tasks are added to it with
+// SendDynamicGroupTask and it is closed with CloseDynamicGroup once no more
+// tasks are added
+func (server *Server) NewDynamicGroup() (*backends.DynamicGroupResult, error) {
+	if _, ok := server.backend.(backends.DynamicGroupStore); !ok {
+		return nil, errors.New("Result backend does not support dynamic groups")
+	}
+	groupUUID := fmt.Sprintf("group_%v", uuid.NewV4())
+	return backends.NewDynamicGroupResult(groupUUID, server.backend), nil
+}
+
+// SendDynamicGroupTask sends the task and adds it to the dynamic group. A
+// task of the group may add further tasks (e.g. for recursive fan-out) as
+// long as it adds them before it completes
+func (server *Server) SendDynamicGroupTask(groupUUID string, signature *tasks.Signature) (*backends.AsyncResult, error) {
+	store, ok := server.backend.(backends.DynamicGroupStore)
+	if !ok {
+		return nil, errors.New("Result backend does not support dynamic groups")
+	}
+
+	// The task is added once its pending state is stored
+	asyncResult, err := server.SendTask(signature)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.AddDynamicGroupMember(groupUUID, signature.UUID); err != nil {
+		return nil, fmt.Errorf("Add dynamic group member error: %s", err)
+	}
+	return asyncResult, nil
+}
+
+// CloseDynamicGroup marks the dynamic group as complete once the task
+// spawning its tasks added all of them
+func (server *Server) CloseDynamicGroup(groupUUID string) error {
+	store, ok := server.backend.(backends.DynamicGroupStore)
+	if !ok {
+		return errors.New("Result backend does not support dynamic groups")
+	}
+	return store.CloseDynamicGroup(groupUUID)
+}
+
+// SendChord triggers a group of parallel tasks with a callback, the group is
+// sent like by SendGroup so sendConcurrency is ignored by brokers
+// implementing brokers.TransactionalPublisher (AMQP and Redis)
 func (server *Server) SendChord(chord *tasks.Chord, sendConcurrency int) (*backends.ChordAsyncResult, error) {
+	if server.backend == nil {
+		return nil, errors.New("Result backend required")
+	}
+
+	if err := checkChordMembers(chord.Group); err != nil {
+		return nil, err
+	}
+
+	setGroupCorrelationID(chord.Group)
+	if server.config.StoreWorkflows {
+		if err := server.saveWorkflow(tasks.NewChordWorkflow(chord)); err != nil {
+			return nil, err
+		}
+	}
+
 	_, err := server.SendGroup(chord.Group, sendConcurrency)
 	if err != nil {
 		return nil, err
 	}
 
-	return backends.NewChordAsyncResult(
-		chord.Group.Tasks,
-		chord.Callback,
+	groupAsyncResults := make([]*backends.AsyncResult, len(chord.Group.Tasks))
+	for i, signature := range chord.Group.Tasks {
+		groupAsyncResults[i] = backends.NewAsyncResult(signature, server.backend)
+	}
+
+	return backends.NewChordAsyncResultFromResults(
+		groupAsyncResults,
+		backends.NewAsyncResult(chord.Callback, server.GetTaskBackend(chord.Callback)),
 		server.backend,
 	), nil
 }
 
+// checkChordMembers returns an error if a task of the group has a chord
+// callback but ignores its result, the chord would never be triggered as the
+// task never stores its terminal state
+func checkChordMembers(group *tasks.Group) error {
+	for _, signature := range group.Tasks {
+		if signature.ChordCallback != nil && signature.IgnoreResult {
+			return fmt.Errorf("Task %s of a chord can't ignore its result", signature.UUID)
+		}
+	}
+	return nil
+}
+
+// setGroupCorrelationID makes tasks of the group share a correlation ID, the
+// first one set on any of them or a new one, tasks keep their own if they
+// have one
+func setGroupCorrelationID(group *tasks.Group) {
+	correlationID := tasks.NewCorrelationID()
+	for _, signature := range group.Tasks {
+		if signature.CorrelationID != "" {
+			correlationID = signature.CorrelationID
+			break
+		}
+	}
+	for _, signature := range group.Tasks {
+		if signature.CorrelationID == "" {
+			signature.CorrelationID = correlationID
+		}
+		signature.PropagateCorrelationID()
+	}
+}
+
+// saveWorkflow stores the structure of the workflow if the result backend
+// supports it
+func (server *Server) saveWorkflow(workflow *tasks.Workflow) error {
+	store, ok := server.backend.(backends.WorkflowStore)
+	if !ok {
+		return nil
+	}
+	if err := store.SetWorkflow(workflow); err != nil {
+		return fmt.Errorf("Save workflow error: %s", err)
+	}
+	return nil
+}
+
+// markPublished saves the marker telling a Coordinator the task of the
+// reactive workflow was published
+func (server *Server) markPublished(workflow *tasks.Workflow, signature *tasks.Signature) error {
+	if workflow.Published == nil {
+		workflow.Published = make(map[string]bool)
+	}
+	workflow.Published[signature.UUID] = true
+	return server.saveWorkflow(workflow)
+}
+
+// GetWorkflowState reconstructs progress of the chain, group or chord with
+// the given UUID (Chain.UUID or the group UUID) from the structure of the
+// workflow stored with StoreWorkflows and states of all its tasks. Tasks
+// without a state yet, such as tasks of a chain not sent yet, are reported
+// as pending
+func (server *Server) GetWorkflowState(workflowUUID string) (*tasks.WorkflowState, error) {
+	workflow, err := server.getWorkflow(workflowUUID)
+	if err != nil {
+		return nil, err
+	}
+	return server.workflowState(workflow)
+}
+
+// getWorkflow returns the stored structure of the workflow
+func (server *Server) getWorkflow(workflowUUID string) (*tasks.Workflow, error) {
+	store, ok := server.backend.(backends.WorkflowStore)
+	if !ok {
+		return nil, errors.New("Result backend does not support workflows")
+	}
+
+	workflow, err := store.GetWorkflow(workflowUUID)
+	if err != nil {
+		return nil, fmt.Errorf("Get workflow error: %s", err)
+	}
+	if workflow == nil {
+		return nil, fmt.Errorf("Workflow not found: %s", workflowUUID)
+	}
+	return workflow, nil
+}
+
+// workflowState reconstructs progress of the workflow from states of its
+// tasks, tasks without a state are pending while other errors reading states
+// are returned
+func (server *Server) workflowState(workflow *tasks.Workflow) (*tasks.WorkflowState, error) {
+	states := make([][]*tasks.TaskState, len(workflow.Steps))
+	for i, step := range workflow.Steps {
+		states[i] = make([]*tasks.TaskState, len(step))
+		for j, task := range step {
+			signature := &tasks.Signature{UUID: task.UUID, Name: task.Name}
+			// Group tasks always keep their state in the default backend
+			if workflow.Type != tasks.WorkflowChain && i == 0 {
+				signature.GroupUUID = workflow.UUID
+			}
+
+			state, err := server.GetTaskBackend(signature).GetState(task.UUID)
+			if err == backends.ErrStateNotFound {
+				state, err = tasks.NewPendingTaskState(signature), nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Get state of task %s error: %s", task.UUID, err)
+			}
+			states[i][j] = state
+		}
+	}
+
+	return tasks.NewWorkflowState(workflow, states), nil
+}
+
 // GetRegisteredTaskNames returns slice of registered task names
 func (server *Server) GetRegisteredTaskNames() []string {
 	taskNames := make([]string, len(server.registeredTasks))
@@ -0,0 +1,69 @@
+package machinery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/tasks"
+)
+
+// StreamResult streams the task to the client as server-sent events until it
+// completes or ctx, usually the request context, is done. Each state change
+// is written as a "state" event, a successful task ends with a "result" event
+// holding its results and a failed one with a "failure" event
+func (server *Server) StreamResult(w http.ResponseWriter, asyncResult *backends.AsyncResult, ctx context.Context) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("Response writer does not support flushing")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for taskState := range asyncResult.Watch(ctx) {
+		if err := writeEvent(w, "state", struct{ TaskUUID, State string }{taskState.TaskUUID, taskState.State}); err != nil {
+			return err
+		}
+
+		var err error
+		switch {
+		case taskState.IsSuccess():
+			results := taskState.Results
+			if results == nil {
+				results = []*tasks.TaskResult{}
+			}
+			err = writeEvent(w, "result", results)
+		case taskState.IsFailure():
+			err = writeEvent(w, "failure", struct{ Error string }{taskState.Error})
+		}
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+
+		if taskState.IsCompleted() {
+			return nil
+		}
+	}
+
+	return ctx.Err()
+}
+
+// writeEvent writes a server-sent event with the JSON encoded value as data
+func writeEvent(w http.ResponseWriter, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return fmt.Errorf("Write event error: %s", err)
+	}
+	return nil
+}
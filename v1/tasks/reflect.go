@@ -2,9 +2,16 @@ package tasks
 
 import (
 	"context"
+	"encoding"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 var (
@@ -25,8 +32,27 @@ var (
 		"string":  reflect.TypeOf(string("")),
 	}
 
+	// resultTypes holds types registered with RegisterResultType and
+	// RegisterTaggedResultType, resultTags the tags of the latter
+	resultTypes   = map[string]reflect.Type{}
+	resultTags    = map[reflect.Type]string{}
+	resultTypesMu sync.RWMutex
+
+	// textTypes holds types registered with RegisterTextType
+	textTypes = map[string]reflect.Type{
+		"*big.Int":   reflect.TypeOf(new(big.Int)),
+		"*big.Rat":   reflect.TypeOf(new(big.Rat)),
+		"*big.Float": reflect.TypeOf(new(big.Float)),
+	}
+	textTypesMu sync.RWMutex
+
 	ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
 
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+
 	typeConversionError = func(argValue interface{}, argTypeStr string) error {
 		return fmt.Errorf("%v is not %v", argValue, argTypeStr)
 	}
@@ -47,11 +73,118 @@ func (e ErrUnsupportedType) Error() string {
 	return fmt.Sprintf("%v is not one of supported types", e.valueType)
 }
 
+// RegisterResultType makes results of the type of v (e.g. a struct returned
+// by a task) reflectable by ReflectValue, so AsyncResult.Get can reconstruct
+// them as Go values
+func RegisterResultType(v interface{}) {
+	theType := reflect.TypeOf(v)
+
+	resultTypesMu.Lock()
+	defer resultTypesMu.Unlock()
+	resultTypes[theType.String()] = theType
+}
+
+// RegisterTaggedResultType registers the type of v like RegisterResultType
+// but results of the type are stored with the tag instead of the Go type
+// name. Tasks returning an interface can then return any registered type
+// implementing it and AsyncResult.Get reconstructs the concrete type by the
+// tag, also in clients where the type lives in a different package
+func RegisterTaggedResultType(tag string, v interface{}) error {
+	theType := reflect.TypeOf(v)
+	if _, ok := typesMap[tag]; ok {
+		return fmt.Errorf("Tag %s is a built-in type", tag)
+	}
+
+	resultTypesMu.Lock()
+	defer resultTypesMu.Unlock()
+	if registered, ok := resultTypes[tag]; ok && registered != theType {
+		return fmt.Errorf("Tag %s already registered for %s", tag, registered)
+	}
+	resultTypes[tag] = theType
+	resultTags[theType] = tag
+	return nil
+}
+
+// ResultType returns the name results are stored with, the tag of a type
+// registered with RegisterTaggedResultType or the Go type name otherwise
+func ResultType(value interface{}) string {
+	theType := reflect.TypeOf(value)
+
+	resultTypesMu.RLock()
+	tag, ok := resultTags[theType]
+	resultTypesMu.RUnlock()
+	if ok {
+		return tag
+	}
+	return theType.String()
+}
+
+// RegisterTextType makes values of the type of v (e.g. a decimal type)
+// travel as text produced by their encoding.TextMarshaler, so they are not
+// rounded to float64 by JSON, and reflectable by ReflectValue which parses
+// them with encoding.TextUnmarshaler. *big.Int, *big.Rat and *big.Float are
+// registered already
+func RegisterTextType(v interface{}) error {
+	theType := reflect.TypeOf(v)
+	if !theType.Implements(textMarshalerType) || !newTextValue(theType).Type().Implements(textUnmarshalerType) {
+		return fmt.Errorf("%s does not implement encoding.TextMarshaler and encoding.TextUnmarshaler", theType)
+	}
+
+	textTypesMu.Lock()
+	defer textTypesMu.Unlock()
+	textTypes[theType.String()] = theType
+	return nil
+}
+
+// TextValue returns the text of a value of a type registered with
+// RegisterTextType, other values are returned as they are
+func TextValue(value interface{}) interface{} {
+	if value == nil {
+		return value
+	}
+
+	textTypesMu.RLock()
+	_, ok := textTypes[reflect.TypeOf(value).String()]
+	textTypesMu.RUnlock()
+	if !ok {
+		return value
+	}
+
+	text, err := value.(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return value
+	}
+	return string(text)
+}
+
 // ReflectValue converts interface{} to reflect.Value based on string type
 func ReflectValue(valueType string, value interface{}) (reflect.Value, error) {
+	// Streams are opened by the worker before the task is called
+	if valueType == StreamArgType {
+		reader, ok := value.(io.Reader)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("Stream %v not opened", value)
+		}
+		return reflect.ValueOf(reader), nil
+	}
+
+	if valueType == ErrorArgType {
+		structured, err := reflectStructuredError(value)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(structured), nil
+	}
+
 	theType, ok := typesMap[valueType]
 	if !ok {
-		return reflect.Value{}, NewErrUnsupportedType(valueType)
+		textTypesMu.RLock()
+		textType, ok := textTypes[valueType]
+		textTypesMu.RUnlock()
+		if ok {
+			return reflectTextType(textType, value)
+		}
+		return reflectResultType(valueType, value)
 	}
 	theValue := reflect.New(theType)
 
@@ -113,7 +246,104 @@ func ReflectValue(valueType string, value interface{}) (reflect.Value, error) {
 	return reflect.Value{}, NewErrUnsupportedType(valueType)
 }
 
+// reflectStructuredError converts a value to *StructuredError, values
+// decoded from JSON are maps
+func reflectStructuredError(value interface{}) (*StructuredError, error) {
+	if structured, ok := value.(*StructuredError); ok {
+		return structured, nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, typeConversionError(value, ErrorArgType)
+	}
+	structured := new(StructuredError)
+	if err := json.Unmarshal(encoded, structured); err != nil {
+		return nil, typeConversionError(value, ErrorArgType)
+	}
+	return structured, nil
+}
+
+// reflectTextType converts a value to a type registered with
+// RegisterTextType, values are expected as text but numbers are accepted too
+func reflectTextType(theType reflect.Type, value interface{}) (reflect.Value, error) {
+	if value != nil && reflect.TypeOf(value) == theType {
+		return reflect.ValueOf(value), nil
+	}
+
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case json.Number:
+		text = v.String()
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case int, int64:
+		text = fmt.Sprint(v)
+	default:
+		return reflect.Value{}, typeConversionError(value, theType.String())
+	}
+
+	theValue := newTextValue(theType)
+	if err := theValue.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text)); err != nil {
+		return reflect.Value{}, fmt.Errorf("%s: %s", typeConversionError(value, theType.String()), err)
+	}
+	if theType.Kind() == reflect.Ptr {
+		return theValue, nil
+	}
+	return theValue.Elem(), nil
+}
+
+// newTextValue returns a pointer to a new value a text of the type can be
+// unmarshaled into, types which are pointers already are allocated
+func newTextValue(theType reflect.Type) reflect.Value {
+	if theType.Kind() == reflect.Ptr {
+		return reflect.New(theType.Elem())
+	}
+	return reflect.New(theType)
+}
+
+// reflectResultType converts a value to a type registered with
+// RegisterResultType, values decoded by a result backend are in their
+// canonical (JSON) form so they are decoded again into the type
+func reflectResultType(valueType string, value interface{}) (reflect.Value, error) {
+	resultTypesMu.RLock()
+	theType, ok := resultTypes[valueType]
+	resultTypesMu.RUnlock()
+	if !ok {
+		return reflect.Value{}, NewErrUnsupportedType(valueType)
+	}
+
+	if value != nil && reflect.TypeOf(value) == theType {
+		return reflect.ValueOf(value), nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("JSON marshal error: %s", err)
+	}
+	theValue := reflect.New(theType)
+	if err := json.Unmarshal(encoded, theValue.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("JSON unmarshal error: %s", err)
+	}
+	return theValue.Elem(), nil
+}
+
 func getIntValue(theType string, value interface{}) (int64, error) {
+	// Numbers decoded with json.Decoder.UseNumber keep their exact
+	// representation so we can parse them without losing precision
+	if number, ok := value.(json.Number); ok {
+		if n, err := number.Int64(); err == nil {
+			return n, nil
+		}
+		n, err := number.Float64()
+		if err != nil {
+			return 0, typeConversionError(value, typesMap[theType].String())
+		}
+		return int64(n), nil
+	}
+
 	if strings.HasPrefix(fmt.Sprintf("%T", value), "float") {
 		// Any numbers from unmarshalled JSON will be float64 by default
 		// So we first need to do a type conversion to float64
@@ -135,6 +365,17 @@ func getIntValue(theType string, value interface{}) (int64, error) {
 }
 
 func getUintValue(theType string, value interface{}) (uint64, error) {
+	if number, ok := value.(json.Number); ok {
+		if n, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+			return n, nil
+		}
+		n, err := number.Float64()
+		if err != nil {
+			return 0, typeConversionError(value, typesMap[theType].String())
+		}
+		return uint64(n), nil
+	}
+
 	if strings.HasPrefix(fmt.Sprintf("%T", value), "float") {
 		// Any numbers from unmarshalled JSON will be float64 by default
 		// So we first need to do a type conversion to float64
@@ -156,6 +397,14 @@ func getUintValue(theType string, value interface{}) (uint64, error) {
 }
 
 func getFloatValue(theType string, value interface{}) (float64, error) {
+	if number, ok := value.(json.Number); ok {
+		n, err := number.Float64()
+		if err != nil {
+			return 0, typeConversionError(value, typesMap[theType].String())
+		}
+		return n, nil
+	}
+
 	n, ok := value.(float64)
 	if !ok {
 		return 0, typeConversionError(value, typesMap[theType].String())
@@ -164,6 +413,155 @@ func getFloatValue(theType string, value interface{}) (float64, error) {
 	return n, nil
 }
 
+// CoerceValue converts a reflected argument to the type a task function
+// expects if the conversion is lossless, i.e. integers which fit into the
+// target type, floats which are exactly representable, numeric strings,
+// strings unmarshaled by an encoding.TextUnmarshaler and errors passed as
+// their message
+func CoerceValue(value reflect.Value, target reflect.Type) (reflect.Value, error) {
+	if value.Type().AssignableTo(target) {
+		return value, nil
+	}
+
+	coerced := reflect.New(target).Elem()
+	conversionError := typeConversionError(value.Interface(), target.String())
+
+	// Errors are passed to tasks taking a string as their message
+	if structured, ok := value.Interface().(*StructuredError); ok && target.Kind() == reflect.String {
+		coerced.SetString(structured.Message)
+		return coerced, nil
+	}
+
+	// and messages to tasks taking an error, e.g. ones sent by producers
+	// which don't send error details
+	if value.Kind() == reflect.String && target == errorType {
+		coerced.Set(reflect.ValueOf(&StructuredError{Message: value.String()}))
+		return coerced, nil
+	}
+
+	// Strings can be unmarshaled into types implementing TextUnmarshaler
+	if value.Kind() == reflect.String && reflect.PtrTo(target).Implements(textUnmarshalerType) {
+		unmarshaler := coerced.Addr().Interface().(encoding.TextUnmarshaler)
+		if err := unmarshaler.UnmarshalText([]byte(value.String())); err != nil {
+			return reflect.Value{}, fmt.Errorf("%s: %s", conversionError, err)
+		}
+		return coerced, nil
+	}
+
+	switch target.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := coerceInt(value)
+		if !ok || coerced.OverflowInt(n) {
+			return reflect.Value{}, conversionError
+		}
+		coerced.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := coerceUint(value)
+		if !ok || coerced.OverflowUint(n) {
+			return reflect.Value{}, conversionError
+		}
+		coerced.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, ok := coerceFloat(value)
+		if !ok || coerced.OverflowFloat(n) {
+			return reflect.Value{}, conversionError
+		}
+		coerced.SetFloat(n)
+		// Make sure no precision is lost, e.g. converting float64 to float32
+		if coerced.Float() != n {
+			return reflect.Value{}, conversionError
+		}
+	default:
+		return reflect.Value{}, conversionError
+	}
+
+	return coerced, nil
+}
+
+// hasCoercion returns true if CoerceValue has a conversion of the value to
+// the target type, lossless or not
+func hasCoercion(value reflect.Value, target reflect.Type) bool {
+	if value.Type().AssignableTo(target) {
+		return true
+	}
+	if _, ok := value.Interface().(*StructuredError); ok && target.Kind() == reflect.String {
+		return true
+	}
+	if value.Kind() == reflect.String && target == errorType {
+		return true
+	}
+	if value.Kind() == reflect.String && reflect.PtrTo(target).Implements(textUnmarshalerType) {
+		return true
+	}
+
+	switch target.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+	default:
+		return false
+	}
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String:
+		return true
+	}
+	return false
+}
+
+// coerceInt returns value as int64 if it can be represented exactly
+func coerceInt(value reflect.Value) (int64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint()), value.Uint() <= math.MaxInt64
+	case reflect.Float32, reflect.Float64:
+		f := value.Float()
+		return int64(f), f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+	case reflect.String:
+		n, err := strconv.ParseInt(value.String(), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// coerceUint returns value as uint64 if it can be represented exactly
+func coerceUint(value reflect.Value) (uint64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(value.Int()), value.Int() >= 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint(), true
+	case reflect.Float32, reflect.Float64:
+		f := value.Float()
+		return uint64(f), f == math.Trunc(f) && f >= 0 && f < math.MaxUint64
+	case reflect.String:
+		n, err := strconv.ParseUint(value.String(), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// coerceFloat returns value as float64 if it can be represented exactly
+func coerceFloat(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f := float64(value.Int())
+		return f, f < math.MaxInt64 && int64(f) == value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f := float64(value.Uint())
+		return f, f < math.MaxUint64 && uint64(f) == value.Uint()
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	case reflect.String:
+		f, err := strconv.ParseFloat(value.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
 // IsContextType checks to see if the type is a context.Context
 func IsContextType(t reflect.Type) bool {
 	return t == ctxType
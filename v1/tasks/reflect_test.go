@@ -1,6 +1,8 @@
 package tasks_test
 
 import (
+	"encoding/json"
+	"math"
 	"testing"
 
 	"github.com/koblelabs/machinery/v1/tasks"
@@ -119,3 +121,49 @@ func TestReflectValue(t *testing.T) {
 		t.Errorf("type is %v, want string", value.Type().String())
 	}
 }
+
+func TestReflectValueJSONNumber(t *testing.T) {
+	value, err := tasks.ReflectValue("int64", json.Number("9223372036854775806"))
+	if err != nil {
+		t.Error(err)
+	}
+	if value.Int() != math.MaxInt64-1 {
+		t.Errorf("value is %v, want %v", value.Int(), int64(math.MaxInt64-1))
+	}
+
+	value, err = tasks.ReflectValue("uint64", json.Number("18446744073709551614"))
+	if err != nil {
+		t.Error(err)
+	}
+	if value.Uint() != math.MaxUint64-1 {
+		t.Errorf("value is %v, want %v", value.Uint(), uint64(math.MaxUint64-1))
+	}
+
+	value, err = tasks.ReflectValue("float64", json.Number("0.5"))
+	if err != nil {
+		t.Error(err)
+	}
+	if value.Float() != 0.5 {
+		t.Errorf("value is %v, want 0.5", value.Float())
+	}
+}
+
+type reflectedResult struct {
+	Name string
+}
+
+func TestReflectValueRegisteredType(t *testing.T) {
+	if _, err := tasks.ReflectValue("tasks_test.reflectedResult", map[string]interface{}{"Name": "foo"}); err == nil {
+		t.Error("unregistered type was reflected")
+	}
+
+	tasks.RegisterResultType(reflectedResult{})
+
+	value, err := tasks.ReflectValue("tasks_test.reflectedResult", map[string]interface{}{"Name": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.Interface() != (reflectedResult{Name: "foo"}) {
+		t.Errorf("value is %v, want {foo}", value.Interface())
+	}
+}
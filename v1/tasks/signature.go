@@ -1,16 +1,43 @@
 package tasks
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/satori/go.uuid"
 )
 
+// StreamArgType is the type of args referencing a stream by URL, e.g.
+// blob://key or https://..., which the worker opens and passes to the task
+// as an io.Reader so large inputs don't travel in the message
+const StreamArgType = "stream"
+
+// ErrorArgType is the type of args holding a *StructuredError. Error callbacks
+// get the error as a string arg with the details in Arg.Error, so consumers
+// which don't know them still get the message, both are accepted. Tasks may
+// take it as an error, or as a string to get just the message
+const ErrorArgType = "error"
+
 // Arg represents a single argument passed to invocation fo a task
 type Arg struct {
 	Type  string
 	Value interface{}
+	// Encrypted makes brokers encrypt the value with ArgEncryptionKey, so
+	// secrets don't sit in the broker in plaintext
+	Encrypted bool `json:",omitempty"`
+	// Error keeps the details of an error passed as its message
+	Error *StructuredError `json:",omitempty"`
+}
+
+// MarshalJSON encodes values of types registered with RegisterTextType as
+// text so no precision is lost
+func (arg Arg) MarshalJSON() ([]byte, error) {
+	type plainArg Arg
+	arg.Value = TextValue(arg.Value)
+	return json.Marshal(plainArg(arg))
 }
 
 // Headers represents the headers which should be used to direct the task
@@ -24,14 +51,74 @@ type Signature struct {
 	ETA            *time.Time
 	GroupUUID      string
 	GroupTaskCount int
+	GroupTaskIndex int
 	Args           []Arg
 	Headers        Headers
 	Immutable      bool
 	RetryCount     int
 	RetryTimeout   int
+	// RetryUntil keeps retrying the failed task until the deadline
+	// passes, combined with RetryCount whichever is exhausted first
+	RetryUntil     *time.Time
 	OnSuccess      []*Signature
 	OnError        []*Signature
 	ChordCallback  *Signature
+	DebounceKey    string
+	DebounceWindow int
+	// Replaceable makes workers check whether the task was replaced with
+	// Server.ReplaceTask before running it, other tasks are not looked up
+	Replaceable bool
+	// PartitionKey routes all tasks with the same key to the same one of
+	// the configured partitions, e.g. an entity ID for cache locality
+	PartitionKey string
+	// WorkerGroup makes only workers of the group process the task, e.g.
+	// workers on GPU nodes, other workers requeue it
+	WorkerGroup string
+	// ChainRetryBudget is the number of retries left to all remaining tasks
+	// of a chain, nil means retries are only limited per task
+	ChainRetryBudget *int
+	// ChainDeadline is when the chain the task belongs to must have
+	// finished, it shortens the task's time limit to the time remaining
+	ChainDeadline *time.Time
+	// TimeLimit is how many seconds the task is allowed to run, 0 means no
+	// limit and nil falls back to the worker's DefaultTaskTimeLimit
+	TimeLimit *int
+	// StartJitter is up to how many milliseconds the worker waits before
+	// starting the task, nil falls back to the worker's StartJitter
+	StartJitter *int
+	// PublishedAt is when the task was sent to the broker
+	PublishedAt *time.Time
+	// ReceivedAt is when a worker received the task
+	ReceivedAt *time.Time
+	// StartedAt is when a worker started processing the task
+	StartedAt *time.Time
+	// WorkerName is the consumer tag of the worker processing the task
+	WorkerName string
+	// CacheKey enables caching of the task results, tasks sent with the
+	// same key get the cached results instead of running again
+	CacheKey string
+	// CacheTTL is how many seconds results are cached for, 0 falls back
+	// to the result backend's default expiration
+	CacheTTL int
+	// CorrelationID identifies the workflow the task belongs to, callbacks
+	// inherit it so all tasks of a workflow can be traced by one ID
+	CorrelationID string
+	// WorkflowDepth is how many workflow steps preceded the task, callbacks
+	// are one step deeper than the task triggering them
+	WorkflowDepth int
+	// IgnoreResult skips all writes of the task state to the result backend,
+	// for fire-and-forget tasks whose result nobody reads
+	IgnoreResult bool
+	// Weight is how much of the worker's WeightBudget the task takes up
+	// while it runs, tasks without a weight weigh 1
+	Weight int
+	// Mandatory makes publishing fail with an error instead of dropping
+	// the task if no queue is bound to its routing key (AMQP only)
+	Mandatory bool
+	// Persistent controls whether the broker writes the task to disk, nil
+	// means persistent. Transient tasks are faster to publish but lost if
+	// the broker restarts (AMQP only)
+	Persistent *bool
 }
 
 // NewSignature creates a new task signature
@@ -42,3 +129,53 @@ func NewSignature(name string, args []Arg) *Signature {
 		Args: args,
 	}
 }
+
+// NewCorrelationID generates a new correlation ID
+func NewCorrelationID() string {
+	return fmt.Sprintf("correlation_%v", uuid.NewV4())
+}
+
+// PropagateCorrelationID hands the correlation ID of the task down to its
+// callbacks which don't have one of their own
+func (signature *Signature) PropagateCorrelationID() {
+	callbacks := append(append([]*Signature{}, signature.OnSuccess...), signature.OnError...)
+	if signature.ChordCallback != nil {
+		callbacks = append(callbacks, signature.ChordCallback)
+	}
+
+	for _, callback := range callbacks {
+		if callback.CorrelationID == "" {
+			callback.CorrelationID = signature.CorrelationID
+			callback.PropagateCorrelationID()
+		}
+	}
+}
+
+// NewCacheKey derives a cache key from the task name and arguments, calls
+// with the same arguments get the same key
+func NewCacheKey(name string, args []Arg) (string, error) {
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return "", fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	sum := sha256.Sum256(append([]byte(name+":"), encoded...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// QueueWaitTime returns how long the task waited in the queue before it was
+// received by a worker, delayed tasks only wait from their ETA
+func (signature *Signature) QueueWaitTime() time.Duration {
+	if signature.PublishedAt == nil || signature.ReceivedAt == nil {
+		return 0
+	}
+
+	waitStart := *signature.PublishedAt
+	if signature.ETA != nil && signature.ETA.After(waitStart) {
+		waitStart = *signature.ETA
+	}
+	if signature.ReceivedAt.Before(waitStart) {
+		return 0
+	}
+	return signature.ReceivedAt.Sub(waitStart)
+}
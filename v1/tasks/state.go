@@ -1,5 +1,10 @@
 package tasks
 
+import (
+	"fmt"
+	"time"
+)
+
 const (
 	// StatePending - initial state of a task
 	StatePending = "PENDING"
@@ -15,14 +20,49 @@ const (
 	StateFailure = "FAILURE"
 	// StateCancelled - when processing of the task fails
 	StateCancelled = "CANCELLED"
+	// StateSkipped - when the task was not sent as its dispatch condition did
+	// not hold, or was discarded by a worker as it was stale
+	StateSkipped = "SKIPPED"
+	// StateDeduplicated - when the task was dropped as a duplicate of another one
+	StateDeduplicated = "DEDUPLICATED"
 )
 
 // TaskState represents a state of a task
 type TaskState struct {
-	TaskUUID string        `bson:"_id"`
-	State    string        `bson:"state"`
-	Results  []*TaskResult `bson:"results"`
-	Error    string        `bson:"error"`
+	TaskUUID    string        `bson:"_id"`
+	State       string        `bson:"state"`
+	Results     []*TaskResult `bson:"results"`
+	Error       string        `bson:"error"`
+	ErrorDetail *ErrorDetail  `bson:"error_detail,omitempty"`
+	RetryCount  int           `bson:"retry_count"`
+	// ChainRetryBudget is what is left of the chain retry budget once the
+	// task succeeded, handed over to the next step of a reactive chain
+	ChainRetryBudget *int `bson:"chain_retry_budget,omitempty"`
+	// GroupTaskIndex is the position of the task within its group, used to
+	// pass group results to the chord callback in the original order
+	GroupTaskIndex int `bson:"group_task_index"`
+	// QueueWaitTime is how long the task waited in the queue before it was
+	// received by a worker
+	QueueWaitTime time.Duration `bson:"queue_wait_time"`
+	// CorrelationID is shared by all tasks of a workflow
+	CorrelationID string `bson:"correlation_id"`
+	// WorkerName is the consumer tag of the worker which processed the task
+	WorkerName string `bson:"worker_name"`
+	// StartedAt is when the worker started processing the task
+	StartedAt *time.Time `bson:"started_at"`
+	// CompletedAt is when the task succeeded or finally failed
+	CompletedAt *time.Time `bson:"completed_at"`
+}
+
+// ErrorDetail holds debugging information about a task failure
+type ErrorDetail struct {
+	// Chain lists messages of the error and all errors it wraps
+	Chain []string `bson:"chain"`
+	// Verbose is the error formatted with %+v, errors from packages such
+	// as github.com/pkg/errors include their stack trace this way
+	Verbose string `bson:"verbose"`
+	// Stack is a stack trace of the panic if the task panicked
+	Stack string `bson:"stack,omitempty"`
 }
 
 // GroupMeta stores useful metadata about tasks within the same group
@@ -38,57 +78,185 @@ type GroupMeta struct {
 // NewPendingTaskState ...
 func NewPendingTaskState(signature *Signature) *TaskState {
 	return &TaskState{
-		TaskUUID: signature.UUID,
-		State:    StatePending,
+		TaskUUID:      signature.UUID,
+		CorrelationID: signature.CorrelationID,
+		State:         StatePending,
 	}
 }
 
 // NewReceivedTaskState ...
 func NewReceivedTaskState(signature *Signature) *TaskState {
 	return &TaskState{
-		TaskUUID: signature.UUID,
-		State:    StateReceived,
+		TaskUUID:      signature.UUID,
+		CorrelationID: signature.CorrelationID,
+		State:         StateReceived,
+		QueueWaitTime: signature.QueueWaitTime(),
 	}
 }
 
 // NewStartedTaskState ...
 func NewStartedTaskState(signature *Signature) *TaskState {
 	return &TaskState{
-		TaskUUID: signature.UUID,
-		State:    StateStarted,
+		TaskUUID:      signature.UUID,
+		CorrelationID: signature.CorrelationID,
+		State:         StateStarted,
+		QueueWaitTime: signature.QueueWaitTime(),
+		WorkerName:    signature.WorkerName,
+		StartedAt:     signature.StartedAt,
 	}
 }
 
 // NewSuccessTaskState ...
 func NewSuccessTaskState(signature *Signature, results []*TaskResult) *TaskState {
 	return &TaskState{
-		TaskUUID: signature.UUID,
-		State:    StateSuccess,
-		Results:  results,
+		TaskUUID:       signature.UUID,
+		CorrelationID:  signature.CorrelationID,
+		State:          StateSuccess,
+		Results:        results,
+		GroupTaskIndex: signature.GroupTaskIndex,
+		QueueWaitTime:  signature.QueueWaitTime(),
+		RetryCount:     signature.RetryCount,
+		WorkerName:     signature.WorkerName,
+		StartedAt:      signature.StartedAt,
+		CompletedAt:    completedAt(),
+		// Copied so retries of the next step do not change the state
+		ChainRetryBudget: copyBudget(signature.ChainRetryBudget),
 	}
 }
 
+// copyBudget returns a copy of the chain retry budget, nil if there is none
+func copyBudget(budget *int) *int {
+	if budget == nil {
+		return nil
+	}
+	left := *budget
+	return &left
+}
+
 // NewFailureTaskState ...
 func NewFailureTaskState(signature *Signature, err string) *TaskState {
 	return &TaskState{
-		TaskUUID: signature.UUID,
-		State:    StateFailure,
-		Error:    err,
+		TaskUUID:      signature.UUID,
+		CorrelationID: signature.CorrelationID,
+		State:         StateFailure,
+		Error:         err,
+		QueueWaitTime: signature.QueueWaitTime(),
+		RetryCount:    signature.RetryCount,
+		WorkerName:    signature.WorkerName,
+		StartedAt:     signature.StartedAt,
+		CompletedAt:   completedAt(),
+	}
+}
+
+// NewSkippedTaskState ...
+func NewSkippedTaskState(signature *Signature) *TaskState {
+	return &TaskState{
+		TaskUUID:      signature.UUID,
+		CorrelationID: signature.CorrelationID,
+		State:         StateSkipped,
+	}
+}
+
+// NewDeduplicatedTaskState ...
+func NewDeduplicatedTaskState(signature *Signature, err string) *TaskState {
+	return &TaskState{
+		TaskUUID:      signature.UUID,
+		CorrelationID: signature.CorrelationID,
+		State:         StateDeduplicated,
+		Error:         err,
+		QueueWaitTime: signature.QueueWaitTime(),
+	}
+}
+
+// NewErrorDetail captures the error chain and stack trace of a task error
+func NewErrorDetail(err error) *ErrorDetail {
+	detail := &ErrorDetail{Verbose: fmt.Sprintf("%+v", err)}
+
+	for e := err; e != nil; e = unwrap(e) {
+		// A panic error only carries the stack trace of the recovered value
+		if panicErr, ok := e.(*PanicError); ok {
+			detail.Stack = string(panicErr.Stack)
+			continue
+		}
+		detail.Chain = append(detail.Chain, e.Error())
+	}
+
+	return detail
+}
+
+// unwrap returns the error wrapped by err, nil if it does not wrap any
+func unwrap(err error) error {
+	wrapper, ok := err.(interface {
+		Unwrap() error
+	})
+	if !ok {
+		return nil
 	}
+	return wrapper.Unwrap()
+}
+
+// ErrorCoder is implemented by errors carrying a machine readable code, the
+// code is kept when the error is passed to error callbacks
+type ErrorCoder interface {
+	ErrorCode() string
+}
+
+// StructuredError is an error passed between tasks of a workflow. Errors
+// don't survive JSON encoding, so the message, the type of the root cause
+// and the code of the original error are kept instead
+type StructuredError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+// NewStructuredError returns a StructuredError describing the error
+func NewStructuredError(err error) *StructuredError {
+	structured := &StructuredError{Message: err.Error()}
+	for e := err; e != nil; e = unwrap(e) {
+		structured.Type = fmt.Sprintf("%T", e)
+		if coder, ok := e.(ErrorCoder); ok && structured.Code == "" {
+			structured.Code = coder.ErrorCode()
+		}
+	}
+	return structured
+}
+
+// Error returns the message of the original error
+func (e *StructuredError) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the code of the original error, "" if it had none
+func (e *StructuredError) ErrorCode() string {
+	return e.Code
 }
 
 // NewRetryTaskState ...
-func NewRetryTaskState(signature *Signature) *TaskState {
+func NewRetryTaskState(signature *Signature, err string) *TaskState {
 	return &TaskState{
-		TaskUUID: signature.UUID,
-		State:    StateRetry,
+		TaskUUID:      signature.UUID,
+		CorrelationID: signature.CorrelationID,
+		State:         StateRetry,
+		Error:         err,
+		RetryCount:    signature.RetryCount,
+		QueueWaitTime: signature.QueueWaitTime(),
+		WorkerName:    signature.WorkerName,
+		StartedAt:     signature.StartedAt,
 	}
 }
 
-// IsCompleted returns true if state is SUCCESS or FAILURE,
-// i.e. the task has finished processing and either succeeded or failed.
+// completedAt returns the current time for states of completed tasks
+func completedAt() *time.Time {
+	now := time.Now().UTC()
+	return &now
+}
+
+// IsCompleted returns true if state is SUCCESS, FAILURE or DEDUPLICATED,
+// i.e. the task has finished processing and either succeeded or failed,
+// or it was dropped as a duplicate and will never run.
 func (taskState *TaskState) IsCompleted() bool {
-	return taskState.IsSuccess() || taskState.IsFailure()
+	return taskState.IsSuccess() || taskState.IsFailure() || taskState.IsDeduplicated()
 }
 
 // IsSuccess returns true if state is SUCCESS
@@ -100,3 +268,19 @@ func (taskState *TaskState) IsSuccess() bool {
 func (taskState *TaskState) IsFailure() bool {
 	return taskState.State == StateFailure
 }
+
+// IsSkipped returns true if state is SKIPPED
+func (taskState *TaskState) IsSkipped() bool {
+	return taskState.State == StateSkipped
+}
+
+// IsDeduplicated returns true if state is DEDUPLICATED
+func (taskState *TaskState) IsDeduplicated() bool {
+	return taskState.State == StateDeduplicated
+}
+
+// IsRetry returns true if state is RETRY, i.e. the task failed but
+// has been scheduled for another attempt. FAILURE is always permanent.
+func (taskState *TaskState) IsRetry() bool {
+	return taskState.State == StateRetry
+}
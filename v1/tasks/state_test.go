@@ -27,3 +27,14 @@ func TestTaskStateIsCompleted(t *testing.T) {
 	taskState.State = tasks.StateFailure
 	assert.True(t, taskState.IsCompleted())
 }
+
+func TestTaskStateIsRetry(t *testing.T) {
+	taskState := tasks.NewRetryTaskState(&tasks.Signature{UUID: "taskUUID", RetryCount: 2}, "error")
+	assert.True(t, taskState.IsRetry())
+	assert.False(t, taskState.IsCompleted())
+	assert.Equal(t, 2, taskState.RetryCount)
+	assert.Equal(t, "error", taskState.Error)
+
+	taskState.State = tasks.StateFailure
+	assert.False(t, taskState.IsRetry())
+}
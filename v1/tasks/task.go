@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"runtime"
 	"runtime/debug"
+	"time"
 
 	"context"
 
@@ -14,12 +16,89 @@ import (
 // ErrTaskPanicked ...
 var ErrTaskPanicked = errors.New("Invoking task caused a panic")
 
+// ErrTaskTimedOut ...
+var ErrTaskTimedOut = errors.New("Task exceeded its time limit")
+
+// ErrChainDeadlineExceeded is returned for a task of a chain which passed
+// its deadline before the task started
+var ErrChainDeadlineExceeded = errors.New("Chain exceeded its deadline")
+
+// ErrMemoryLimitExceeded is returned for a task which was aborted as it
+// allocated more memory than its limit
+var ErrMemoryLimitExceeded = errors.New("Task exceeded its memory limit")
+
+// ErrGoroutineLeak is returned for a task which left goroutines running
+var ErrGoroutineLeak = errors.New("Task left goroutines running")
+
+// PanicError is returned when invoking a task caused a panic, it keeps the
+// stack trace of the panic. Err is the recovered error, ErrTaskPanicked if
+// the task panicked with a value other than an error or a string
+type PanicError struct {
+	Err   error
+	Stack []byte
+}
+
+// Error returns the message of the recovered error
+func (e *PanicError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the recovered error
+func (e *PanicError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for ErrTaskPanicked whatever the task panicked with, so
+// errors.Is(err, ErrTaskPanicked) holds for every panic
+func (e *PanicError) Is(target error) bool {
+	return target == ErrTaskPanicked
+}
+
+// ErrRetryLater is returned by a task which can't run yet, e.g. because a
+// resource it depends on is not ready, the worker requeues the task to run
+// again after Delay without spending its retries
+type ErrRetryLater struct {
+	Delay time.Duration
+}
+
+// NewErrRetryLater returns new ErrRetryLater
+func NewErrRetryLater(delay time.Duration) ErrRetryLater {
+	return ErrRetryLater{Delay: delay}
+}
+
+// Error method so we implement the error interface
+func (e ErrRetryLater) Error() string {
+	return fmt.Sprintf("Task is not ready, retry in %s", e.Delay)
+}
+
+// commitKey is the context key of the func acknowledging a task's delivery
+type commitKey struct{}
+
+// WithCommit returns a context carrying the func acknowledging delivery of
+// the task
+func WithCommit(ctx context.Context, commit func()) context.Context {
+	return context.WithValue(ctx, commitKey{}, commit)
+}
+
+// Commit acknowledges delivery of the task running with the context, tasks
+// with manual commit call it once their work is durable. It does nothing
+// for other tasks
+func Commit(ctx context.Context) {
+	if commit, ok := ctx.Value(commitKey{}).(func()); ok {
+		commit()
+	}
+}
+
 // Task wraps a signature and methods used to reflect task arguments and
 // return values after invoking the task
 type Task struct {
 	TaskFunc   reflect.Value
 	UseContext bool
+	Context    context.Context
 	Args       []reflect.Value
+	// RunOnLockedThread locks the goroutine calling the task function to its
+	// OS thread for the duration of the call, e.g. for thread-affine cgo code
+	RunOnLockedThread bool
 }
 
 // New tries to use reflection to convert the function and arguments
@@ -51,6 +130,11 @@ func New(taskFunc interface{}, args []Arg) (*Task, error) {
 //    argument list).
 // 2. The task func itself returns a non-nil error.
 func (t *Task) Call() (taskResults []*TaskResult, err error) {
+	if t.RunOnLockedThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
 	defer func() {
 		// Recover from panic and set err.
 		if e := recover(); e != nil {
@@ -62,15 +146,20 @@ func (t *Task) Call() (taskResults []*TaskResult, err error) {
 			case string:
 				err = errors.New(e)
 			}
+			stack := debug.Stack()
+			err = &PanicError{Err: err, Stack: stack}
 			// Print stack trace
-			log.ERROR.Printf("%s", debug.Stack())
+			log.ERROR.Printf("%s", stack)
 		}
 	}()
 
 	args := t.Args
 
 	if t.UseContext {
-		ctx := context.Background()
+		ctx := t.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
 		ctxValue := reflect.ValueOf(ctx)
 		args = append([]reflect.Value{ctxValue}, args...)
 	}
@@ -102,26 +191,139 @@ func (t *Task) Call() (taskResults []*TaskResult, err error) {
 	taskResults = make([]*TaskResult, len(results)-1)
 	for i := 0; i < len(results)-1; i++ {
 		taskResults[i] = &TaskResult{
-			Type:  reflect.TypeOf(results[i].Interface()).String(),
-			Value: results[i].Interface(),
+			Type:  ResultType(results[i].Interface()),
+			Value: TextValue(results[i].Interface()),
 		}
 	}
 
 	return taskResults, err
 }
 
-// ReflectArgs converts []TaskArg to []reflect.Value
+// CallWithTimeout calls the task and fails it with ErrTaskTimedOut once the
+// timeout elapses. Tasks accepting a context get it cancelled at that point,
+// the time limit is cooperative: the call only returns once the task did, so
+// a task ignoring its context keeps running (and holding its slot) until it
+// finishes and its results are discarded
+func (t *Task) CallWithTimeout(timeout time.Duration) ([]*TaskResult, error) {
+	parent := t.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	t.Context = ctx
+
+	type callResult struct {
+		taskResults []*TaskResult
+		err         error
+	}
+	resultChan := make(chan callResult, 1)
+	go func() {
+		taskResults, err := t.Call()
+		resultChan <- callResult{taskResults, err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		return result.taskResults, result.err
+	case <-ctx.Done():
+		// Not retried or replaced before the call returned
+		<-resultChan
+		return nil, ErrTaskTimedOut
+	}
+}
+
+// paramType returns type of the task function parameter the i-th argument
+// is passed to or nil if there is no such parameter
+func (t *Task) paramType(i int) reflect.Type {
+	if !t.TaskFunc.IsValid() || t.TaskFunc.Kind() != reflect.Func {
+		return nil
+	}
+
+	funcType := t.TaskFunc.Type()
+	if t.UseContext {
+		i++
+	}
+
+	if funcType.IsVariadic() && i >= funcType.NumIn()-1 {
+		return funcType.In(funcType.NumIn() - 1).Elem()
+	}
+	if i >= funcType.NumIn() {
+		return nil
+	}
+	return funcType.In(i)
+}
+
+// ReflectArgs converts []TaskArg to []reflect.Value, arguments are coerced
+// to types of the task function parameters where the conversion is lossless.
+// Lossy conversions are returned as errors, arguments of types there is no
+// conversion for are passed as they are
 func (t *Task) ReflectArgs(args []Arg) error {
 	argValues := make([]reflect.Value, len(args))
 
 	for i, arg := range args {
-		argValue, err := ReflectValue(arg.Type, arg.Value)
+		valueType, value := arg.Type, arg.Value
+		if arg.Error != nil {
+			valueType, value = ErrorArgType, arg.Error
+		}
+		argValue, err := ReflectValue(valueType, value)
 		if err != nil {
 			return err
 		}
+
+		// Arguments there is no conversion for are passed as they are,
+		// invoking the task then fails with a type mismatch
+		if paramType := t.paramType(i); paramType != nil && hasCoercion(argValue, paramType) {
+			coerced, err := CoerceValue(argValue, paramType)
+			if err != nil {
+				return err
+			}
+			argValue = coerced
+		}
+
 		argValues[i] = argValue
 	}
 
 	t.Args = argValues
 	return nil
 }
+
+// FillOptionalArgs passes defaults to trailing parameters of the task function
+// the signature provided no arguments for, defaults are aligned to the last
+// parameters (not counting variadic one) and parameters without a default
+// get zero value of their type
+func (t *Task) FillOptionalArgs(defaults []interface{}) error {
+	funcType := t.TaskFunc.Type()
+
+	first := 0
+	if t.UseContext {
+		first = 1
+	}
+	last := funcType.NumIn()
+	if funcType.IsVariadic() {
+		last--
+	}
+
+	numParams := last - first
+	if len(defaults) > numParams {
+		return fmt.Errorf("%d defaults given for %d parameters", len(defaults), numParams)
+	}
+
+	args := t.Args
+	for i := len(args); i < numParams; i++ {
+		paramType := funcType.In(first + i)
+
+		argValue := reflect.Zero(paramType)
+		if j := i - (numParams - len(defaults)); j >= 0 && defaults[j] != nil {
+			argValue = reflect.ValueOf(defaults[j])
+			if !argValue.Type().AssignableTo(paramType) {
+				return fmt.Errorf("Default %v is not assignable to %s", defaults[j], paramType)
+			}
+		}
+
+		args = append(args, argValue)
+	}
+
+	t.Args = args
+	return nil
+}
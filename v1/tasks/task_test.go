@@ -2,8 +2,14 @@ package tasks_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math"
+	"net"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/koblelabs/machinery/v1/tasks"
 	"github.com/stretchr/testify/assert"
@@ -27,6 +33,23 @@ func TestInvalidArgRobustness(t *testing.T) {
 	assert.Nil(t, results)
 }
 
+func TestPanicError(t *testing.T) {
+	for _, value := range []interface{}{errors.New("boom"), "boom", 42} {
+		task, err := tasks.New(func() error { panic(value) }, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		_, err = task.Call()
+		panicErr, ok := err.(*tasks.PanicError)
+		if assert.True(t, ok) {
+			assert.True(t, panicErr.Is(tasks.ErrTaskPanicked))
+			assert.False(t, panicErr.Is(tasks.ErrTaskTimedOut))
+			assert.NotEmpty(t, panicErr.Stack)
+		}
+	}
+}
+
 func TestInterfaceValuedResult(t *testing.T) {
 	// Create a test task function
 	f := func() (interface{}, error) { return math.Pi, nil }
@@ -52,3 +75,99 @@ func TestTaskHasContext(t *testing.T) {
 	assert.Equal(t, "float64", taskResults[0].Type)
 	assert.Equal(t, math.Pi, taskResults[0].Value)
 }
+
+func TestCallWithTimeout(t *testing.T) {
+	var returned int32
+	task, err := tasks.New(func() error {
+		// Ignores the timeout
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+		return nil
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = task.CallWithTimeout(time.Millisecond)
+	assert.Equal(t, tasks.ErrTaskTimedOut, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&returned))
+
+	// Tasks accepting a context return early
+	task, err = tasks.New(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = task.CallWithTimeout(time.Millisecond)
+	assert.Equal(t, tasks.ErrTaskTimedOut, err)
+}
+
+func TestArgCoercion(t *testing.T) {
+	f := func(n int64, small int8, u uint, f float64, ip net.IP) (string, error) {
+		return fmt.Sprintf("%d %d %d %v %s", n, small, u, f, ip), nil
+	}
+
+	args := []tasks.Arg{
+		{Type: "int32", Value: int64(42)},
+		{Type: "int64", Value: int64(-3)},
+		{Type: "string", Value: "7"},
+		{Type: "int", Value: int64(2)},
+		{Type: "string", Value: "10.0.0.1"},
+	}
+
+	task, err := tasks.New(f, args)
+	assert.NoError(t, err)
+	assert.Equal(t, reflect.Int64, task.Args[0].Kind())
+
+	taskResults, err := task.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, "42 -3 7 2 10.0.0.1", taskResults[0].Value)
+
+	// Variadic parameters are coerced as well
+	sum := func(args ...int64) (int64, error) {
+		total := int64(0)
+		for _, arg := range args {
+			total += arg
+		}
+		return total, nil
+	}
+	task, err = tasks.New(sum, []tasks.Arg{{Type: "int32", Value: int64(1)}, {Type: "uint8", Value: uint64(2)}})
+	assert.NoError(t, err)
+	taskResults, err = task.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), taskResults[0].Value)
+
+	// Lossy coercion fails
+	_, err = tasks.New(func(n int8) error { return nil }, []tasks.Arg{{Type: "int64", Value: int64(300)}})
+	assert.EqualError(t, err, "Reflect task args error: 300 is not int8")
+	_, err = tasks.New(func(n int64) error { return nil }, []tasks.Arg{{Type: "string", Value: "seven"}})
+	assert.EqualError(t, err, "Reflect task args error: seven is not int64")
+	_, err = tasks.New(func(ip net.IP) error { return nil }, []tasks.Arg{{Type: "string", Value: "not an ip"}})
+	assert.Error(t, err)
+
+	_, err = tasks.CoerceValue(reflect.ValueOf(1.5), reflect.TypeOf(int64(0)))
+	assert.EqualError(t, err, "1.5 is not int64")
+	_, err = tasks.CoerceValue(reflect.ValueOf(float64(0.1)), reflect.TypeOf(float32(0)))
+	assert.Error(t, err)
+}
+
+func TestFillOptionalArgs(t *testing.T) {
+	f := func(ctx context.Context, n int64, label string, verbose bool, rest ...int64) (string, error) {
+		return fmt.Sprintf("%d %q %v %d", n, label, verbose, len(rest)), nil
+	}
+
+	task, err := tasks.New(f, []tasks.Arg{{Type: "int64", Value: int64(1)}})
+	assert.NoError(t, err)
+	assert.NoError(t, task.FillOptionalArgs([]interface{}{true}))
+
+	taskResults, err := task.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, `1 "" true 0`, taskResults[0].Value)
+
+	task, err = tasks.New(f, nil)
+	assert.NoError(t, err)
+	assert.EqualError(t, task.FillOptionalArgs([]interface{}{"label", 1}), "Default 1 is not assignable to bool")
+	assert.EqualError(t, task.FillOptionalArgs([]interface{}{1, "label", true, 2}), "4 defaults given for 3 parameters")
+}
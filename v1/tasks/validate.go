@@ -3,6 +3,8 @@ package tasks
 import (
 	"errors"
 	"reflect"
+	"runtime"
+	"strings"
 )
 
 var (
@@ -14,6 +16,23 @@ var (
 	ErrLastReturnValueMustBeError = errors.New("Last return value of a task must be error")
 )
 
+// FuncName returns the name a task function is registered and sent under
+// when no name is given, its package path and name as known to the runtime,
+// e.g. github.com/example/app/tasks.SendEmail. Names of anonymous functions
+// depend on where they are declared, so named functions are best suited
+func FuncName(task interface{}) string {
+	v := reflect.ValueOf(task)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return ""
+	}
+	fn := runtime.FuncForPC(v.Pointer())
+	if fn == nil {
+		return ""
+	}
+	// Method values are named like the method with -fm appended
+	return strings.TrimSuffix(fn.Name(), "-fm")
+}
+
 // ValidateTask validates task function using reflection and makes sure
 // it has a proper signature. Functions used as tasks must return at least a
 // single value and the last return type must be error
@@ -2,19 +2,45 @@ package tasks
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/satori/go.uuid"
 )
 
 // Chain creates a chain of tasks to be executed one after another
 type Chain struct {
+	// UUID identifies the chain as a workflow, see Server.GetWorkflowState
+	UUID  string
 	Tasks []*Signature
+	// MaxTotalRetries limits number of retries shared by all tasks of the
+	// chain, 0 means retries are only limited per task
+	MaxTotalRetries int
+	// Reactive makes a Coordinator publish each task once the previous one
+	// succeeded instead of the worker which ran it
+	Reactive bool
+	// Deadline is when the whole chain must have finished, each task runs
+	// under the time remaining until then
+	Deadline *time.Time
 }
 
 // Group creates a set of tasks to be executed in parallel
 type Group struct {
 	GroupUUID string
 	Tasks     []*Signature
+	// OrderedDispatch publishes tasks one by one in the order of Tasks, so
+	// they are received in that order, they still run and finish in any
+	// order. GroupTaskIndex of each task is its position
+	OrderedDispatch bool
+}
+
+// LazyGroup creates a set of tasks to be executed in parallel which are
+// generated on demand, so even enormous groups don't have to be held in
+// memory. Task returns the i-th of Size tasks, at most MaxParallel of them
+// are sent and tracked at once
+type LazyGroup struct {
+	Size        int
+	MaxParallel int
+	Task        func(i int) *Signature
 }
 
 // Chord adds an optional callback to the group to be executed
@@ -49,23 +75,29 @@ func NewChain(signatures ...*Signature) *Chain {
 		}
 	}
 
-	chain := &Chain{Tasks: signatures}
+	chain := &Chain{UUID: NewChainUUID(), Tasks: signatures}
 
 	return chain
 }
 
+// NewChainUUID generates a new UUID of a chain
+func NewChainUUID() string {
+	return fmt.Sprintf("chain_%v", uuid.NewV4())
+}
+
 // NewGroup creates a new group of tasks to be processed in parallel
 func NewGroup(signatures ...*Signature) *Group {
 	// Generate a group UUID
 	groupUUID := fmt.Sprintf("group_%v", uuid.NewV4())
 
 	// Auto generate task UUIDs if needed, group tasks by common group UUID
-	for _, signature := range signatures {
+	for i, signature := range signatures {
 		if signature.UUID == "" {
 			signature.UUID = fmt.Sprintf("task_%v", uuid.NewV4())
 		}
 		signature.GroupUUID = groupUUID
 		signature.GroupTaskCount = len(signatures)
+		signature.GroupTaskIndex = i
 	}
 
 	return &Group{
@@ -74,6 +106,22 @@ func NewGroup(signatures ...*Signature) *Group {
 	}
 }
 
+// NewLazyGroup creates a new group of size tasks generated by the task func
+// once they are about to be sent, maxParallel of them at most at a time.
+// Unlike tasks of a Group they don't share a group UUID, so a lazy group
+// can't be used in a chord
+func NewLazyGroup(size, maxParallel int, task func(i int) *Signature) *LazyGroup {
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+
+	return &LazyGroup{
+		Size:        size,
+		MaxParallel: maxParallel,
+		Task:        task,
+	}
+}
+
 // NewChord creates a new chord (a group of tasks with a single callback
 // to be executed after all tasks in the group has completed)
 func NewChord(group *Group, callback *Signature) *Chord {
@@ -87,3 +135,151 @@ func NewChord(group *Group, callback *Signature) *Chord {
 
 	return &Chord{Group: group, Callback: callback}
 }
+
+const (
+	// WorkflowChain - workflow of tasks executed one after another
+	WorkflowChain = "chain"
+	// WorkflowGroup - workflow of tasks executed in parallel
+	WorkflowGroup = "group"
+	// WorkflowChord - workflow of parallel tasks followed by a callback
+	WorkflowChord = "chord"
+)
+
+// Workflow describes the structure of a chain, group or chord, so its
+// progress can be reconstructed from states of its tasks. UUID is the UUID of
+// the chain or the group UUID of the group or chord
+type Workflow struct {
+	UUID string
+	Type string
+	// Steps are executed one after another, tasks of a step in parallel
+	Steps [][]WorkflowTask
+	// Signatures of the steps of a reactive workflow, published by a
+	// Coordinator
+	Signatures [][]*Signature `json:",omitempty"`
+	// Published holds UUIDs of tasks of a reactive workflow which were
+	// published successfully, a task marked as pending but not published
+	// because of a crash is published again
+	Published map[string]bool `json:",omitempty"`
+	// Deadline of a chain
+	Deadline *time.Time `json:",omitempty"`
+}
+
+// WorkflowTask identifies a task of a workflow
+type WorkflowTask struct {
+	UUID string
+	Name string
+}
+
+// WorkflowStepState represents a state of a step of a workflow, the state is
+// PENDING until any of its tasks is received, STARTED until all of them
+// succeed (SUCCESS) or any of them fails (FAILURE)
+type WorkflowStepState struct {
+	State string
+	Tasks []*TaskState
+}
+
+// WorkflowState represents progress of a workflow, ActiveStep is the index of
+// the first step which did not succeed yet, -1 once all of them did
+type WorkflowState struct {
+	UUID       string
+	Type       string
+	State      string
+	ActiveStep int
+	Steps      []*WorkflowStepState
+}
+
+// NewChainWorkflow describes the chain, each task is a step of its own
+func NewChainWorkflow(chain *Chain) *Workflow {
+	workflow := &Workflow{UUID: chain.UUID, Type: WorkflowChain, Deadline: chain.Deadline}
+	for _, signature := range chain.Tasks {
+		workflow.Steps = append(workflow.Steps, []WorkflowTask{newWorkflowTask(signature)})
+	}
+	return workflow
+}
+
+// NewGroupWorkflow describes the group, all tasks make up a single step
+func NewGroupWorkflow(group *Group) *Workflow {
+	return &Workflow{
+		UUID:  group.GroupUUID,
+		Type:  WorkflowGroup,
+		Steps: [][]WorkflowTask{newWorkflowTasks(group.Tasks)},
+	}
+}
+
+// NewChordWorkflow describes the chord, the group is followed by a step with
+// the callback
+func NewChordWorkflow(chord *Chord) *Workflow {
+	workflow := NewGroupWorkflow(chord.Group)
+	workflow.Type = WorkflowChord
+	workflow.Steps = append(workflow.Steps, []WorkflowTask{newWorkflowTask(chord.Callback)})
+	return workflow
+}
+
+func newWorkflowTask(signature *Signature) WorkflowTask {
+	return WorkflowTask{UUID: signature.UUID, Name: signature.Name}
+}
+
+func newWorkflowTasks(signatures []*Signature) []WorkflowTask {
+	workflowTasks := make([]WorkflowTask, len(signatures))
+	for i, signature := range signatures {
+		workflowTasks[i] = newWorkflowTask(signature)
+	}
+	return workflowTasks
+}
+
+// NewWorkflowState reconstructs progress of the workflow from states of its
+// tasks, given in the same shape as the workflow steps
+func NewWorkflowState(workflow *Workflow, states [][]*TaskState) *WorkflowState {
+	workflowState := &WorkflowState{
+		UUID:       workflow.UUID,
+		Type:       workflow.Type,
+		State:      StateSuccess,
+		ActiveStep: -1,
+		Steps:      make([]*WorkflowStepState, len(states)),
+	}
+
+	pending := true
+	for i, taskStates := range states {
+		stepState := &WorkflowStepState{State: newStepState(taskStates), Tasks: taskStates}
+		workflowState.Steps[i] = stepState
+
+		if stepState.State != StatePending {
+			pending = false
+		}
+		if stepState.State != StateSuccess && workflowState.ActiveStep == -1 {
+			workflowState.ActiveStep = i
+			workflowState.State = StateStarted
+		}
+		if stepState.State == StateFailure {
+			workflowState.State = StateFailure
+		}
+	}
+	if pending && len(states) > 0 {
+		workflowState.State = StatePending
+	}
+
+	return workflowState
+}
+
+// newStepState determines a state of a step from states of its tasks
+func newStepState(taskStates []*TaskState) string {
+	succeeded, pending := 0, 0
+	for _, taskState := range taskStates {
+		switch taskState.State {
+		case StateFailure, StateCancelled:
+			return StateFailure
+		case StateSuccess, StateSkipped, StateDeduplicated:
+			succeeded++
+		case StatePending:
+			pending++
+		}
+	}
+
+	switch len(taskStates) {
+	case succeeded:
+		return StateSuccess
+	case pending:
+		return StatePending
+	}
+	return StateStarted
+}
@@ -1,25 +1,88 @@
 package machinery
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/RichardKnop/logging"
 	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/clock"
 	"github.com/koblelabs/machinery/v1/log"
 	"github.com/koblelabs/machinery/v1/retry"
 	"github.com/koblelabs/machinery/v1/tasks"
 )
 
+// deduplicatedTasks counts tasks dropped as duplicates by task name, it is
+// published with other expvar variables, e.g. on /debug/vars
+var deduplicatedTasks = expvar.NewMap("machinery_tasks_deduplicated_total")
+
+// backendPingInterval is how often an unavailable result backend is pinged
+var backendPingInterval = time.Second
+
+// defaultDrainTimeout is how long a draining worker waits for tasks being
+// processed to finish unless DrainTimeout is set
+var defaultDrainTimeout = 30 * time.Second
+
+// globalSlotLeaseTTL is how long a slot of a global concurrency limit is
+// leased for, the lease is renewed while the task runs so only slots of
+// crashed workers expire
+var globalSlotLeaseTTL = 30 * time.Second
+
+// globalSlotRetryDelay is how long a task waits in the queue when all slots
+// of its global concurrency limit are taken
+var globalSlotRetryDelay = time.Second
+
+// supersededCheckRetryDelay is how long a replaceable or debounced task
+// waits in the queue when the result backend can't tell whether it was
+// superseded
+var supersededCheckRetryDelay = time.Second
+
+// defaultETAPrecision is how early a delayed task can arrive before its ETA
+// and still run right away unless ETAPrecision is set
+var defaultETAPrecision = 100 * time.Millisecond
+
 // Worker represents a single worker process
 type Worker struct {
 	server      *Server
 	ConsumerTag string
 	Concurrency int
+	taskFilter  func(*tasks.Signature) bool
+	// resumeChan is closed once consumption paused due to the result
+	// backend being unavailable is resumed, nil when not paused
+	resumeChan chan struct{}
+	pauseMu    sync.Mutex
+	// drainSignal makes Launch drain the worker when received
+	drainSignal os.Signal
+	// drained is closed once a draining worker has stopped, nil unless
+	// the worker is draining
+	drained     chan struct{}
+	drainReport *brokers.ShutdownReport
+	drainMu     sync.Mutex
+	// maxTasks is the number of tasks processed before the worker stops,
+	// 0 means no limit
+	maxTasks int
+	clock    clock.Clock
+	// random spreads task starts, it is seeded per worker so workers
+	// started together don't pick the same delays
+	random   *rand.Rand
+	randomMu sync.Mutex
+	// calls tracks tasks being called for resource guards
+	calls callTracker
 }
 
 // Launch starts a new worker process. The worker subscribes
@@ -66,7 +129,71 @@ func (worker *Worker) Launch() error {
 		errorsChan <- err
 	}()
 
-	return <-errorsChan
+	if worker.drainSignal != nil {
+		drainSig := make(chan os.Signal, 1)
+		signal.Notify(drainSig, worker.drainSignal)
+		defer signal.Stop(drainSig)
+
+		go func() {
+			log.WARNING.Printf("Signal received: %v. Draining the worker", <-drainSig)
+			worker.DrainAndStop()
+		}()
+	}
+
+	err := <-errorsChan
+
+	// A draining worker exits cleanly once tasks in flight finished
+	worker.drainMu.Lock()
+	drained := worker.drained
+	worker.drainMu.Unlock()
+	if drained != nil {
+		<-drained
+		return nil
+	}
+	return err
+}
+
+// SetMaxTasks makes the worker stop consuming once it processed maxTasks
+// tasks, Launch then returns nil. No more tasks are received meanwhile than
+// may be needed to reach the limit. Zero means no limit
+func (worker *Worker) SetMaxTasks(maxTasks int) {
+	worker.maxTasks = maxTasks
+}
+
+// TaskLimit returns the number of tasks processed before the worker stops,
+// 0 means no limit
+func (worker *Worker) TaskLimit() int {
+	return worker.maxTasks
+}
+
+// SetDrainSignal makes the worker drain (see DrainAndStop) when it receives
+// the signal, e.g. syscall.SIGUSR1, so a drain can be requested without
+// terminating the process
+func (worker *Worker) SetDrainSignal(sig os.Signal) {
+	worker.drainSignal = sig
+}
+
+// DrainAndStop stops consuming new tasks and waits up to DrainTimeout for
+// tasks being processed to finish, Launch then returns nil. The report lists
+// tasks which did not finish in time (nil if the broker cannot report them)
+func (worker *Worker) DrainAndStop() *brokers.ShutdownReport {
+	worker.drainMu.Lock()
+	if worker.drained != nil {
+		drained := worker.drained
+		worker.drainMu.Unlock()
+		<-drained
+		return worker.drainReport
+	}
+	worker.drained = make(chan struct{})
+	worker.drainMu.Unlock()
+
+	timeout := defaultDrainTimeout
+	if drainTimeout := worker.server.GetConfig().DrainTimeout; drainTimeout > 0 {
+		timeout = time.Duration(drainTimeout) * time.Second
+	}
+	worker.drainReport = worker.QuitWithTimeout(timeout)
+	close(worker.drained)
+	return worker.drainReport
 }
 
 // Quit tears down the running worker process
@@ -74,8 +201,111 @@ func (worker *Worker) Quit() {
 	worker.server.GetBroker().StopConsuming()
 }
 
+// QuitWithTimeout tears down the running worker process and waits up to the
+// timeout for tasks being processed to finish, the returned report lists the
+// ones which did not (nil if the broker cannot report them)
+func (worker *Worker) QuitWithTimeout(timeout time.Duration) *brokers.ShutdownReport {
+	if stopper, ok := worker.server.GetBroker().(brokers.GracefulStopper); ok {
+		return stopper.StopConsumingWithTimeout(timeout)
+	}
+	worker.Quit()
+	return nil
+}
+
+// SetTaskFilter sets a predicate consulted before processing a delivered task,
+// tasks not matching the filter are requeued for other workers
+func (worker *Worker) SetTaskFilter(filter func(*tasks.Signature) bool) {
+	worker.taskFilter = filter
+}
+
+// AcceptsTask returns true if the task was sent to the worker's group, if
+// any, and passes the worker's task filter
+func (worker *Worker) AcceptsTask(signature *tasks.Signature) bool {
+	if signature.WorkerGroup != "" && signature.WorkerGroup != worker.server.GetConfig().WorkerGroup {
+		return false
+	}
+	if worker.taskFilter == nil {
+		return true
+	}
+	return worker.taskFilter(signature)
+}
+
+// Resumed returns a channel which is closed once the worker can consume tasks,
+// consumption is paused while the result backend is unavailable
+func (worker *Worker) Resumed() <-chan struct{} {
+	worker.pauseMu.Lock()
+	defer worker.pauseMu.Unlock()
+
+	if worker.resumeChan == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return worker.resumeChan
+}
+
+// pauseOnBackendError pauses consumption after a failed backend write if
+// enabled, consumption is resumed once the backend responds to a ping again
+func (worker *Worker) pauseOnBackendError(backend backends.Interface, err error) bool {
+	if !worker.server.GetConfig().PauseOnBackendUnavailable {
+		return false
+	}
+
+	pinger, ok := backend.(backends.Pinger)
+	if !ok {
+		return false
+	}
+
+	worker.pauseMu.Lock()
+	defer worker.pauseMu.Unlock()
+
+	if worker.resumeChan == nil {
+		log.WARNING.Printf("Result backend unavailable, pausing consumption: %s", err)
+		worker.resumeChan = make(chan struct{})
+		go worker.resumeWhenBackendAvailable(pinger)
+	}
+
+	return true
+}
+
+// resumeWhenBackendAvailable pings the backend until it responds and
+// resumes consumption
+func (worker *Worker) resumeWhenBackendAvailable(pinger backends.Pinger) {
+	for {
+		<-time.After(backendPingInterval)
+
+		if err := pinger.Ping(); err != nil {
+			log.WARNING.Printf("Result backend still unavailable: %s", err)
+			continue
+		}
+
+		worker.pauseMu.Lock()
+		close(worker.resumeChan)
+		worker.resumeChan = nil
+		worker.pauseMu.Unlock()
+
+		log.INFO.Print("Result backend available again, resuming consumption")
+		return
+	}
+}
+
 // Process handles received tasks and triggers success/error callbacks
 func (worker *Worker) Process(signature *tasks.Signature) error {
+	return worker.process(signature, nil)
+}
+
+// CommitsTask returns true if the task acknowledges its delivery itself
+func (worker *Worker) CommitsTask(signature *tasks.Signature) bool {
+	return worker.server.taskOptions[signature.Name].ManualCommit
+}
+
+// ProcessWithCommit handles received tasks like Process, the task gets commit
+// in its context to acknowledge the delivery once its work is durable
+func (worker *Worker) ProcessWithCommit(signature *tasks.Signature, commit func()) error {
+	return worker.process(signature, commit)
+}
+
+func (worker *Worker) process(signature *tasks.Signature, commit func()) error {
 	// If the task is not registered with this worker, do not continue
 	// but only return nil as we do not want to restart the worker process
 	if !worker.server.IsTaskRegistered(signature.Name) {
@@ -87,91 +317,672 @@ func (worker *Worker) Process(signature *tasks.Signature) error {
 		return nil
 	}
 
-	// Update task state to RECEIVED
-	if err = worker.server.GetBackend().SetStateReceived(signature); err != nil {
+	// A delayed task arriving before its ETA, e.g. due to clock skew between
+	// nodes or a delay which drifted from the ETA while publishing, is
+	// delayed again for the remaining time instead of running early
+	if early := worker.earlyBy(signature); early > 0 {
+		worker.taskLogger(signature).Printf("Task %s received %s before its ETA. Delaying it again.", logID(signature), early)
+		if err := worker.setStatePending(signature); err != nil {
+			return fmt.Errorf("Set state pending error: %s", err)
+		}
+		if err := worker.server.GetBroker().Publish(signature); err != nil {
+			return fmt.Errorf("Publish message error: %s", err)
+		}
+		return nil
+	}
+
+	// A task replaced by another one before it ran is not executed, if
+	// that can't be told yet the task is requeued without spending a retry
+	if signature.Replaceable {
+		replaced, err := worker.isReplaced(signature)
+		if err != nil {
+			log.WARNING.Printf("Check whether task %s was replaced error: %s", logID(signature), err)
+			return worker.taskRetryLater(signature, tasks.NewErrRetryLater(supersededCheckRetryDelay))
+		}
+		if replaced {
+			return nil
+		}
+	}
+
+	// If a newer task with the same debounce key has been sent since,
+	// this one is superseded and will not be executed, if that can't be
+	// told yet the task is requeued without spending a retry
+	if signature.DebounceKey != "" {
+		superseded, err := worker.isSuperseded(signature)
+		if err != nil {
+			log.WARNING.Printf("Debounce error: %s", err)
+			return worker.taskRetryLater(signature, tasks.NewErrRetryLater(supersededCheckRetryDelay))
+		}
+		if superseded {
+			return nil
+		}
+	}
+
+	// A task published longer than MaxConsumeAge ago is stale, e.g. a
+	// backlog left behind by an outage, and is discarded
+	if worker.isStale(signature) {
+		worker.taskLogger(signature).Printf("Task %s is older than MaxConsumeAge. Discarding it.", logID(signature))
+		if err := worker.setStateSkipped(signature); err != nil {
+			return fmt.Errorf("Set state skipped error: %s", err)
+		}
+		return nil
+	}
+
+	// Update task state to RECEIVED, the time the task spent in the queue is
+	// stored alongside it
+	receivedAt := worker.clock.Now().UTC()
+	signature.ReceivedAt = &receivedAt
+	backend := worker.server.GetTaskBackend(signature)
+	if err = worker.setStateReceived(backend, signature); err != nil {
+		if worker.pauseOnBackendError(backend, err) {
+			// Process the task again once the backend is reachable
+			<-worker.Resumed()
+			return worker.process(signature, commit)
+		}
 		return fmt.Errorf("Set state received error: %s", err)
 	}
+	worker.progressLogger(signature).Printf("Received task %s", logID(signature))
+
+	// The stored retry count is authoritative, the one in the message might
+	// have been reset on its way back to the queue
+	if err := worker.loadRetryCount(signature); err != nil {
+		return fmt.Errorf("Get retry count error: %s", err)
+	}
+
+	// Tasks with cached results succeed without running again
+	if signature.CacheKey != "" {
+		if results := worker.cachedResults(signature); results != nil {
+			return worker.taskSucceeded(signature, results)
+		}
+	}
+
+	// Tasks with a global concurrency limit wait in the queue until a slot
+	// is free
+	options := worker.server.taskOptions[signature.Name]
+	if max := options.GlobalConcurrency; max > 0 {
+		release, acquired, err := worker.acquireGlobalSlot(signature, max)
+		if err != nil {
+			return fmt.Errorf("Acquire global concurrency slot error: %s", err)
+		}
+		if !acquired {
+			return worker.taskRetryLater(signature, tasks.NewErrRetryLater(globalSlotRetryDelay))
+		}
+		defer release()
+	}
+
+	ctx := context.Background()
+	if commit != nil {
+		ctx = tasks.WithCommit(ctx, commit)
+	}
+
+	// Open streams referenced by stream args, they are closed once the
+	// task returns
+	args, closeStreams, err := worker.openStreams(ctx, signature)
+	if err != nil {
+		err = fmt.Errorf("Open stream error: %s", err)
+		if worker.hasRetriesLeft(signature) && hasChainRetryBudget(signature) {
+			return worker.taskRetry(signature, err)
+		}
+		return worker.taskFailed(signature, err)
+	}
+	defer closeStreams()
 
 	// Prepare task for processing
-	task, err := tasks.New(taskFunc, signature.Args)
+	task, err := tasks.New(taskFunc, args)
+	if options.OptionalArgs != nil && err == nil {
+		err = task.FillOptionalArgs(options.OptionalArgs)
+	}
 	// if this failed, it means the task is malformed, probably has invalid
 	// signature, go directly to task failed without checking whether to retry
 	if err != nil {
 		worker.taskFailed(signature, err)
 		return err
 	}
+	task.RunOnLockedThread = options.RunOnLockedThread
+	if commit != nil {
+		task.Context = ctx
+	}
+
+	// Later tasks of a chain which ran out of time are not run either
+	if signature.ChainDeadline != nil && !worker.clock.Now().Before(*signature.ChainDeadline) {
+		return worker.taskFailed(signature, tasks.ErrChainDeadlineExceeded)
+	}
+
+	// Spread the start of tasks sent at once
+	if jitter := worker.startJitter(signature); jitter > 0 {
+		<-worker.clock.After(worker.randomDuration(jitter))
+	}
 
 	// Update task state to STARTED
-	if err = worker.server.GetBackend().SetStateStarted(signature); err != nil {
+	startedAt := worker.clock.Now().UTC()
+	signature.StartedAt = &startedAt
+	signature.WorkerName = worker.ConsumerTag
+	if err = worker.setStateStarted(backend, signature); err != nil {
+		if worker.pauseOnBackendError(backend, err) {
+			<-worker.Resumed()
+			return worker.process(signature, commit)
+		}
 		return fmt.Errorf("Set state started error: %s", err)
 	}
+	worker.progressLogger(signature).Printf("Started task %s", logID(signature))
 
 	// Call the task
-	results, err := task.Call()
+	results, err := worker.callTask(task, signature)
+	if retryLater, ok := err.(tasks.ErrRetryLater); ok {
+		return worker.taskRetryLater(signature, retryLater)
+	}
+	if panicErr, ok := err.(*tasks.PanicError); ok && worker.server.GetConfig().DeadLetterOnPanic {
+		// Retrying would most likely panic again
+		if err := worker.taskFailed(signature, panicErr); err != nil {
+			return err
+		}
+		return &brokers.DeadLetterError{Err: panicErr}
+	}
 	if err != nil {
-		// Let's retry the task
-		if signature.RetryCount > 0 {
-			return worker.taskRetry(signature)
+		// Let's retry the task unless the chain has run out of retries
+		if worker.hasRetriesLeft(signature) && hasChainRetryBudget(signature) {
+			return worker.taskRetry(signature, err)
 		}
 
 		return worker.taskFailed(signature, err)
 	}
 
+	if signature.CacheKey != "" {
+		worker.cacheResults(signature, results)
+	}
+
 	return worker.taskSucceeded(signature, results)
 }
 
-// retryTask decrements RetryCount counter and republishes the task to the queue
-func (worker *Worker) taskRetry(signature *tasks.Signature) error {
-	// Update task state to RETRY
-	if err := worker.server.GetBackend().SetStateRetry(signature); err != nil {
-		return fmt.Errorf("Set state retry error: %s", err)
+// acquireGlobalSlot leases a slot of the task's global concurrency limit, the
+// lease is renewed while the task runs until the returned func releases it
+func (worker *Worker) acquireGlobalSlot(signature *tasks.Signature, max int) (func(), bool, error) {
+	semaphore, ok := worker.server.GetTaskBackend(signature).(backends.Semaphore)
+	if !ok {
+		return nil, false, errors.New("Result backend does not support global concurrency limits")
+	}
+
+	acquired, err := semaphore.AcquireSlot(signature.Name, signature.UUID, max, globalSlotLeaseTTL)
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(globalSlotLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// A lease which expired before it was renewed may have been
+				// taken by another task, which then runs beyond the limit
+				renewed, err := semaphore.AcquireSlot(signature.Name, signature.UUID, max, globalSlotLeaseTTL)
+				if err != nil {
+					log.WARNING.Printf("Renew global concurrency slot error: %s", err)
+				} else if !renewed {
+					log.WARNING.Printf("Global concurrency slot of task %s lost, all %d slots are taken by other tasks", logID(signature), max)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	release := func() {
+		close(done)
+		if err := semaphore.ReleaseSlot(signature.Name, signature.UUID); err != nil {
+			log.WARNING.Printf("Release global concurrency slot error: %s", err)
+		}
+	}
+	return release, true, nil
+}
+
+// logID identifies the task in log lines, along with its correlation ID
+func logID(signature *tasks.Signature) string {
+	if signature.CorrelationID == "" {
+		return signature.UUID
+	}
+	return fmt.Sprintf("%s [%s]", signature.UUID, signature.CorrelationID)
+}
+
+// taskLogger returns the logger of the level set for the task
+func (worker *Worker) taskLogger(signature *tasks.Signature) logging.LoggerInterface {
+	return log.Logger(worker.server.taskOptions[signature.Name].LogLevel)
+}
+
+// progressLogger returns the logger receiving and starting the task is
+// logged with, DEBUG unless a level was set for the task
+func (worker *Worker) progressLogger(signature *tasks.Signature) logging.LoggerInterface {
+	if level := worker.server.taskOptions[signature.Name].LogLevel; level != "" {
+		return log.Logger(level)
 	}
+	return log.DEBUG
+}
+
+// cachedResults returns results cached under the task's cache key or nil
+// if there are none
+func (worker *Worker) cachedResults(signature *tasks.Signature) []*tasks.TaskResult {
+	cache, ok := worker.server.GetTaskBackend(signature).(backends.ResultCache)
+	if !ok {
+		return nil
+	}
+
+	results, err := cache.GetCachedResults(signature.CacheKey)
+	if err != nil {
+		log.WARNING.Printf("Get cached results error: %s", err)
+		return nil
+	}
+	return results
+}
 
+// cacheResults caches results under the task's cache key, the task has
+// succeeded already so failing to cache them is only logged
+func (worker *Worker) cacheResults(signature *tasks.Signature, results []*tasks.TaskResult) {
+	cache, ok := worker.server.GetTaskBackend(signature).(backends.ResultCache)
+	if !ok {
+		log.WARNING.Printf("Result backend does not support caching results of %s", logID(signature))
+		return
+	}
+
+	ttl := time.Duration(signature.CacheTTL) * time.Second
+	if err := cache.SetCachedResults(signature.CacheKey, results, ttl); err != nil {
+		log.WARNING.Printf("Cache results error: %s", err)
+	}
+}
+
+// taskCall calls a task and returns its results
+type taskCall func() ([]*tasks.TaskResult, error)
+
+// callTask calls the task within its time limit and resource guards
+func (worker *Worker) callTask(task *tasks.Task, signature *tasks.Signature) ([]*tasks.TaskResult, error) {
+	options := worker.server.taskOptions[signature.Name]
+
+	// The memory guard cancels the context the time limit derives from
+	var call taskCall = task.Call
+	if timeLimit := worker.timeLimit(signature); timeLimit > 0 {
+		call = func() ([]*tasks.TaskResult, error) {
+			return task.CallWithTimeout(timeLimit)
+		}
+	}
+	alone, done := worker.calls.start()
+	defer done()
+	if options.MaxMemoryBytes > 0 {
+		call = limitMemory(task, call, options.MaxMemoryBytes, alone)
+	}
+	if options.FailOnGoroutineLeak {
+		call = checkGoroutineLeak(call, alone, worker.clock)
+	}
+	return call()
+}
+
+// memorySampleInterval is how often the heap is sampled while a task with a
+// memory limit runs, reading memory statistics stops the world briefly
+var memorySampleInterval = 100 * time.Millisecond
+
+// limitMemory cancels the context of the task once more than maxBytes were
+// allocated on the heap since it started and fails the call once the task
+// returned. Allocations are counted for the whole process, so the limit is
+// only enforced while the task runs alone on the worker
+func limitMemory(task *tasks.Task, call taskCall, maxBytes uint64, alone func() bool) taskCall {
+	return func() ([]*tasks.TaskResult, error) {
+		parent := task.Context
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithCancel(parent)
+		defer cancel()
+		task.Context = ctx
+
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		baseline := stats.TotalAlloc
+
+		type callResult struct {
+			taskResults []*tasks.TaskResult
+			err         error
+		}
+		resultChan := make(chan callResult, 1)
+		go func() {
+			taskResults, err := call()
+			resultChan <- callResult{taskResults, err}
+		}()
+
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+		samples, exceeded := ticker.C, false
+		for {
+			select {
+			case result := <-resultChan:
+				if exceeded {
+					return nil, tasks.ErrMemoryLimitExceeded
+				}
+				return result.taskResults, result.err
+			case <-samples:
+				runtime.ReadMemStats(&stats)
+				if stats.TotalAlloc-baseline > maxBytes && alone() {
+					samples, exceeded = nil, true
+					cancel()
+				}
+			}
+		}
+	}
+}
+
+// goroutineLeakGrace is how long goroutines started by a task get to exit
+// after it returned
+var goroutineLeakGrace = 100 * time.Millisecond
+
+// checkGoroutineLeak makes the call on a goroutine of its own and fails it if
+// goroutines started since are still running once it returned. Goroutines
+// started by other tasks or by libraries meanwhile can't be told apart, so
+// leaks are only checked for while the task runs alone on the worker and the
+// check is only meaningful then
+func checkGoroutineLeak(call taskCall, alone func() bool, clock clock.Clock) taskCall {
+	return func() ([]*tasks.TaskResult, error) {
+		// Goroutine IDs are unique but not assigned in the order goroutines
+		// start, running ones are compared with those running before
+		running := goroutineIDs()
+
+		type callResult struct {
+			taskResults []*tasks.TaskResult
+			err         error
+		}
+		resultChan := make(chan callResult, 1)
+		go func() {
+			running[currentGoroutineID()] = true
+			taskResults, err := call()
+			resultChan <- callResult{taskResults, err}
+		}()
+
+		result := <-resultChan
+		if result.err != nil {
+			return result.taskResults, result.err
+		}
+
+		deadline := clock.Now().Add(goroutineLeakGrace)
+		for hasGoroutinesBesides(running) && alone() {
+			if clock.Now().After(deadline) {
+				return nil, tasks.ErrGoroutineLeak
+			}
+			<-clock.After(10 * time.Millisecond)
+		}
+		return result.taskResults, nil
+	}
+}
+
+// currentGoroutineID returns ID of the calling goroutine, its stack dump
+// starts with e.g. "goroutine 7 [running]:", 0 if it can't be parsed
+func currentGoroutineID() int64 {
+	buf := make([]byte, 64)
+	return goroutineID(string(buf[:runtime.Stack(buf, false)]))
+}
+
+// goroutineID parses ID of the goroutine from the header of its stack dump
+func goroutineID(stack string) int64 {
+	fields := strings.Fields(stack)
+	if len(fields) < 2 || fields[0] != "goroutine" {
+		return 0
+	}
+	id, _ := strconv.ParseInt(fields[1], 10, 64)
+	return id
+}
+
+// goroutineIDs returns IDs of all goroutines other than the runtime's own,
+// which stack dumps leave out
+func goroutineIDs() map[int64]bool {
+	buf := make([]byte, 64<<10)
+	n := runtime.Stack(buf, true)
+	for n == len(buf) {
+		buf = make([]byte, 2*len(buf))
+		n = runtime.Stack(buf, true)
+	}
+
+	ids := make(map[int64]bool)
+	for _, stack := range strings.Split(string(buf[:n]), "\n\n") {
+		if id := goroutineID(stack); id > 0 {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// hasGoroutinesBesides returns true if any goroutine not in ids is running
+func hasGoroutinesBesides(ids map[int64]bool) bool {
+	for id := range goroutineIDs() {
+		if !ids[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// callTracker tells whether a task ran alone on the worker, i.e. no other
+// task was called while it was, so process wide measurements such as heap
+// allocations can be attributed to it
+type callTracker struct {
+	mu      sync.Mutex
+	running int
+	started int
+}
+
+// start records the start of a call, alone reports whether no other call
+// overlapped it so far and done records its end
+func (t *callTracker) start() (alone func() bool, done func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running++
+	t.started++
+	startedAlone, started := t.running == 1, t.started
+
+	alone = func() bool {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return startedAlone && t.started == started
+	}
+	done = func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.running--
+	}
+	return alone, done
+}
+
+// timeLimit returns how long the task is allowed to run, 0 means no limit
+func (worker *Worker) timeLimit(signature *tasks.Signature) time.Duration {
+	limit := time.Duration(worker.server.GetConfig().DefaultTaskTimeLimit) * time.Second
+	if signature.TimeLimit != nil {
+		limit = time.Duration(*signature.TimeLimit) * time.Second
+	}
+
+	// Tasks of a chain with a deadline get at most the time remaining
+	if signature.ChainDeadline != nil {
+		remaining := signature.ChainDeadline.Sub(worker.clock.Now())
+		if remaining <= 0 {
+			remaining = time.Nanosecond
+		}
+		if limit == 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+	return limit
+}
+
+// startJitter returns up to how long the worker waits before starting the
+// task, the signature's StartJitter takes precedence over the config's
+func (worker *Worker) startJitter(signature *tasks.Signature) time.Duration {
+	if signature.StartJitter != nil {
+		return time.Duration(*signature.StartJitter) * time.Millisecond
+	}
+	return time.Duration(worker.server.GetConfig().StartJitter) * time.Millisecond
+}
+
+// randomDuration returns a random duration in [0, max)
+func (worker *Worker) randomDuration(max time.Duration) time.Duration {
+	worker.randomMu.Lock()
+	defer worker.randomMu.Unlock()
+	return time.Duration(worker.random.Int63n(int64(max)))
+}
+
+// hasRetriesLeft returns true if the task can be retried. RetryCount limits
+// the number of retries and RetryUntil the time until which the task is
+// retried, whichever is exhausted first. A task with RetryUntil and no
+// RetryCount is retried however many times it takes until the deadline. No
+// task is retried once the deadline of its chain has passed
+func (worker *Worker) hasRetriesLeft(signature *tasks.Signature) bool {
+	now := worker.clock.Now()
+	if signature.ChainDeadline != nil && !now.Before(*signature.ChainDeadline) {
+		return false
+	}
+	if signature.RetryUntil != nil {
+		return now.Before(*signature.RetryUntil)
+	}
+	return signature.RetryCount > 0
+}
+
+// hasChainRetryBudget returns false when the task is part of a chain which
+// has exhausted its shared retry budget
+func hasChainRetryBudget(signature *tasks.Signature) bool {
+	return signature.ChainRetryBudget == nil || *signature.ChainRetryBudget > 0
+}
+
+// retryTask decrements RetryCount counter and republishes the task to the queue
+func (worker *Worker) taskRetry(signature *tasks.Signature, taskErr error) error {
 	// Decrement the retry counter, when it reaches 0, we won't retry again
-	signature.RetryCount--
+	// even if the RetryUntil deadline has not passed yet
+	if signature.RetryCount > 0 {
+		signature.RetryCount--
+		if signature.RetryCount == 0 {
+			signature.RetryUntil = nil
+		}
+	}
+
+	if err := worker.storeRetryCount(signature); err != nil {
+		return fmt.Errorf("Set retry count error: %s", err)
+	}
+
+	// Spend one retry of the budget shared by the chain
+	if signature.ChainRetryBudget != nil {
+		*signature.ChainRetryBudget--
+	}
+
+	// Update task state to RETRY, the state keeps the number of remaining
+	// retries so clients can tell a retrying task from a failed one
+	if err := worker.setStateRetry(signature, taskErr.Error()); err != nil {
+		return fmt.Errorf("Set state retry error: %s", err)
+	}
 
 	// Increase retry timeout
 	signature.RetryTimeout = retry.FibonacciNext(signature.RetryTimeout)
 
 	// Delay task by signature.RetryTimeout seconds
-	eta := time.Now().UTC().Add(time.Second * time.Duration(signature.RetryTimeout))
+	eta := worker.clock.Now().UTC().Add(time.Second * time.Duration(signature.RetryTimeout))
 	signature.ETA = &eta
 
-	log.WARNING.Printf("Task %s failed. Going to retry in %ds.", signature.UUID, signature.RetryTimeout)
+	log.WARNING.Printf("Task %s failed. Going to retry in %ds.", logID(signature), signature.RetryTimeout)
 
-	// Send the task back to the queue
-	_, err := worker.server.SendTask(signature)
-	return err
+	// Send the task back to the queue, the task state is left as RETRY
+	// until a worker receives the task again
+	publishedAt := worker.clock.Now().UTC()
+	signature.PublishedAt = &publishedAt
+	if err := worker.server.GetBroker().Publish(signature); err != nil {
+		return fmt.Errorf("Publish message error: %s", err)
+	}
+
+	return nil
+}
+
+// retryCountStore returns the backend keeping retry counts, nil unless
+// StoreRetryCount is enabled and the backend supports it
+func (worker *Worker) retryCountStore() backends.RetryCountStore {
+	if !worker.server.GetConfig().StoreRetryCount {
+		return nil
+	}
+	store, _ := worker.server.GetBackend().(backends.RetryCountStore)
+	return store
+}
+
+// loadRetryCount lowers RetryCount of the signature to the number of retries
+// stored for the task, if any
+func (worker *Worker) loadRetryCount(signature *tasks.Signature) error {
+	store := worker.retryCountStore()
+	if store == nil {
+		return nil
+	}
+
+	retryCount, ok, err := store.GetRetryCount(signature.UUID)
+	if err != nil || !ok || retryCount >= signature.RetryCount {
+		return err
+	}
+	signature.RetryCount = retryCount
+	if retryCount == 0 {
+		signature.RetryUntil = nil
+	}
+	return nil
+}
+
+// storeRetryCount stores the number of retries the task has left
+func (worker *Worker) storeRetryCount(signature *tasks.Signature) error {
+	store := worker.retryCountStore()
+	if store == nil {
+		return nil
+	}
+	return store.SetRetryCount(signature.UUID, signature.RetryCount)
+}
+
+// taskRetryLater requeues a task which is not ready to run yet, unlike
+// taskRetry it leaves the retry counters alone
+func (worker *Worker) taskRetryLater(signature *tasks.Signature, retryLater tasks.ErrRetryLater) error {
+	if err := worker.setStateRetry(signature, retryLater.Error()); err != nil {
+		return fmt.Errorf("Set state retry error: %s", err)
+	}
+
+	now := worker.clock.Now().UTC()
+	signature.ETA = nil
+	if retryLater.Delay > 0 {
+		eta := now.Add(retryLater.Delay)
+		signature.ETA = &eta
+	}
+
+	worker.taskLogger(signature).Printf("Task %s is not ready. Going to retry in %s.", logID(signature), retryLater.Delay)
+
+	signature.PublishedAt = &now
+	if err := worker.server.GetBroker().Publish(signature); err != nil {
+		return fmt.Errorf("Publish message error: %s", err)
+	}
+
+	return nil
 }
 
 // taskSucceeded updates the task state and triggers success callbacks or a
 // chord callback if this was the last task of a group with a chord callback
 func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*tasks.TaskResult) error {
 	// Update task state to SUCCESS
-	if err := worker.server.GetBackend().SetStateSuccess(signature, taskResults); err != nil {
+	if err := worker.setStateSuccess(signature, taskResults); err != nil {
 		return fmt.Errorf("Set state success error: %s", err)
 	}
+	worker.markCompleted(signature)
 
 	debugResults := make([]string, len(taskResults))
 	for i, taskResult := range taskResults {
 		debugResults[i] = fmt.Sprintf("%v", taskResult.Value)
 	}
-	log.INFO.Printf("Processed task %s. Results = [%v]", signature.UUID, strings.Join(debugResults, ", "))
+	worker.taskLogger(signature).Printf("Processed task %s. Results = [%v]", logID(signature), strings.Join(debugResults, ", "))
 
 	// Trigger success callbacks
 
 	for _, successTask := range signature.OnSuccess {
+		// Hand over what is left of the chain retry budget
+		if signature.ChainRetryBudget != nil {
+			budget := *signature.ChainRetryBudget
+			successTask.ChainRetryBudget = &budget
+		}
+
 		if signature.Immutable == false {
-			// Pass results of the task to success callbacks
-			for _, taskResult := range taskResults {
-				successTask.Args = append([]tasks.Arg{{
-					Type:  taskResult.Type,
-					Value: taskResult.Value,
-				}}, successTask.Args...)
-			}
+			passResults(successTask, taskResults)
 		}
 
-		worker.server.SendTask(successTask)
+		worker.sendCallback(signature, successTask)
 	}
 
 	// If the task was not part of a group, just return
@@ -223,6 +1034,12 @@ func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*t
 		return nil
 	}
 
+	// Backends may return states in completion order, sort them so results
+	// are passed to the chord callback in the order tasks were grouped
+	sort.SliceStable(taskStates, func(i, j int) bool {
+		return taskStates[i].GroupTaskIndex < taskStates[j].GroupTaskIndex
+	})
+
 	// Append group tasks' return values to chord task if it's not immutable
 	for _, taskState := range taskStates {
 		if !taskState.IsSuccess() {
@@ -241,39 +1058,329 @@ func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*t
 	}
 
 	// Send the chord task
-	_, err = worker.server.SendTask(signature.ChordCallback)
-	if err != nil {
-		return err
+	return worker.sendCallback(signature, signature.ChordCallback)
+}
+
+// passResults passes results of a task to its success callback
+func passResults(successTask *tasks.Signature, taskResults []*tasks.TaskResult) {
+	for _, taskResult := range taskResults {
+		successTask.Args = append([]tasks.Arg{{
+			Type:  taskResult.Type,
+			Value: taskResult.Value,
+		}}, successTask.Args...)
 	}
+}
 
-	return nil
+// sendCallback sends a callback of the task one workflow step deeper. Once
+// the workflow gets deeper than MaxWorkflowDepth the callback is marked as
+// failed instead, so a workflow re-enqueueing itself can't loop forever
+func (worker *Worker) sendCallback(signature, callback *tasks.Signature) error {
+	callback.WorkflowDepth = signature.WorkflowDepth + 1
+
+	maxDepth := worker.server.GetConfig().MaxWorkflowDepth
+	if maxDepth > 0 && callback.WorkflowDepth > maxDepth {
+		err := fmt.Errorf("Max workflow depth of %d exceeded", maxDepth)
+		log.ERROR.Printf("Not sending callback %s of %s: %s", callback.Name, logID(signature), err)
+		if callback.UUID == "" {
+			return err
+		}
+		if callback.IgnoreResult {
+			return err
+		}
+		return worker.server.GetTaskBackend(callback).SetStateFailure(callback, err.Error())
+	}
+
+	_, err := worker.server.SendTask(callback)
+	return err
+}
+
+// openStreams returns args of the task with streams opened in place of stream
+// args, which keep referencing them so a retried task opens them again. The
+// returned function closes the streams
+func (worker *Worker) openStreams(ctx context.Context, signature *tasks.Signature) ([]tasks.Arg, func(), error) {
+	var streams []io.Closer
+	closeStreams := func() {
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}
+
+	args := append([]tasks.Arg{}, signature.Args...)
+	for i, arg := range args {
+		if arg.Type != tasks.StreamArgType {
+			continue
+		}
+
+		ref, _ := arg.Value.(string)
+		stream, err := worker.server.openStream(ctx, ref)
+		if err != nil {
+			closeStreams()
+			return nil, nil, err
+		}
+		streams = append(streams, stream)
+		args[i].Value = stream
+	}
+
+	return args, closeStreams, nil
+}
+
+// setStatePending updates task state to PENDING unless the task ignores its
+// result, as do the other state updates below
+func (worker *Worker) setStatePending(signature *tasks.Signature) error {
+	if signature.IgnoreResult {
+		return nil
+	}
+	return worker.server.GetTaskBackend(signature).SetStatePending(signature)
+}
+
+// setStateReceived updates task state to RECEIVED
+func (worker *Worker) setStateReceived(backend backends.Interface, signature *tasks.Signature) error {
+	if signature.IgnoreResult {
+		return nil
+	}
+	return backend.SetStateReceived(signature)
+}
+
+// setStateStarted updates task state to STARTED
+func (worker *Worker) setStateStarted(backend backends.Interface, signature *tasks.Signature) error {
+	if signature.IgnoreResult {
+		return nil
+	}
+	return backend.SetStateStarted(signature)
+}
+
+// isStale returns true if the task became due more than MaxConsumeAge seconds
+// ago, i.e. it was published or, if delayed, its ETA passed
+func (worker *Worker) isStale(signature *tasks.Signature) bool {
+	maxAge := worker.server.GetConfig().MaxConsumeAge
+	if maxAge <= 0 || signature.PublishedAt == nil {
+		return false
+	}
+
+	due := *signature.PublishedAt
+	if signature.ETA != nil && signature.ETA.After(due) {
+		due = *signature.ETA
+	}
+	return worker.clock.Now().Sub(due) > time.Duration(maxAge)*time.Second
+}
+
+// SetClock sets the clock ages of tasks and time left to chain deadlines
+// are measured with
+func (worker *Worker) SetClock(clock clock.Clock) {
+	worker.clock = clock
+}
+
+// setStateSkipped updates task state to SKIPPED if supported by the result
+// backend
+func (worker *Worker) setStateSkipped(signature *tasks.Signature) error {
+	if signature.IgnoreResult {
+		return nil
+	}
+	recorder, ok := worker.server.GetTaskBackend(signature).(backends.SkipRecorder)
+	if !ok {
+		return nil
+	}
+	return recorder.SetStateSkipped(signature)
+}
+
+// setStateRetry updates task state to RETRY
+func (worker *Worker) setStateRetry(signature *tasks.Signature, err string) error {
+	if signature.IgnoreResult {
+		return nil
+	}
+	backend := worker.server.GetTaskBackend(signature)
+	if recorder, ok := backend.(backends.RetryErrorRecorder); ok {
+		return recorder.SetStateRetryWithError(signature, err)
+	}
+	return backend.SetStateRetry(signature)
+}
+
+// setStateSuccess updates task state to SUCCESS
+func (worker *Worker) setStateSuccess(signature *tasks.Signature, taskResults []*tasks.TaskResult) error {
+	if signature.IgnoreResult {
+		return nil
+	}
+	backend := worker.server.GetTaskBackend(signature)
+	return worker.retryBackendWrite(func() error {
+		return backend.SetStateSuccess(signature, taskResults)
+	})
+}
+
+// setStateFailure updates task state to FAILURE, the error chain and stack
+// trace are stored as well if enabled and supported by the result backend
+func (worker *Worker) setStateFailure(signature *tasks.Signature, taskErr error) error {
+	if signature.IgnoreResult {
+		return nil
+	}
+	backend := worker.server.GetTaskBackend(signature)
+
+	recorder, ok := backend.(backends.ErrorDetailRecorder)
+	if ok && worker.server.GetConfig().CaptureStackTraces {
+		detail := tasks.NewErrorDetail(taskErr)
+		return worker.retryBackendWrite(func() error {
+			return recorder.SetStateFailureWithDetail(signature, taskErr.Error(), detail)
+		})
+	}
+
+	return worker.retryBackendWrite(func() error {
+		return backend.SetStateFailure(signature, taskErr.Error())
+	})
+}
+
+// retryBackendWrite calls write until it succeeds or BackendWriteRetries
+// retries are used up, so a transient backend error doesn't lose the result
+// of a task which already ran
+func (worker *Worker) retryBackendWrite(write func() error) error {
+	cnf := worker.server.GetConfig()
+	backoff := time.Duration(cnf.BackendWriteBackoff) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	err := write()
+	fibonacci := retry.Fibonacci()
+	for i := 0; err != nil && i < cnf.BackendWriteRetries; i++ {
+		delay := backoff * time.Duration(fibonacci())
+		log.WARNING.Printf("Result backend write failed, retrying in %s: %s", delay, err)
+		<-worker.clock.After(delay)
+		err = write()
+	}
+	return err
 }
 
 // taskFailed updates the task state and triggers error callbacks
 func (worker *Worker) taskFailed(signature *tasks.Signature, taskErr error) error {
 	// Update task state to FAILURE
-	if err := worker.server.GetBackend().SetStateFailure(signature, taskErr.Error()); err != nil {
+	if err := worker.setStateFailure(signature, taskErr); err != nil {
 		return fmt.Errorf("Set state failure error: %s", err)
 	}
+	worker.markCompleted(signature)
 
-	log.ERROR.Printf("Failed processing %s. Error = %v", signature.UUID, taskErr)
+	log.ERROR.Printf("Failed processing %s. Error = %v", logID(signature), taskErr)
 
 	// Trigger error callbacks
 	for _, errorTask := range signature.OnError {
 		// Pass error as a first argument to error callbacks
+		structured := tasks.NewStructuredError(taskErr)
 		args := append([]tasks.Arg{{
 			Type:  "string",
-			Value: taskErr.Error(),
+			Value: structured.Message,
+			Error: structured,
 		}}, errorTask.Args...)
 		errorTask.Args = args
-		worker.server.SendTask(errorTask)
+		worker.sendCallback(signature, errorTask)
 	}
 
 	return nil
 }
 
+// markCompleted records a completion marker if the result backend supports
+// them, so clients can tell an expired result from a pending task
+func (worker *Worker) markCompleted(signature *tasks.Signature) {
+	if signature.IgnoreResult {
+		return
+	}
+	marker, ok := worker.server.GetTaskBackend(signature).(backends.CompletionMarker)
+	if !ok {
+		return
+	}
+
+	if err := marker.SetCompletionMarker(signature.UUID); err != nil {
+		log.WARNING.Printf("Set completion marker of task %s error: %s", logID(signature), err)
+	}
+}
+
+// isSuperseded checks whether a newer task has been sent with the same
+// debounce key, if so the task is marked as superseded
+func (worker *Worker) isSuperseded(signature *tasks.Signature) (bool, error) {
+	debouncer, ok := worker.server.GetTaskBackend(signature).(backends.Debouncer)
+	if !ok {
+		return false, errors.New("Result backend does not support debouncing")
+	}
+
+	// Only an expired key runs the task, a failed lookup must not defeat
+	// debouncing
+	latestUUID, err := debouncer.GetDebounce(signature.DebounceKey)
+	if err != nil {
+		return false, err
+	}
+	if latestUUID == "" || latestUUID == signature.UUID {
+		// The debounce key has expired, run the task in that case
+		return false, nil
+	}
+
+	return true, worker.markSuperseded(signature, latestUUID)
+}
+
+// isReplaced checks whether the task was replaced by another one with
+// Server.ReplaceTask, if so the task is marked as superseded the same way
+// as a debounced task
+func (worker *Worker) isReplaced(signature *tasks.Signature) (bool, error) {
+	superseder, ok := worker.server.GetBackend().(backends.Superseder)
+	if !ok {
+		return false, nil
+	}
+
+	replacementUUID, err := superseder.GetSuperseded(signature.UUID)
+	if err != nil {
+		return false, err
+	}
+	if replacementUUID == "" {
+		return false, nil
+	}
+
+	return true, worker.markSuperseded(signature, replacementUUID)
+}
+
+// markSuperseded marks the task as deduplicated (or failed if the backend
+// can't record that) without triggering error callbacks
+func (worker *Worker) markSuperseded(signature *tasks.Signature, latestUUID string) error {
+	log.WARNING.Printf("Task %s superseded by %s", logID(signature), latestUUID)
+	deduplicatedTasks.Add(signature.Name, 1)
+
+	if signature.IgnoreResult {
+		return nil
+	}
+
+	taskErr := fmt.Sprintf("Task superseded by %s", latestUUID)
+	backend := worker.server.GetTaskBackend(signature)
+	if recorder, ok := backend.(backends.DeduplicationRecorder); ok {
+		if err := recorder.SetStateDeduplicated(signature, taskErr); err != nil {
+			return fmt.Errorf("Set state deduplicated error: %s", err)
+		}
+		return nil
+	}
+
+	if err := backend.SetStateFailure(signature, taskErr); err != nil {
+		return fmt.Errorf("Set state failure error: %s", err)
+	}
+
+	return nil
+}
+
+// earlyBy returns how long before its ETA the task was received, 0 if it was
+// received in time within ETAPrecision. Brokers delivering tasks right away
+// regardless of their ETA, like the eager broker, run them early
+func (worker *Worker) earlyBy(signature *tasks.Signature) time.Duration {
+	if signature.ETA == nil {
+		return 0
+	}
+	if deliverer, ok := worker.server.GetBroker().(brokers.ImmediateDeliverer); ok && deliverer.DeliversImmediately() {
+		return 0
+	}
+
+	precision := defaultETAPrecision
+	if etaPrecision := worker.server.GetConfig().ETAPrecision; etaPrecision > 0 {
+		precision = time.Duration(etaPrecision) * time.Millisecond
+	}
+
+	if early := signature.ETA.Sub(worker.clock.Now()); early > precision {
+		return early
+	}
+	return 0
+}
+
 // Returns true if the worker uses AMQP backend
 func (worker *Worker) hasAMQPBackend() bool {
-	_, ok := worker.server.GetBackend().(*backends.AMQPBackend)
-	return ok
+	return worker.server.GetBackend().Type() == backends.TypeAMQP
 }
@@ -0,0 +1,53 @@
+package machinery_test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunOnLockedThread(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	// The thread must not change even though the task keeps blocking in
+	// syscalls, which lets other goroutines take over its thread otherwise
+	var threadIDs []int
+	err := server.RegisterTask("native_call", func() error {
+		for i := 0; i < 20; i++ {
+			threadIDs = append(threadIDs, syscall.Gettid())
+			syscall.Nanosleep(&syscall.Timespec{Nsec: int64(time.Millisecond)}, nil)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	server.SetRunOnLockedThread("native_call", true)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}()
+	}
+
+	_, err = server.SendTask(&tasks.Signature{Name: "native_call"})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(broker.published()[0]))
+
+	if assert.Len(t, threadIDs, 20) {
+		for _, threadID := range threadIDs {
+			assert.Equal(t, threadIDs[0], threadID)
+		}
+	}
+}
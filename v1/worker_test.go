@@ -0,0 +1,2267 @@
+package machinery_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koblelabs/machinery/v1"
+	"github.com/koblelabs/machinery/v1/backends"
+	"github.com/koblelabs/machinery/v1/brokers"
+	"github.com/koblelabs/machinery/v1/clock"
+	"github.com/koblelabs/machinery/v1/config"
+	"github.com/koblelabs/machinery/v1/log"
+	"github.com/koblelabs/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingBroker keeps published tasks in memory so tests can process them
+// with a worker at their own pace
+type recordingBroker struct {
+	brokers.Broker
+	mu         sync.Mutex
+	signatures []*tasks.Signature
+}
+
+func (b *recordingBroker) Type() string {
+	return "recording"
+}
+
+func (b *recordingBroker) StartConsuming(consumerTag string, concurrency int, p brokers.TaskProcessor) (bool, error) {
+	return false, nil
+}
+
+func (b *recordingBroker) StopConsuming() {}
+
+func (b *recordingBroker) Publish(signature *tasks.Signature) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.signatures = append(b.signatures, signature)
+	return nil
+}
+
+// published returns a snapshot of the tasks published so far
+func (b *recordingBroker) published() []*tasks.Signature {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*tasks.Signature(nil), b.signatures...)
+}
+
+// delivered simulates the broker delivering a delayed task once its ETA has
+// passed, the worker would delay a task received earlier again
+func delivered(signature *tasks.Signature) *tasks.Signature {
+	if signature.ETA != nil {
+		eta := time.Now().UTC()
+		signature.ETA = &eta
+	}
+	return signature
+}
+
+func getEagerTestServer(t *testing.T) (*machinery.Server, *recordingBroker) {
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "eager",
+		ResultBackend: "eager",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := new(recordingBroker)
+	server.SetBroker(broker)
+	return server, broker
+}
+
+func TestDebounce(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	var executed []int64
+	err := server.RegisterTask("reindex", func(n int64) error {
+		executed = append(executed, n)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		_, err := server.SendTask(&tasks.Signature{
+			Name:           "reindex",
+			Args:           []tasks.Arg{{Type: "int64", Value: int64(i)}},
+			DebounceKey:    "document_x",
+			DebounceWindow: 1,
+		})
+		assert.NoError(t, err)
+	}
+
+	deduplicated := expvar.Get("machinery_tasks_deduplicated_total").(*expvar.Map)
+	before := int64(0)
+	if counter, ok := deduplicated.Get("reindex").(*expvar.Int); ok {
+		before = counter.Value()
+	}
+
+	worker := server.NewWorker("test_worker", 0)
+	for _, signature := range broker.published() {
+		assert.NotNil(t, signature.ETA)
+		assert.NoError(t, worker.Process(delivered(signature)))
+	}
+
+	assert.Equal(t, []int64{3}, executed)
+	assert.Equal(t, before+2, deduplicated.Get("reindex").(*expvar.Int).Value())
+
+	state, err := server.GetBackend().GetState(broker.published()[0].UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsDeduplicated())
+		assert.Equal(t, fmt.Sprintf("Task superseded by %s", broker.published()[2].UUID), state.Error)
+	}
+
+	// Waiting for the duplicate returns instead of blocking forever
+	_, err = backends.NewAsyncResult(broker.published()[0], server.GetBackend()).Get(time.Millisecond)
+	assert.Error(t, err)
+}
+
+// debouncerBackend fails debounce key lookups while err is set and forgets
+// debounce keys while expired is set
+type debouncerBackend struct {
+	*backends.EagerBackend
+	err     error
+	expired bool
+}
+
+func (b *debouncerBackend) GetDebounce(debounceKey string) (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	if b.expired {
+		return "", nil
+	}
+	return b.EagerBackend.GetDebounce(debounceKey)
+}
+
+func TestDebounceLookupError(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	var executed []int64
+	err := server.RegisterTask("reindex", func(n int64) error {
+		executed = append(executed, n)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// Debounce keys are kept by the backend of the task
+	backend := &debouncerBackend{EagerBackend: backends.NewEagerBackend().(*backends.EagerBackend)}
+	server.SetTaskBackend("reindex", backend)
+
+	for i := 1; i <= 2; i++ {
+		_, err := server.SendTask(&tasks.Signature{
+			Name:        "reindex",
+			Args:        []tasks.Arg{{Type: "int64", Value: int64(i)}},
+			DebounceKey: "document_x",
+		})
+		assert.NoError(t, err)
+	}
+	worker := server.NewWorker("test_worker", 0)
+
+	// A failed lookup requeues the task instead of running it
+	backend.err = errors.New("connection refused")
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	assert.Empty(t, executed)
+	if assert.Len(t, broker.published(), 3) {
+		assert.NotNil(t, broker.published()[2].ETA)
+	}
+
+	backend.err = nil
+	assert.NoError(t, worker.Process(delivered(broker.published()[2])))
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+	assert.Equal(t, []int64{2}, executed)
+
+	// An expired key runs the task
+	_, err = server.SendTask(&tasks.Signature{
+		Name:        "reindex",
+		Args:        []tasks.Arg{{Type: "int64", Value: int64(3)}},
+		DebounceKey: "document_y",
+	})
+	assert.NoError(t, err)
+	backend.expired = true
+	assert.NoError(t, worker.Process(delivered(broker.published()[3])))
+	assert.Equal(t, []int64{2, 3}, executed)
+}
+
+func TestResultExpired(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTask("add", func(a, b int64) (int64, error) {
+		return a + b, nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name: "add",
+		Args: []tasks.Arg{{Type: "int64", Value: int64(1)}, {Type: "int64", Value: int64(2)}},
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	// The result expires before the client gets to it
+	assert.NoError(t, server.GetBackend().PurgeState(asyncResult.Signature.UUID))
+
+	done := make(chan error)
+	go func() {
+		_, err := asyncResult.Get(time.Millisecond)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, backends.ErrResultExpired, err)
+	case <-time.After(time.Second):
+		t.Fatal("Get should not keep polling for an expired result")
+	}
+}
+
+func TestTaskFilter(t *testing.T) {
+	server, _ := getEagerTestServer(t)
+	worker := server.NewWorker("test_worker", 0)
+
+	eu := &tasks.Signature{Name: "task", Headers: tasks.Headers{"region": "eu"}}
+	us := &tasks.Signature{Name: "task", Headers: tasks.Headers{"region": "us"}}
+
+	assert.True(t, worker.AcceptsTask(eu))
+	assert.True(t, worker.AcceptsTask(us))
+
+	worker.SetTaskFilter(func(signature *tasks.Signature) bool {
+		return signature.Headers["region"] == "eu"
+	})
+
+	assert.True(t, worker.AcceptsTask(eu))
+	assert.False(t, worker.AcceptsTask(us))
+}
+
+func TestWorkerGroup(t *testing.T) {
+	cpuServer, _ := getEagerTestServer(t)
+	cpuServer.GetConfig().WorkerGroup = "cpu"
+	gpuServer, _ := getEagerTestServer(t)
+	gpuServer.GetConfig().WorkerGroup = "gpu"
+
+	cpuWorker := cpuServer.NewWorker("cpu_worker", 0)
+	gpuWorker := gpuServer.NewWorker("gpu_worker", 0)
+
+	// A CPU worker requeues the GPU task for a GPU worker to pick up, tasks
+	// without a group are processed by both
+	render := &tasks.Signature{Name: "render", WorkerGroup: "gpu"}
+	assert.False(t, cpuWorker.AcceptsTask(render))
+	assert.True(t, gpuWorker.AcceptsTask(render))
+
+	resize := &tasks.Signature{Name: "resize"}
+	assert.True(t, cpuWorker.AcceptsTask(resize))
+	assert.True(t, gpuWorker.AcceptsTask(resize))
+}
+
+func TestOrderedDispatch(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	assert.NoError(t, server.RegisterTask("acquire", func(n int64) (int64, error) {
+		return n, nil
+	}))
+
+	var signatures []*tasks.Signature
+	for i := 0; i < 20; i++ {
+		signatures = append(signatures, &tasks.Signature{
+			Name: "acquire",
+			Args: []tasks.Arg{{Type: "int64", Value: int64(i)}},
+		})
+	}
+	group := tasks.NewGroup(signatures...)
+	group.OrderedDispatch = true
+
+	asyncResults, err := server.SendGroup(group, 10)
+	assert.NoError(t, err)
+
+	// Tasks are published in submission order
+	if !assert.Len(t, broker.published(), 20) {
+		return
+	}
+	for i, signature := range broker.published() {
+		assert.Equal(t, signatures[i].UUID, signature.UUID)
+		assert.Equal(t, i, signature.GroupTaskIndex)
+	}
+
+	// They may still finish in any order
+	worker := server.NewWorker("test_worker", 0)
+	for i := len(broker.published()) - 1; i >= 0; i-- {
+		assert.NoError(t, worker.Process(broker.published()[i]))
+	}
+	for i, asyncResult := range asyncResults {
+		results, err := asyncResult.Get(time.Millisecond)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, i, results[0].Interface())
+		}
+	}
+}
+
+func TestRetryState(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTask("fail", func() error {
+		return errors.New("oops")
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name:       "fail",
+		RetryCount: 2,
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+
+	// The first two failures are retried
+	for i := 1; i >= 0; i-- {
+		assert.NoError(t, worker.Process(delivered(broker.published()[len(broker.published())-1])))
+
+		state := asyncResult.GetState()
+		assert.True(t, state.IsRetry())
+		assert.False(t, state.IsCompleted())
+		assert.Equal(t, i, state.RetryCount)
+		assert.Equal(t, "oops", state.Error)
+
+		_, err = asyncResult.GetFailFast(time.Millisecond)
+		assert.EqualError(t, err, "oops")
+	}
+
+	// The last failure is permanent
+	assert.NoError(t, worker.Process(delivered(broker.published()[len(broker.published())-1])))
+
+	state := asyncResult.GetState()
+	assert.True(t, state.IsFailure())
+	assert.False(t, state.IsRetry())
+	assert.Equal(t, 0, state.RetryCount)
+	assert.Len(t, broker.published(), 3)
+}
+
+func TestStoreRetryCount(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().StoreRetryCount = true
+
+	err := server.RegisterTask("fail", func() error {
+		return errors.New("oops")
+	})
+	assert.NoError(t, err)
+
+	_, err = server.SendTask(&tasks.Signature{Name: "fail", RetryCount: 2})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+
+	// An intermediary resets the retry count of every retried message, the
+	// stored count still allows only two retries
+	for i := 0; i < 3; i++ {
+		signature := delivered(broker.published()[len(broker.published())-1])
+		signature.RetryCount = 2
+		assert.NoError(t, worker.Process(signature))
+	}
+	assert.Len(t, broker.published(), 3)
+}
+
+func TestMaxConsumeAge(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().MaxConsumeAge = 60
+
+	var runs int
+	assert.NoError(t, server.RegisterTask("sync_account", func() error {
+		runs++
+		return nil
+	}))
+
+	stale, err := server.SendTask(&tasks.Signature{Name: "sync_account"})
+	assert.NoError(t, err)
+	fresh, err := server.SendTask(&tasks.Signature{Name: "sync_account"})
+	assert.NoError(t, err)
+
+	// Delayed tasks are due only once their ETA passed
+	delayed, err := server.SendTask(&tasks.Signature{Name: "sync_account"})
+	assert.NoError(t, err)
+	staleDelayed, err := server.SendTask(&tasks.Signature{Name: "sync_account"})
+	assert.NoError(t, err)
+
+	// The first task waited out an outage in the queue
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	publishedAt := now.Add(-time.Hour)
+	broker.published()[0].PublishedAt = &publishedAt
+	broker.published()[1].PublishedAt = &now
+	delayedETA := now.Add(-time.Second)
+	broker.published()[2].PublishedAt = &publishedAt
+	broker.published()[2].ETA = &delayedETA
+	staleETA := now.Add(-2 * time.Minute)
+	broker.published()[3].PublishedAt = &publishedAt
+	broker.published()[3].ETA = &staleETA
+
+	worker := server.NewWorker("test_worker", 0)
+	worker.SetClock(clock.NewFake(now))
+	for _, signature := range broker.published() {
+		assert.NoError(t, worker.Process(signature))
+	}
+
+	assert.Equal(t, 2, runs)
+	assert.Equal(t, tasks.StateSkipped, stale.GetState().State)
+	assert.True(t, fresh.GetState().IsSuccess())
+	assert.True(t, delayed.GetState().IsSuccess())
+	assert.Equal(t, tasks.StateSkipped, staleDelayed.GetState().State)
+}
+
+func TestServerClock(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().MaxConsumeAge = 60
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFake(now)
+	server.SetClock(fakeClock)
+
+	var runs int
+	assert.NoError(t, server.RegisterTask("sync_account", func() error {
+		runs++
+		return errors.New("oops")
+	}))
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "sync_account", RetryCount: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, now, *broker.published()[0].PublishedAt)
+
+	// The retry is published and delayed by the same clock
+	fakeClock.Advance(30 * time.Second)
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(broker.published()[0]))
+	assert.Equal(t, 1, runs)
+	if assert.Len(t, broker.published(), 2) {
+		retried := broker.published()[1]
+		assert.Equal(t, now.Add(30*time.Second), *retried.PublishedAt)
+		assert.Equal(t, now.Add(30*time.Second+time.Duration(retried.RetryTimeout)*time.Second), *retried.ETA)
+	}
+
+	// The retry waited too long in the queue by the clock
+	fakeClock.Advance(2 * time.Minute)
+	assert.NoError(t, worker.Process(broker.published()[1]))
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, tasks.StateSkipped, asyncResult.GetState().State)
+}
+
+func TestChainRetryBudget(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	calls := 0
+	err := server.RegisterTasks(map[string]interface{}{
+		"flaky": func() error {
+			calls++
+			if calls == 1 {
+				return errors.New("flaky")
+			}
+			return nil
+		},
+		"fail": func() error {
+			return errors.New("oops")
+		},
+	})
+	assert.NoError(t, err)
+
+	chain := tasks.NewChain(
+		&tasks.Signature{Name: "flaky", RetryCount: 5, Immutable: true},
+		&tasks.Signature{Name: "fail", RetryCount: 5},
+	)
+	chain.MaxTotalRetries = 2
+
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+
+	// Keep processing until the chain gives up
+	worker := server.NewWorker("test_worker", 0)
+	for i := 0; i < len(broker.published()); i++ {
+		assert.NoError(t, worker.Process(delivered(broker.published()[i])))
+	}
+
+	// One retry is spent by each task, the second one fails for good even
+	// though its own retry counter has not been exhausted
+	assert.Len(t, broker.published(), 4)
+
+	assert.Equal(t, 4, broker.published()[3].RetryCount)
+
+	state, err := server.GetBackend().GetState(chain.Tasks[1].UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsFailure())
+	}
+}
+
+func TestCaptureStackTraces(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().CaptureStackTraces = true
+
+	err := server.RegisterTasks(map[string]interface{}{
+		"load": func() error {
+			return &wrappedError{"load config", os.ErrNotExist}
+		},
+		"panic": func() error {
+			panic("oops")
+		},
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "load"})
+	assert.NoError(t, err)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	state := asyncResult.GetState()
+	assert.Equal(t, "load config: file does not exist", state.Error)
+	if assert.NotNil(t, state.ErrorDetail) {
+		assert.Equal(t, []string{"load config: file does not exist", "file does not exist"}, state.ErrorDetail.Chain)
+		assert.Empty(t, state.ErrorDetail.Stack)
+	}
+
+	asyncResult, err = server.SendTask(&tasks.Signature{Name: "panic"})
+	assert.NoError(t, err)
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+
+	state = asyncResult.GetState()
+	assert.Equal(t, "oops", state.Error)
+	if assert.NotNil(t, state.ErrorDetail) {
+		assert.Equal(t, []string{"oops"}, state.ErrorDetail.Chain)
+		assert.Contains(t, state.ErrorDetail.Stack, "runtime/debug.Stack")
+	}
+}
+
+// unavailableBackend fails all writes while it is down
+type unavailableBackend struct {
+	backends.Interface
+	mu   sync.Mutex
+	down bool
+}
+
+func (b *unavailableBackend) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = down
+}
+
+func (b *unavailableBackend) Ping() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (b *unavailableBackend) SetStateReceived(signature *tasks.Signature) error {
+	if err := b.Ping(); err != nil {
+		return err
+	}
+	return b.Interface.SetStateReceived(signature)
+}
+
+// flakyBackend fails to store the first few task successes
+type flakyBackend struct {
+	backends.Interface
+	failures int
+}
+
+func (b *flakyBackend) SetStateSuccess(signature *tasks.Signature, results []*tasks.TaskResult) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("connection reset")
+	}
+	return b.Interface.SetStateSuccess(signature, results)
+}
+
+func TestBackendWriteRetries(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().BackendWriteRetries = 2
+	server.GetConfig().BackendWriteBackoff = 1
+	server.SetBackend(&flakyBackend{Interface: server.GetBackend(), failures: 2})
+
+	var runs int
+	assert.NoError(t, server.RegisterTask("add", func(a, b int64) (int64, error) {
+		runs++
+		return a + b, nil
+	}))
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name: "add",
+		Args: []tasks.Arg{{Type: "int64", Value: int64(1)}, {Type: "int64", Value: int64(2)}},
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	assert.Equal(t, 1, runs)
+	state := asyncResult.GetState()
+	assert.True(t, state.IsSuccess())
+	if assert.Len(t, state.Results, 1) {
+		assert.EqualValues(t, 3, state.Results[0].Value)
+	}
+}
+
+func TestPauseOnBackendUnavailable(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().PauseOnBackendUnavailable = true
+
+	backend := &unavailableBackend{Interface: server.GetBackend()}
+	server.SetBackend(backend)
+
+	var executed int32
+	err := server.RegisterTask("task", func() error {
+		atomic.StoreInt32(&executed, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	_, err = server.SendTask(&tasks.Signature{Name: "task"})
+	assert.NoError(t, err)
+
+	backend.setDown(true)
+
+	worker := server.NewWorker("test_worker", 0)
+	done := make(chan error)
+	go func() {
+		done <- worker.Process(delivered(broker.published()[0]))
+	}()
+
+	// Consumption pauses and the task is held back
+	paused := false
+	for i := 0; i < 100 && !paused; i++ {
+		select {
+		case <-worker.Resumed():
+			<-time.After(10 * time.Millisecond)
+		default:
+			paused = true
+		}
+	}
+	assert.True(t, paused)
+	select {
+	case <-done:
+		t.Fatal("Task processed while the backend is unavailable")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&executed))
+
+	// Consumption resumes once the backend is back
+	backend.setDown(false)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consumption has not resumed")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&executed))
+
+	select {
+	case <-worker.Resumed():
+	default:
+		t.Error("Worker is still paused")
+	}
+}
+
+func TestTaskBackend(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTasks(map[string]interface{}{
+		"default": func() (int64, error) {
+			return 1, nil
+		},
+		"audit": func() (int64, error) {
+			return 2, nil
+		},
+	})
+	assert.NoError(t, err)
+
+	auditBackend := backends.NewEagerBackend()
+	server.SetTaskBackend("audit", auditBackend)
+
+	worker := server.NewWorker("test_worker", 0)
+
+	defaultResult, err := server.SendTask(&tasks.Signature{Name: "default"})
+	assert.NoError(t, err)
+	auditResult, err := server.SendTask(&tasks.Signature{Name: "audit"})
+	assert.NoError(t, err)
+
+	for _, signature := range broker.published() {
+		assert.NoError(t, worker.Process(signature))
+	}
+
+	state, err := server.GetBackend().GetState(defaultResult.Signature.UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsSuccess())
+	}
+	_, err = auditBackend.GetState(defaultResult.Signature.UUID)
+	assert.Error(t, err)
+
+	state, err = auditBackend.GetState(auditResult.Signature.UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsSuccess())
+	}
+	_, err = server.GetBackend().GetState(auditResult.Signature.UUID)
+	assert.Error(t, err)
+
+	// AsyncResult reads the state from the backend of the task
+	results, err := auditResult.Get(time.Millisecond)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), results[0].Interface())
+	}
+}
+
+// completionOrderBackend returns group task states in the order the tasks
+// succeeded, like the AMQP backend does
+type completionOrderBackend struct {
+	backends.Interface
+	completed []*tasks.TaskState
+}
+
+func (b *completionOrderBackend) SetStateSuccess(signature *tasks.Signature, results []*tasks.TaskResult) error {
+	b.completed = append(b.completed, tasks.NewSuccessTaskState(signature, results))
+	return b.Interface.SetStateSuccess(signature, results)
+}
+
+func (b *completionOrderBackend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*tasks.TaskState, error) {
+	return b.completed, nil
+}
+
+func TestChordResultsOrder(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.SetBackend(&completionOrderBackend{Interface: server.GetBackend()})
+
+	var received []int64
+	err := server.RegisterTasks(map[string]interface{}{
+		"chunk": func(n int64) (int64, error) {
+			return n, nil
+		},
+		"join": func(chunks ...int64) error {
+			received = chunks
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+
+	group := tasks.NewGroup(
+		&tasks.Signature{Name: "chunk", Args: []tasks.Arg{{Type: "int64", Value: int64(1)}}},
+		&tasks.Signature{Name: "chunk", Args: []tasks.Arg{{Type: "int64", Value: int64(2)}}},
+		&tasks.Signature{Name: "chunk", Args: []tasks.Arg{{Type: "int64", Value: int64(3)}}},
+	)
+	chord := tasks.NewChord(group, &tasks.Signature{Name: "join"})
+
+	_, err = server.SendChord(chord, 0)
+	assert.NoError(t, err)
+
+	// Group members finish in reverse order
+	worker := server.NewWorker("test_worker", 0)
+	groupTasks := append([]*tasks.Signature{}, broker.published()...)
+	for i := len(groupTasks) - 1; i >= 0; i-- {
+		assert.NoError(t, worker.Process(groupTasks[i]))
+	}
+
+	if assert.Len(t, broker.published(), 4) {
+		assert.NoError(t, worker.Process(delivered(broker.published()[3])))
+	}
+	assert.Equal(t, []int64{1, 2, 3}, received)
+}
+
+func TestDefaultTaskTimeLimit(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().DefaultTaskTimeLimit = 1
+
+	err := server.RegisterTask("runaway", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "runaway"})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	state := asyncResult.GetState()
+	assert.True(t, state.IsFailure())
+	assert.Equal(t, tasks.ErrTaskTimedOut.Error(), state.Error)
+}
+
+func TestQueueWaitTime(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTask("test_task", func() error { return nil })
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "test_task"})
+	assert.NoError(t, err)
+
+	// The task waits in the queue before a worker picks it up
+	delay := 50 * time.Millisecond
+	<-time.After(delay)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	state := asyncResult.GetState()
+	assert.True(t, state.IsSuccess())
+	assert.True(t, state.QueueWaitTime >= delay, "queue wait time %s", state.QueueWaitTime)
+	assert.True(t, state.QueueWaitTime < delay+time.Second, "queue wait time %s", state.QueueWaitTime)
+}
+
+func TestResultCache(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	calls := 0
+	err := server.RegisterTask("render", func(id int64) (string, error) {
+		calls++
+		return fmt.Sprintf("report %d", id), nil
+	})
+	assert.NoError(t, err)
+
+	args := []tasks.Arg{{Type: "int64", Value: int64(1)}}
+	cacheKey, err := tasks.NewCacheKey("render", args)
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	for i := 0; i < 2; i++ {
+		asyncResult, err := server.SendTask(&tasks.Signature{Name: "render", Args: args, CacheKey: cacheKey})
+		assert.NoError(t, err)
+		assert.NoError(t, worker.Process(delivered(broker.published()[i])))
+
+		results, err := asyncResult.Get(time.Millisecond)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "report 1", results[0].Interface())
+		}
+	}
+
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryUntil(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTask("fail", func() error {
+		return errors.New("oops")
+	})
+	assert.NoError(t, err)
+
+	retryUntil := time.Now().Add(50 * time.Millisecond)
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name:       "fail",
+		RetryCount: 5,
+		RetryUntil: &retryUntil,
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+
+	// The task is retried before the deadline
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	assert.True(t, asyncResult.GetState().IsRetry())
+	assert.Len(t, broker.published(), 2)
+
+	// Once the deadline has passed the failure is permanent even though
+	// there are retries left
+	<-time.After(time.Until(retryUntil))
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+
+	assert.True(t, asyncResult.GetState().IsFailure())
+	assert.Equal(t, 4, broker.published()[1].RetryCount)
+	assert.Len(t, broker.published(), 2)
+}
+
+func TestOptionalArgs(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	// The task gained two parameters since the messages were sent
+	err := server.RegisterTask("greet", func(name string, excited bool, greeting string) (string, error) {
+		if excited {
+			return fmt.Sprintf("%s %s!", greeting, name), nil
+		}
+		return fmt.Sprintf("%s %s", greeting, name), nil
+	})
+	assert.NoError(t, err)
+
+	signature := &tasks.Signature{
+		Name: "greet",
+		Args: []tasks.Arg{{Type: "string", Value: "Gopher"}},
+	}
+	asyncResult, err := server.SendTask(signature)
+	assert.NoError(t, err)
+
+	// Strict by default
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	assert.True(t, asyncResult.GetState().IsFailure())
+
+	server.SetOptionalArgs("greet")
+	asyncResult, err = server.SendTask(&tasks.Signature{Name: "greet", Args: signature.Args})
+	assert.NoError(t, err)
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+	if state := asyncResult.GetState(); assert.True(t, state.IsSuccess()) {
+		assert.Equal(t, " Gopher", state.Results[0].Value)
+	}
+
+	server.SetOptionalArgs("greet", "Hello")
+	asyncResult, err = server.SendTask(&tasks.Signature{Name: "greet", Args: signature.Args})
+	assert.NoError(t, err)
+	assert.NoError(t, worker.Process(delivered(broker.published()[2])))
+	if state := asyncResult.GetState(); assert.True(t, state.IsSuccess()) {
+		assert.Equal(t, "Hello Gopher", state.Results[0].Value)
+	}
+}
+
+func TestTaskLogLevel(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	var debugLog, infoLog bytes.Buffer
+	defaultDebug, defaultInfo := log.DEBUG, log.INFO
+	log.DEBUG = stdlog.New(&debugLog, "", 0)
+	log.INFO = stdlog.New(&infoLog, "", 0)
+	defer func() {
+		log.DEBUG, log.INFO = defaultDebug, defaultInfo
+	}()
+
+	noop := func() error { return nil }
+	assert.NoError(t, server.RegisterTaskWithOptions("heartbeat", noop, machinery.TaskOptions{LogLevel: log.LevelDebug}))
+	assert.NoError(t, server.RegisterTaskWithOptions("payout", noop, machinery.TaskOptions{LogLevel: log.LevelInfo}))
+	assert.NoError(t, server.RegisterTask("report", noop))
+
+	worker := server.NewWorker("test_worker", 0)
+	for _, name := range []string{"heartbeat", "payout", "report"} {
+		_, err := server.SendTask(&tasks.Signature{UUID: "task_" + name, Name: name})
+		assert.NoError(t, err)
+	}
+	for _, signature := range broker.published() {
+		assert.NoError(t, worker.Process(signature))
+	}
+
+	for _, msg := range []string{"Received task %s [", "Started task %s [", "Processed task %s ["} {
+		assert.Contains(t, debugLog.String(), fmt.Sprintf(msg, "task_heartbeat"))
+		assert.NotContains(t, infoLog.String(), fmt.Sprintf(msg, "task_heartbeat"))
+		assert.Contains(t, infoLog.String(), fmt.Sprintf(msg, "task_payout"))
+		assert.NotContains(t, debugLog.String(), fmt.Sprintf(msg, "task_payout"))
+	}
+
+	// Tasks without a level keep logging only processing at INFO
+	for _, msg := range []string{"Received task %s [", "Started task %s ["} {
+		assert.Contains(t, debugLog.String(), fmt.Sprintf(msg, "task_report"))
+		assert.NotContains(t, infoLog.String(), fmt.Sprintf(msg, "task_report"))
+	}
+	assert.Contains(t, infoLog.String(), "Processed task task_report [")
+}
+
+func TestRetryLater(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	ready := false
+	err := server.RegisterTask("sync_account", func() error {
+		if !ready {
+			return tasks.NewErrRetryLater(time.Minute)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	_, err = server.SendTask(&tasks.Signature{UUID: "task_1", Name: "sync_account", RetryCount: 1})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	// The task is redelayed without spending its retries
+	if assert.Len(t, broker.published(), 2) {
+		requeued := broker.published()[1]
+		assert.Equal(t, 1, requeued.RetryCount)
+		if assert.NotNil(t, requeued.ETA) {
+			assert.WithinDuration(t, time.Now().Add(time.Minute), *requeued.ETA, 5*time.Second)
+		}
+	}
+	state, err := server.GetBackend().GetState("task_1")
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateRetry, state.State)
+
+	ready = true
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+	state, err = server.GetBackend().GetState("task_1")
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateSuccess, state.State)
+}
+
+func TestGetEnvelope(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTask("resize", func(n int64) (int64, error) {
+		time.Sleep(10 * time.Millisecond)
+		return n * 2, nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name:       "resize",
+		Args:       []tasks.Arg{{Type: "int64", Value: int64(21)}},
+		RetryCount: 2,
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("resizer_1", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	envelope, err := asyncResult.GetEnvelope(time.Millisecond)
+	assert.NoError(t, err)
+	if assert.Len(t, envelope.Results, 1) {
+		assert.Equal(t, int64(42), envelope.Results[0].Interface())
+	}
+	assert.Equal(t, "resizer_1", envelope.WorkerName)
+	assert.Equal(t, 2, envelope.RetryCount)
+	if assert.NotNil(t, envelope.StartedAt) && assert.NotNil(t, envelope.CompletedAt) {
+		assert.True(t, envelope.CompletedAt.After(*envelope.StartedAt))
+		assert.Equal(t, envelope.CompletedAt.Sub(*envelope.StartedAt), envelope.Duration)
+		assert.True(t, envelope.Duration >= 10*time.Millisecond)
+	}
+}
+
+func TestGlobalTaskConcurrency(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	charged := 0
+	err := server.RegisterTask("charge", func() error {
+		charged++
+		return nil
+	})
+	assert.NoError(t, err)
+	server.SetGlobalTaskConcurrency("charge", 1)
+
+	// Another worker holds the only slot
+	semaphore := server.GetBackend().(backends.Semaphore)
+	acquired, err := semaphore.AcquireSlot("charge", "task_other", 1, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	_, err = server.SendTask(&tasks.Signature{UUID: "task_1", Name: "charge"})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	// The task waits in the queue until the slot is free
+	assert.Equal(t, 0, charged)
+	if assert.Len(t, broker.published(), 2) {
+		assert.NotNil(t, broker.published()[1].ETA)
+	}
+
+	assert.NoError(t, semaphore.ReleaseSlot("charge", "task_other"))
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+	assert.Equal(t, 1, charged)
+
+	// The slot is released once the task completes
+	acquired, err = semaphore.AcquireSlot("charge", "task_other", 1, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestManualCommit(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	acked := false
+	err := server.RegisterTask("store_order", func(ctx context.Context) error {
+		// The delivery is acked only once the task commits
+		assert.False(t, acked)
+		defer tasks.Commit(ctx)
+		return nil
+	})
+	assert.NoError(t, err)
+	server.SetManualCommit("store_order", true)
+
+	_, err = server.SendTask(&tasks.Signature{Name: "store_order"})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.True(t, worker.CommitsTask(broker.published()[0]))
+	assert.NoError(t, worker.ProcessWithCommit(broker.published()[0], func() { acked = true }))
+	assert.True(t, acked)
+}
+
+func TestCorrelationID(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTask("add", func(args ...int64) (int64, error) {
+		sum := int64(0)
+		for _, arg := range args {
+			sum += arg
+		}
+		return sum, nil
+	})
+	assert.NoError(t, err)
+
+	newAdd := func(n int64) *tasks.Signature {
+		return &tasks.Signature{Name: "add", Args: []tasks.Arg{{Type: "int64", Value: n}}}
+	}
+	processAll := func() {
+		worker := server.NewWorker("test_worker", 0)
+		for i := 0; i < len(broker.published()); i++ {
+			assert.NoError(t, worker.Process(delivered(broker.published()[i])))
+		}
+	}
+
+	// Every step of the chain carries the correlation ID of the root
+	chain := tasks.NewChain(newAdd(1), newAdd(2), newAdd(3))
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+	processAll()
+
+	root := chain.Tasks[0].CorrelationID
+	assert.NotEmpty(t, root)
+	for _, signature := range chain.Tasks {
+		state, err := server.GetBackend().GetState(signature.UUID)
+		assert.NoError(t, err)
+		assert.Equal(t, tasks.StateSuccess, state.State)
+		assert.Equal(t, root, state.CorrelationID)
+	}
+
+	// Tasks of a chord share the ID set on one of them with the callback
+	group := tasks.NewGroup(newAdd(1), newAdd(2))
+	group.Tasks[1].CorrelationID = "checkout_1"
+	chord := tasks.NewChord(group, newAdd(3))
+	_, err = server.SendChord(chord, 0)
+	assert.NoError(t, err)
+	processAll()
+
+	for _, signature := range append(group.Tasks, chord.Callback) {
+		state, err := server.GetBackend().GetState(signature.UUID)
+		assert.NoError(t, err)
+		assert.Equal(t, "checkout_1", state.CorrelationID)
+	}
+}
+
+// consumingBroker hands tasks sent on its channel to the worker until it is
+// stopped, a stop with timeout waits for tasks in flight
+type consumingBroker struct {
+	recordingBroker
+	deliveries chan *tasks.Signature
+	stop       chan struct{}
+	stopped    chan struct{}
+	inFlight   sync.WaitGroup
+}
+
+func (b *consumingBroker) StartConsuming(consumerTag string, concurrency int, p brokers.TaskProcessor) (bool, error) {
+	defer close(b.stopped)
+	for {
+		select {
+		case <-b.stop:
+			return false, nil
+		case signature := <-b.deliveries:
+			b.inFlight.Add(1)
+			go func() {
+				defer b.inFlight.Done()
+				p.Process(signature)
+			}()
+		}
+	}
+}
+
+func (b *consumingBroker) StopConsuming() {
+	close(b.stop)
+}
+
+func (b *consumingBroker) StopConsumingWithTimeout(timeout time.Duration) *brokers.ShutdownReport {
+	b.StopConsuming()
+	b.inFlight.Wait()
+	return new(brokers.ShutdownReport)
+}
+
+func TestDrainAndStop(t *testing.T) {
+	server, _ := getEagerTestServer(t)
+	broker := &consumingBroker{
+		deliveries: make(chan *tasks.Signature, 1),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	server.SetBroker(broker)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	err := server.RegisterTask("export", func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "export"})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	launched := make(chan error)
+	go func() {
+		launched <- worker.Launch()
+	}()
+
+	broker.deliveries <- broker.published()[0]
+	<-started
+
+	drained := make(chan *brokers.ShutdownReport)
+	go func() {
+		drained <- worker.DrainAndStop()
+	}()
+
+	// Consumption stops while the task in flight keeps running
+	<-broker.stopped
+	broker.deliveries <- &tasks.Signature{UUID: "task_2", Name: "export"}
+	select {
+	case <-launched:
+		t.Fatal("worker exited before the task in flight finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NotNil(t, <-drained)
+	assert.NoError(t, <-launched)
+
+	assert.True(t, asyncResult.GetState().IsSuccess())
+	assert.Len(t, broker.deliveries, 1)
+}
+
+func TestMaxWorkflowDepth(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().MaxWorkflowDepth = 3
+
+	calls := 0
+	err := server.RegisterTask("loop", func() error {
+		calls++
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// The task is its own success callback
+	loop := &tasks.Signature{UUID: "loop", Name: "loop", Immutable: true}
+	loop.OnSuccess = []*tasks.Signature{loop}
+
+	_, err = server.SendTask(loop)
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	for i := 0; i < len(broker.published()) && i < 100; i++ {
+		assert.NoError(t, worker.Process(delivered(broker.published()[i])))
+	}
+
+	// The workflow stops at the configured depth instead of looping forever
+	assert.Equal(t, 4, calls)
+	assert.Len(t, broker.published(), 4)
+
+	state, err := server.GetBackend().GetState("loop")
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsFailure())
+		assert.Equal(t, "Max workflow depth of 3 exceeded", state.Error)
+	}
+}
+
+func TestReplaceTask(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	var saved []string
+	err := server.RegisterTask("save", func(draft string) error {
+		saved = append(saved, draft)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	original, err := server.SendTask(&tasks.Signature{
+		Name:        "save",
+		Args:        []tasks.Arg{{Type: "string", Value: "first draft"}},
+		Replaceable: true,
+	})
+	assert.NoError(t, err)
+
+	replacement, err := server.ReplaceTask(original.Signature, &tasks.Signature{
+		Name: "save",
+		Args: []tasks.Arg{{Type: "string", Value: "second draft"}},
+	})
+	assert.NoError(t, err)
+
+	// Tasks which were not sent as Replaceable can't be replaced
+	fixed, err := server.SendTask(&tasks.Signature{
+		Name: "save",
+		Args: []tasks.Arg{{Type: "string", Value: "final draft"}},
+	})
+	assert.NoError(t, err)
+	_, err = server.ReplaceTask(fixed.Signature, &tasks.Signature{
+		Name: "save",
+		Args: []tasks.Arg{{Type: "string", Value: "third draft"}},
+	})
+	assert.Equal(t, machinery.ErrNotReplaceable, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	for _, signature := range broker.published() {
+		assert.NoError(t, worker.Process(signature))
+	}
+
+	assert.Equal(t, []string{"second draft", "final draft"}, saved)
+
+	state, err := server.GetBackend().GetState(original.Signature.UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsDeduplicated())
+		assert.Equal(t, fmt.Sprintf("Task superseded by %s", replacement.Signature.UUID), state.Error)
+	}
+
+	state, err = server.GetBackend().GetState(replacement.Signature.UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsSuccess())
+	}
+}
+
+// supersederBackend counts lookups of replaced tasks and fails them while
+// err is set
+type supersederBackend struct {
+	*backends.EagerBackend
+	lookups int
+	err     error
+}
+
+func (b *supersederBackend) GetSuperseded(taskUUID string) (string, error) {
+	b.lookups++
+	if b.err != nil {
+		return "", b.err
+	}
+	return b.EagerBackend.GetSuperseded(taskUUID)
+}
+
+func TestReplaceTaskLookups(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	backend := &supersederBackend{EagerBackend: server.GetBackend().(*backends.EagerBackend)}
+	server.SetBackend(backend)
+
+	calls := 0
+	assert.NoError(t, server.RegisterTask("save", func() error {
+		calls++
+		return nil
+	}))
+	worker := server.NewWorker("test_worker", 0)
+
+	// Tasks which can't be replaced are not looked up
+	_, err := server.SendTask(&tasks.Signature{Name: "save"})
+	assert.NoError(t, err)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	assert.Equal(t, 0, backend.lookups)
+	assert.Equal(t, 1, calls)
+
+	// A failed lookup requeues the task instead of failing it
+	backend.err = errors.New("connection refused")
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "save", Replaceable: true})
+	assert.NoError(t, err)
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+	assert.Equal(t, 1, backend.lookups)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, tasks.StateRetry, asyncResult.GetState().State)
+	if assert.Len(t, broker.published(), 3) {
+		assert.NotNil(t, broker.published()[2].ETA)
+	}
+
+	backend.err = nil
+	assert.NoError(t, worker.Process(delivered(broker.published()[2])))
+	assert.Equal(t, 2, calls)
+}
+
+func TestEarlyTaskDelayedAgain(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	calls := 0
+	err := server.RegisterTask("report", func() error {
+		calls++
+		return nil
+	})
+	assert.NoError(t, err)
+
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	eta := now.Add(time.Hour)
+	_, err = server.SendTask(&tasks.Signature{UUID: "task_1", Name: "report", ETA: &eta})
+	assert.NoError(t, err)
+
+	// The task arrives before its ETA, e.g. because of clock skew, after an
+	// earlier delivery got as far as receiving it
+	assert.NoError(t, server.GetBackend().SetStateReceived(broker.published()[0]))
+	worker := server.NewWorker("test_worker", 0)
+	worker.SetClock(clock.NewFake(now))
+	assert.NoError(t, worker.Process(broker.published()[0]))
+
+	assert.Equal(t, 0, calls)
+	if assert.Len(t, broker.published(), 2) {
+		assert.Equal(t, eta, *broker.published()[1].ETA)
+	}
+	state, err := server.GetBackend().GetState("task_1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StatePending, state.State)
+	}
+
+	// Tasks arriving within the precision or late run right away
+	server.GetConfig().ETAPrecision = 1000
+	soon := now.Add(500 * time.Millisecond)
+	broker.published()[1].ETA = &soon
+	assert.NoError(t, worker.Process(broker.published()[1]))
+	assert.Equal(t, 1, calls)
+	assert.Len(t, broker.published(), 2)
+
+	// Brokers delivering tasks right away run them regardless of their ETA
+	server.SetBroker(brokers.NewRecordingBroker(brokers.NewEagerBroker()))
+	server.GetBroker().(*brokers.RecordingBroker).Interface.(brokers.EagerMode).AssignWorker(worker)
+	_, err = server.SendTask(&tasks.Signature{Name: "report", ETA: &eta})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+// unreadableBackend fails to read task states, workflows are still stored
+type unreadableBackend struct {
+	*backends.EagerBackend
+}
+
+func (b *unreadableBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestGetWorkflowState(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().StoreWorkflows = true
+
+	var workflowUUID string
+	var midway *tasks.WorkflowState
+	err := server.RegisterTasks(map[string]interface{}{
+		"step": func() error {
+			return nil
+		},
+		"inspect": func() error {
+			var err error
+			midway, err = server.GetWorkflowState(workflowUUID)
+			return err
+		},
+	})
+	assert.NoError(t, err)
+
+	chain := tasks.NewChain(
+		&tasks.Signature{Name: "step"},
+		&tasks.Signature{Name: "inspect"},
+		&tasks.Signature{Name: "step"},
+	)
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+	workflowUUID = chain.UUID
+
+	state, err := server.GetWorkflowState(workflowUUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.WorkflowChain, state.Type)
+		assert.Equal(t, tasks.StatePending, state.State)
+		assert.Equal(t, 0, state.ActiveStep)
+	}
+
+	worker := server.NewWorker("test_worker", 0)
+	for i := 0; i < len(broker.published()); i++ {
+		assert.NoError(t, worker.Process(delivered(broker.published()[i])))
+	}
+
+	// The second step was running while the state was fetched
+	if assert.NotNil(t, midway) && assert.Len(t, midway.Steps, 3) {
+		assert.Equal(t, tasks.StateStarted, midway.State)
+		assert.Equal(t, 1, midway.ActiveStep)
+		assert.Equal(t, tasks.StateSuccess, midway.Steps[0].State)
+		assert.Equal(t, tasks.StateStarted, midway.Steps[1].State)
+		assert.Equal(t, tasks.StatePending, midway.Steps[2].State)
+	}
+
+	state, err = server.GetWorkflowState(workflowUUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StateSuccess, state.State)
+		assert.Equal(t, -1, state.ActiveStep)
+	}
+
+	_, err = server.GetWorkflowState("unknown")
+	assert.Error(t, err)
+
+	// Workflows sharing a correlation ID are stored apart
+	other := tasks.NewChain(&tasks.Signature{Name: "step", CorrelationID: chain.Tasks[0].CorrelationID})
+	_, err = server.SendChain(other)
+	assert.NoError(t, err)
+	state, err = server.GetWorkflowState(workflowUUID)
+	if assert.NoError(t, err) {
+		assert.Len(t, state.Steps, 3)
+	}
+
+	// Groups are stored under their group UUID
+	group := tasks.NewGroup(&tasks.Signature{Name: "step"}, &tasks.Signature{Name: "step"})
+	_, err = server.SendGroup(group, 0)
+	assert.NoError(t, err)
+	state, err = server.GetWorkflowState(group.GroupUUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.WorkflowGroup, state.Type)
+		assert.Equal(t, tasks.StatePending, state.State)
+	}
+
+	// Failing to read states is not mistaken for pending tasks
+	server.SetBackend(&unreadableBackend{server.GetBackend().(*backends.EagerBackend)})
+	_, err = server.GetWorkflowState(workflowUUID)
+	assert.EqualError(t, err, "Get state of task "+chain.Tasks[0].UUID+" error: connection refused")
+
+	// Nothing is stored unless enabled
+	server, _ = getEagerTestServer(t)
+	chain = tasks.NewChain(&tasks.Signature{Name: "step"})
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+	_, err = server.GetWorkflowState(chain.UUID)
+	assert.Error(t, err)
+}
+
+func TestReactiveChain(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	var received int64
+	err := server.RegisterTasks(map[string]interface{}{
+		"first": func() (int64, error) {
+			return 2, nil
+		},
+		"second": func(n int64) error {
+			received = n
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+
+	chain := tasks.NewChain(
+		&tasks.Signature{Name: "first"},
+		&tasks.Signature{Name: "second"},
+	)
+	chain.Reactive = true
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+	workflowUUID := chain.UUID
+
+	// The worker does not publish the next step of a reactive chain
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	assert.Len(t, broker.published(), 1)
+
+	coordinator := server.NewCoordinator()
+	done, err := coordinator.Advance(workflowUUID)
+	assert.NoError(t, err)
+	assert.False(t, done)
+	if assert.Len(t, broker.published(), 2) {
+		assert.Equal(t, "second", broker.published()[1].Name)
+		assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+	}
+	assert.Equal(t, int64(2), received)
+
+	// Advancing again does not publish the step twice
+	done, err = coordinator.Advance(workflowUUID)
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Len(t, broker.published(), 2)
+}
+
+func TestReactiveChainCoordinatorCrash(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTasks(map[string]interface{}{
+		"first":  func() error { return nil },
+		"second": func() error { return nil },
+	})
+	assert.NoError(t, err)
+
+	chain := tasks.NewChain(
+		&tasks.Signature{Name: "first"},
+		&tasks.Signature{Name: "second"},
+	)
+	chain.Reactive = true
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+	workflowUUID := chain.UUID
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	// The coordinator crashed after the next step was marked as pending
+	// but before it was published
+	assert.NoError(t, server.GetBackend().SetStatePending(chain.Tasks[1]))
+
+	coordinator := server.NewCoordinator()
+	_, err = coordinator.Advance(workflowUUID)
+	assert.NoError(t, err)
+	if assert.Len(t, broker.published(), 2) {
+		assert.Equal(t, "second", broker.published()[1].Name)
+	}
+
+	// Once published the step is not published again while it is pending
+	_, err = coordinator.Advance(workflowUUID)
+	assert.NoError(t, err)
+	assert.Len(t, broker.published(), 2)
+}
+
+func TestReactiveChainIgnoreResult(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTasks(map[string]interface{}{
+		"first":  func() error { return nil },
+		"notify": func() error { return nil },
+		"last":   func() error { return nil },
+	})
+	assert.NoError(t, err)
+
+	chain := tasks.NewChain(
+		&tasks.Signature{Name: "first"},
+		&tasks.Signature{Name: "notify", IgnoreResult: true},
+		&tasks.Signature{Name: "last"},
+	)
+	chain.Reactive = true
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+	workflowUUID := chain.UUID
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+
+	coordinator := server.NewCoordinator()
+	for i := 0; i < 3; i++ {
+		_, err = coordinator.Advance(workflowUUID)
+		assert.NoError(t, err)
+	}
+
+	// The task ignoring its result never gets a state, it is published once
+	// and the next step follows it
+	if assert.Len(t, broker.published(), 3) {
+		assert.Equal(t, "notify", broker.published()[1].Name)
+		assert.Equal(t, "last", broker.published()[2].Name)
+		assert.NoError(t, worker.Process(delivered(broker.published()[2])))
+	}
+
+	done, err := coordinator.Advance(workflowUUID)
+	assert.NoError(t, err)
+	assert.True(t, done)
+}
+
+func TestReactiveChainRetryBudget(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	calls := 0
+	err := server.RegisterTasks(map[string]interface{}{
+		"flaky": func() error {
+			calls++
+			if calls == 1 {
+				return errors.New("flaky")
+			}
+			return nil
+		},
+		"next": func() error { return nil },
+	})
+	assert.NoError(t, err)
+
+	chain := tasks.NewChain(
+		&tasks.Signature{Name: "flaky", RetryCount: 5},
+		&tasks.Signature{Name: "next", RetryCount: 5},
+	)
+	chain.MaxTotalRetries = 2
+	chain.Reactive = true
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	for i := 0; i < len(broker.published()); i++ {
+		assert.NoError(t, worker.Process(delivered(broker.published()[i])))
+	}
+
+	_, err = server.NewCoordinator().Advance(chain.UUID)
+	assert.NoError(t, err)
+
+	// The retry spent by the first step is taken from the budget of the next
+	if assert.Len(t, broker.published(), 3) && assert.NotNil(t, broker.published()[2].ChainRetryBudget) {
+		assert.Equal(t, "next", broker.published()[2].Name)
+		assert.Equal(t, 1, *broker.published()[2].ChainRetryBudget)
+	}
+}
+
+func TestMaxArgBytes(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().MaxArgBytes = 64
+
+	signature := &tasks.Signature{
+		Name: "upload",
+		Args: []tasks.Arg{
+			{Type: "string", Value: "name"},
+			{Type: "string", Value: strings.Repeat("x", 100)},
+			{Type: "int64", Value: 1},
+		},
+	}
+	_, err := server.SendTask(signature)
+	assert.EqualError(t, err, "Argument 1 of task upload is 128 bytes, exceeds limit of 64 bytes")
+	assert.Empty(t, broker.published())
+
+	// Small arguments are within the limit
+	signature.Args = signature.Args[:1]
+	_, err = server.SendTask(signature)
+	assert.NoError(t, err)
+	assert.Len(t, broker.published(), 1)
+}
+
+func TestDeadLetterOnPanic(t *testing.T) {
+	for _, deadLetterOnPanic := range []bool{false, true} {
+		server, broker := getEagerTestServer(t)
+		server.GetConfig().DeadLetterOnPanic = deadLetterOnPanic
+
+		assert.NoError(t, server.RegisterTask("broken", func() error {
+			panic("nil map")
+		}))
+
+		asyncResult, err := server.SendTask(&tasks.Signature{Name: "broken", RetryCount: 3})
+		assert.NoError(t, err)
+
+		worker := server.NewWorker("test_worker", 0)
+		err = worker.Process(delivered(broker.published()[0]))
+
+		if !deadLetterOnPanic {
+			// The panic is retried like any other failure
+			assert.NoError(t, err)
+			assert.Len(t, broker.published(), 2)
+			continue
+		}
+
+		if assert.IsType(t, new(brokers.DeadLetterError), err) {
+			assert.EqualError(t, err, "nil map")
+		}
+		assert.Len(t, broker.published(), 1)
+		assert.Equal(t, tasks.StateFailure, asyncResult.GetState().State)
+	}
+}
+
+func TestChainDeadline(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().StoreWorkflows = true
+	now := clock.NewFake(time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	var (
+		mu        sync.Mutex
+		steps     []string
+		remaining time.Duration
+	)
+	step := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		steps = append(steps, name)
+	}
+	ranSteps := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), steps...)
+	}
+	hung := make(chan struct{})
+	err := server.RegisterTasks(map[string]interface{}{
+		"slow": func() error {
+			step("slow")
+			now.Advance(150 * time.Millisecond)
+			return nil
+		},
+		"check": func(ctx context.Context) error {
+			step("check")
+			deadline, _ := ctx.Deadline()
+			mu.Lock()
+			remaining = time.Until(deadline)
+			mu.Unlock()
+			return nil
+		},
+		"hang": func(ctx context.Context) error {
+			defer close(hung)
+			step("hang")
+			now.Advance(time.Millisecond)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	assert.NoError(t, err)
+
+	// The slow first step leaves less than the full time to the second one
+	deadline := now.Now().Add(250 * time.Millisecond)
+	chain := tasks.NewChain(
+		&tasks.Signature{Name: "slow"},
+		&tasks.Signature{Name: "check"},
+	)
+	chain.Deadline = &deadline
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	worker.SetClock(now)
+	for i := 0; i < len(broker.published()); i++ {
+		assert.NoError(t, worker.Process(delivered(broker.published()[i])))
+	}
+	assert.Equal(t, []string{"slow", "check"}, ranSteps())
+	mu.Lock()
+	assert.True(t, remaining > 0 && remaining <= 100*time.Millisecond, "remaining %s", remaining)
+	mu.Unlock()
+
+	workflow, err := server.GetWorkflowState(chain.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StateSuccess, workflow.State)
+	}
+
+	// A step blowing the deadline is cut short and the chain fails without
+	// running the remaining steps or retrying
+	mu.Lock()
+	steps = nil
+	mu.Unlock()
+	deadline = now.Now().Add(time.Millisecond)
+	chain = tasks.NewChain(
+		&tasks.Signature{Name: "hang", RetryCount: 3},
+		&tasks.Signature{Name: "check"},
+	)
+	chain.Deadline = &deadline
+	_, err = server.SendChain(chain)
+	assert.NoError(t, err)
+
+	published := len(broker.published())
+	assert.NoError(t, worker.Process(delivered(broker.published()[published-1])))
+	<-hung
+	assert.Equal(t, []string{"hang"}, ranSteps())
+	assert.Len(t, broker.published(), published)
+
+	// Later steps are not run once the deadline has passed
+	assert.NoError(t, worker.Process(delivered(chain.Tasks[1])))
+	assert.Equal(t, []string{"hang"}, ranSteps())
+
+	workflow, err = server.GetWorkflowState(chain.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StateFailure, workflow.State)
+	}
+}
+
+func TestDynamicGroup(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	err := server.RegisterTasks(map[string]interface{}{
+		"spawn": func(groupUUID string, n int64) error {
+			for i := int64(1); i <= n; i++ {
+				_, err := server.SendDynamicGroupTask(groupUUID, &tasks.Signature{
+					Name: "square",
+					Args: []tasks.Arg{{Type: "int64", Value: i}},
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return server.CloseDynamicGroup(groupUUID)
+		},
+		"square": func(n int64) (int64, error) {
+			return n * n, nil
+		},
+	})
+	assert.NoError(t, err)
+
+	group, err := server.NewDynamicGroup()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = server.SendTask(&tasks.Signature{
+		Name: "spawn",
+		Args: []tasks.Arg{
+			{Type: "string", Value: group.GroupUUID},
+			{Type: "int64", Value: int64(3)},
+		},
+	})
+	assert.NoError(t, err)
+
+	// Nothing was added yet
+	_, err = group.GetWithTimeout(10*time.Millisecond, time.Millisecond)
+	assert.EqualError(t, err, "Timeout reached")
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	assert.Len(t, broker.published(), 4)
+
+	// The group is closed but waits for all of its tasks
+	for _, signature := range broker.published()[1:3] {
+		assert.NoError(t, worker.Process(delivered(signature)))
+	}
+	_, err = group.GetWithTimeout(10*time.Millisecond, time.Millisecond)
+	assert.EqualError(t, err, "Timeout reached")
+
+	assert.NoError(t, worker.Process(delivered(broker.published()[3])))
+	results, err := group.Get(time.Millisecond)
+	if assert.NoError(t, err) && assert.Len(t, results, 3) {
+		for i, result := range results {
+			assert.Equal(t, int64((i+1)*(i+1)), result[0].Interface())
+		}
+	}
+}
+
+func TestIgnoreResult(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	calls := 0
+	err := server.RegisterTasks(map[string]interface{}{
+		"fire": func() error {
+			calls++
+			return nil
+		},
+		"flaky": func() error {
+			calls++
+			return errors.New("oops")
+		},
+	})
+	assert.NoError(t, err)
+
+	for _, signature := range []*tasks.Signature{
+		{Name: "fire", IgnoreResult: true},
+		{Name: "flaky", IgnoreResult: true, RetryCount: 1},
+	} {
+		_, err := server.SendTask(signature)
+		assert.NoError(t, err)
+	}
+
+	worker := server.NewWorker("test_worker", 0)
+	for i := 0; i < len(broker.published()); i++ {
+		worker.Process(delivered(broker.published()[i]))
+	}
+
+	// Both tasks ran, the failing one twice, without any state stored
+	assert.Equal(t, 3, calls)
+	assert.Len(t, broker.published(), 3)
+	for _, signature := range broker.published() {
+		_, err := server.GetBackend().GetState(signature.UUID)
+		assert.Error(t, err)
+	}
+}
+
+func TestIgnoreResultChord(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	// Members of a chord must store their results for the callback to fire
+	group := tasks.NewGroup(
+		&tasks.Signature{Name: "chunk"},
+		&tasks.Signature{Name: "chunk", IgnoreResult: true},
+	)
+	chord := tasks.NewChord(group, &tasks.Signature{Name: "join"})
+
+	_, err := server.SendChord(chord, 0)
+	assert.EqualError(t, err, fmt.Sprintf("Task %s of a chord can't ignore its result", group.Tasks[1].UUID))
+	assert.Empty(t, broker.published())
+
+	// The callback itself may ignore its result
+	group = tasks.NewGroup(&tasks.Signature{Name: "chunk"})
+	chord = tasks.NewChord(group, &tasks.Signature{Name: "join", IgnoreResult: true})
+	_, err = server.SendChord(chord, 0)
+	assert.NoError(t, err)
+	assert.Len(t, broker.published(), 1)
+}
+
+func TestStreamArgs(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	content := bytes.Repeat([]byte("machinery"), 100000)
+	store := server.GetBackend().(backends.BlobStore)
+	assert.NoError(t, store.SetBlob("inputs/large.txt", bytes.NewReader(content)))
+
+	var read []byte
+	err := server.RegisterTask("transform", func(input io.Reader, suffix string) error {
+		var err error
+		read, err = ioutil.ReadAll(input)
+		read = append(read, suffix...)
+		return err
+	})
+	assert.NoError(t, err)
+
+	signature := &tasks.Signature{
+		Name: "transform",
+		Args: []tasks.Arg{
+			{Type: tasks.StreamArgType, Value: "blob://inputs/large.txt"},
+			{Type: "string", Value: "!"},
+		},
+	}
+	_, err = server.SendTask(signature)
+	assert.NoError(t, err)
+
+	// Only the reference travels in the message
+	encoded, err := json.Marshal(broker.published()[0])
+	assert.NoError(t, err)
+	assert.True(t, len(encoded) < 10000)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	assert.Equal(t, append(content, '!'), read)
+
+	// Unknown streams fail the task
+	_, err = server.SendTask(&tasks.Signature{
+		Name: "transform",
+		Args: []tasks.Arg{
+			{Type: tasks.StreamArgType, Value: "blob://missing"},
+			{Type: "string", Value: "!"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, worker.Process(delivered(broker.published()[1])))
+	state, err := server.GetBackend().GetState(broker.published()[1].UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsFailure())
+	}
+}
+
+func TestHTTPStreamArgs(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote"))
+	}))
+	defer remote.Close()
+
+	var read []byte
+	assert.NoError(t, server.RegisterTask("transform", func(input io.Reader) error {
+		var err error
+		read, err = ioutil.ReadAll(input)
+		return err
+	}))
+	send := func() *tasks.Signature {
+		_, err := server.SendTask(&tasks.Signature{
+			Name: "transform",
+			Args: []tasks.Arg{{Type: tasks.StreamArgType, Value: remote.URL + "/input"}},
+		})
+		assert.NoError(t, err)
+		published := broker.published()
+		return published[len(published)-1]
+	}
+	worker := server.NewWorker("test_worker", 0)
+
+	// Workers don't fetch URLs unless enabled
+	signature := send()
+	assert.NoError(t, worker.Process(delivered(signature)))
+	state, err := server.GetBackend().GetState(signature.UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, state.IsFailure())
+	}
+	assert.Nil(t, read)
+
+	server.SetStreamOpener("http", machinery.NewHTTPStreamOpener(time.Second))
+	signature = send()
+	assert.NoError(t, worker.Process(delivered(signature)))
+	assert.Equal(t, []byte("remote"), read)
+}
+
+// wrappedError prefixes the message of the error it wraps, like
+// fmt.Errorf with %w on Go versions having it
+type wrappedError struct {
+	prefix string
+	err    error
+}
+
+func (e *wrappedError) Error() string { return e.prefix + ": " + e.err.Error() }
+func (e *wrappedError) Unwrap() error { return e.err }
+
+// paymentError is an error carrying a code for error callbacks
+type paymentError struct {
+	code string
+}
+
+func (e *paymentError) Error() string     { return "payment declined" }
+func (e *paymentError) ErrorCode() string { return e.code }
+
+func TestStructuredErrorCallback(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	assert.NoError(t, server.RegisterTask("charge", func() error {
+		return &wrappedError{"charge order", &paymentError{code: "insufficient_funds"}}
+	}))
+	var code, message string
+	assert.NoError(t, server.RegisterTask("handle_decline", func(err error) error {
+		if coder, ok := err.(tasks.ErrorCoder); ok {
+			code = coder.ErrorCode()
+		}
+		return nil
+	}))
+	assert.NoError(t, server.RegisterTask("log_decline", func(err string) error {
+		message = err
+		return nil
+	}))
+
+	_, err := server.SendTask(&tasks.Signature{
+		Name:    "charge",
+		OnError: []*tasks.Signature{{Name: "handle_decline"}, {Name: "log_decline"}},
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	assert.NoError(t, worker.Process(delivered(broker.published()[0])))
+	if !assert.Len(t, broker.published(), 3) {
+		return
+	}
+
+	// Callbacks get the error as it arrives through a broker
+	for _, callback := range broker.published()[1:] {
+		encoded, err := json.Marshal(callback)
+		assert.NoError(t, err)
+		received := new(tasks.Signature)
+		assert.NoError(t, json.Unmarshal(encoded, received))
+		assert.NoError(t, worker.Process(received))
+	}
+
+	assert.Equal(t, "insufficient_funds", code)
+	assert.Equal(t, "charge order: payment declined", message)
+
+	// The error travels as a string so consumers of earlier versions still
+	// get the message
+	arg := broker.published()[1].Args[0]
+	assert.Equal(t, "string", arg.Type)
+	assert.Equal(t, "charge order: payment declined", arg.Value)
+
+	// Errors sent by earlier producers as their message, or with the error
+	// type, are accepted
+	code, message = "", ""
+	assert.NoError(t, worker.Process(&tasks.Signature{
+		Name: "handle_decline",
+		Args: []tasks.Arg{{Type: "string", Value: "payment declined"}},
+	}))
+	assert.Equal(t, "", code)
+	assert.NoError(t, worker.Process(&tasks.Signature{
+		Name: "handle_decline",
+		Args: []tasks.Arg{{Type: tasks.ErrorArgType, Value: map[string]interface{}{"message": "payment declined", "code": "expired"}}},
+	}))
+	assert.Equal(t, "expired", code)
+}
+
+func TestTaskOptions(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	var returned int32
+	assert.NoError(t, server.RegisterTask("bloat", func(ctx context.Context) (int64, error) {
+		defer atomic.StoreInt32(&returned, 1)
+		buf := make([]byte, 64<<20)
+		<-ctx.Done()
+		runtime.KeepAlive(buf)
+		return int64(len(buf)), nil
+	}))
+	server.SetTaskOptions("bloat", machinery.TaskOptions{MaxMemoryBytes: 16 << 20})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	assert.NoError(t, server.RegisterTask("leak", func() error {
+		go func() { <-stop }()
+		return nil
+	}))
+	server.SetTaskOptions("leak", machinery.TaskOptions{FailOnGoroutineLeak: true})
+	assert.NoError(t, server.RegisterTask("join", func() error {
+		done := make(chan struct{})
+		go func() { close(done) }()
+		<-done
+		return nil
+	}))
+	server.SetTaskOptions("join", machinery.TaskOptions{FailOnGoroutineLeak: true})
+
+	bloat, err := server.SendTask(&tasks.Signature{Name: "bloat"})
+	assert.NoError(t, err)
+	leak, err := server.SendTask(&tasks.Signature{Name: "leak"})
+	assert.NoError(t, err)
+	join, err := server.SendTask(&tasks.Signature{Name: "join"})
+	assert.NoError(t, err)
+
+	// Misbehaving tasks fail instead of taking the worker down
+	worker := server.NewWorker("test_worker", 0)
+	for _, signature := range broker.published() {
+		assert.NoError(t, worker.Process(signature))
+	}
+
+	// The task was cancelled and returned before it failed
+	state := bloat.GetState()
+	assert.True(t, state.IsFailure())
+	assert.Equal(t, tasks.ErrMemoryLimitExceeded.Error(), state.Error)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&returned))
+
+	state = leak.GetState()
+	assert.True(t, state.IsFailure())
+	assert.Equal(t, tasks.ErrGoroutineLeak.Error(), state.Error)
+
+	assert.True(t, join.GetState().IsSuccess())
+}
+
+func TestTaskOptionsConcurrentTasks(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	assert.NoError(t, server.RegisterTask("busy", func() error {
+		close(started)
+		<-release
+		return nil
+	}))
+	assert.NoError(t, server.RegisterTaskWithOptions("spike", func() (int64, error) {
+		buf := make([]byte, 64<<20)
+		time.Sleep(150 * time.Millisecond)
+		runtime.KeepAlive(buf)
+		return int64(len(buf)), nil
+	}, machinery.TaskOptions{MaxMemoryBytes: 16 << 20, FailOnGoroutineLeak: true}))
+
+	busy, err := server.SendTask(&tasks.Signature{Name: "busy"})
+	assert.NoError(t, err)
+	spike, err := server.SendTask(&tasks.Signature{Name: "spike"})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("test_worker", 0)
+	done := make(chan error)
+	go func() {
+		done <- worker.Process(broker.published()[0])
+	}()
+	<-started
+
+	// Allocations and goroutines of the process can't be attributed to a
+	// task while another one runs, the guards don't fail it then
+	assert.NoError(t, worker.Process(broker.published()[1]))
+	assert.True(t, spike.GetState().IsSuccess())
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.True(t, busy.GetState().IsSuccess())
+}
+
+func TestStartJitter(t *testing.T) {
+	server, broker := getEagerTestServer(t)
+	server.GetConfig().StartJitter = 40
+
+	var started time.Time
+	err := server.RegisterTask("stampede", func() error {
+		started = time.Now()
+		return nil
+	})
+	assert.NoError(t, err)
+
+	signatures := make([]*tasks.Signature, 40)
+	for i := range signatures {
+		signatures[i] = &tasks.Signature{Name: "stampede"}
+	}
+	_, err = server.SendGroup(tasks.NewGroup(signatures...), 0)
+	assert.NoError(t, err)
+
+	// Measure how long each task waited before it started
+	worker := server.NewWorker("test_worker", 0)
+	min, max := time.Hour, time.Duration(0)
+	for _, signature := range broker.published() {
+		received := time.Now()
+		assert.NoError(t, worker.Process(delivered(signature)))
+		delay := started.Sub(received)
+		if delay < min {
+			min = delay
+		}
+		if delay > max {
+			max = delay
+		}
+	}
+
+	// Starts are spread across the jitter window rather than clustered
+	assert.True(t, max-min > 20*time.Millisecond, "spread %s", max-min)
+	assert.True(t, max < 40*time.Millisecond+50*time.Millisecond, "max %s", max)
+
+	// The signature overrides the config
+	noJitter := 0
+	_, err = server.SendTask(&tasks.Signature{Name: "stampede", StartJitter: &noJitter})
+	assert.NoError(t, err)
+	received := time.Now()
+	assert.NoError(t, worker.Process(broker.published()[len(broker.published())-1]))
+	assert.True(t, started.Sub(received) < 10*time.Millisecond)
+}